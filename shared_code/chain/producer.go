@@ -0,0 +1,91 @@
+package chain
+
+import (
+	"fmt"
+	"time"
+
+	"bitcoin-sidechain/membership"
+	"bitcoin-sidechain/mempool"
+	"bitcoin-sidechain/peg"
+	"bitcoin-sidechain/storage"
+)
+
+// DefaultMaxBlockTxs is the number of transfers taken from the mempool per
+// block when the producer is not given a limit.
+const DefaultMaxBlockTxs = 1000
+
+// Producer drains the mempool into blocks.
+type Producer struct {
+	store   storage.Store
+	pool    *mempool.Pool
+	members *membership.Pipeline
+	bitcoin *peg.Watcher
+	id      string
+	maxTxs  int
+}
+
+// NewProducer returns a producer that signs its blocks with the given
+// producer id, puts at most maxTxs transfers in each block, takes the
+// membership changes of its blocks from members and puts in the deposits and
+// payouts that bitcoin finds ready, if it is not nil.
+func NewProducer(store storage.Store, pool *mempool.Pool, members *membership.Pipeline, bitcoin *peg.Watcher, id string, maxTxs int) *Producer {
+	if maxTxs <= 0 {
+		maxTxs = DefaultMaxBlockTxs
+	}
+	return &Producer{store: store, pool: pool, members: members, bitcoin: bitcoin, id: id, maxTxs: maxTxs}
+}
+
+// ProduceBlock takes the oldest pending transfers from the mempool, applies
+// them as the next block and removes them from the pool. Transfers that were
+// rejected while applying the block are dropped from the pool as well.
+func (p *Producer) ProduceBlock() (storage.Block, error) {
+	pending := p.pool.Pending(p.maxTxs)
+	transfers := make([]storage.Transfer, len(pending))
+	for i, tx := range pending {
+		transfers[i] = tx.Transfer
+	}
+
+	changes, err := p.members.Changes()
+	if err != nil {
+		return storage.Block{}, fmt.Errorf("failed to pick membership changes: %w", err)
+	}
+
+	var pegChanges storage.PegChanges
+	if p.bitcoin != nil {
+		pegChanges = p.bitcoin.Ready()
+	}
+
+	block, rejected, err := p.store.ProduceBlock(p.id, time.Now().Unix(), transfers, changes, pegChanges)
+	if err != nil {
+		return storage.Block{}, fmt.Errorf("failed to produce block: %w", err)
+	}
+	for id, reason := range rejected {
+		fmt.Printf("%s left out of block %d: %v\n", id, block.Height, reason)
+	}
+	membership.LogChanges(block)
+
+	ids := make([]string, len(transfers))
+	for i, t := range transfers {
+		ids[i] = t.TxID
+	}
+	p.pool.Remove(ids...)
+	return block, nil
+}
+
+// Run produces a block on every tick until stop is closed. Blocks are
+// produced even when the mempool is empty, so the height keeps time.
+func (p *Producer) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := p.ProduceBlock(); err != nil {
+				fmt.Println("Error producing block:", err)
+			}
+		}
+	}
+}
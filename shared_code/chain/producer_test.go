@@ -0,0 +1,147 @@
+package chain
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"bitcoin-sidechain/epoch"
+	"bitcoin-sidechain/membership"
+	"bitcoin-sidechain/mempool"
+	"bitcoin-sidechain/storage"
+)
+
+var genesis = storage.Genesis{Wallets: []storage.GenesisWallet{{Wallet: "alice", Balance: 10}, {Wallet: "bob", Balance: 5}}}
+
+func openStore(t *testing.T, name string) storage.Store {
+	t.Helper()
+	store, err := storage.Open("sqlite3", filepath.Join(t.TempDir(), name+".db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if _, err := store.ApplyGenesis(genesis); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func transfer(from, to string, amount int64, nonce string) storage.Transfer {
+	return storage.Transfer{TxID: storage.TransferID(from, to, amount, nonce), From: from, To: to, Amount: amount, Nonce: nonce}
+}
+
+func newProducer(t *testing.T, store storage.Store, pool *mempool.Pool, maxTxs int) *Producer {
+	t.Helper()
+	epochs := epoch.NewManager(store, 100, 4)
+	if _, err := epochs.Advance(); err != nil {
+		t.Fatal(err)
+	}
+	members := membership.New(store, epochs, nil, nil, nil, membership.Config{})
+	return NewProducer(store, pool, members, nil, "producer", maxTxs)
+}
+
+// checkHashes checks that a block carries the roots of its transfers and of
+// the balances it leaves, and the hash of its header.
+func checkHashes(t *testing.T, store storage.Store, block storage.Block) {
+	t.Helper()
+	if block.TxRoot != storage.TxRoot(block.Transfers) {
+		t.Errorf("block %d has tx root %s, its transfers give %s", block.Height, block.TxRoot, storage.TxRoot(block.Transfers))
+	}
+	balances, err := store.ListBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.StateRoot != storage.StateRoot(balances) {
+		t.Errorf("block %d has state root %s, the balances give %s", block.Height, block.StateRoot, storage.StateRoot(balances))
+	}
+	if block.Hash != storage.BlockHash(block) {
+		t.Errorf("block %d has hash %s, its header gives %s", block.Height, block.Hash, storage.BlockHash(block))
+	}
+}
+
+func TestProduceBlockChainsHashes(t *testing.T) {
+	store := openStore(t, "producer")
+	pool := mempool.New(mempool.Config{})
+	producer := newProducer(t, store, pool, 2)
+	transfers := []storage.Transfer{
+		transfer("alice", "bob", 3, "n1"),
+		transfer("bob", "carol", 4, "n2"),
+		transfer("carol", "alice", 1, "n3"),
+		transfer("alice", "carol", 100, "n4"),
+	}
+	for _, tx := range transfers {
+		if _, err := pool.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The oldest transfers fill the first block
+	first, err := producer.ProduceBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Height != 1 || first.PrevHash != storage.ZeroHash || len(first.Transfers) != 2 || first.Transfers[0].TxID != transfers[0].TxID {
+		t.Fatalf("first block is %d on %s with %v", first.Height, first.PrevHash, first.Transfers)
+	}
+	checkHashes(t, store, first)
+	if pool.Len() != 2 {
+		t.Errorf("pool holds %d transfers after the first block, expected 2", pool.Len())
+	}
+
+	// The overspend is left out of the next block and out of the pool
+	second, err := producer.ProduceBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.PrevHash != first.Hash || len(second.Transfers) != 1 || second.Transfers[0].TxID != transfers[2].TxID {
+		t.Fatalf("second block is on %s with %v; expected on %s with the third transfer", second.PrevHash, second.Transfers, first.Hash)
+	}
+	checkHashes(t, store, second)
+	if pool.Len() != 0 {
+		t.Errorf("pool holds %d transfers after the second block, expected none", pool.Len())
+	}
+
+	// An empty block still chains and commits the balances
+	third, err := producer.ProduceBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.PrevHash != second.Hash || third.TxRoot != storage.TxRoot(nil) || third.StateRoot != second.StateRoot {
+		t.Errorf("empty block is on %s with roots %s, %s", third.PrevHash, third.TxRoot, third.StateRoot)
+	}
+	checkHashes(t, store, third)
+
+	// Another node reproduces the chain, and refuses a block whose roots or
+	// links were changed, even with its hash made to match
+	replica := openStore(t, "replica")
+	if err := replica.CommitBlock(first); err != nil {
+		t.Fatalf("replica refused the first block: %v", err)
+	}
+	changes := map[string]func(b *storage.Block){
+		"another tx root":       func(b *storage.Block) { b.TxRoot = storage.TxRoot(b.Transfers[:0]) },
+		"another state root":    func(b *storage.Block) { b.StateRoot = first.StateRoot },
+		"another previous hash": func(b *storage.Block) { b.PrevHash = storage.ZeroHash },
+		"another transfer":      func(b *storage.Block) { b.Transfers = []storage.Transfer{transfer("carol", "bob", 1, "n9")} },
+	}
+	for name, change := range changes {
+		changed := second
+		change(&changed)
+		changed.Hash = storage.BlockHash(changed)
+		if err := replica.CommitBlock(changed); !errors.Is(err, storage.ErrInvalidBlock) {
+			t.Errorf("block with %s: got %v, expected ErrInvalidBlock", name, err)
+		}
+	}
+	wrongHash := second
+	wrongHash.Hash = first.Hash
+	if err := replica.CommitBlock(wrongHash); !errors.Is(err, storage.ErrInvalidBlock) {
+		t.Errorf("block with another hash: got %v, expected ErrInvalidBlock", err)
+	}
+	for _, block := range []storage.Block{second, third} {
+		if err := replica.CommitBlock(block); err != nil {
+			t.Fatalf("replica refused block %d: %v", block.Height, err)
+		}
+	}
+	if latest, err := replica.LatestBlock(); err != nil || latest.Hash != third.Hash {
+		t.Errorf("replica is at %s, %v; expected %s", latest.Hash, err, third.Hash)
+	}
+}
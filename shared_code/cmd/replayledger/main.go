@@ -0,0 +1,80 @@
+// Command replayledger replays the transactions log and compares the result
+// with the current wallet_balances table.
+//
+//	go run ./cmd/replayledger -driver sqlite3 -dsn node.db
+//	go run ./cmd/replayledger -rebuild
+//
+// It exits with status 1 if any balance differs. With -rebuild it overwrites
+// wallet_balances with the replayed balances instead.
+package main
+
+import (
+	"bitcoin-sidechain/storage"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+func main() {
+	driver := flag.String("driver", "mysql", "database driver: mysql or sqlite3")
+	dsn := flag.String("dsn", "node:test@tcp(node-1-database:3306)/node", "database DSN")
+	rebuild := flag.Bool("rebuild", false, "overwrite wallet_balances with the replayed balances")
+	flag.Parse()
+
+	store, err := storage.Open(*driver, *dsn)
+	if err != nil {
+		fmt.Printf("Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	replayed, err := storage.ReplayLedger(store)
+	if err != nil {
+		fmt.Printf("Error replaying transactions: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *rebuild {
+		if err := store.ReplaceBalances(replayed); err != nil {
+			fmt.Printf("Error rebuilding wallet_balances: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("wallet_balances rebuilt from the log: %d wallets\n", len(replayed))
+		return
+	}
+
+	current, err := store.ListBalances()
+	if err != nil {
+		fmt.Printf("Error reading wallet_balances: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Wallets missing on either side count as a balance of 0
+	wallets := make(map[string]bool)
+	for wallet := range replayed {
+		wallets[wallet] = true
+	}
+	for wallet := range current {
+		wallets[wallet] = true
+	}
+	sorted := make([]string, 0, len(wallets))
+	for wallet := range wallets {
+		sorted = append(sorted, wallet)
+	}
+	sort.Strings(sorted)
+
+	mismatches := 0
+	for _, wallet := range sorted {
+		if replayed[wallet] != current[wallet] {
+			fmt.Printf("MISMATCH %s: log %d, wallet_balances %d\n", wallet, replayed[wallet], current[wallet])
+			mismatches++
+		}
+	}
+
+	if mismatches > 0 {
+		fmt.Printf("%d of %d wallets differ from the log\n", mismatches, len(sorted))
+		os.Exit(1)
+	}
+	fmt.Printf("OK: %d wallets match the log\n", len(sorted))
+}
@@ -0,0 +1,166 @@
+// Command verifyreserves checks that the sidechain supply is backed by the
+// Bitcoin the peg holds, from a snapshot of a node database and a bitcoind of
+// its own.
+//
+//	go run ./cmd/verifyreserves -driver sqlite3 -dsn snapshot.db \
+//	    -rpc http://127.0.0.1:8332 -rpc-user user -rpc-password pass \
+//	    -report reserves.json
+//
+// It replays the transactions log of the snapshot to recompute every balance
+// and the supply, and reads the peg UTXOs and the queued withdrawals. The
+// UTXOs must add up to the supply plus the withdrawals, and with -rpc each of
+// them must be unspent on Bitcoin with the amount and script the peg key
+// gives. With -report, the answer of GET /reserves saved to a file, the
+// report must be the one of the snapshot and a quorum of leaders must have
+// signed it. It exits with status 1 if any check fails.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"bitcoin-sidechain/peg"
+	"bitcoin-sidechain/reserves"
+	"bitcoin-sidechain/storage"
+)
+
+func main() {
+	driver := flag.String("driver", "sqlite3", "database driver of the snapshot: mysql or sqlite3")
+	dsn := flag.String("dsn", "nodes.db", "database DSN of the snapshot")
+	rpcURL := flag.String("rpc", "", "bitcoind RPC URL; without it the UTXOs are not looked up")
+	rpcUser := flag.String("rpc-user", "", "bitcoind RPC user")
+	rpcPassword := flag.String("rpc-password", "", "bitcoind RPC password")
+	network := flag.String("network", "mainnet", "Bitcoin network: mainnet, testnet, signet or regtest")
+	reportFile := flag.String("report", "", "GET /reserves answer to check against the snapshot")
+	flag.Parse()
+
+	params, err := peg.Network(*network)
+	if err != nil {
+		fail("%v", err)
+	}
+	store, err := storage.Open(*driver, *dsn)
+	if err != nil {
+		fail("failed to open snapshot: %v", err)
+	}
+	defer store.Close()
+
+	// Recompute the supply from the transactions log
+	replayed, err := storage.ReplayLedger(store)
+	if err != nil {
+		fail("failed to replay the transactions log: %v", err)
+	}
+	balances, err := store.ListBalances()
+	if err != nil {
+		fail("failed to read wallet_balances: %v", err)
+	}
+	var supply int64
+	failed := false
+	for wallet, balance := range replayed {
+		supply += balance
+		if balances[wallet] != balance {
+			fmt.Printf("MISMATCH %s: log %d, wallet_balances %d\n", wallet, balance, balances[wallet])
+			failed = true
+		}
+	}
+	for wallet, balance := range balances {
+		if _, ok := replayed[wallet]; !ok && balance != 0 {
+			fmt.Printf("MISMATCH %s: log 0, wallet_balances %d\n", wallet, balance)
+			failed = true
+		}
+	}
+
+	r, err := store.GetReserves()
+	if err != nil {
+		fail("failed to read reserves: %v", err)
+	}
+	if r.Supply != supply {
+		fmt.Printf("MISMATCH supply: log %d, wallet_balances %d\n", supply, r.Supply)
+		failed = true
+	}
+	var pegKey string
+	if key, err := store.LatestCustodyKey(); err == nil {
+		pegKey = key.GroupKey
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		fail("failed to read the peg key: %v", err)
+	}
+
+	// Check the signed report, if any, is the one of the snapshot
+	report := reserves.NewReport(r, 0, 0, pegKey)
+	if *reportFile != "" {
+		statement, err := readStatement(*reportFile)
+		if err != nil {
+			fail("%v", err)
+		}
+		report = reserves.NewReport(r, statement.Report.Epoch, statement.Report.Group, pegKey)
+		if statement.Report.Height != report.Height {
+			fail("report is for block %d, the snapshot is at block %d", statement.Report.Height, report.Height)
+		}
+		if statement.Report.Digest() != report.Digest() {
+			fmt.Printf("MISMATCH report: the snapshot gives digest %s, the report %s\n", report.Digest(), statement.Report.Digest())
+			failed = true
+		}
+		epoch, err := store.GetEpoch(statement.Report.Epoch)
+		if err != nil {
+			fail("failed to read epoch %d: %v", statement.Report.Epoch, err)
+		}
+		signers, err := reserves.Verify(statement.Report, epoch, statement.Attestations)
+		if err != nil {
+			fmt.Printf("UNSIGNED report: %v\n", err)
+			failed = true
+		} else {
+			fmt.Printf("report of block %d signed by %d leaders of group %d of epoch %d\n", report.Height, signers, report.Group, report.Epoch)
+		}
+	}
+
+	fmt.Printf("block %d: supply %d sats, %d sats to pay out, %d sats in %d peg UTXOs\n", report.Height, report.Supply, report.Pending, report.Reserves, len(report.UTXOs))
+	if err := report.Check(); err != nil {
+		fmt.Printf("UNBACKED: %v\n", err)
+		failed = true
+	}
+
+	// Look up every UTXO on Bitcoin
+	if *rpcURL != "" {
+		backend := peg.NewRPCBackend(*rpcURL, *rpcUser, *rpcPassword, 0)
+		holdings, err := reserves.CheckHoldings(store, report, backend, params)
+		if err != nil {
+			fail("failed to check the UTXOs: %v", err)
+		}
+		for _, missing := range holdings.Missing {
+			fmt.Printf("MISSING %s\n", missing)
+		}
+		for _, pending := range holdings.Pending {
+			fmt.Printf("PENDING %s: payout not on Bitcoin yet, its inputs are held\n", pending)
+		}
+		fmt.Printf("Bitcoin holds %d sats of the peg\n", holdings.Held)
+		if len(holdings.Missing) > 0 || holdings.Held < report.Supply+report.Pending {
+			failed = true
+		}
+	}
+
+	if failed {
+		fmt.Println("FAIL: the supply is not shown to be backed")
+		os.Exit(1)
+	}
+	fmt.Printf("OK: %d sats of supply and %d to pay out are backed by the peg\n", report.Supply, report.Pending)
+}
+
+// readStatement reads a GET /reserves answer from a file.
+func readStatement(path string) (reserves.Statement, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return reserves.Statement{}, fmt.Errorf("failed to read report: %w", err)
+	}
+	var statement reserves.Statement
+	if err := json.Unmarshal(data, &statement); err != nil {
+		return reserves.Statement{}, fmt.Errorf("invalid report: %w", err)
+	}
+	return statement, nil
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Printf("FAIL: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,864 @@
+// Package consensus runs BFT consensus among the active leader group, in the
+// style of Tendermint. Each height goes through rounds of three steps:
+//
+//   - propose: the proposer of the round broadcasts a block built from its
+//     mempool, signed with its node key.
+//   - prevote: every leader checks the block (signatures, transfers, state
+//     root) and broadcasts a signed prevote for it, or for nil.
+//   - precommit: a leader that sees 2f+1 prevotes for the block locks on it and
+//     broadcasts a precommit.
+//
+// A block is committed to wallet_balances only once 2f+1 precommits for it
+// are collected; they are stored with the block as its commit certificate.
+// Every step has a timeout that grows with the round, and a round without a
+// decision moves on to the next round and the next proposer.
+//
+// If the leading group commits nothing for the failover timeout, the members
+// of the next group sign timeout votes, and so do the members of the leading
+// group that have not precommitted a block at the stalled height, which then
+// stop voting at it. A quorum of each group is a failover certificate: the
+// leading group cannot have committed the height nor commit it any more, so
+// the next group decides every height from the stalled one on, for the rest
+// of the epoch. The certificate is stored so any node can check who led each
+// height. A stalled standby group is replaced by the one after it in the same
+// way, wrapping around to group 1 after the last.
+package consensus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/epoch"
+	"bitcoin-sidechain/membership"
+	"bitcoin-sidechain/mempool"
+	"bitcoin-sidechain/peg"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// maxClockDrift is how far in the future a proposed block timestamp may be.
+const maxClockDrift = time.Minute
+
+// Config holds the timeouts of the engine.
+type Config struct {
+	ProposeTimeout   time.Duration
+	PrevoteTimeout   time.Duration
+	PrecommitTimeout time.Duration
+	TimeoutDelta     time.Duration // added to every timeout for each round
+	CommitDelay      time.Duration // wait after a commit before the next height
+	SyncInterval     time.Duration // how often to fetch missing blocks from peers
+	FailoverTimeout  time.Duration // how long the standby group waits for a commit
+	MaxBlockTxs      int
+}
+
+// DefaultConfig is used for any value left at zero.
+var DefaultConfig = Config{
+	ProposeTimeout:   3 * time.Second,
+	PrevoteTimeout:   time.Second,
+	PrecommitTimeout: time.Second,
+	TimeoutDelta:     500 * time.Millisecond,
+	CommitDelay:      10 * time.Second,
+	SyncInterval:     5 * time.Second,
+	FailoverTimeout:  time.Minute,
+	MaxBlockTxs:      1000,
+}
+
+type step int
+
+const (
+	stepNewHeight step = iota
+	stepPropose
+	stepPrevote
+	stepPrecommit
+)
+
+// timeout fires when a step of a round has waited long enough.
+type timeout struct {
+	height int64
+	round  int
+	step   step
+}
+
+// Engine is the consensus state machine of one node. All state is owned by
+// the goroutine running Run; other goroutines talk to it through Receive.
+type Engine struct {
+	store     storage.Store
+	pool      *mempool.Pool
+	epochs    *epoch.Manager
+	members   *membership.Pipeline
+	bitcoin   *peg.Watcher // nil without a Bitcoin backend
+	key       *btcec.PrivateKey
+	publicKey string
+	transport Transport
+	config    Config
+
+	messages     chan Message
+	timeouts     chan timeout
+	stop         <-chan struct{} // closed when Run returns, so pending timeouts are dropped
+	lastSync     time.Time
+	lastProgress time.Time // last commit or failover
+
+	// State of the current height
+	height       int64
+	previous     string // hash of the latest block, which the height builds on
+	round        int
+	step         step
+	epoch        *storage.Epoch // epoch deciding the height
+	validators   *Validators
+	self         string // our computer_id, empty if we are not a validator
+	lockedRound  int
+	lockedBlock  *storage.Block
+	validRound   int
+	validBlock   *storage.Block
+	proposals    map[int]Proposal
+	checked      map[string]error // result of checking a block, by hash
+	votes        map[int]map[VoteType]map[string]Vote
+	onceFlags    map[string]bool
+	timeoutVotes map[string]TimeoutVote // latest timeout vote of each member of either group
+	stalled      *TimeoutVote           // our vote giving up a height our group leads
+}
+
+// NewEngine returns an engine that signs with key, takes the membership
+// changes of its blocks from members and the deposits and payouts they carry
+// from bitcoin, which may be nil. Zero values in config are taken from
+// DefaultConfig.
+func NewEngine(store storage.Store, pool *mempool.Pool, epochs *epoch.Manager, members *membership.Pipeline, bitcoin *peg.Watcher, key *btcec.PrivateKey, transport Transport, config Config) *Engine {
+	if config.ProposeTimeout <= 0 {
+		config.ProposeTimeout = DefaultConfig.ProposeTimeout
+	}
+	if config.PrevoteTimeout <= 0 {
+		config.PrevoteTimeout = DefaultConfig.PrevoteTimeout
+	}
+	if config.PrecommitTimeout <= 0 {
+		config.PrecommitTimeout = DefaultConfig.PrecommitTimeout
+	}
+	if config.TimeoutDelta <= 0 {
+		config.TimeoutDelta = DefaultConfig.TimeoutDelta
+	}
+	if config.CommitDelay <= 0 {
+		config.CommitDelay = DefaultConfig.CommitDelay
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = DefaultConfig.SyncInterval
+	}
+	if config.FailoverTimeout <= 0 {
+		config.FailoverTimeout = DefaultConfig.FailoverTimeout
+	}
+	if config.MaxBlockTxs <= 0 {
+		config.MaxBlockTxs = DefaultConfig.MaxBlockTxs
+	}
+	return &Engine{
+		store:     store,
+		pool:      pool,
+		epochs:    epochs,
+		members:   members,
+		bitcoin:   bitcoin,
+		key:       key,
+		publicKey: cryptoUtils.PublicKeyBase64(key),
+		transport: transport,
+		config:    config,
+		messages:  make(chan Message, 1024),
+		timeouts:  make(chan timeout, 64),
+	}
+}
+
+// Receive queues a message from another leader. It never blocks; messages
+// arriving faster than the engine handles them are dropped, and the rounds
+// that need them time out and are retried.
+func (e *Engine) Receive(message Message) {
+	select {
+	case e.messages <- message:
+	default:
+		fmt.Println("Consensus message dropped: queue full")
+	}
+}
+
+// Run drives consensus until stop is closed.
+func (e *Engine) Run(stop <-chan struct{}) {
+	syncTicker := time.NewTicker(e.config.SyncInterval)
+	defer syncTicker.Stop()
+
+	e.stop = stop
+	e.lastProgress = time.Now()
+	e.enterHeight()
+	for {
+		select {
+		case <-stop:
+			return
+		case message := <-e.messages:
+			e.handleMessage(message)
+		case t := <-e.timeouts:
+			e.handleTimeout(t)
+		case <-syncTicker.C:
+			if e.validators == nil {
+				e.enterHeight()
+			}
+			e.sync()
+			e.checkFailover()
+		}
+		for e.applyRules() {
+		}
+	}
+}
+
+// enterHeight resets the state for the height after the latest block and
+// loads the leader group that decides it. Height h is decided by the epoch
+// that block h-1 belongs to, so the block that starts an epoch is still
+// agreed on by the previous group. Within the epoch it is decided by group 1
+// or by the group the latest failover handed the lead to.
+func (e *Engine) enterHeight() {
+	height, previous := int64(1), storage.ZeroHash
+	latest, err := e.store.LatestBlock()
+	switch {
+	case err == nil:
+		height, previous = latest.Height+1, latest.Hash
+	case !errors.Is(err, storage.ErrNotFound):
+		fmt.Println("Consensus: error reading latest block:", err)
+	}
+	if height != e.height || e.timeoutVotes == nil {
+		e.timeoutVotes = make(map[string]TimeoutVote)
+	}
+	e.height, e.previous = height, previous
+
+	e.round = 0
+	e.step = stepNewHeight
+	e.lockedRound, e.lockedBlock = -1, nil
+	e.validRound, e.validBlock = -1, nil
+	e.proposals = make(map[int]Proposal)
+	e.checked = make(map[string]error)
+	e.votes = make(map[int]map[VoteType]map[string]Vote)
+	e.onceFlags = make(map[string]bool)
+	e.epoch, e.validators, e.self = nil, nil, ""
+
+	if _, err := e.epochs.Advance(); err != nil {
+		fmt.Println("Consensus: error advancing epoch:", err)
+	}
+	current, err := e.store.GetEpoch(e.epochs.EpochAt(e.height - 1))
+	if err != nil {
+		fmt.Printf("Consensus: no leader group for height %d: %v\n", e.height, err)
+		return
+	}
+	e.epoch = &current
+	group := current.GroupAt(e.height)
+	validators := NewValidators(current, group)
+	if validators.Size() == 0 {
+		fmt.Printf("Consensus: group %d of epoch %d has no keys\n", group, current.Number)
+		return
+	}
+	e.validators = validators
+	if member, ok := validators.ByPublicKey(e.publicKey); ok {
+		e.self = member.ComputerID
+	}
+
+	e.schedule(e.config.CommitDelay, timeout{e.height, 0, stepNewHeight})
+}
+
+// startRound moves to a round and, if we are its proposer, proposes a block.
+func (e *Engine) startRound(round int) {
+	e.round = round
+	e.step = stepPropose
+
+	if e.self != "" && !e.gaveUp() && e.validators.Proposer(e.height, round).ComputerID == e.self {
+		e.propose()
+	}
+	e.schedule(e.config.ProposeTimeout+time.Duration(round)*e.config.TimeoutDelta, timeout{e.height, round, stepPropose})
+}
+
+// propose broadcasts the block we locked on earlier, or a new one built from
+// the mempool and, at the start of an epoch, the nodes to admit.
+func (e *Engine) propose() {
+	proposal := Proposal{Height: e.height, Round: e.round, ValidRound: -1, Proposer: e.self}
+	if e.validBlock != nil {
+		proposal.Block = *e.validBlock
+		proposal.ValidRound = e.validRound
+	} else {
+		pending := e.pool.Pending(e.config.MaxBlockTxs)
+		transfers := make([]storage.Transfer, len(pending))
+		for i, tx := range pending {
+			transfers[i] = tx.Transfer
+		}
+		changes, err := e.members.Changes()
+		if err != nil {
+			fmt.Println("Consensus: error picking membership changes:", err)
+		}
+		var pegChanges storage.PegChanges
+		if e.bitcoin != nil {
+			pegChanges = e.bitcoin.Ready()
+		}
+		block, rejected, err := e.store.BuildBlock(e.self, time.Now().Unix(), transfers, changes, pegChanges)
+		if err != nil {
+			fmt.Println("Consensus: error building block:", err)
+			return
+		}
+		for id, reason := range rejected {
+			fmt.Printf("%s left out of block %d: %v\n", id, block.Height, reason)
+			e.pool.Remove(id)
+		}
+		proposal.Block = block
+	}
+	proposal.Signature = cryptoUtils.SignMessage(e.key, proposal.SignBytes())
+
+	e.proposals[e.round] = proposal
+	e.broadcast(Message{Proposal: &proposal})
+}
+
+// castVote signs a vote for a block hash (empty for nil), records it and
+// broadcasts it. Nodes outside the leader group do not vote, and neither do
+// leaders that gave up the height.
+func (e *Engine) castVote(voteType VoteType, blockHash string) {
+	if e.self == "" || e.gaveUp() {
+		return
+	}
+	vote := Vote{Type: voteType, Height: e.height, Round: e.round, BlockHash: blockHash, Voter: e.self}
+	vote.Signature = cryptoUtils.SignMessage(e.key, vote.SignBytes())
+	e.addVote(vote)
+	e.broadcast(Message{Vote: &vote})
+}
+
+// handleMessage checks a proposal or vote and records it.
+func (e *Engine) handleMessage(message Message) {
+	switch {
+	case message.Proposal != nil:
+		proposal := *message.Proposal
+		if !e.forCurrentHeight(proposal.Height) {
+			return
+		}
+		if _, ok := e.proposals[proposal.Round]; ok {
+			return
+		}
+		if err := e.validators.VerifyProposal(proposal); err != nil {
+			fmt.Println("Consensus: proposal rejected:", err)
+			return
+		}
+		e.proposals[proposal.Round] = proposal
+	case message.Vote != nil:
+		vote := *message.Vote
+		if !e.forCurrentHeight(vote.Height) {
+			return
+		}
+		if err := e.validators.VerifyVote(vote); err != nil {
+			fmt.Println("Consensus: vote rejected:", err)
+			return
+		}
+		e.addVote(vote)
+	case message.Timeout != nil:
+		vote := *message.Timeout
+		if vote.Height > e.height {
+			e.sync()
+		}
+		if e.epoch == nil || vote.Epoch != e.epoch.Number || vote.Height != e.height || vote.Previous != e.previous {
+			return
+		}
+		from := e.epoch.GroupAt(e.height)
+		if vote.FromGroup != from || vote.ToGroup != NextGroup(*e.epoch, from) {
+			return
+		}
+		group := NewValidators(*e.epoch, vote.ToGroup)
+		if _, ok := group.Get(vote.Voter); !ok {
+			group = NewValidators(*e.epoch, vote.FromGroup)
+		}
+		if err := VerifyTimeoutVote(group, vote); err != nil {
+			fmt.Println("Consensus: timeout vote rejected:", err)
+			return
+		}
+		e.addTimeoutVote(vote)
+	case message.Failover != nil:
+		certificate := *message.Failover
+		if certificate.Height > e.height {
+			e.sync()
+		}
+		if e.epoch == nil || certificate.Epoch != e.epoch.Number || certificate.Height != e.height ||
+			certificate.Previous != e.previous || certificate.FromGroup != e.epoch.GroupAt(e.height) {
+			return
+		}
+		if err := VerifyFailover(*e.epoch, certificate); err != nil {
+			fmt.Println("Consensus: failover rejected:", err)
+			return
+		}
+		if err := e.failover(certificate); err != nil {
+			fmt.Println("Consensus:", err)
+		}
+	}
+}
+
+// forCurrentHeight reports whether a message is for the height being decided.
+// A message for a later height means we fell behind, so we fetch the missing
+// blocks from our peers.
+func (e *Engine) forCurrentHeight(height int64) bool {
+	if height > e.height {
+		e.sync()
+	}
+	return e.validators != nil && height == e.height
+}
+
+// handleTimeout acts on a timeout that is still current.
+func (e *Engine) handleTimeout(t timeout) {
+	if t.height != e.height || e.validators == nil {
+		return
+	}
+	switch t.step {
+	case stepNewHeight:
+		if e.step == stepNewHeight {
+			e.startRound(0)
+		}
+	case stepPropose:
+		if t.round == e.round && e.step == stepPropose {
+			e.castVote(Prevote, "")
+			e.step = stepPrevote
+		}
+	case stepPrevote:
+		if t.round == e.round && e.step == stepPrevote {
+			e.castVote(Precommit, "")
+			e.step = stepPrecommit
+		}
+	case stepPrecommit:
+		if t.round == e.round {
+			e.startRound(e.round + 1)
+		}
+	}
+}
+
+// applyRules applies the first consensus rule whose condition holds and
+// reports whether it changed the state, in which case it is called again.
+func (e *Engine) applyRules() bool {
+	if e.validators == nil {
+		return false
+	}
+	quorum := e.validators.Quorum()
+
+	// Commit any block with a quorum of precommits, whatever the round
+	for round, proposal := range e.proposals {
+		hash := proposal.Block.Hash
+		if e.count(Precommit, round, hash) >= quorum && e.check(proposal.Block) == nil {
+			e.commit(proposal.Block, round)
+			return true
+		}
+	}
+	if e.step == stepNewHeight {
+		return false
+	}
+
+	// Skip ahead to a later round that f+1 leaders have reached
+	for round := range e.votes {
+		if round > e.round && e.voters(round) > e.validators.MaxFaulty() {
+			e.startRound(round)
+			return true
+		}
+	}
+
+	proposal, hasProposal := e.proposals[e.round]
+	hash := proposal.Block.Hash
+
+	// Prevote for the proposal if it is valid and we are not locked on
+	// another block, or the proposal carries a newer prevote quorum
+	if e.step == stepPropose && hasProposal {
+		validRound := proposal.ValidRound
+		switch {
+		case validRound == -1:
+			if e.check(proposal.Block) == nil && (e.lockedRound == -1 || e.lockedBlock.Hash == hash) {
+				e.castVote(Prevote, hash)
+			} else {
+				e.castVote(Prevote, "")
+			}
+			e.step = stepPrevote
+			return true
+		case validRound < e.round && e.count(Prevote, validRound, hash) >= quorum:
+			if e.check(proposal.Block) == nil && (e.lockedRound <= validRound || e.lockedBlock.Hash == hash) {
+				e.castVote(Prevote, hash)
+			} else {
+				e.castVote(Prevote, "")
+			}
+			e.step = stepPrevote
+			return true
+		}
+	}
+
+	// Wait a little longer once a quorum prevoted, whatever for
+	if e.step == stepPrevote && e.total(Prevote, e.round) >= quorum && e.once("prevote-timeout", e.round) {
+		e.schedule(e.config.PrevoteTimeout+time.Duration(e.round)*e.config.TimeoutDelta, timeout{e.height, e.round, stepPrevote})
+	}
+
+	// Lock on and precommit a block with a quorum of prevotes
+	if hasProposal && e.step >= stepPrevote && e.count(Prevote, e.round, hash) >= quorum &&
+		e.check(proposal.Block) == nil && e.once("prevote-quorum", e.round) {
+		block := proposal.Block
+		if e.step == stepPrevote {
+			e.lockedRound, e.lockedBlock = e.round, &block
+			e.castVote(Precommit, hash)
+			e.step = stepPrecommit
+		}
+		e.validRound, e.validBlock = e.round, &block
+		return true
+	}
+
+	// Precommit nil when a quorum prevoted nil
+	if e.step == stepPrevote && e.count(Prevote, e.round, "") >= quorum {
+		e.castVote(Precommit, "")
+		e.step = stepPrecommit
+		return true
+	}
+
+	// Move to the next round if a quorum precommitted without a decision
+	if e.total(Precommit, e.round) >= quorum && e.once("precommit-timeout", e.round) {
+		e.schedule(e.config.PrecommitTimeout+time.Duration(e.round)*e.config.TimeoutDelta, timeout{e.height, e.round, stepPrecommit})
+	}
+	return false
+}
+
+// check verifies a proposed block once and remembers the result: every
+// transfer must be signed by its sender, the timestamp must be sane, the
+// membership changes must follow the membership rules, withdrawals must go to
+// Bitcoin addresses that can be paid, the deposits must be confirmed on
+// Bitcoin, the payouts signed by the peg and replaying the block must reproduce its roots and
+// hash. A block that could not be checked, say because bitcoind did not
+// answer, is checked again the next time.
+func (e *Engine) check(block storage.Block) error {
+	if err, ok := e.checked[block.Hash]; ok {
+		return err
+	}
+	err := e.verifyBlock(block)
+	if err != nil {
+		fmt.Printf("Consensus: block %d (%s) is invalid: %v\n", block.Height, block.Hash, err)
+	}
+	if err == nil || errors.Is(err, storage.ErrInvalidBlock) {
+		e.checked[block.Hash] = err
+	}
+	return err
+}
+
+func (e *Engine) verifyBlock(block storage.Block) error {
+	if block.Timestamp > time.Now().Add(maxClockDrift).Unix() {
+		return fmt.Errorf("%w: timestamp %d is in the future", storage.ErrInvalidBlock, block.Timestamp)
+	}
+	for _, transfer := range block.Transfers {
+		if err := cryptoUtils.VerifyTransfer(transfer); err != nil {
+			return err
+		}
+		if _, ok := storage.WithdrawalAddress(transfer.To); ok {
+			if e.bitcoin == nil {
+				return fmt.Errorf("cannot check the withdrawals of block %d without a Bitcoin backend", block.Height)
+			}
+			if err := e.bitcoin.CheckWithdrawal(transfer); err != nil {
+				return fmt.Errorf("%w: transfer %s: %w", storage.ErrInvalidBlock, transfer.TxID, err)
+			}
+		}
+	}
+	if err := e.members.CheckChanges(block); err != nil {
+		return err
+	}
+	if len(block.Deposits) > 0 || len(block.Payouts) > 0 {
+		if e.bitcoin == nil {
+			return fmt.Errorf("cannot check the deposits and payouts of block %d without a Bitcoin backend", block.Height)
+		}
+		if err := e.bitcoin.Check(storage.PegChanges{Deposits: block.Deposits, Payouts: block.Payouts}); err != nil {
+			return err
+		}
+	}
+	return e.store.VerifyBlock(block)
+}
+
+// commit stores a block with the precommits of a round as its certificate
+// and moves to the next height.
+func (e *Engine) commit(block storage.Block, round int) {
+	certificate := Certificate{Height: e.height, Round: round, BlockHash: block.Hash}
+	for _, vote := range e.votes[round][Precommit] {
+		if vote.BlockHash == block.Hash {
+			certificate.Precommits = append(certificate.Precommits, vote)
+		}
+	}
+	if err := e.store.CommitBlock(withCertificate(block, certificate)); err != nil {
+		fmt.Printf("Consensus: error committing block %d: %v\n", block.Height, err)
+	} else {
+		fmt.Printf("Block %d committed in round %d with %d transactions\n", block.Height, round, len(block.Transfers))
+		membership.LogChanges(block)
+		e.lastProgress = time.Now()
+		e.removeFromPool(block)
+	}
+	e.enterHeight()
+}
+
+// checkFailover casts a timeout vote on our latest block when the leading
+// group has not committed a block within the failover timeout and we are in
+// the standby group, or in the leading group without having precommitted a
+// block at the height. A leader that votes gives up the height: it votes and
+// proposes no more at it, so once a quorum of its group did the same the group
+// can no longer commit it. A leader that precommitted a block does not vote,
+// since its group may have committed that block. The vote is sent again on
+// every call until the failover happens, which makes up for votes lost on the
+// way.
+func (e *Engine) checkFailover() {
+	if e.epoch == nil || time.Since(e.lastProgress) < e.config.FailoverTimeout {
+		return
+	}
+	from := e.epoch.GroupAt(e.height)
+	to := NextGroup(*e.epoch, from)
+	if to == from {
+		return
+	}
+
+	vote := TimeoutVote{Epoch: e.epoch.Number, Height: e.height, Previous: e.previous, FromGroup: from, ToGroup: to}
+	if member, ok := NewValidators(*e.epoch, to).ByPublicKey(e.publicKey); ok {
+		vote.Voter = member.ComputerID
+	} else if e.self != "" && e.lockedRound == -1 {
+		vote.Voter = e.self
+	} else {
+		return
+	}
+	vote.Signature = cryptoUtils.SignMessage(e.key, vote.SignBytes())
+	if vote.Voter == e.self {
+		e.stalled = &vote
+	}
+	e.transport.Broadcast(e.peers(), Message{Timeout: &vote})
+	e.addTimeoutVote(vote)
+}
+
+// gaveUp reports whether we signed a timeout vote for the current height as
+// a member of the group that leads it.
+func (e *Engine) gaveUp() bool {
+	return e.stalled != nil && e.epoch != nil && e.stalled.Epoch == e.epoch.Number &&
+		e.stalled.Height == e.height && e.stalled.FromGroup == e.epoch.GroupAt(e.height)
+}
+
+// addTimeoutVote records a checked timeout vote for the current height and
+// our latest block. Once a quorum of the standby group agrees, their votes
+// and those of the leading group so far become the failover certificate,
+// which is applied and sent to every member of the epoch. The leading group
+// need not vote, so a group that went offline is replaced all the same.
+func (e *Engine) addTimeoutVote(vote TimeoutVote) {
+	e.timeoutVotes[vote.Voter] = vote
+
+	certificate := FailoverCertificate{Epoch: vote.Epoch, Height: vote.Height, Previous: vote.Previous, FromGroup: vote.FromGroup, ToGroup: vote.ToGroup}
+	standby, stalled := NewValidators(*e.epoch, vote.ToGroup), NewValidators(*e.epoch, vote.FromGroup)
+	for _, v := range e.timeoutVotes {
+		if v.Epoch != vote.Epoch || v.Height != vote.Height || v.Previous != vote.Previous ||
+			v.FromGroup != vote.FromGroup || v.ToGroup != vote.ToGroup {
+			continue
+		}
+		if _, ok := standby.Get(v.Voter); ok {
+			certificate.Votes = append(certificate.Votes, v)
+		} else if _, ok := stalled.Get(v.Voter); ok {
+			certificate.Stalled = append(certificate.Stalled, v)
+		}
+	}
+	if len(certificate.Votes) < standby.Quorum() {
+		return
+	}
+	sort.Slice(certificate.Votes, func(i, j int) bool { return certificate.Votes[i].Voter < certificate.Votes[j].Voter })
+	sort.Slice(certificate.Stalled, func(i, j int) bool { return certificate.Stalled[i].Voter < certificate.Stalled[j].Voter })
+
+	peers := e.peers()
+	if err := e.failover(certificate); err != nil {
+		fmt.Println("Consensus:", err)
+		return
+	}
+	e.transport.Broadcast(peers, Message{Failover: &certificate})
+}
+
+// failover stores a checked failover certificate, which hands the current
+// height and the rest of the epoch to its group, and restarts the height
+// with that group.
+func (e *Engine) failover(certificate FailoverCertificate) error {
+	payload, err := json.Marshal(certificate)
+	if err != nil {
+		return fmt.Errorf("failed to encode failover certificate: %w", err)
+	}
+	failover := storage.Failover{
+		Epoch:       certificate.Epoch,
+		Seq:         len(e.epoch.Failovers),
+		Height:      certificate.Height,
+		FromGroup:   certificate.FromGroup,
+		ToGroup:     certificate.ToGroup,
+		Certificate: payload,
+	}
+	if err := e.store.SaveFailover(failover); err != nil {
+		return fmt.Errorf("failed to save failover to group %d: %w", certificate.ToGroup, err)
+	}
+	fmt.Printf("Group %d of epoch %d took over from group %d at height %d\n",
+		certificate.ToGroup, certificate.Epoch, certificate.FromGroup, certificate.Height)
+	e.lastProgress = time.Now()
+	e.enterHeight()
+	return nil
+}
+
+// sync fetches blocks we are missing from the other members of the epoch
+// and commits those whose certificate checks out. It runs at most once a
+// second.
+func (e *Engine) sync() {
+	if time.Since(e.lastSync) < time.Second || e.epoch == nil {
+		return
+	}
+	e.lastSync = time.Now()
+
+	for _, peer := range e.peers() {
+		for e.epoch != nil {
+			block, err := e.transport.FetchBlock(peer, e.height)
+			if err != nil {
+				break
+			}
+			if err := e.syncBlock(peer, block); err != nil {
+				fmt.Printf("Consensus: block %d from %s: %v\n", block.Height, peer.IPAddress, err)
+				break
+			}
+			fmt.Printf("Block %d synced from %s\n", block.Height, peer.IPAddress)
+		}
+	}
+}
+
+// syncBlock commits a block fetched from a peer if its certificate checks
+// out. A certificate from a group we do not know to be leading may follow a
+// failover we missed, so the peer's failovers are checked and applied before
+// the certificate is rejected.
+func (e *Engine) syncBlock(peer storage.EpochMember, block storage.Block) error {
+	var certificate Certificate
+	if err := json.Unmarshal(block.Certificate, &certificate); err != nil {
+		return fmt.Errorf("%w: block has no certificate", ErrInvalidMessage)
+	}
+	if e.validators == nil || e.validators.VerifyCertificate(certificate, block) != nil {
+		if err := e.syncFailovers(peer); err != nil {
+			return err
+		}
+		if e.validators == nil {
+			return fmt.Errorf("no leader group for height %d", e.height)
+		}
+		if err := e.validators.VerifyCertificate(certificate, block); err != nil {
+			return err
+		}
+	}
+	if err := e.store.CommitBlock(block); err != nil {
+		return err
+	}
+	e.lastProgress = time.Now()
+	e.removeFromPool(block)
+	e.enterHeight()
+	return nil
+}
+
+// syncFailovers applies the failovers of the current epoch that a peer has
+// and we do not, checking each certificate in turn. A failover below the
+// current height would overrule blocks we already committed and is refused.
+func (e *Engine) syncFailovers(peer storage.EpochMember) error {
+	remote, err := e.transport.FetchEpoch(peer, e.epoch.Number)
+	if err != nil {
+		return err
+	}
+	for e.epoch != nil && len(remote.Failovers) > len(e.epoch.Failovers) {
+		var certificate FailoverCertificate
+		if err := json.Unmarshal(remote.Failovers[len(e.epoch.Failovers)].Certificate, &certificate); err != nil {
+			return fmt.Errorf("%w: failover has no certificate", ErrInvalidMessage)
+		}
+		if certificate.Height < e.height || certificate.Height == e.height && certificate.Previous != e.previous {
+			return fmt.Errorf("%w: failover at height %d conflicts with committed blocks", ErrInvalidMessage, certificate.Height)
+		}
+		if err := VerifyFailover(*e.epoch, certificate); err != nil {
+			return err
+		}
+		if err := e.failover(certificate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFromPool drops the transfers of a committed block from the mempool.
+func (e *Engine) removeFromPool(block storage.Block) {
+	ids := make([]string, len(block.Transfers))
+	for i, t := range block.Transfers {
+		ids[i] = t.TxID
+	}
+	e.pool.Remove(ids...)
+}
+
+// broadcast sends a message to every other leader.
+func (e *Engine) broadcast(message Message) {
+	var peers []storage.EpochMember
+	for _, member := range e.validators.Members() {
+		if member.ComputerID != e.self {
+			peers = append(peers, member)
+		}
+	}
+	e.transport.Broadcast(peers, message)
+}
+
+// peers returns every other member of the epoch, in any group.
+func (e *Engine) peers() []storage.EpochMember {
+	var peers []storage.EpochMember
+	for _, member := range e.epoch.Members {
+		if member.PublicKey != e.publicKey {
+			peers = append(peers, member)
+		}
+	}
+	return peers
+}
+
+// schedule delivers a timeout to Run after a delay. Once Run has stopped
+// the timeout is dropped instead of blocking its goroutine forever.
+func (e *Engine) schedule(delay time.Duration, t timeout) {
+	stop := e.stop
+	time.AfterFunc(delay, func() {
+		select {
+		case e.timeouts <- t:
+		case <-stop:
+		}
+	})
+}
+
+// addVote records the first vote of each leader for each round and step.
+func (e *Engine) addVote(vote Vote) {
+	if e.votes[vote.Round] == nil {
+		e.votes[vote.Round] = make(map[VoteType]map[string]Vote)
+	}
+	if e.votes[vote.Round][vote.Type] == nil {
+		e.votes[vote.Round][vote.Type] = make(map[string]Vote)
+	}
+	if _, ok := e.votes[vote.Round][vote.Type][vote.Voter]; !ok {
+		e.votes[vote.Round][vote.Type][vote.Voter] = vote
+	}
+}
+
+// count returns the votes of a type in a round for a block hash.
+func (e *Engine) count(voteType VoteType, round int, blockHash string) int {
+	n := 0
+	for _, vote := range e.votes[round][voteType] {
+		if vote.BlockHash == blockHash {
+			n++
+		}
+	}
+	return n
+}
+
+// total returns the votes of a type in a round, whatever they are for.
+func (e *Engine) total(voteType VoteType, round int) int {
+	return len(e.votes[round][voteType])
+}
+
+// voters returns the number of leaders that voted in a round.
+func (e *Engine) voters(round int) int {
+	seen := make(map[string]bool)
+	for _, votes := range e.votes[round] {
+		for voter := range votes {
+			seen[voter] = true
+		}
+	}
+	return len(seen)
+}
+
+// once reports whether an action was not taken yet in a round, and marks it taken.
+func (e *Engine) once(action string, round int) bool {
+	key := fmt.Sprintf("%s/%d", action, round)
+	if e.onceFlags[key] {
+		return false
+	}
+	e.onceFlags[key] = true
+	return true
+}
+
+// withCertificate returns the block with the certificate attached.
+func withCertificate(block storage.Block, certificate Certificate) storage.Block {
+	block.Certificate, _ = json.Marshal(certificate)
+	return block
+}
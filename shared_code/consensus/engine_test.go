@@ -0,0 +1,414 @@
+package consensus_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"bitcoin-sidechain/consensus"
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/epoch"
+	"bitcoin-sidechain/membership"
+	"bitcoin-sidechain/mempool"
+	"bitcoin-sidechain/peg"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// testConfig keeps rounds short so a test goes through several of them.
+var testConfig = consensus.Config{
+	ProposeTimeout:   300 * time.Millisecond,
+	PrevoteTimeout:   100 * time.Millisecond,
+	PrecommitTimeout: 100 * time.Millisecond,
+	TimeoutDelta:     50 * time.Millisecond,
+	CommitDelay:      50 * time.Millisecond,
+	SyncInterval:     time.Second,
+	FailoverTimeout:  time.Hour,
+}
+
+// action is what the network does with a message on its way to a node.
+type action int
+
+const (
+	deliver action = iota
+	drop
+	hold    // keep until a message routed with release
+	release // deliver every held message, then this one
+)
+
+type delivery struct {
+	to      string
+	message consensus.Message
+}
+
+// errOffline is returned when fetching from a node that is down.
+var errOffline = errors.New("node is offline")
+
+// network carries consensus messages between in-process engines through
+// JSON, as they would travel between nodes. route, if set, decides the fate
+// of each message. While paused every message is held. Nodes marked down
+// before run never start, and nothing reaches them or comes from them.
+type network struct {
+	mu     sync.Mutex
+	nodes  map[string]*testNode
+	route  func(from, to string, message consensus.Message) action
+	held   []delivery
+	paused bool
+	down   map[string]bool
+}
+
+type testNode struct {
+	id      string
+	key     *btcec.PrivateKey
+	store   storage.Store
+	pool    *mempool.Pool
+	epochs  *epoch.Manager
+	watcher *peg.Watcher
+	engine  *consensus.Engine
+}
+
+// link is the transport of one node.
+type link struct {
+	net  *network
+	self string
+}
+
+func (l link) Broadcast(peers []storage.EpochMember, message consensus.Message) {
+	l.net.send(l.self, peers, message)
+}
+
+func (l link) FetchBlock(peer storage.EpochMember, height int64) (storage.Block, error) {
+	node := l.net.node(peer.ComputerID)
+	if node == nil {
+		return storage.Block{}, errOffline
+	}
+	return node.store.GetBlock(height)
+}
+
+func (l link) FetchEpoch(peer storage.EpochMember, number int64) (storage.Epoch, error) {
+	node := l.net.node(peer.ComputerID)
+	if node == nil {
+		return storage.Epoch{}, errOffline
+	}
+	return node.store.GetEpoch(number)
+}
+
+// node returns a node that is up, or nil.
+func (n *network) node(id string) *testNode {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.down[id] {
+		return nil
+	}
+	return n.nodes[id]
+}
+
+// stop marks nodes as down. It is called before run.
+func (n *network) stop(nodes []*testNode) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, node := range nodes {
+		n.down[node.id] = true
+	}
+}
+
+func (n *network) send(from string, peers []storage.EpochMember, message consensus.Message) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		panic(err)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.down[from] {
+		return
+	}
+	for _, peer := range peers {
+		to, ok := n.nodes[peer.ComputerID]
+		if !ok || n.down[to.id] {
+			continue
+		}
+		var copied consensus.Message
+		if err := json.Unmarshal(payload, &copied); err != nil {
+			panic(err)
+		}
+		verdict := deliver
+		if n.paused {
+			verdict = hold
+		} else if n.route != nil {
+			verdict = n.route(from, to.id, copied)
+		}
+		switch verdict {
+		case release:
+			for _, d := range n.held {
+				n.nodes[d.to].engine.Receive(d.message)
+			}
+			n.held = nil
+			to.engine.Receive(copied)
+		case deliver:
+			to.engine.Receive(copied)
+		case hold:
+			n.held = append(n.held, delivery{to: to.id, message: copied})
+		}
+	}
+}
+
+// newNetwork opens size nodes that share a genesis naming all of them, split
+// into leader groups of groupSize in epoch 0. setup, if set, runs on each
+// node before its engine is made, and may give it a watcher.
+func newNetwork(t *testing.T, size, groupSize int, config consensus.Config, setup func(n *testNode)) *network {
+	t.Helper()
+	keys := make([]*btcec.PrivateKey, size)
+	var genesis storage.Genesis
+	for i := range keys {
+		key, err := btcec.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+		genesis.Nodes = append(genesis.Nodes, storage.GenesisNode{
+			ComputerID: cryptoUtils.NodeID(key.PubKey()),
+			IPAddress:  fmt.Sprintf("10.0.0.%d:8080", i+1),
+			PublicKey:  cryptoUtils.PublicKeyBase64(key),
+		})
+	}
+
+	net := &network{nodes: make(map[string]*testNode), down: make(map[string]bool)}
+	dir := t.TempDir()
+	for i, key := range keys {
+		store, err := storage.Open("sqlite3", filepath.Join(dir, fmt.Sprintf("node%d.db", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		if _, err := store.ApplyGenesis(genesis); err != nil {
+			t.Fatal(err)
+		}
+		epochs := epoch.NewManager(store, 1000, groupSize)
+		if _, err := epochs.Advance(); err != nil {
+			t.Fatal(err)
+		}
+
+		n := &testNode{
+			id:     cryptoUtils.NodeID(key.PubKey()),
+			key:    key,
+			store:  store,
+			pool:   mempool.New(mempool.Config{}),
+			epochs: epochs,
+		}
+		if setup != nil {
+			setup(n)
+		}
+		members := membership.New(store, epochs, nil, nil, nil, membership.Config{})
+		n.engine = consensus.NewEngine(store, n.pool, epochs, members, n.watcher, key, link{net: net, self: n.id}, config)
+		net.nodes[n.id] = n
+	}
+	return net
+}
+
+// group returns the nodes of a group of epoch 0, in order.
+func (n *network) group(t *testing.T, number int) []*testNode {
+	t.Helper()
+	var any *testNode
+	for _, node := range n.nodes {
+		any = node
+		break
+	}
+	current, err := any.store.GetEpoch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leaders []*testNode
+	for _, member := range consensus.NewValidators(current, number).Members() {
+		leaders = append(leaders, n.nodes[member.ComputerID])
+	}
+	return leaders
+}
+
+// run starts the engine of every node that is up until the test ends.
+func (n *network) run(t *testing.T) {
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	for _, node := range n.up() {
+		go node.engine.Run(stop)
+	}
+}
+
+// up returns the nodes that are not down.
+func (n *network) up() []*testNode {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var nodes []*testNode
+	for _, node := range n.nodes {
+		if !n.down[node.id] {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// pause holds the messages between the engines and waits until every node
+// has the same latest block, fetched from the others if it missed the last
+// commit, so the chain holds still while the test looks at it.
+func (n *network) pause(t *testing.T) {
+	t.Helper()
+	n.mu.Lock()
+	n.paused = true
+	n.mu.Unlock()
+
+	deadline := time.Now().Add(10 * time.Second)
+	var last int64 = -1
+	for time.Now().Before(deadline) {
+		time.Sleep(300 * time.Millisecond)
+		height, same := int64(-1), true
+		for _, node := range n.up() {
+			latest, err := node.store.LatestBlock()
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				t.Fatal(err)
+			}
+			if height >= 0 && latest.Height != height {
+				same = false
+			}
+			height = latest.Height
+		}
+		if same && height == last {
+			return
+		}
+		last = height
+	}
+	t.Fatal("the nodes did not settle on the same block")
+}
+
+// resume delivers the messages held since pause and lets the next ones
+// through.
+func (n *network) resume() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.paused = false
+	for _, d := range n.held {
+		n.nodes[d.to].engine.Receive(d.message)
+	}
+	n.held = nil
+}
+
+// waitFor waits until condition holds on every node that is up.
+func (n *network) waitFor(t *testing.T, what string, within time.Duration, condition func(node *testNode) bool) {
+	t.Helper()
+	deadline := time.Now().Add(within)
+	for {
+		done := true
+		for _, node := range n.up() {
+			if !condition(node) {
+				done = false
+			}
+		}
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not happen on every node within %s", what, within)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// waitHeight waits until every node that is up committed height and returns
+// the block after checking that they all stored the same.
+func (n *network) waitHeight(t *testing.T, height int64, within time.Duration) storage.Block {
+	t.Helper()
+	deadline := time.Now().Add(within)
+	for {
+		done := true
+		for _, node := range n.up() {
+			if latest, err := node.store.LatestBlock(); err != nil || latest.Height < height {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("height %d was not committed by every node within %s", height, within)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var first storage.Block
+	for _, node := range n.up() {
+		block, err := node.store.GetBlock(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.Hash == "" {
+			first = block
+		} else if block.Hash != first.Hash {
+			t.Fatalf("nodes committed different blocks at height %d", height)
+		}
+	}
+	return first
+}
+
+func certificateOf(t *testing.T, block storage.Block) consensus.Certificate {
+	t.Helper()
+	var certificate consensus.Certificate
+	if err := json.Unmarshal(block.Certificate, &certificate); err != nil {
+		t.Fatalf("block %d has no certificate: %v", block.Height, err)
+	}
+	return certificate
+}
+
+func TestCommitsInFirstRound(t *testing.T) {
+	net := newNetwork(t, 4, 4, testConfig, nil)
+	net.run(t)
+	block := net.waitHeight(t, 2, 10*time.Second)
+	if round := certificateOf(t, block).Round; round != 0 {
+		t.Errorf("block 2 committed in round %d with every message delivered", round)
+	}
+}
+
+// In round 0 only the proposer of round 1 sees a quorum of prevotes for the
+// block, locks on it and precommits it; the others precommit nil. Round 1's
+// proposer must then propose the block of round 0 again, and once the late
+// prevotes reach the others they prevote it and commit it.
+func TestReproposesLockedBlock(t *testing.T) {
+	net := newNetwork(t, 4, 4, testConfig, nil)
+	leaders := net.group(t, 1)
+	// Height 1 is proposed by leader 1 in round 0 and leader 2 in round 1
+	first, second, late := leaders[1].id, leaders[2].id, leaders[0].id
+
+	var mu sync.Mutex
+	var proposed string
+	net.route = func(from, to string, message consensus.Message) action {
+		switch {
+		case message.Proposal != nil && message.Proposal.Height == 1 && message.Proposal.Round == 0:
+			mu.Lock()
+			proposed = message.Proposal.Block.Hash
+			mu.Unlock()
+			if to == late {
+				return drop
+			}
+		case message.Vote != nil && message.Vote.Height == 1 && message.Vote.Round == 0 &&
+			message.Vote.Type == consensus.Prevote && from == second:
+			return hold
+		case message.Proposal != nil && message.Proposal.Height == 1 && message.Proposal.Round == 1:
+			return release
+		}
+		return deliver
+	}
+	net.run(t)
+
+	block := net.waitHeight(t, 1, 10*time.Second)
+	certificate := certificateOf(t, block)
+	mu.Lock()
+	defer mu.Unlock()
+	if block.Hash != proposed || block.Producer != first {
+		t.Errorf("committed block %s by %s, expected the block %s of round 0 by %s", block.Hash, block.Producer, proposed, first)
+	}
+	if certificate.Round != 1 {
+		t.Errorf("block committed in round %d, expected round 1", certificate.Round)
+	}
+}
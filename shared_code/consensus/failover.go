@@ -0,0 +1,133 @@
+package consensus
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/storage"
+)
+
+// TimeoutVote asks for the lead of an epoch to move from FromGroup to ToGroup
+// from Height on, once FromGroup has not committed Height within the failover
+// timeout. Previous is the hash of block Height-1, the last block the voter
+// committed. A member of the standby group ToGroup signs one to take over. A
+// member of the stalled group FromGroup signs one only if it has not
+// precommitted a block at Height, and then stops voting at Height, so that
+// its group can no longer commit a block there.
+type TimeoutVote struct {
+	Epoch     int64  `json:"epoch"`
+	Height    int64  `json:"height"`
+	Previous  string `json:"previous"`
+	FromGroup int    `json:"from_group"`
+	ToGroup   int    `json:"to_group"`
+	Voter     string `json:"voter"`
+	Signature string `json:"signature"`
+}
+
+// SignBytes returns the canonical form of the timeout vote that is signed.
+// The type field keeps it from ever being read as a prevote or precommit.
+func (v TimeoutVote) SignBytes() []byte {
+	payload, _ := json.Marshal(struct {
+		Type      string `json:"type"`
+		Epoch     int64  `json:"epoch"`
+		Height    int64  `json:"height"`
+		Previous  string `json:"previous"`
+		FromGroup int    `json:"from_group"`
+		ToGroup   int    `json:"to_group"`
+		Voter     string `json:"voter"`
+	}{"timeout", v.Epoch, v.Height, v.Previous, v.FromGroup, v.ToGroup, v.Voter})
+	return payload
+}
+
+// FailoverCertificate is a quorum of timeout votes from the standby group,
+// Votes, all on the same last committed block, Previous. That block anchors
+// the failover: the standby group goes on from it and never from a block
+// below. Stalled holds the timeout votes of the stalled group that arrived in
+// time. They are not needed, so a group that went offline is still replaced,
+// but with a quorum of them the stalled group can no longer commit Height
+// either. It is stored with the failover so any node can check who leads a
+// height.
+type FailoverCertificate struct {
+	Epoch     int64         `json:"epoch"`
+	Height    int64         `json:"height"`
+	Previous  string        `json:"previous"`
+	FromGroup int           `json:"from_group"`
+	ToGroup   int           `json:"to_group"`
+	Votes     []TimeoutVote `json:"votes"`
+	Stalled   []TimeoutVote `json:"stalled"`
+}
+
+// NextGroup returns the group that takes over from a group: the next one by
+// number, wrapping around to group 1 after the last.
+func NextGroup(epoch storage.Epoch, group int) int {
+	groups := epoch.Groups()
+	if groups == 0 {
+		return group
+	}
+	return group%groups + 1
+}
+
+// VerifyTimeoutVote checks that a timeout vote comes from a member of group,
+// the standby or the stalled group the vote names, and is signed by it.
+func VerifyTimeoutVote(group *Validators, vote TimeoutVote) error {
+	member, ok := group.Get(vote.Voter)
+	if !ok {
+		return fmt.Errorf("%w: %s is not in the group", ErrInvalidMessage, vote.Voter)
+	}
+	if err := cryptoUtils.VerifyMessage(member.PublicKey, vote.SignBytes(), vote.Signature); err != nil {
+		return fmt.Errorf("%w: timeout vote from %s: %v", ErrInvalidMessage, vote.Voter, err)
+	}
+	return nil
+}
+
+// VerifyFailover checks a failover certificate against an epoch and the
+// failovers already known in it: the lead must move from the group deciding
+// the height to the next group, no earlier than the last failover, and a
+// quorum of the next group must have signed timeout votes for exactly that.
+// Votes of the stalled group are optional, but each must check out.
+func VerifyFailover(epoch storage.Epoch, certificate FailoverCertificate) error {
+	if certificate.Epoch != epoch.Number {
+		return fmt.Errorf("%w: failover is for epoch %d, not %d", ErrInvalidMessage, certificate.Epoch, epoch.Number)
+	}
+	if certificate.Height <= epoch.StartHeight {
+		return fmt.Errorf("%w: failover height %d is not decided by epoch %d", ErrInvalidMessage, certificate.Height, epoch.Number)
+	}
+	if n := len(epoch.Failovers); n > 0 && certificate.Height < epoch.Failovers[n-1].Height {
+		return fmt.Errorf("%w: failover at height %d comes before the last one", ErrInvalidMessage, certificate.Height)
+	}
+	if from := epoch.GroupAt(certificate.Height); certificate.FromGroup != from {
+		return fmt.Errorf("%w: group %d does not lead height %d", ErrInvalidMessage, certificate.FromGroup, certificate.Height)
+	}
+	if certificate.ToGroup != NextGroup(epoch, certificate.FromGroup) || certificate.ToGroup == certificate.FromGroup {
+		return fmt.Errorf("%w: group %d cannot take over from group %d", ErrInvalidMessage, certificate.ToGroup, certificate.FromGroup)
+	}
+
+	standby := NewValidators(epoch, certificate.ToGroup)
+	voters, err := verifyTimeoutVotes(standby, certificate, certificate.Votes)
+	if err != nil {
+		return err
+	}
+	if standby.Size() == 0 || voters < standby.Quorum() {
+		return fmt.Errorf("%w: failover has %d timeout votes from group %d, %d needed", ErrInvalidMessage, voters, certificate.ToGroup, standby.Quorum())
+	}
+	_, err = verifyTimeoutVotes(NewValidators(epoch, certificate.FromGroup), certificate, certificate.Stalled)
+	return err
+}
+
+// verifyTimeoutVotes checks that votes come from members of a group and are
+// for the failover of a certificate, and returns how many members voted.
+func verifyTimeoutVotes(group *Validators, certificate FailoverCertificate, votes []TimeoutVote) (int, error) {
+	voters := make(map[string]bool)
+	for _, vote := range votes {
+		if vote.Epoch != certificate.Epoch || vote.Height != certificate.Height || vote.Previous != certificate.Previous ||
+			vote.FromGroup != certificate.FromGroup || vote.ToGroup != certificate.ToGroup {
+			return 0, fmt.Errorf("%w: failover holds a vote for something else", ErrInvalidMessage)
+		}
+		if err := VerifyTimeoutVote(group, vote); err != nil {
+			return 0, err
+		}
+		voters[vote.Voter] = true
+	}
+	return len(voters), nil
+}
@@ -0,0 +1,125 @@
+package consensus_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"bitcoin-sidechain/consensus"
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/storage"
+)
+
+// failoverConfig lets the standby group take over after a second.
+var failoverConfig = func() consensus.Config {
+	config := testConfig
+	config.FailoverTimeout = time.Second
+	config.SyncInterval = 200 * time.Millisecond
+	return config
+}()
+
+func signTimeout(node *testNode, certificate consensus.FailoverCertificate) consensus.TimeoutVote {
+	vote := consensus.TimeoutVote{
+		Epoch:     certificate.Epoch,
+		Height:    certificate.Height,
+		Previous:  certificate.Previous,
+		FromGroup: certificate.FromGroup,
+		ToGroup:   certificate.ToGroup,
+		Voter:     node.id,
+	}
+	vote.Signature = cryptoUtils.SignMessage(node.key, vote.SignBytes())
+	return vote
+}
+
+func TestVerifyFailover(t *testing.T) {
+	net := newNetwork(t, 8, 4, testConfig, nil)
+	current, err := net.group(t, 1)[0].store.GetEpoch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaders, standby := net.group(t, 1), net.group(t, 2)
+	certificate := consensus.FailoverCertificate{Epoch: 0, Height: 1, Previous: storage.ZeroHash, FromGroup: 1, ToGroup: 2}
+	for _, node := range standby[:2] {
+		certificate.Votes = append(certificate.Votes, signTimeout(node, certificate))
+	}
+	if err := consensus.VerifyFailover(current, certificate); !errors.Is(err, consensus.ErrInvalidMessage) {
+		t.Fatalf("failover with 2 of 4 standby votes: got %v, expected ErrInvalidMessage", err)
+	}
+
+	// A standby quorum is enough: the stalled group may be offline
+	certificate.Votes = append(certificate.Votes, signTimeout(standby[2], certificate))
+	if err := consensus.VerifyFailover(current, certificate); err != nil {
+		t.Fatalf("failover with a standby quorum: %v", err)
+	}
+
+	// Stalled votes are optional, but must come from the stalled group
+	certificate.Stalled = []consensus.TimeoutVote{signTimeout(leaders[0], certificate)}
+	if err := consensus.VerifyFailover(current, certificate); err != nil {
+		t.Fatalf("failover with one stalled vote: %v", err)
+	}
+	certificate.Stalled = append(certificate.Stalled, signTimeout(standby[3], certificate))
+	if err := consensus.VerifyFailover(current, certificate); !errors.Is(err, consensus.ErrInvalidMessage) {
+		t.Fatalf("failover with a standby vote as a stalled one: got %v, expected ErrInvalidMessage", err)
+	}
+	certificate.Stalled = nil
+
+	// Every vote must build on the same last committed block
+	other := certificate
+	other.Previous = strings.Repeat("ab", 32)
+	certificate.Votes[2] = signTimeout(standby[2], other)
+	if err := consensus.VerifyFailover(current, certificate); !errors.Is(err, consensus.ErrInvalidMessage) {
+		t.Fatalf("failover with a vote on another block: got %v, expected ErrInvalidMessage", err)
+	}
+}
+
+// The leaders never see a proposal, so none of them locks: they give up
+// height 1 and the standby group commits it.
+func TestFailsOverWhenLeadersStall(t *testing.T) {
+	net := newNetwork(t, 8, 4, failoverConfig, nil)
+	leaders := make(map[string]bool)
+	for _, node := range net.group(t, 1) {
+		leaders[node.id] = true
+	}
+	net.route = func(from, to string, message consensus.Message) action {
+		if message.Proposal != nil && leaders[message.Proposal.Proposer] {
+			return drop
+		}
+		return deliver
+	}
+	net.run(t)
+
+	block := net.waitHeight(t, 1, 15*time.Second)
+	if leaders[block.Producer] {
+		t.Errorf("block 1 was produced by %s of the stalled group", block.Producer)
+	}
+	current, err := net.group(t, 1)[0].store.GetEpoch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group := current.GroupAt(1); group != 2 {
+		t.Errorf("group %d leads height 1, expected group 2", group)
+	}
+}
+
+// Every node of the leading group is down, so none of them can sign a
+// timeout vote: the standby group fails over on its own and commits.
+func TestFailsOverWhenLeadersOffline(t *testing.T) {
+	net := newNetwork(t, 8, 4, failoverConfig, nil)
+	net.stop(net.group(t, 1))
+	net.run(t)
+
+	block := net.waitHeight(t, 2, 15*time.Second)
+	for _, node := range net.group(t, 1) {
+		if block.Producer == node.id {
+			t.Errorf("block 2 was produced by %s of the offline group", block.Producer)
+		}
+	}
+	current, err := net.group(t, 2)[0].store.GetEpoch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(current.Failovers) == 0 || current.Failovers[0].Height != 1 || current.Failovers[0].ToGroup != 2 {
+		t.Errorf("failovers %+v, expected group 2 to take over at height 1", current.Failovers)
+	}
+}
@@ -0,0 +1,206 @@
+package consensus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/storage"
+)
+
+// ErrInvalidMessage is returned when a proposal, vote or certificate does not
+// come from the expected leader or is not signed by it.
+var ErrInvalidMessage = errors.New("invalid consensus message")
+
+// VoteType is the step a vote belongs to.
+type VoteType string
+
+const (
+	Prevote   VoteType = "prevote"
+	Precommit VoteType = "precommit"
+)
+
+// Vote is a signed prevote or precommit for a block hash. An empty BlockHash
+// is a vote for nil: no block in this round.
+type Vote struct {
+	Type      VoteType `json:"type"`
+	Height    int64    `json:"height"`
+	Round     int      `json:"round"`
+	BlockHash string   `json:"block_hash"`
+	Voter     string   `json:"voter"`
+	Signature string   `json:"signature"`
+}
+
+// SignBytes returns the canonical form of the vote that is signed.
+func (v Vote) SignBytes() []byte {
+	payload, _ := json.Marshal(struct {
+		Type      VoteType `json:"type"`
+		Height    int64    `json:"height"`
+		Round     int      `json:"round"`
+		BlockHash string   `json:"block_hash"`
+		Voter     string   `json:"voter"`
+	}{v.Type, v.Height, v.Round, v.BlockHash, v.Voter})
+	return payload
+}
+
+// Proposal is a block proposed by the leader of a round. ValidRound is the
+// round in which the block last gathered a prevote quorum, or -1.
+type Proposal struct {
+	Height     int64         `json:"height"`
+	Round      int           `json:"round"`
+	ValidRound int           `json:"valid_round"`
+	Block      storage.Block `json:"block"`
+	Proposer   string        `json:"proposer"`
+	Signature  string        `json:"signature"`
+}
+
+// SignBytes returns the canonical form of the proposal that is signed. The
+// block is covered by its hash.
+func (p Proposal) SignBytes() []byte {
+	payload, _ := json.Marshal(struct {
+		Height     int64  `json:"height"`
+		Round      int    `json:"round"`
+		ValidRound int    `json:"valid_round"`
+		BlockHash  string `json:"block_hash"`
+		Proposer   string `json:"proposer"`
+	}{p.Height, p.Round, p.ValidRound, p.Block.Hash, p.Proposer})
+	return payload
+}
+
+// Certificate is the quorum of precommits that committed a block. It is
+// stored with the block so any node can check the block was agreed on.
+type Certificate struct {
+	Height     int64  `json:"height"`
+	Round      int    `json:"round"`
+	BlockHash  string `json:"block_hash"`
+	Precommits []Vote `json:"precommits"`
+}
+
+// Validators is the leader group that decides a height, in sort order.
+type Validators struct {
+	Epoch   int64
+	members []storage.EpochMember
+	byID    map[string]storage.EpochMember
+}
+
+// NewValidators returns a group of an epoch as a validator set. Members
+// without a public key cannot sign and are left out.
+func NewValidators(epoch storage.Epoch, group int) *Validators {
+	v := &Validators{Epoch: epoch.Number, byID: make(map[string]storage.EpochMember)}
+	for _, member := range epoch.Group(group) {
+		if member.PublicKey == "" {
+			continue
+		}
+		v.members = append(v.members, member)
+		v.byID[member.ComputerID] = member
+	}
+	sort.Slice(v.members, func(i, j int) bool { return v.members[i].SortOrder < v.members[j].SortOrder })
+	return v
+}
+
+// Size returns the number of validators.
+func (v *Validators) Size() int {
+	return len(v.members)
+}
+
+// Members returns the validators in sort order.
+func (v *Validators) Members() []storage.EpochMember {
+	return v.members
+}
+
+// Quorum returns the number of votes needed to decide: 2f+1 out of 3f+1, or
+// more generally every validator but the f that may be faulty.
+func (v *Validators) Quorum() int {
+	return len(v.members) - v.MaxFaulty()
+}
+
+// MaxFaulty returns f, the number of faulty validators the group tolerates.
+func (v *Validators) MaxFaulty() int {
+	if len(v.members) == 0 {
+		return 0
+	}
+	return (len(v.members) - 1) / 3
+}
+
+// Get returns the validator with a computer id.
+func (v *Validators) Get(computerID string) (storage.EpochMember, bool) {
+	member, ok := v.byID[computerID]
+	return member, ok
+}
+
+// ByPublicKey returns the validator with a public key.
+func (v *Validators) ByPublicKey(publicKey string) (storage.EpochMember, bool) {
+	for _, member := range v.members {
+		if member.PublicKey == publicKey {
+			return member, true
+		}
+	}
+	return storage.EpochMember{}, false
+}
+
+// Proposer returns the validator that proposes in a round. The role moves
+// one place along the group every height and every round.
+func (v *Validators) Proposer(height int64, round int) storage.EpochMember {
+	index := (height + int64(round)) % int64(len(v.members))
+	return v.members[index]
+}
+
+// VerifyVote checks that a vote comes from a validator and is signed by it.
+func (v *Validators) VerifyVote(vote Vote) error {
+	member, ok := v.byID[vote.Voter]
+	if !ok {
+		return fmt.Errorf("%w: %s is not a validator", ErrInvalidMessage, vote.Voter)
+	}
+	if vote.Type != Prevote && vote.Type != Precommit {
+		return fmt.Errorf("%w: unknown vote type %q", ErrInvalidMessage, vote.Type)
+	}
+	if err := cryptoUtils.VerifyMessage(member.PublicKey, vote.SignBytes(), vote.Signature); err != nil {
+		return fmt.Errorf("%w: vote from %s: %v", ErrInvalidMessage, vote.Voter, err)
+	}
+	return nil
+}
+
+// VerifyProposal checks that a proposal comes from the proposer of its round
+// and is signed by it. It does not check the block itself. A new block must
+// be produced by the proposer; a block proposed again with a ValidRound was
+// produced by the proposer of an earlier round.
+func (v *Validators) VerifyProposal(proposal Proposal) error {
+	proposer := v.Proposer(proposal.Height, proposal.Round)
+	if proposal.Proposer != proposer.ComputerID {
+		return fmt.Errorf("%w: %s is not the proposer of round %d", ErrInvalidMessage, proposal.Proposer, proposal.Round)
+	}
+	if proposal.ValidRound < -1 || proposal.ValidRound >= proposal.Round {
+		return fmt.Errorf("%w: valid round %d is not before round %d", ErrInvalidMessage, proposal.ValidRound, proposal.Round)
+	}
+	if proposal.Block.Height != proposal.Height || proposal.ValidRound == -1 && proposal.Block.Producer != proposal.Proposer {
+		return fmt.Errorf("%w: block does not match the proposal", ErrInvalidMessage)
+	}
+	if err := cryptoUtils.VerifyMessage(proposer.PublicKey, proposal.SignBytes(), proposal.Signature); err != nil {
+		return fmt.Errorf("%w: proposal from %s: %v", ErrInvalidMessage, proposal.Proposer, err)
+	}
+	return nil
+}
+
+// VerifyCertificate checks that a certificate holds a quorum of valid
+// precommits from distinct validators for the given block.
+func (v *Validators) VerifyCertificate(certificate Certificate, block storage.Block) error {
+	if certificate.Height != block.Height || certificate.BlockHash != block.Hash {
+		return fmt.Errorf("%w: certificate is for another block", ErrInvalidMessage)
+	}
+	voters := make(map[string]bool)
+	for _, vote := range certificate.Precommits {
+		if vote.Type != Precommit || vote.Height != certificate.Height || vote.Round != certificate.Round || vote.BlockHash != certificate.BlockHash {
+			return fmt.Errorf("%w: certificate holds a vote for something else", ErrInvalidMessage)
+		}
+		if err := v.VerifyVote(vote); err != nil {
+			return err
+		}
+		voters[vote.Voter] = true
+	}
+	if len(voters) < v.Quorum() {
+		return fmt.Errorf("%w: certificate has %d precommits, %d needed", ErrInvalidMessage, len(voters), v.Quorum())
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package consensus_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"bitcoin-sidechain/consensus"
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+func TestVerifyProposal(t *testing.T) {
+	current := storage.Epoch{Number: 0, GroupSize: 4}
+	keys := make(map[string]*btcec.PrivateKey)
+	for i := 0; i < 4; i++ {
+		key, err := btcec.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := cryptoUtils.NodeID(key.PubKey())
+		keys[id] = key
+		current.Members = append(current.Members, storage.EpochMember{
+			ComputerID: id,
+			IPAddress:  fmt.Sprintf("10.0.0.%d:8080", i+1),
+			SortOrder:  i + 1,
+			NodeGroup:  1,
+			PublicKey:  cryptoUtils.PublicKeyBase64(key),
+		})
+	}
+	validators := consensus.NewValidators(current, 1)
+	signed := func(round, validRound int, producer string) consensus.Proposal {
+		proposer := validators.Proposer(1, round).ComputerID
+		proposal := consensus.Proposal{
+			Height:     1,
+			Round:      round,
+			ValidRound: validRound,
+			Block:      storage.Block{Height: 1, Hash: "00", Producer: producer},
+			Proposer:   proposer,
+		}
+		proposal.Signature = cryptoUtils.SignMessage(keys[proposer], proposal.SignBytes())
+		return proposal
+	}
+	first := validators.Proposer(1, 0).ComputerID
+
+	tests := []struct {
+		name     string
+		proposal consensus.Proposal
+		valid    bool
+	}{
+		{"new block by its proposer", signed(0, -1, first), true},
+		{"block of round 0 proposed again in round 1", signed(1, 0, first), true},
+		{"new block by another node", signed(1, -1, first), false},
+		{"valid round not before the round", signed(1, 1, first), false},
+		{"valid round below -1", signed(1, -2, first), false},
+	}
+	for _, test := range tests {
+		err := validators.VerifyProposal(test.proposal)
+		if test.valid && err != nil {
+			t.Errorf("%s: refused: %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, consensus.ErrInvalidMessage) {
+			t.Errorf("%s: expected an invalid message, got %v", test.name, err)
+		}
+	}
+}
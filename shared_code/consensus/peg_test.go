@@ -0,0 +1,524 @@
+package consensus_test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/custody"
+	"bitcoin-sidechain/frost"
+	"bitcoin-sidechain/peg"
+	"bitcoin-sidechain/reserves"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// pegConfig credits deposits one block deep on the in-memory chain.
+var pegConfig = peg.Config{Network: &chaincfg.RegressionNetParams, Confirmations: 1, StartHeight: 1}
+
+// withPeg gives every node a watcher of the same Bitcoin chain, with a peg
+// key as a completed handoff would leave it.
+func withPeg(t *testing.T, bitcoin *peg.FakeBackend, pegKey *btcec.PrivateKey) func(n *testNode) {
+	return func(n *testNode) {
+		_, err := n.store.CompleteHandoff(storage.CustodyKey{
+			Epoch:       1,
+			GroupKey:    hex.EncodeToString(schnorr.SerializePubKey(pegKey.PubKey())),
+			PublicKeys:  json.RawMessage(`{}`),
+			Certificate: json.RawMessage(`[]`),
+			CreatedAt:   time.Now().Unix(),
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.watcher = peg.NewWatcher(n.store, bitcoin, nil, pegConfig)
+	}
+}
+
+// newWallet returns the key of a new wallet and its address.
+func newWallet(t *testing.T) (*btcec.PrivateKey, string) {
+	t.Helper()
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, base64.StdEncoding.EncodeToString(key.PubKey().SerializeCompressed())
+}
+
+// A deposit deep enough on Bitcoin is proposed, checked by every leader
+// against its own watcher and credited by the committed block.
+func TestCommitsDeposits(t *testing.T) {
+	pegKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitcoin := peg.NewFakeBackend()
+	bitcoin.Mine(5)
+	net := newNetwork(t, 4, 4, testConfig, withPeg(t, bitcoin, pegKey))
+
+	_, alice := newWallet(t)
+	var address storage.DepositAddress
+	for _, node := range net.nodes {
+		if address, err = node.watcher.Address(alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script, _ := hex.DecodeString(address.Script)
+	payment := bitcoin.Pay(script, 50000)
+	bitcoin.Mine(1)
+	for _, node := range net.nodes {
+		if err := node.watcher.Scan(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	net.run(t)
+
+	block := net.waitHeight(t, 1, 10*time.Second)
+	if len(block.Deposits) != 1 || block.Deposits[0].Outpoint != peg.Outpoint(payment.TxHash(), 0) {
+		t.Fatalf("block 1 carries deposits %+v, expected the payment to alice", block.Deposits)
+	}
+	for _, node := range net.nodes {
+		if balance, err := node.store.GetBalance(alice); err != nil || balance != 50000 {
+			t.Errorf("node %s credited %d to alice, expected 50000 (%v)", node.id, balance, err)
+		}
+	}
+}
+
+// custodian is a node holding a share of the peg key, with the payer and the
+// reserves auditor that use it.
+type custodian struct {
+	*testNode
+	payer   *peg.Payer
+	auditor *reserves.Auditor
+}
+
+// custodyLink carries the signing rounds, the signed payouts and the
+// reserves attestations between the custodians in memory.
+type custodyLink struct {
+	custodians map[string]*custodian
+	self       string
+}
+
+func (l custodyLink) Commit(peer storage.EpochMember, request peg.CommitRequest) (peg.CommitResponse, error) {
+	return l.custodians[peer.ComputerID].payer.Commit(request)
+}
+
+func (l custodyLink) Sign(peer storage.EpochMember, request peg.SignRequest) (peg.SignResponse, error) {
+	return l.custodians[peer.ComputerID].payer.Sign(request)
+}
+
+func (l custodyLink) Attest(peer storage.EpochMember, request reserves.Attestation) (reserves.Attestation, error) {
+	return l.custodians[peer.ComputerID].auditor.Attest(request)
+}
+
+func (l custodyLink) Submit(payout storage.Payout) {
+	for id, c := range l.custodians {
+		if id == l.self {
+			continue
+		}
+		if err := c.watcher.Submit(payout); err != nil {
+			fmt.Printf("%s refused payout %s: %v\n", id, payout.TxID, err)
+		}
+	}
+}
+
+// withCustody deals the peg key among the leaders of epoch 0, which are its
+// custodians, and gives every node a watcher of the same Bitcoin chain, a
+// payer and an auditor.
+func withCustody(t *testing.T, bitcoin *peg.FakeBackend, custodians map[string]*custodian) func(n *testNode) {
+	var shares []*frost.KeyShare
+	return func(n *testNode) {
+		current, err := n.store.GetEpoch(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members := custody.Custodians(current)
+		if shares == nil {
+			if shares, err = frost.Deal(nil, custody.Threshold(len(members)), len(members), rand.Reader); err != nil {
+				t.Fatal(err)
+			}
+		}
+		public, err := json.Marshal(shares[0].Public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var share *storage.CustodyShare
+		for i, member := range members {
+			if member.ComputerID != n.id {
+				continue
+			}
+			data, err := json.Marshal(shares[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			share = &storage.CustodyShare{Epoch: 0, SignerID: shares[i].ID, KeyShare: data, CreatedAt: time.Now().Unix()}
+		}
+		_, err = n.store.CompleteHandoff(storage.CustodyKey{
+			Epoch:       0,
+			GroupKey:    hex.EncodeToString(shares[0].Public.XOnly()),
+			PublicKeys:  public,
+			Certificate: json.RawMessage(`[]`),
+			CreatedAt:   time.Now().Unix(),
+		}, share)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n.watcher = peg.NewWatcher(n.store, bitcoin, nil, pegConfig)
+		c := &custodian{testNode: n}
+		c.payer = peg.NewPayer(n.store, n.watcher, n.key, custodyLink{custodians: custodians, self: n.id}, peg.PayerConfig{})
+		c.auditor = reserves.New(n.store, n.epochs, n.watcher, n.key, custodyLink{custodians: custodians, self: n.id})
+		custodians[n.id] = c
+	}
+}
+
+// signedTransfer returns a transfer signed by a wallet key the way the wallet
+// page signs it.
+func signedTransfer(t *testing.T, key *btcec.PrivateKey, to string, amount int64, nonce string) storage.Transfer {
+	t.Helper()
+	from := base64.StdEncoding.EncodeToString(key.PubKey().SerializeCompressed())
+	message, err := json.Marshal(map[string]string{"from": from, "to": to, "amount": strconv.FormatInt(amount, 10), "nonce": nonce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage.Transfer{
+		TxID:      storage.TransferID(from, to, amount, nonce),
+		From:      from,
+		To:        to,
+		Amount:    amount,
+		Nonce:     nonce,
+		Signature: cryptoUtils.SignMessage(key, message),
+	}
+}
+
+func newAddress(t *testing.T, params *chaincfg.Params) string {
+	t.Helper()
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(key.PubKey().SerializeCompressed()), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return address.EncodeAddress()
+}
+
+func balanceOf(node *testNode, wallet string) int64 {
+	balance, err := node.store.GetBalance(wallet)
+	if err != nil {
+		return 0
+	}
+	return balance
+}
+
+// Withdrawals go through the engine like any transfer: a block burns and
+// queues them, the coordinator of a turn has the custodians sign one payout
+// of both, and a later block records it. The nodes then broadcast it until it
+// confirms, nothing is paid twice, changed payouts are refused, the reserves
+// back the supply all along and the ledger replays.
+func TestPaysWithdrawals(t *testing.T) {
+	bitcoin := peg.NewFakeBackend()
+	bitcoin.Mine(10)
+	custodians := make(map[string]*custodian)
+	net := newNetwork(t, 4, 4, testConfig, withCustody(t, bitcoin, custodians))
+	current, err := net.group(t, 1)[0].store.GetEpoch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := custody.Custodians(current)
+	coordinator, other, checker := custodians[members[0].ComputerID], custodians[members[1].ComputerID], custodians[members[2].ComputerID]
+
+	// Two deposits to alice are credited
+	aliceKey, alice := newWallet(t)
+	address, err := coordinator.watcher.Address(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range custodians {
+		if _, err := c.watcher.Accept(alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script, _ := hex.DecodeString(address.Script)
+	bitcoin.Pay(script, 60000)
+	bitcoin.Pay(script, 50000)
+	bitcoin.Mine(1)
+	scanAll(t, custodians)
+	net.run(t)
+	net.waitFor(t, "crediting the deposits", 10*time.Second, func(node *testNode) bool { return balanceOf(node, alice) == 110000 })
+
+	// Withdrawals below the minimum or to another network are refused
+	mainnet := storage.WithdrawalPrefix + newAddress(t, &chaincfg.MainNetParams)
+	if err := coordinator.watcher.CheckWithdrawal(signedTransfer(t, aliceKey, mainnet, 30000, "n0")); !errors.Is(err, peg.ErrInvalidWithdrawal) {
+		t.Fatalf("withdrawal to a mainnet address: expected an invalid withdrawal, got %v", err)
+	}
+	small := storage.WithdrawalPrefix + newAddress(t, pegConfig.Network)
+	if err := coordinator.watcher.CheckWithdrawal(signedTransfer(t, aliceKey, small, peg.MinWithdrawal-1, "n0")); !errors.Is(err, peg.ErrInvalidWithdrawal) {
+		t.Fatalf("withdrawal below the minimum: expected an invalid withdrawal, got %v", err)
+	}
+
+	// Two withdrawals burn their amounts and are queued
+	supply, err := coordinator.store.TotalSupply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withdrawals := []storage.Transfer{
+		signedTransfer(t, aliceKey, storage.WithdrawalPrefix+newAddress(t, pegConfig.Network), 70000, "n1"),
+		signedTransfer(t, aliceKey, storage.WithdrawalPrefix+newAddress(t, pegConfig.Network), 25000, "n2"),
+	}
+	for _, c := range custodians {
+		for _, w := range withdrawals {
+			if _, err := c.pool.Add(w); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	net.waitFor(t, "burning the withdrawals", 10*time.Second, func(node *testNode) bool {
+		queued, err := node.store.ListQueuedWithdrawals(10)
+		return err == nil && len(queued) == 2 && balanceOf(node, alice) == 15000
+	})
+	if after, _ := coordinator.store.TotalSupply(); after != supply-95000 {
+		t.Fatalf("supply went from %d to %d, expected %d burnt", supply, after, 95000)
+	}
+
+	// Only the coordinator of the slot acts; it has the custodians sign a
+	// payout of both withdrawals and sends it to every node
+	net.pause(t)
+	if err := other.payer.Turn(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(coordinator.watcher.Pooled()) != 0 {
+		t.Fatal("a custodian paid out of its turn")
+	}
+	if err := coordinator.payer.Turn(0); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range custodians {
+		if pooled := c.watcher.Pooled(); len(pooled) != 1 {
+			t.Fatalf("%s holds %d signed payouts, expected 1", c.id, len(pooled))
+		}
+	}
+	payout := coordinator.watcher.Pooled()[0]
+	if len(payout.Withdrawals) != 2 || len(payout.Inputs) != 2 || payout.Change != 15000 {
+		t.Fatalf("unexpected payout %+v", payout)
+	}
+
+	// The next coordinator finds nothing left to pay
+	if err := other.payer.Turn(1); err != nil {
+		t.Fatal(err)
+	}
+	if pooled := coordinator.watcher.Pooled(); len(pooled) != 1 {
+		t.Fatal("a second payout was signed for the same withdrawals")
+	}
+	checkForgedPayouts(t, checker.watcher, payout)
+
+	// A block records the payout
+	net.resume()
+	net.waitFor(t, "recording the payout", 10*time.Second, func(node *testNode) bool {
+		_, err := node.store.GetPayout(payout.TxID)
+		return err == nil
+	})
+	net.pause(t)
+	for _, c := range custodians {
+		recorded, err := c.store.GetPayout(payout.TxID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recorded.BitcoinHeight != 0 {
+			t.Fatalf("%s has the payout confirmed before it was mined", c.id)
+		}
+		for _, w := range withdrawals {
+			withdrawal, err := c.store.GetWithdrawal(w.TxID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if withdrawal.Payout != payout.TxID {
+				t.Fatalf("%s has withdrawal %s paid by %q", c.id, w.TxID, withdrawal.Payout)
+			}
+		}
+		if ready := c.watcher.Ready(); len(ready.Payouts) != 0 || len(c.watcher.Pooled()) != 0 {
+			t.Fatalf("%s still offers the recorded payout", c.id)
+		}
+	}
+	// Until the payout is broadcast, the peg holds its inputs
+	checkReserves(t, other, checker, bitcoin, 15000, 1)
+
+	// The nodes broadcast the payout, and once mined every node sees it
+	// confirmed
+	scanAll(t, custodians)
+	mempool := bitcoin.Mempool()
+	if len(mempool) != 1 || mempool[0].TxHash().String() != payout.TxID {
+		t.Fatalf("expected the payout in the Bitcoin mempool, found %d transactions", len(mempool))
+	}
+	tx := mempool[0]
+	for i, id := range payout.Withdrawals {
+		w, err := coordinator.store.GetWithdrawal(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx.TxOut[i].Value != w.Amount-payout.Fee {
+			t.Fatalf("output %d pays %d sats, expected %d", i, tx.TxOut[i].Value, w.Amount-payout.Fee)
+		}
+	}
+	bitcoin.Mine(1)
+	scanAll(t, custodians)
+	for _, c := range custodians {
+		recorded, err := c.store.GetPayout(payout.TxID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recorded.BitcoinHeight == 0 {
+			t.Fatalf("%s did not see the payout confirm", c.id)
+		}
+	}
+
+	// The payout is not recorded twice, and its withdrawals are not paid again
+	_, rejected, err := coordinator.store.BuildBlock(coordinator.id, time.Now().Unix(), nil, storage.MembershipChanges{}, storage.PegChanges{Payouts: []storage.Payout{payout}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(rejected[payout.TxID], storage.ErrInvalidBlock) {
+		t.Fatal("a recorded payout was accepted again")
+	}
+	if err := checker.watcher.Check(storage.PegChanges{Payouts: []storage.Payout{payout}}); !errors.Is(err, storage.ErrInvalidBlock) {
+		t.Fatalf("a recorded payout still checks: %v", err)
+	}
+	if err := coordinator.payer.Turn(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(coordinator.watcher.Pooled()) != 0 {
+		t.Fatal("paid withdrawals were paid again")
+	}
+
+	// The peg holds the change, as much as the wallets hold
+	utxos, err := coordinator.store.ListUnspentPegUTXOs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 || utxos[0].Outpoint != payout.ChangeOutpoint() || utxos[0].Amount != 15000 {
+		t.Fatalf("unexpected peg outputs %+v", utxos)
+	}
+	if supply, _ := coordinator.store.TotalSupply(); supply != utxos[0].Amount {
+		t.Fatalf("wallets hold %d sats, the peg %d", supply, utxos[0].Amount)
+	}
+	checkReserves(t, other, checker, bitcoin, 15000, 0)
+
+	// Every node replays its ledger to its balances
+	for _, c := range custodians {
+		replayed, err := storage.ReplayLedger(c.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		balances, err := c.store.ListBalances()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for wallet, balance := range balances {
+			if replayed[wallet] != balance {
+				t.Errorf("%s: wallet %s has %d but the log gives %d", c.id, wallet, balance, replayed[wallet])
+			}
+		}
+	}
+}
+
+func scanAll(t *testing.T, custodians map[string]*custodian) {
+	t.Helper()
+	for _, c := range custodians {
+		if err := c.watcher.Scan(); err != nil {
+			t.Fatalf("%s: scan: %v", c.id, err)
+		}
+	}
+}
+
+// checkReserves checks the reserves report of a node: it must balance, every
+// custodian must attest it and the Bitcoin chain must hold its UTXOs, pending
+// of them as the change of payouts not broadcast yet. A changed report must
+// fail the attestations, also of another leader.
+func checkReserves(t *testing.T, c, other *custodian, bitcoin *peg.FakeBackend, held int64, pending int) {
+	t.Helper()
+	statement, err := c.auditor.Statement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statement.Backed {
+		t.Fatalf("reserves do not balance: %s", statement.Problem)
+	}
+	current, err := c.store.GetEpoch(statement.Report.Epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers, err := reserves.Verify(statement.Report, current, statement.Attestations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signers != len(custody.Custodians(current)) {
+		t.Fatalf("%d leaders attested the reserves, expected all %d", signers, len(custody.Custodians(current)))
+	}
+	holdings, err := reserves.CheckHoldings(c.store, statement.Report, bitcoin, pegConfig.Network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(holdings.Missing) != 0 || len(holdings.Pending) != pending {
+		t.Fatalf("Bitcoin misses %v with %d pending", holdings.Missing, len(holdings.Pending))
+	}
+	if holdings.Held < statement.Report.Supply+statement.Report.Pending || statement.Report.Reserves != held {
+		t.Fatalf("peg holds %d sats on Bitcoin and %d on the sidechain", holdings.Held, statement.Report.Reserves)
+	}
+
+	inflated := statement.Report
+	inflated.Supply++
+	if _, err := reserves.Verify(inflated, current, statement.Attestations); err == nil {
+		t.Fatal("a changed report kept its attestations")
+	}
+	if _, err := other.auditor.Attest(reserves.Attestation{Height: inflated.Height, Digest: inflated.Digest()}); !errors.Is(err, reserves.ErrRefused) {
+		t.Fatalf("a leader attested a changed report: %v", err)
+	}
+}
+
+// checkForgedPayouts checks that a signed payout checks and that changed
+// copies of it are refused as invalid.
+func checkForgedPayouts(t *testing.T, watcher *peg.Watcher, payout storage.Payout) {
+	t.Helper()
+	if err := watcher.Check(storage.PegChanges{Payouts: []storage.Payout{payout}}); err != nil {
+		t.Fatalf("signed payout refused: %v", err)
+	}
+	retx := func(change func(tx *wire.MsgTx)) func(p *storage.Payout) {
+		return func(p *storage.Payout) {
+			tx, _ := peg.DecodeTx(p.Tx)
+			change(tx)
+			p.Tx, _ = peg.EncodeTx(tx)
+			p.TxID = tx.TxHash().String()
+		}
+	}
+	forged := map[string]func(p *storage.Payout){
+		"a larger fee":          func(p *storage.Payout) { p.Fee++ },
+		"withdrawals swapped":   func(p *storage.Payout) { p.Withdrawals[0], p.Withdrawals[1] = p.Withdrawals[1], p.Withdrawals[0] },
+		"another txid":          func(p *storage.Payout) { p.TxID = p.Inputs[0][:64] },
+		"a larger output":       retx(func(tx *wire.MsgTx) { tx.TxOut[0].Value++ }),
+		"the change kept":       retx(func(tx *wire.MsgTx) { tx.TxOut = tx.TxOut[:len(tx.TxOut)-1] }),
+		"a signature missing":   retx(func(tx *wire.MsgTx) { tx.TxIn[1].Witness = nil }),
+		"signatures swapped":    retx(func(tx *wire.MsgTx) { tx.TxIn[0].Witness, tx.TxIn[1].Witness = tx.TxIn[1].Witness, tx.TxIn[0].Witness }),
+		"a withdrawal repeated": func(p *storage.Payout) { p.Withdrawals[1] = p.Withdrawals[0] },
+	}
+	for name, change := range forged {
+		p := payout
+		p.Withdrawals = append([]string{}, payout.Withdrawals...)
+		p.Inputs = append([]string{}, payout.Inputs...)
+		change(&p)
+		if err := watcher.Check(storage.PegChanges{Payouts: []storage.Payout{p}}); !errors.Is(err, storage.ErrInvalidBlock) {
+			t.Errorf("payout with %s: expected an invalid block, got %v", name, err)
+		}
+	}
+}
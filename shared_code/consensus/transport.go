@@ -0,0 +1,156 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"bitcoin-sidechain/networkUtils"
+	"bitcoin-sidechain/storage"
+)
+
+// maxMessageSize bounds the body of a consensus message; a proposal carries a
+// whole block.
+const maxMessageSize = 32 << 20
+
+// Message is a proposal or a vote sent between leaders, or a timeout vote or
+// failover certificate sent to every member of the epoch.
+type Message struct {
+	Proposal *Proposal            `json:"proposal,omitempty"`
+	Vote     *Vote                `json:"vote,omitempty"`
+	Timeout  *TimeoutVote         `json:"timeout,omitempty"`
+	Failover *FailoverCertificate `json:"failover,omitempty"`
+}
+
+// parts returns the number of messages set, which must be exactly one.
+func (m Message) parts() int {
+	n := 0
+	if m.Proposal != nil {
+		n++
+	}
+	if m.Vote != nil {
+		n++
+	}
+	if m.Timeout != nil {
+		n++
+	}
+	if m.Failover != nil {
+		n++
+	}
+	return n
+}
+
+// Transport delivers consensus messages between leaders.
+type Transport interface {
+	// Broadcast sends a message to every peer without waiting for delivery.
+	Broadcast(peers []storage.EpochMember, message Message)
+	// FetchBlock asks a peer for a committed block.
+	FetchBlock(peer storage.EpochMember, height int64) (storage.Block, error)
+	// FetchEpoch asks a peer for an epoch with its failovers.
+	FetchEpoch(peer storage.EpochMember, number int64) (storage.Epoch, error)
+}
+
+// HTTPTransport posts messages to POST /consensus on each peer and fetches
+// blocks from GET /block/{height} and epochs from GET /epoch/{number}.
+type HTTPTransport struct {
+	Outbound *networkUtils.Outbound
+}
+
+// NewHTTPTransport returns a transport that reaches peers through outbound.
+func NewHTTPTransport(outbound *networkUtils.Outbound) *HTTPTransport {
+	return &HTTPTransport{Outbound: outbound}
+}
+
+// Broadcast sends the message to every peer concurrently.
+func (t *HTTPTransport) Broadcast(peers []storage.EpochMember, message Message) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		fmt.Println("Consensus: error encoding message:", err)
+		return
+	}
+	for _, peer := range peers {
+		go func(peer storage.EpochMember) {
+			req, err := t.Outbound.NewRequest(http.MethodPost, peer.IPAddress, "/consensus", bytes.NewReader(body))
+			if err != nil {
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := t.Outbound.Open(req)
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}(peer)
+	}
+}
+
+// FetchBlock gets a block and its certificate from a peer.
+func (t *HTTPTransport) FetchBlock(peer storage.EpochMember, height int64) (storage.Block, error) {
+	resp, err := t.get(peer, fmt.Sprintf("/block/%d", height))
+	if err != nil {
+		return storage.Block{}, fmt.Errorf("failed to fetch block %d from %s: %w", height, peer.IPAddress, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return storage.Block{}, storage.ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return storage.Block{}, fmt.Errorf("failed to fetch block %d from %s: status %d", height, peer.IPAddress, resp.StatusCode)
+	}
+	var block storage.Block
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxMessageSize)).Decode(&block); err != nil {
+		return storage.Block{}, fmt.Errorf("failed to decode block %d from %s: %w", height, peer.IPAddress, err)
+	}
+	return block, nil
+}
+
+// FetchEpoch gets an epoch with its members and failovers from a peer.
+func (t *HTTPTransport) FetchEpoch(peer storage.EpochMember, number int64) (storage.Epoch, error) {
+	resp, err := t.get(peer, fmt.Sprintf("/epoch/%d", number))
+	if err != nil {
+		return storage.Epoch{}, fmt.Errorf("failed to fetch epoch %d from %s: %w", number, peer.IPAddress, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return storage.Epoch{}, storage.ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return storage.Epoch{}, fmt.Errorf("failed to fetch epoch %d from %s: status %d", number, peer.IPAddress, resp.StatusCode)
+	}
+	var epoch storage.Epoch
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxMessageSize)).Decode(&epoch); err != nil {
+		return storage.Epoch{}, fmt.Errorf("failed to decode epoch %d from %s: %w", number, peer.IPAddress, err)
+	}
+	return epoch, nil
+}
+
+// get sends a GET for path to a peer. The caller closes the body.
+func (t *HTTPTransport) get(peer storage.EpochMember, path string) (*http.Response, error) {
+	req, err := t.Outbound.NewRequest(http.MethodGet, peer.IPAddress, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return t.Outbound.Open(req)
+}
+
+// Handler returns the POST /consensus endpoint that feeds messages to an engine.
+func Handler(engine *Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var message Message
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxMessageSize)).Decode(&message); err != nil {
+			http.Error(w, "Invalid consensus message", http.StatusBadRequest)
+			return
+		}
+		if message.parts() != 1 {
+			http.Error(w, "Expected a proposal, a vote, a timeout vote or a failover", http.StatusBadRequest)
+			return
+		}
+		engine.Receive(message)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
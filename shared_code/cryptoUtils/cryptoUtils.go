@@ -1,13 +1,13 @@
 package cryptoUtils
 
 import (
+	"bitcoin-sidechain/storage"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
-	"database/sql"
 	"encoding/asn1"
 	"encoding/base64"
 	"encoding/hex"
@@ -24,10 +24,6 @@ import (
 	"github.com/btcsuite/btcd/btcec/v2"
 
 	"fmt"
-
-	_ "github.com/mattn/go-sqlite3"
-
-	_ "github.com/go-sql-driver/mysql" // This imports the MySQL driver
 )
 
 func KeyGenRSAOLDSTYLE() {
@@ -369,40 +365,35 @@ func ReorderJSON(jsonStr string) (string, error) {
 	return string(reorderedJSON), nil
 }
 
-func ComputeDatabaseHash() string {
-	// MySQL connection string (DSN format)
-	dsn := "node:test@tcp(node-1-database:3306)/node" // Modify with your actual MySQL connection string
-
-	// Open the MySQL database
-	db, err := sql.Open("mysql", dsn)
+// ComputeDatabaseHash returns the SHA-256 of the nodes table in a form that
+// is the same on every node.
+func ComputeDatabaseHash(store storage.Store) (string, error) {
+	// Query the "nodes" table
+	nodes, err := store.ListNodes()
 	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+		return "", fmt.Errorf("failed to query nodes: %w", err)
 	}
-	defer db.Close()
 
-	// Query sorted data from the "nodes" table
-	rows, err := db.Query(`
-		SELECT sort_order, computer_id, ip_address, node_group 
-		FROM nodes 
-		ORDER BY sort_order, computer_id, ip_address, node_group
-	`)
-	if err != nil {
-		log.Fatalf("Failed to query rows: %v", err)
-	}
-	defer rows.Close()
+	// Sort the rows the same way on every node
+	sort.Slice(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if a.SortOrder != b.SortOrder {
+			return a.SortOrder < b.SortOrder
+		}
+		if a.ComputerID != b.ComputerID {
+			return a.ComputerID < b.ComputerID
+		}
+		if a.IPAddress != b.IPAddress {
+			return a.IPAddress < b.IPAddress
+		}
+		return a.NodeGroup < b.NodeGroup
+	})
 
 	// Collect rows as strings
 	var rowsData []string
-	for rows.Next() {
-		var sortOrder int
-		var computerID, ipAddress string
-		var nodeGroup int
-		if err := rows.Scan(&sortOrder, &computerID, &ipAddress, &nodeGroup); err != nil {
-			log.Fatalf("Failed to scan row: %v", err)
-		}
-
+	for _, node := range nodes {
 		// Format each row consistently
-		rowsData = append(rowsData, fmt.Sprintf("%d|%s|%s|%d", sortOrder, computerID, ipAddress, nodeGroup))
+		rowsData = append(rowsData, fmt.Sprintf("%d|%s|%s|%d", node.SortOrder, node.ComputerID, node.IPAddress, node.NodeGroup))
 	}
 
 	// Join rows into a single string
@@ -410,146 +401,99 @@ func ComputeDatabaseHash() string {
 
 	// Compute SHA-256 hash of the normalized data
 	hash := sha256.Sum256([]byte(normalizedData))
-	return hex.EncodeToString(hash[:])
+	return hex.EncodeToString(hash[:]), nil
 }
 
-func NewWallet(walletAddress string, dbName string) (bool, error) {
-	// Create the MySQL connection string (Data Source Name)
-	dsn := "node:test@tcp(node-1-database:3306)/node" // Modify this as per your setup
-
-	// Open a connection to the MySQL database
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return false, fmt.Errorf("failed to open database: %w", err)
-	}
-	defer db.Close()
-
-	// Check if wallet already exists
-	var exists int
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM wallet_balances WHERE wallet = ?)", walletAddress).Scan(&exists)
+func NewWallet(store storage.Store, walletAddress string) (bool, error) {
+	created, err := store.CreateWallet(walletAddress)
 	if err != nil {
-		return false, fmt.Errorf("failed to check wallet existence: %w", err)
+		return false, err
 	}
 
 	// If wallet already exists, do nothing
-	if exists == 1 {
+	if !created {
 		fmt.Println("Wallet already exists.")
 		return false, fmt.Errorf("wallet already exists")
 	}
 
-	// If wallet does not exist, create it with a balance of 0
-	_, err = db.Exec("INSERT INTO wallet_balances (wallet, balance) VALUES (?, 0)", walletAddress)
-	if err != nil {
-		return false, fmt.Errorf("failed to create new wallet: %w", err)
-	}
-
 	fmt.Println("New wallet created with balance 0.")
 
 	return true, nil
 }
 
 // MoveSats moves an amount from one wallet to another, checking for sufficient balance.
-func MoveSats(fromAddress string, toAddress string, amount string, database string) error {
-	// MySQL connection string
-	dsn := "node:node@tcp(node-1-database:3306)/" + database // Modify this based on your MySQL setup
-
-	// Open the MySQL database connection
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return fmt.Errorf("failed to open database: %v", err)
-	}
-	defer db.Close()
-
+func MoveSats(store storage.Store, fromAddress string, toAddress string, amount string) error {
 	// Convert amount to integer
-	amountInt, err := strconv.Atoi(amount)
+	amountInt, err := strconv.ParseInt(amount, 10, 64)
 	if err != nil {
 		return fmt.Errorf("invalid amount: %v", err)
 	}
 
-	// Begin a transaction
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %v", err)
-	}
-
-	// Rollback if something goes wrong
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
+	return store.MoveSats(fromAddress, toAddress, amountInt)
+}
 
-	// Check balance of fromAddress
-	var fromBalance int
-	err = tx.QueryRow("SELECT balance FROM wallet_balances WHERE wallet = ?", fromAddress).Scan(&fromBalance)
+// CheckNonce checks if a nonce exists in the nonce table, and adds it if it
+// does not exist, then returns false.
+func CheckNonce(store storage.Store, nonce string) (bool, error) {
+	exists, err := store.CheckNonce(nonce)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve balance for fromAddress: %v", err)
-	}
-
-	// Ensure fromAddress has sufficient funds
-	if fromBalance < amountInt {
-		return fmt.Errorf("insufficient funds in wallet %s", fromAddress)
+		log.Println("Error checking nonce:", err)
+		return false, err
 	}
 
-	// Subtract amount from fromAddress
-	_, err = tx.Exec("UPDATE wallet_balances SET balance = balance - ? WHERE wallet = ?", amountInt, fromAddress)
-	if err != nil {
-		return fmt.Errorf("failed to deduct amount from fromAddress: %v", err)
-	}
+	// Return true if the nonce already existed
+	return exists, nil
+}
 
-	// Add amount to toAddress
-	_, err = tx.Exec("UPDATE wallet_balances SET balance = balance + ? WHERE wallet = ?", amountInt, toAddress)
-	if err != nil {
-		return fmt.Errorf("failed to add amount to toAddress: %v", err)
-	}
+// ErrInvalidSignature is returned by ValidateTransaction when the transaction is
+// not signed by the sending wallet.
+var ErrInvalidSignature = errors.New("invalid signature")
 
-	// Commit the transaction
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
-	}
-
-	return nil
+// Transaction is a signed transfer as sent by the wallet page.
+type Transaction struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount string `json:"amount"`
+	Nonce  string `json:"nonce"`
 }
 
-// CheckAndAddNonce opens an SQLite database, checks if a nonce exists in the nonce table,
-// and adds it if it does not exist, then returns false.
-func CheckNonce(dbFileName string, nonce string) (bool, error) {
-	// Create the MySQL connection string (Data Source Name)
-	// You should have your DB user, password, host, and database name set as per your configuration
-	dsn := "node:test@tcp(node-1-database:3306)/node" // Modify this as per your setup
-	// Open a connection to the MySQL database
-	db, err := sql.Open("mysql", dsn)
+// ValidateTransaction verifies the signature and amount of a transaction and
+// returns it as a transfer ready to be applied. It does not touch the database.
+func ValidateTransaction(signature string, transaction Transaction) (storage.Transfer, error) {
+	// Check the signature
+	message, err := json.Marshal(transaction)
 	if err != nil {
-		return false, fmt.Errorf("could not open database: %w", err)
+		return storage.Transfer{}, fmt.Errorf("failed to encode transaction: %w", err)
+	}
+	if result, err := VerifySignature(signature, transaction.From, string(message)); err != nil || result != "valid" {
+		return storage.Transfer{}, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
 	}
-	defer db.Close()
-
-	// Prepare the query to check if the nonce exists
-	query := "SELECT EXISTS(SELECT 1 FROM nonce WHERE nonce = ?)"
 
-	// Create a variable to hold the result of the query
-	var exists int
+	// Convert amount to integer
+	amount, err := strconv.ParseInt(transaction.Amount, 10, 64)
+	if err != nil || amount <= 0 {
+		return storage.Transfer{}, fmt.Errorf("%w: %s", storage.ErrInvalidAmount, transaction.Amount)
+	}
+
+	return storage.Transfer{
+		TxID:      storage.TransferID(transaction.From, transaction.To, amount, transaction.Nonce),
+		From:      transaction.From,
+		To:        transaction.To,
+		Amount:    amount,
+		Nonce:     transaction.Nonce,
+		Signature: signature,
+	}, nil
+}
 
-	// Execute the query
-	err = db.QueryRow(query, nonce).Scan(&exists)
+// ApplyTransaction verifies the signature of a transaction and then applies it
+// as one ledger operation: the nonce is consumed, the recipient is created if
+// needed and the funds are moved together, or not at all.
+func ApplyTransaction(store storage.Store, signature string, transaction Transaction) error {
+	// Check the signature before touching the database
+	transfer, err := ValidateTransaction(signature, transaction)
 	if err != nil {
-		log.Println("Error executing query:", err)
-		return false, fmt.Errorf("query execution failed: %w", err)
+		return err
 	}
-
-	// If the nonce does not exist, insert it into the database
-	if exists == 0 {
-		insertQuery := "INSERT INTO nonce (nonce) VALUES (?)"
-		_, err = db.Exec(insertQuery, nonce)
-		if err != nil {
-			log.Println("Error inserting nonce:", err)
-			return false, fmt.Errorf("failed to insert nonce: %w", err)
-		}
-		// Return false as per the requirement after adding the nonce
-		return false, nil
-	}
-
-	// Return true if the nonce already existed
-	return true, nil
+	_, err = store.ApplyTransfer(transfer)
+	return err
 }
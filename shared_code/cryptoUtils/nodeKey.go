@@ -0,0 +1,137 @@
+package cryptoUtils
+
+import (
+	"bitcoin-sidechain/storage"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+)
+
+// LoadNodeKey reads a node's secp256k1 private key from a file holding it in hex.
+func LoadNodeKey(filename string) (*btcec.PrivateKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read node key: %w", err)
+	}
+	keyBytes, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(keyBytes) != 32 {
+		return nil, errors.New("failed to parse node key: expected 32 bytes in hex")
+	}
+	privateKey, _ := btcec.PrivKeyFromBytes(keyBytes)
+	return privateKey, nil
+}
+
+// LoadOrCreateNodeKey reads the node's identity key, generating it and saving
+// it to filename on first start. The file is only readable by its owner.
+func LoadOrCreateNodeKey(filename string) (*btcec.PrivateKey, error) {
+	if _, err := os.Stat(filename); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return LoadNodeKey(filename)
+	}
+
+	privateKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate node key: %w", err)
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create node key file: %w", err)
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintln(file, hex.EncodeToString(privateKey.Serialize())); err != nil {
+		return nil, fmt.Errorf("failed to write node key: %w", err)
+	}
+	return privateKey, nil
+}
+
+// NodeID returns the computer_id of the node holding a key: the SHA-256 of
+// its uncompressed public key, in hex.
+func NodeID(publicKey *btcec.PublicKey) string {
+	hash := sha256.Sum256(publicKey.SerializeUncompressed())
+	return hex.EncodeToString(hash[:])
+}
+
+// NodeIDFromBase64 returns the computer_id that belongs to a base64 public key.
+func NodeIDFromBase64(publicKeyB64 string) (string, error) {
+	publicKeyBytes, err := base64.StdEncoding.DecodeString(publicKeyB64)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode public key: %w", err)
+	}
+	publicKey, err := btcec.ParsePubKey(publicKeyBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return NodeID(publicKey), nil
+}
+
+// PublicKeyBase64 returns the uncompressed public key of a private key in
+// base64, the same form wallet addresses use.
+func PublicKeyBase64(privateKey *btcec.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(privateKey.PubKey().SerializeUncompressed())
+}
+
+// SignMessage signs the SHA-256 of a message and returns the DER signature in base64.
+func SignMessage(privateKey *btcec.PrivateKey, message []byte) string {
+	hash := sha256.Sum256(message)
+	return base64.StdEncoding.EncodeToString(ecdsa.Sign(privateKey, hash[:]).Serialize())
+}
+
+// VerifyMessage checks a signature made by SignMessage against a base64 public
+// key. Only the low-S form of a signature is accepted.
+func VerifyMessage(publicKeyB64 string, message []byte, signatureB64 string) error {
+	publicKeyBytes, err := base64.StdEncoding.DecodeString(publicKeyB64)
+	if err != nil {
+		return fmt.Errorf("%w: failed to decode public key: %v", ErrInvalidSignature, err)
+	}
+	publicKey, err := btcec.ParsePubKey(publicKeyBytes)
+	if err != nil {
+		return fmt.Errorf("%w: failed to parse public key: %v", ErrInvalidSignature, err)
+	}
+	signatureBytes, err := base64.StdEncoding.DecodeString(signatureB64)
+	if err != nil {
+		return fmt.Errorf("%w: failed to decode signature: %v", ErrInvalidSignature, err)
+	}
+	signature, err := ecdsa.ParseDERSignature(signatureBytes)
+	if err != nil {
+		return fmt.Errorf("%w: failed to parse signature: %v", ErrInvalidSignature, err)
+	}
+	// Serialize picks the low S of the two valid ones, so a signature with a
+	// high S, which anyone can make from the low one, does not round-trip
+	if !bytes.Equal(signature.Serialize(), signatureBytes) {
+		return fmt.Errorf("%w: signature is not in canonical low-S form", ErrInvalidSignature)
+	}
+
+	hash := sha256.Sum256(message)
+	if !signature.Verify(hash[:], publicKey) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// VerifyTransfer checks that a transfer taken from a block was signed by its
+// sender, by rebuilding the transaction the wallet signed.
+func VerifyTransfer(transfer storage.Transfer) error {
+	transaction := Transaction{
+		From:   transfer.From,
+		To:     transfer.To,
+		Amount: strconv.FormatInt(transfer.Amount, 10),
+		Nonce:  transfer.Nonce,
+	}
+	message, err := json.Marshal(transaction)
+	if err != nil {
+		return fmt.Errorf("failed to encode transaction: %w", err)
+	}
+	if result, err := VerifySignature(transfer.Signature, transfer.From, string(message)); err != nil || result != "valid" {
+		return fmt.Errorf("%w: transfer %s: %v", ErrInvalidSignature, transfer.TxID, err)
+	}
+	return nil
+}
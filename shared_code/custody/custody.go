@@ -0,0 +1,810 @@
+// Package custody keeps the peg key with the active leaders. The key is a
+// FROST key (see package frost) shared among the custodians of an epoch, the
+// nodes of its group 1, so that Threshold of them can sign for the peg
+// wallet. When an epoch starts, the key is handed to its custodians:
+//
+//  1. Dealers send every custodian a Dealing: commitments and a share sealed
+//     to the custodian's node key. The dealers are the custodians of the
+//     latest completed handoff, who reshare their shares, or, while no node
+//     knows of a key, the new custodians themselves, who generate one.
+//  2. A coordinator, custodian 1 and then the next one every two timeouts,
+//     picks the dealings it could check and sends them as a Transcript.
+//  3. Every custodian checks its share in each dealing. If one is invalid it
+//     sends a Complaint and the coordinator drops that dealer. Otherwise it
+//     finishes the transcript and sends a Confirmation with the hash of the
+//     public keys it got.
+//  4. With Threshold confirmations the coordinator sends the Completion to
+//     every member of the epoch. Custodians store their new share and every
+//     node deletes its shares of earlier keys.
+//
+// Resharing keeps the group key, and with it the peg wallet address, and
+// never rebuilds the secret. A handoff that does not complete leaves the key
+// with the custodians of the latest completed one, and the next epoch reshares
+// from them.
+package custody
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/epoch"
+	"bitcoin-sidechain/frost"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// Config sets the pace of handoffs.
+type Config struct {
+	Timeout  time.Duration // wait for dealings, and for confirmations before the next coordinator
+	Attempts int           // coordinators tried before a handoff is given up, 0 for every custodian
+}
+
+// DefaultConfig is used for any value left at zero.
+var DefaultConfig = Config{
+	Timeout: 20 * time.Second,
+}
+
+// Transport delivers custody messages between nodes.
+type Transport interface {
+	// Send sends a message to every peer without waiting for delivery.
+	Send(peers []storage.EpochMember, message Message)
+	// FetchLatest asks a peer for its latest completed handoff.
+	FetchLatest(peer storage.EpochMember) (storage.CustodyKey, error)
+}
+
+// Manager runs this node's part in handoffs.
+type Manager struct {
+	store     storage.Store
+	key       *btcec.PrivateKey
+	self      string
+	transport Transport
+	config    Config
+	random    io.Reader
+
+	mu      sync.Mutex
+	current *handoff // latest handoff this node takes part in
+}
+
+// handoff is the state of one handoff on one node.
+type handoff struct {
+	epoch      storage.Epoch
+	custodians []storage.EpochMember
+	self       int // signer id of this node, 0 if it is not a custodian
+	previous   *storage.CustodyKey
+	plan       frost.Handoff
+	dealers    []storage.EpochMember
+	started    time.Time
+	done       bool
+
+	// As a dealer
+	dealing *Dealing
+
+	// As coordinator
+	dealings      map[string]Dealing // checked, by dealer
+	excluded      map[string]bool    // dealers dropped
+	complained    map[string]bool    // custodians that had a dealer dropped
+	transcript    *Transcript
+	publicKeys    string // hash of the public keys the transcript leads to
+	confirmations map[string]Confirmation
+	completed     bool
+
+	// As custodian
+	attempt    int
+	revision   int
+	locked     *Transcript                // first transcript confirmed, then its later revisions
+	lockedKeys string                     // hash of the public keys it leads to
+	pending    map[string]*frost.KeyShare // shares of the transcripts finished, by hash of their public keys
+	confirmed  map[string]Confirmation    // by transcript hash
+}
+
+// New returns a manager for the node with the given key.
+func New(store storage.Store, key *btcec.PrivateKey, transport Transport, config Config) *Manager {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultConfig.Timeout
+	}
+	return &Manager{
+		store:     store,
+		key:       key,
+		self:      cryptoUtils.NodeID(key.PubKey()),
+		transport: transport,
+		config:    config,
+		random:    rand.Reader,
+	}
+}
+
+// OnEpoch starts the handoff to a new epoch. It is an epoch.Manager
+// subscriber and returns at once.
+func (m *Manager) OnEpoch(event epoch.Event) {
+	go m.Begin(event.Epoch)
+}
+
+// Begin runs this node's part in the handoff to an epoch until it completes
+// or is given up. It returns at once if the node has no part in it.
+func (m *Manager) Begin(epoch storage.Epoch) {
+	m.catchUp(epoch.Number)
+	h, err := m.start(epoch)
+	if err != nil {
+		fmt.Printf("Custody: handoff to epoch %d: %v\n", epoch.Number, err)
+		return
+	}
+	if h != nil {
+		m.drive(h)
+	}
+}
+
+// Latest returns the latest completed handoff this node knows of, or nil.
+func (m *Manager) Latest() (*storage.CustodyKey, error) {
+	key, err := m.store.LatestCustodyKey()
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// catchUp fetches the latest handoff from the custodians of the previous
+// epoch if this node missed it.
+func (m *Manager) catchUp(number int64) {
+	latest, err := m.Latest()
+	if err != nil || number == 0 || (latest != nil && latest.Epoch >= number-1) {
+		return
+	}
+	previous, err := m.store.GetEpoch(number - 1)
+	if err != nil {
+		return
+	}
+	for _, custodian := range Custodians(previous) {
+		if custodian.ComputerID == m.self {
+			continue
+		}
+		key, err := m.transport.FetchLatest(custodian)
+		if err != nil || (latest != nil && key.Epoch <= latest.Epoch) {
+			continue
+		}
+		if err := m.complete(key); err != nil {
+			fmt.Printf("Custody: handoff from %s: %v\n", custodian.IPAddress, err)
+			continue
+		}
+		return
+	}
+}
+
+// start sets up the handoff to an epoch and deals this node's shares. It
+// returns nil if the node has no part in it or it is already done.
+func (m *Manager) start(epoch storage.Epoch) (*handoff, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.current != nil && m.current.epoch.Number >= epoch.Number {
+		return nil, nil
+	}
+	previous, err := m.Latest()
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil && previous.Epoch >= epoch.Number {
+		return nil, nil
+	}
+	custodians := Custodians(epoch)
+	if len(custodians) == 0 {
+		return nil, nil
+	}
+	plan, dealers, err := m.plan(epoch.Number, len(custodians), previous)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &handoff{
+		epoch:         epoch,
+		custodians:    custodians,
+		self:          signerID(custodians, m.self),
+		previous:      previous,
+		plan:          plan,
+		dealers:       dealers,
+		started:       time.Now(),
+		dealings:      make(map[string]Dealing),
+		excluded:      make(map[string]bool),
+		complained:    make(map[string]bool),
+		confirmations: make(map[string]Confirmation),
+		attempt:       -1,
+		pending:       make(map[string]*frost.KeyShare),
+		confirmed:     make(map[string]Confirmation),
+	}
+
+	// Check this node has a part in the handoff
+	dealer := signerID(h.dealersOf(), m.self)
+	if h.self == 0 && dealer == 0 {
+		return nil, nil
+	}
+	if dealer > 0 {
+		dealing, err := m.deal(h, dealer)
+		if err != nil {
+			fmt.Printf("Custody: cannot deal for epoch %d: %v\n", epoch.Number, err)
+		} else {
+			h.dealing = &dealing
+		}
+	}
+	if h.self == 0 && h.dealing == nil {
+		return nil, nil
+	}
+	if m.current != nil {
+		m.current.done = true
+	}
+	m.current = h
+
+	kind := "generating a new key"
+	if previous != nil {
+		kind = fmt.Sprintf("resharing the key of epoch %d", previous.Epoch)
+	}
+	fmt.Printf("Custody: handoff to epoch %d started, %s, %d of %d custodians\n", epoch.Number, kind, plan.Threshold, len(custodians))
+	return h, nil
+}
+
+// plan returns the handoff to an epoch with n custodians from the latest
+// completed one, and its dealers.
+func (m *Manager) plan(number int64, n int, previous *storage.CustodyKey) (frost.Handoff, []storage.EpochMember, error) {
+	plan := frost.Handoff{
+		Context:   []byte(fmt.Sprintf("peg custody handoff to epoch %d", number)),
+		Threshold: Threshold(n),
+	}
+	for id := 1; id <= n; id++ {
+		plan.Recipients = append(plan.Recipients, id)
+	}
+	if previous == nil {
+		return plan, nil, nil
+	}
+	from, err := m.store.GetEpoch(previous.Epoch)
+	if err != nil {
+		return plan, nil, fmt.Errorf("failed to read epoch %d: %w", previous.Epoch, err)
+	}
+	if plan.Previous, err = VerifyKey(*previous, from); err != nil {
+		return plan, nil, err
+	}
+	return plan, Custodians(from), nil
+}
+
+// dealersOf returns the dealers of a handoff: the custodians that reshare,
+// or the new custodians for a new key.
+func (h *handoff) dealersOf() []storage.EpochMember {
+	if h.dealers == nil {
+		return h.custodians
+	}
+	return h.dealers
+}
+
+// deal makes this node's dealing as dealer with the given signer id.
+func (m *Manager) deal(h *handoff, dealer int) (Dealing, error) {
+	var share *frost.KeyShare
+	if h.previous != nil {
+		stored, err := m.store.GetCustodyShare(h.previous.Epoch)
+		if err != nil {
+			return Dealing{}, fmt.Errorf("no share of the key of epoch %d: %w", h.previous.Epoch, err)
+		}
+		share = &frost.KeyShare{}
+		if err := json.Unmarshal(stored.KeyShare, share); err != nil {
+			return Dealing{}, fmt.Errorf("invalid share of the key of epoch %d: %w", h.previous.Epoch, err)
+		}
+	}
+	dealing, shares, err := h.plan.Deal(dealer, share, m.random)
+	if err != nil {
+		return Dealing{}, err
+	}
+
+	d := Dealing{
+		Epoch:   h.epoch.Number,
+		From:    from(h.previous),
+		Dealer:  m.self,
+		Dealing: dealing,
+		Shares:  make(map[int]string, len(shares)),
+	}
+	for id, share := range shares {
+		sealed, err := seal(m.key, h.custodians[id-1].PublicKey, shareContext(h.epoch.Number, dealer, id), share, m.random)
+		if err != nil {
+			return Dealing{}, fmt.Errorf("failed to seal the share of custodian %d: %w", id, err)
+		}
+		d.Shares[id] = sealed
+	}
+	d.Signature = cryptoUtils.SignMessage(m.key, d.SignBytes())
+	return d, nil
+}
+
+// from returns the epoch a handoff reshares from, -1 for a new key.
+func from(previous *storage.CustodyKey) int64 {
+	if previous == nil {
+		return -1
+	}
+	return previous.Epoch
+}
+
+// drive resends this node's messages until the handoff completes, and issues
+// transcripts in the slots where this node coordinates.
+func (m *Manager) drive(h *handoff) {
+	attempts := m.config.Attempts
+	if attempts <= 0 {
+		attempts = len(h.custodians)
+	}
+	deadline := h.started.Add(time.Duration(attempts) * m.slotLength())
+	tick := m.config.Timeout / 4
+	var lastSent time.Time
+
+	for {
+		m.mu.Lock()
+		if h.done || m.current != h {
+			m.mu.Unlock()
+			return
+		}
+		if time.Now().After(deadline) {
+			h.done = true
+			m.mu.Unlock()
+			fmt.Printf("Custody: handoff to epoch %d given up, the key stays with the custodians of epoch %d\n", h.epoch.Number, from(h.previous))
+			return
+		}
+		if h.self > 0 && m.coordinator(h, m.slot(h)) == h.self {
+			m.coordinate(h, false)
+		}
+
+		// Send again what may have been lost: the dealing, and the
+		// transcript to the custodians that have not confirmed it
+		var resend []func()
+		if time.Since(lastSent) >= m.config.Timeout {
+			lastSent = time.Now()
+			if h.dealing != nil {
+				message := Message{Dealing: h.dealing}
+				resend = append(resend, func() { m.send(h.custodians, message) })
+			}
+			if h.transcript != nil && !h.completed {
+				var missing []storage.EpochMember
+				for _, custodian := range h.custodians {
+					if _, ok := h.confirmations[custodian.ComputerID]; !ok {
+						missing = append(missing, custodian)
+					}
+				}
+				message := Message{Transcript: h.transcript}
+				resend = append(resend, func() { m.send(missing, message) })
+			}
+		}
+		m.mu.Unlock()
+
+		for _, send := range resend {
+			send()
+		}
+		time.Sleep(tick)
+	}
+}
+
+// slotLength is how long each coordinator has.
+func (m *Manager) slotLength() time.Duration {
+	return 2 * m.config.Timeout
+}
+
+// slot returns the current coordinator slot of a handoff.
+func (m *Manager) slot(h *handoff) int {
+	return int(time.Since(h.started) / m.slotLength())
+}
+
+// coordinator returns the signer id of the coordinator of a slot.
+func (m *Manager) coordinator(h *handoff, slot int) int {
+	return slot%len(h.custodians) + 1
+}
+
+// coordinate issues a transcript for the current slot once this node has all
+// dealings, or enough of them and the slot is half over. force issues a new
+// revision at once. The caller holds m.mu.
+func (m *Manager) coordinate(h *handoff, force bool) {
+	slot := m.slot(h)
+	if h.completed || (!force && h.transcript != nil && h.transcript.Attempt == slot) {
+		return
+	}
+
+	// Pick the checked dealings that were not complained about. A
+	// coordinator that confirmed an earlier transcript keeps its dealings,
+	// so that the custodians locked on them can confirm again
+	var dealings []Dealing
+	if h.locked != nil && !force {
+		for _, d := range h.locked.Dealings {
+			if !h.excluded[d.Dealer] {
+				dealings = append(dealings, d)
+			}
+		}
+	} else {
+		for dealer, d := range h.dealings {
+			if !h.excluded[dealer] {
+				dealings = append(dealings, d)
+			}
+		}
+	}
+	sort.Slice(dealings, func(i, j int) bool { return dealings[i].Dealing.Dealer < dealings[j].Dealing.Dealer })
+	if len(dealings) < h.plan.Dealers() {
+		return
+	}
+	slotStart := h.started.Add(time.Duration(slot) * m.slotLength())
+	if !force && len(dealings) < len(h.dealersOf()) && time.Since(slotStart) < m.config.Timeout {
+		return
+	}
+	frostDealings := make([]frost.Dealing, len(dealings))
+	for i, d := range dealings {
+		frostDealings[i] = d.Dealing
+	}
+	public, err := h.plan.Result(frostDealings)
+	if err != nil {
+		fmt.Printf("Custody: cannot build a transcript for epoch %d: %v\n", h.epoch.Number, err)
+		return
+	}
+	publicKeys, err := publicKeysHash(public)
+	if err != nil {
+		return
+	}
+
+	transcript := Transcript{
+		Epoch:       h.epoch.Number,
+		Attempt:     slot,
+		Coordinator: m.self,
+		Previous:    h.previous,
+		Dealings:    dealings,
+	}
+	if h.transcript != nil && h.transcript.Attempt == slot {
+		transcript.Revision = h.transcript.Revision + 1
+	}
+	transcript.Signature = cryptoUtils.SignMessage(m.key, transcript.SignBytes())
+	h.transcript = &transcript
+	h.publicKeys = publicKeys
+	h.confirmations = make(map[string]Confirmation)
+
+	fmt.Printf("Custody: transcript %d.%d for epoch %d with %d dealings\n", transcript.Attempt, transcript.Revision, h.epoch.Number, len(dealings))
+	go m.send(h.custodians, Message{Transcript: &transcript})
+}
+
+// send sends a message to peers, handing it straight to this node if it is
+// one of them.
+func (m *Manager) send(peers []storage.EpochMember, message Message) {
+	var others []storage.EpochMember
+	for _, peer := range peers {
+		if peer.ComputerID == m.self {
+			go func() {
+				if err := m.Receive(message); err != nil {
+					fmt.Println("Custody:", err)
+				}
+			}()
+			continue
+		}
+		others = append(others, peer)
+	}
+	if len(others) > 0 {
+		m.transport.Send(others, message)
+	}
+}
+
+// Receive handles a message from another node.
+func (m *Manager) Receive(message Message) error {
+	if message.Completion != nil {
+		return m.complete(*message.Completion)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Messages for a handoff this node is not running are dropped; the
+	// dealings and transcripts are sent again
+	h := m.current
+	var number int64
+	switch {
+	case message.Dealing != nil:
+		number = message.Dealing.Epoch
+	case message.Transcript != nil:
+		number = message.Transcript.Epoch
+	case message.Complaint != nil:
+		number = message.Complaint.Epoch
+	case message.Confirmation != nil:
+		number = message.Confirmation.Epoch
+	}
+	if h == nil || h.done || h.epoch.Number != number {
+		return nil
+	}
+
+	switch {
+	case message.Dealing != nil:
+		return m.receiveDealing(h, *message.Dealing)
+	case message.Transcript != nil:
+		return m.receiveTranscript(h, *message.Transcript)
+	case message.Complaint != nil:
+		return m.receiveComplaint(h, *message.Complaint)
+	case message.Confirmation != nil:
+		return m.receiveConfirmation(h, *message.Confirmation)
+	}
+	return nil
+}
+
+// receiveDealing keeps a dealing for the transcripts this node may issue.
+func (m *Manager) receiveDealing(h *handoff, d Dealing) error {
+	if h.self == 0 {
+		return nil
+	}
+	if known, ok := h.dealings[d.Dealer]; ok && known.Signature == d.Signature {
+		return nil
+	}
+	if err := checkDealing(h.plan, h.dealersOf(), h.epoch.Number, from(h.previous), d); err != nil {
+		return err
+	}
+	if _, err := m.openShare(h.plan, h.dealersOf(), h.epoch.Number, h.self, d); err != nil {
+		h.excluded[d.Dealer] = true
+		return fmt.Errorf("%w: dealing from %s: %v", ErrInvalidMessage, d.Dealer, err)
+	}
+	h.dealings[d.Dealer] = d
+	if m.coordinator(h, m.slot(h)) == h.self {
+		m.coordinate(h, false)
+	}
+	return nil
+}
+
+// checkDealing checks that a dealing comes from a dealer of the handoff, is
+// signed by it and is valid in public.
+func checkDealing(plan frost.Handoff, dealers []storage.EpochMember, number, from int64, d Dealing) error {
+	if d.Epoch != number || d.From != from {
+		return fmt.Errorf("%w: dealing from %s is for another handoff", ErrInvalidMessage, d.Dealer)
+	}
+	id := d.Dealing.Dealer
+	if id < 1 || id > len(dealers) || dealers[id-1].ComputerID != d.Dealer {
+		return fmt.Errorf("%w: %s is not dealer %d", ErrInvalidMessage, d.Dealer, id)
+	}
+	if err := cryptoUtils.VerifyMessage(dealers[id-1].PublicKey, d.SignBytes(), d.Signature); err != nil {
+		return fmt.Errorf("%w: dealing from %s: %v", ErrInvalidMessage, d.Dealer, err)
+	}
+	if err := plan.Check(d.Dealing); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	return nil
+}
+
+// openShare opens the share of custodian self in a dealing and checks it.
+func (m *Manager) openShare(plan frost.Handoff, dealers []storage.EpochMember, number int64, self int, d Dealing) (btcec.ModNScalar, error) {
+	sealed, ok := d.Shares[self]
+	if !ok {
+		return btcec.ModNScalar{}, fmt.Errorf("no share for custodian %d", self)
+	}
+	dealer := d.Dealing.Dealer
+	share, err := unseal(m.key, dealers[dealer-1].PublicKey, shareContext(number, dealer, self), sealed)
+	if err != nil {
+		return share, err
+	}
+	return share, plan.CheckShare(d.Dealing, self, share)
+}
+
+// receiveTranscript finishes a transcript and confirms it, or complains about
+// the first dealing with an invalid share.
+func (m *Manager) receiveTranscript(h *handoff, t Transcript) error {
+	if h.self == 0 || t.Attempt < 0 {
+		return nil
+	}
+
+	// Check the transcript comes from the coordinator of its attempt
+	coordinator := h.custodians[t.Attempt%len(h.custodians)]
+	if t.Coordinator != coordinator.ComputerID {
+		return fmt.Errorf("%w: %s is not the coordinator of attempt %d", ErrInvalidMessage, t.Coordinator, t.Attempt)
+	}
+	if err := cryptoUtils.VerifyMessage(coordinator.PublicKey, t.SignBytes(), t.Signature); err != nil {
+		return fmt.Errorf("%w: transcript from %s: %v", ErrInvalidMessage, t.Coordinator, err)
+	}
+	hash := t.Hash()
+	if confirmation, ok := h.confirmed[hash]; ok {
+		go m.send([]storage.EpochMember{coordinator}, Message{Confirmation: &confirmation})
+		return nil
+	}
+	if !t.newer(h.attempt, h.revision) {
+		return nil
+	}
+
+	// Check the key being reshared is the latest this node knows of
+	if err := m.adoptPrevious(h, t.Previous); err != nil {
+		return err
+	}
+
+	// Open this custodian's share of every dealing
+	dealings := make([]frost.Dealing, len(t.Dealings))
+	shares := make(map[int]btcec.ModNScalar, len(t.Dealings))
+	for i, d := range t.Dealings {
+		if err := checkDealing(h.plan, h.dealersOf(), h.epoch.Number, from(h.previous), d); err != nil {
+			return err
+		}
+		share, err := m.openShare(h.plan, h.dealersOf(), h.epoch.Number, h.self, d)
+		if err != nil {
+			complaint := Complaint{Epoch: h.epoch.Number, Transcript: hash, Dealer: d.Dealer, Custodian: m.self}
+			complaint.Signature = cryptoUtils.SignMessage(m.key, complaint.SignBytes())
+			go m.send([]storage.EpochMember{coordinator}, Message{Complaint: &complaint})
+			return fmt.Errorf("%w: dealing from %s: %v", ErrInvalidMessage, d.Dealer, err)
+		}
+		dealings[i] = d.Dealing
+		shares[d.Dealing.Dealer] = share
+	}
+	share, err := h.plan.Finish(h.self, dealings, shares)
+	if err != nil {
+		return fmt.Errorf("%w: transcript from %s: %v", ErrInvalidMessage, t.Coordinator, err)
+	}
+	publicKeys, err := publicKeysHash(share.Public)
+	if err != nil {
+		return err
+	}
+
+	// A custodian confirms a single set of public keys, so that two
+	// coordinators cannot each gather a quorum for shares that do not fit
+	// together. Only the coordinator it confirmed can move it to others, by
+	// dropping a dealer after a complaint.
+	if h.locked != nil && publicKeys != h.lockedKeys && t.Attempt != h.locked.Attempt {
+		return nil
+	}
+
+	h.attempt, h.revision = t.Attempt, t.Revision
+	h.locked, h.lockedKeys = &t, publicKeys
+	h.pending[publicKeys] = share
+	confirmation := Confirmation{Epoch: h.epoch.Number, Transcript: hash, PublicKeys: publicKeys, Custodian: m.self}
+	confirmation.Signature = cryptoUtils.SignMessage(m.key, confirmation.SignBytes())
+	h.confirmed[hash] = confirmation
+	go m.send([]storage.EpochMember{coordinator}, Message{Confirmation: &confirmation})
+	return nil
+}
+
+// adoptPrevious checks the key a transcript reshares against the one this
+// node started from. A later key that checks out means this node missed a
+// handoff; it is stored and the handoff reshares from it.
+func (m *Manager) adoptPrevious(h *handoff, previous *storage.CustodyKey) error {
+	switch {
+	case previous == nil && h.previous == nil:
+		return nil
+	case previous == nil:
+		return fmt.Errorf("%w: transcript makes a new key while epoch %d holds one", ErrInvalidMessage, h.previous.Epoch)
+	case h.previous != nil && previous.Epoch == h.previous.Epoch:
+		// Coordinators of several attempts can complete the same keys
+		if !sameKeys(*previous, *h.previous) {
+			return fmt.Errorf("%w: transcript reshares another key of epoch %d", ErrInvalidMessage, previous.Epoch)
+		}
+		return nil
+	case h.previous != nil && previous.Epoch < h.previous.Epoch:
+		return fmt.Errorf("%w: transcript reshares the key of epoch %d, epoch %d holds a later one", ErrInvalidMessage, previous.Epoch, h.previous.Epoch)
+	}
+
+	plan, dealers, err := m.plan(h.epoch.Number, len(h.custodians), previous)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if _, err := m.store.CompleteHandoff(*previous, nil); err != nil {
+		return err
+	}
+	h.previous, h.plan, h.dealers = previous, plan, dealers
+	return nil
+}
+
+// receiveComplaint drops a dealer from this node's transcript and issues a
+// new revision. Each custodian can have one dealer dropped.
+func (m *Manager) receiveComplaint(h *handoff, c Complaint) error {
+	if h.transcript == nil || h.completed || c.Transcript != h.transcript.Hash() {
+		return nil
+	}
+	id := signerID(h.custodians, c.Custodian)
+	if id == 0 {
+		return fmt.Errorf("%w: %s is not a custodian", ErrInvalidMessage, c.Custodian)
+	}
+	if err := cryptoUtils.VerifyMessage(h.custodians[id-1].PublicKey, c.SignBytes(), c.Signature); err != nil {
+		return fmt.Errorf("%w: complaint from %s: %v", ErrInvalidMessage, c.Custodian, err)
+	}
+	if h.complained[c.Custodian] || h.excluded[c.Dealer] {
+		return nil
+	}
+	h.complained[c.Custodian] = true
+	h.excluded[c.Dealer] = true
+	fmt.Printf("Custody: custodian %d complains about the dealing from %s, dropping it\n", id, c.Dealer)
+	m.coordinate(h, true)
+	return nil
+}
+
+// receiveConfirmation counts a confirmation of this node's transcript and
+// sends the completion once Threshold custodians confirmed it.
+func (m *Manager) receiveConfirmation(h *handoff, c Confirmation) error {
+	if h.transcript == nil || h.completed || c.Transcript != h.transcript.Hash() {
+		return nil
+	}
+	id := signerID(h.custodians, c.Custodian)
+	if id == 0 {
+		return fmt.Errorf("%w: %s is not a custodian", ErrInvalidMessage, c.Custodian)
+	}
+	if err := cryptoUtils.VerifyMessage(h.custodians[id-1].PublicKey, c.SignBytes(), c.Signature); err != nil {
+		return fmt.Errorf("%w: confirmation from %s: %v", ErrInvalidMessage, c.Custodian, err)
+	}
+	if c.PublicKeys != h.publicKeys {
+		return fmt.Errorf("%w: custodian %d finished with other public keys", ErrInvalidMessage, id)
+	}
+	h.confirmations[c.Custodian] = c
+	if len(h.confirmations) < h.plan.Threshold {
+		return nil
+	}
+
+	// Build the completion from the transcript and the confirmations
+	dealings := make([]frost.Dealing, len(h.transcript.Dealings))
+	for i, d := range h.transcript.Dealings {
+		dealings[i] = d.Dealing
+	}
+	public, err := h.plan.Result(dealings)
+	if err != nil {
+		return err
+	}
+	publicKeys, err := json.Marshal(public)
+	if err != nil {
+		return err
+	}
+	confirmations := make([]Confirmation, 0, len(h.confirmations))
+	for _, confirmation := range h.confirmations {
+		confirmations = append(confirmations, confirmation)
+	}
+	sort.Slice(confirmations, func(i, j int) bool { return confirmations[i].Custodian < confirmations[j].Custodian })
+	certificate, err := json.Marshal(confirmations)
+	if err != nil {
+		return err
+	}
+	h.completed = true
+
+	key := storage.CustodyKey{
+		Epoch:       h.epoch.Number,
+		GroupKey:    hex.EncodeToString(public.XOnly()),
+		PublicKeys:  publicKeys,
+		Transcript:  c.Transcript,
+		Certificate: certificate,
+		CreatedAt:   time.Now().Unix(),
+	}
+	go m.send(h.epoch.Members, Message{Completion: &key})
+	return nil
+}
+
+// complete stores a completed handoff once it checks out against its epoch,
+// with this node's share if it finished that transcript, and deletes the
+// node's shares of earlier keys.
+func (m *Manager) complete(key storage.CustodyKey) error {
+	epoch, err := m.store.GetEpoch(key.Epoch)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil // not there yet, fetched again at the next epoch
+	}
+	if err != nil {
+		return err
+	}
+	public, err := VerifyKey(key, epoch)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var share *storage.CustodyShare
+	if h := m.current; h != nil && h.epoch.Number == key.Epoch {
+		h.done = true
+		publicKeys, err := publicKeysHash(public)
+		if err != nil {
+			return err
+		}
+		if keyShare := h.pending[publicKeys]; keyShare != nil {
+			data, err := json.Marshal(keyShare)
+			if err != nil {
+				return err
+			}
+			share = &storage.CustodyShare{Epoch: key.Epoch, SignerID: keyShare.ID, KeyShare: data, CreatedAt: time.Now().Unix()}
+		} else if h.self > 0 {
+			fmt.Printf("Custody: custodian %d did not finish the transcript of epoch %d and holds no share\n", h.self, key.Epoch)
+		}
+	}
+	saved, err := m.store.CompleteHandoff(key, share)
+	if err != nil {
+		return err
+	}
+	if saved {
+		fmt.Printf("Custody: epoch %d holds the peg key %s, %d of %d custodians\n", key.Epoch, key.GroupKey, public.Threshold, len(public.Shares))
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package custody_test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/custody"
+	"bitcoin-sidechain/epoch"
+	"bitcoin-sidechain/frost"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// node is one simulated node.
+type node struct {
+	id      string
+	key     *btcec.PrivateKey
+	store   storage.Store
+	manager *custody.Manager
+}
+
+// network delivers messages through JSON between nodes that are online.
+type network struct {
+	mu      sync.Mutex
+	nodes   map[string]*node
+	offline map[string]bool
+}
+
+func (n *network) down(id string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.offline[id]
+}
+
+// link is the transport of one node.
+type link struct {
+	net  *network
+	self string
+}
+
+func (l link) Send(peers []storage.EpochMember, message custody.Message) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		panic(err)
+	}
+	for _, peer := range peers {
+		if l.net.down(l.self) || l.net.down(peer.ComputerID) {
+			continue
+		}
+		var received custody.Message
+		if err := json.Unmarshal(data, &received); err != nil {
+			panic(err)
+		}
+		go l.net.nodes[peer.ComputerID].manager.Receive(received)
+	}
+}
+
+func (l link) FetchLatest(peer storage.EpochMember) (storage.CustodyKey, error) {
+	if l.net.down(l.self) || l.net.down(peer.ComputerID) {
+		return storage.CustodyKey{}, errors.New("offline")
+	}
+	return l.net.nodes[peer.ComputerID].store.LatestCustodyKey()
+}
+
+// Handoffs over several epochs keep the group key, every new group can sign
+// for it, and shares of earlier groups are deleted and no longer fit. Some
+// nodes are offline in each epoch, among them the first coordinator from
+// epoch 2 on.
+func TestHandoffsKeepPegKey(t *testing.T) {
+	const count, group, epochs = 16, 10, 5
+	const timeout = time.Second
+
+	net := &network{nodes: make(map[string]*node), offline: make(map[string]bool)}
+	var all []*node
+	dir := t.TempDir()
+	for i := 0; i < count; i++ {
+		key, err := btcec.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := storage.Open("sqlite3", filepath.Join(dir, fmt.Sprintf("node%d.db", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		n := &node{id: cryptoUtils.NodeID(key.PubKey()), key: key, store: store}
+		n.manager = custody.New(store, key, link{net: net, self: n.id}, custody.Config{Timeout: timeout})
+		net.nodes[n.id] = n
+		all = append(all, n)
+	}
+
+	var groupKey string
+	held := make(map[string]*frost.KeyShare) // shares of the previous epoch, by node
+	for number := int64(0); number < epochs; number++ {
+		// Shuffle the nodes into the groups of the epoch
+		order := mrand.Perm(count)
+		members := make([]storage.Node, count)
+		for i, index := range order {
+			members[i] = storage.Node{
+				SortOrder:  i + 1,
+				ComputerID: all[index].id,
+				IPAddress:  fmt.Sprintf("10.0.0.%d:8080", index+1),
+				NodeGroup:  i/group + 1,
+				PublicKey:  base64.StdEncoding.EncodeToString(all[index].key.PubKey().SerializeUncompressed()),
+			}
+		}
+		meta := storage.Epoch{Number: number, StartHeight: number * 10, Seed: storage.ZeroHash, GroupSize: group, ActiveGroup: 1}
+		for _, n := range all {
+			if err := n.store.SaveEpoch(meta, members); err != nil {
+				t.Fatal(err)
+			}
+		}
+		current, err := all[0].store.GetEpoch(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		custodians := custody.Custodians(current)
+
+		// Take nodes offline: from epoch 2 on the first coordinator, and
+		// from epoch 1 on one more node at random, as long as enough holders
+		// of the previous key stay online to reshare it
+		net.mu.Lock()
+		net.offline = make(map[string]bool)
+		holders := len(held)
+		if number >= 2 {
+			net.offline[custodians[0].ComputerID] = true
+			if held[custodians[0].ComputerID] != nil {
+				holders--
+			}
+		}
+		if number >= 1 {
+			for {
+				id := all[mrand.Intn(count)].id
+				if held[id] == nil || holders > custody.Threshold(group) {
+					net.offline[id] = true
+					break
+				}
+			}
+		}
+		net.mu.Unlock()
+
+		// Start the epoch on every node and wait for the online custodians
+		for _, n := range all {
+			n.manager.OnEpoch(epoch.Event{Epoch: current, Previous: number - 1})
+		}
+		online := onlineCustodians(net, custodians)
+		waitForShares(t, online, number, time.Duration(2*group+4)*timeout)
+
+		// The group key stays the same
+		key, err := online[0].store.GetCustodyKey(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if groupKey == "" {
+			groupKey = key.GroupKey
+		}
+		if key.GroupKey != groupKey {
+			t.Fatalf("epoch %d: group key changed from %s to %s", number, groupKey, key.GroupKey)
+		}
+
+		// The online custodians can sign, and their shares of earlier
+		// epochs are gone
+		shares := make(map[string]*frost.KeyShare)
+		for _, n := range online {
+			stored, err := n.store.GetCustodyShare(number)
+			if err != nil {
+				t.Fatalf("epoch %d: custodian %s has no share: %v", number, n.id[:8], err)
+			}
+			var share frost.KeyShare
+			if err := json.Unmarshal(stored.KeyShare, &share); err != nil {
+				t.Fatal(err)
+			}
+			shares[n.id] = &share
+			if number > 0 {
+				if _, err := n.store.GetCustodyShare(number - 1); !errors.Is(err, storage.ErrNotFound) {
+					t.Fatalf("epoch %d: custodian %s kept its share of epoch %d", number, n.id[:8], number-1)
+				}
+			}
+		}
+		signers := pick(shares, custody.Threshold(len(custodians)))
+		if err := sign(signers, groupKey); err != nil {
+			t.Fatalf("epoch %d: %v", number, err)
+		}
+
+		// A share of the previous epoch does not fit with the new ones
+		for id, old := range held {
+			if _, ok := shares[id]; ok || len(signers) == 0 {
+				continue
+			}
+			mixed := append([]*frost.KeyShare{{ID: signers[0].ID, Secret: old.Secret, Public: signers[0].Public}}, signers[1:]...)
+			var misbehavior *frost.MisbehaviorError
+			if err := sign(mixed, groupKey); !errors.As(err, &misbehavior) {
+				t.Fatalf("epoch %d: an old share signed with the new ones: %v", number, err)
+			}
+			break
+		}
+		held = shares
+	}
+}
+
+// onlineCustodians returns the custodians that are online.
+func onlineCustodians(net *network, custodians []storage.EpochMember) []*node {
+	var online []*node
+	for _, custodian := range custodians {
+		if !net.down(custodian.ComputerID) {
+			online = append(online, net.nodes[custodian.ComputerID])
+		}
+	}
+	return online
+}
+
+// waitForShares waits until every node holds a share of the key of an epoch.
+func waitForShares(t *testing.T, nodes []*node, number int64, within time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(within)
+	for _, n := range nodes {
+		for {
+			if _, err := n.store.GetCustodyShare(number); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("epoch %d: custodian %s holds no share after %v", number, n.id[:8], within)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+// pick returns t of the shares at random.
+func pick(shares map[string]*frost.KeyShare, t int) []*frost.KeyShare {
+	var picked []*frost.KeyShare
+	for _, share := range shares {
+		picked = append(picked, share)
+	}
+	mrand.Shuffle(len(picked), func(i, j int) { picked[i], picked[j] = picked[j], picked[i] })
+	if len(picked) > t {
+		picked = picked[:t]
+	}
+	return picked
+}
+
+// sign signs a random message with the shares and checks it as BIP340
+// against the x-only group key in hex.
+func sign(signers []*frost.KeyShare, groupKey string) error {
+	message := make([]byte, 32)
+	rand.Read(message)
+	nonces := make([]*frost.Nonces, len(signers))
+	commitments := make([]frost.Commitment, len(signers))
+	for i, share := range signers {
+		var err error
+		if nonces[i], err = frost.Commit(share, rand.Reader); err != nil {
+			return err
+		}
+		commitments[i] = nonces[i].Commitment()
+	}
+	pkg := frost.NewSigningPackage(message, commitments)
+	shares := make([]frost.SignatureShare, len(signers))
+	for i, share := range signers {
+		var err error
+		if shares[i], err = frost.Sign(share, nonces[i], pkg); err != nil {
+			return err
+		}
+	}
+	signature, err := frost.Aggregate(signers[0].Public, pkg, shares)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := schnorr.ParseSignature(signature)
+	if err != nil {
+		return err
+	}
+	xOnly, err := hex.DecodeString(groupKey)
+	if err != nil {
+		return err
+	}
+	publicKey, err := schnorr.ParsePubKey(xOnly)
+	if err != nil {
+		return err
+	}
+	if !parsed.Verify(message, publicKey) {
+		return errors.New("signature does not verify under the group key")
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package custody
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/frost"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// ErrInvalidMessage is returned for a custody message that does not come from
+// the node it names, is not signed by it or does not fit the handoff.
+var ErrInvalidMessage = errors.New("invalid custody message")
+
+// Message is one step of a handoff, sent between custodians. Exactly one
+// part is set.
+type Message struct {
+	Dealing      *Dealing            `json:"dealing,omitempty"`
+	Transcript   *Transcript         `json:"transcript,omitempty"`
+	Complaint    *Complaint          `json:"complaint,omitempty"`
+	Confirmation *Confirmation       `json:"confirmation,omitempty"`
+	Completion   *storage.CustodyKey `json:"completion,omitempty"`
+}
+
+// parts returns the number of parts set, which must be exactly one.
+func (m Message) parts() int {
+	n := 0
+	for _, set := range []bool{m.Dealing != nil, m.Transcript != nil, m.Complaint != nil, m.Confirmation != nil, m.Completion != nil} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// Dealing is what a dealer hands to the custodians of an epoch: the public
+// commitments and the share of each custodian, sealed to its node key.
+type Dealing struct {
+	Epoch     int64          `json:"epoch"` // epoch the key is handed to
+	From      int64          `json:"from"`  // epoch of the key being reshared, -1 for a new key
+	Dealer    string         `json:"dealer"`
+	Dealing   frost.Dealing  `json:"dealing"`
+	Shares    map[int]string `json:"shares"` // by signer id
+	Signature string         `json:"signature"`
+}
+
+// SignBytes returns the canonical form of the dealing that is signed.
+func (d Dealing) SignBytes() []byte {
+	d.Signature = ""
+	payload, _ := json.Marshal(d)
+	return payload
+}
+
+// Transcript is the coordinator's pick of the dealings every custodian must
+// finish with. A coordinator bumps Revision when it drops a dealer after a
+// complaint; the next coordinator starts a new Attempt.
+type Transcript struct {
+	Epoch       int64               `json:"epoch"`
+	Attempt     int                 `json:"attempt"`
+	Revision    int                 `json:"revision"`
+	Coordinator string              `json:"coordinator"`
+	Previous    *storage.CustodyKey `json:"previous,omitempty"` // key being reshared
+	Dealings    []Dealing           `json:"dealings"`           // by dealer
+	Signature   string              `json:"signature"`
+}
+
+// SignBytes returns the canonical form of the transcript that is signed.
+func (t Transcript) SignBytes() []byte {
+	t.Signature = ""
+	payload, _ := json.Marshal(t)
+	return payload
+}
+
+// Hash identifies the transcript.
+func (t Transcript) Hash() string {
+	hash := sha256.Sum256(t.SignBytes())
+	return hex.EncodeToString(hash[:])
+}
+
+// newer reports whether t comes after the attempt and revision given.
+func (t Transcript) newer(attempt, revision int) bool {
+	return t.Attempt > attempt || (t.Attempt == attempt && t.Revision > revision)
+}
+
+// Complaint tells the coordinator that a dealing in its transcript carries an
+// invalid share for the custodian complaining.
+type Complaint struct {
+	Epoch      int64  `json:"epoch"`
+	Transcript string `json:"transcript"`
+	Dealer     string `json:"dealer"`
+	Custodian  string `json:"custodian"`
+	Signature  string `json:"signature"`
+}
+
+// SignBytes returns the canonical form of the complaint that is signed.
+func (c Complaint) SignBytes() []byte {
+	c.Signature = ""
+	payload, _ := json.Marshal(c)
+	return payload
+}
+
+// Confirmation tells the coordinator that a custodian finished a transcript
+// and holds its share of the key with the given public keys.
+type Confirmation struct {
+	Epoch      int64  `json:"epoch"`
+	Transcript string `json:"transcript"`
+	PublicKeys string `json:"public_keys"` // hash of the public key package
+	Custodian  string `json:"custodian"`
+	Signature  string `json:"signature"`
+}
+
+// SignBytes returns the canonical form of the confirmation that is signed.
+func (c Confirmation) SignBytes() []byte {
+	c.Signature = ""
+	payload, _ := json.Marshal(c)
+	return payload
+}
+
+// Custodians returns the custodians of an epoch: group 1 in sort order.
+// Custodian i holds signer id i+1. Members without a public key are left out.
+func Custodians(epoch storage.Epoch) []storage.EpochMember {
+	var custodians []storage.EpochMember
+	for _, member := range epoch.Group(1) {
+		if member.PublicKey != "" {
+			custodians = append(custodians, member)
+		}
+	}
+	sort.Slice(custodians, func(i, j int) bool { return custodians[i].SortOrder < custodians[j].SortOrder })
+	return custodians
+}
+
+// Threshold returns the custodians needed to sign out of n: all but the
+// (n-1)/3 that may be faulty, 7 of 10.
+func Threshold(n int) int {
+	return n - (n-1)/3
+}
+
+// signerID returns the signer id of a node among members, or 0.
+func signerID(members []storage.EpochMember, computerID string) int {
+	for i, member := range members {
+		if member.ComputerID == computerID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// publicKeysHash returns the hash of a public key package.
+func publicKeysHash(public *frost.PublicKeyPackage) (string, error) {
+	data, err := json.Marshal(public)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// sameKeys reports whether two handoffs lead to the same public keys, even if
+// they complete different transcripts.
+func sameKeys(a, b storage.CustodyKey) bool {
+	var publicA, publicB frost.PublicKeyPackage
+	if json.Unmarshal(a.PublicKeys, &publicA) != nil || json.Unmarshal(b.PublicKeys, &publicB) != nil {
+		return false
+	}
+	hashA, errA := publicKeysHash(&publicA)
+	hashB, errB := publicKeysHash(&publicB)
+	return errA == nil && errB == nil && hashA == hashB
+}
+
+// VerifyKey checks a completed handoff against the custodians of its epoch:
+// the public keys fit them and a quorum of them confirmed that transcript
+// and those keys. It returns the public key package.
+func VerifyKey(key storage.CustodyKey, epoch storage.Epoch) (*frost.PublicKeyPackage, error) {
+	if key.Epoch != epoch.Number {
+		return nil, fmt.Errorf("%w: handoff to epoch %d checked against epoch %d", ErrInvalidMessage, key.Epoch, epoch.Number)
+	}
+	custodians := Custodians(epoch)
+	var public frost.PublicKeyPackage
+	if err := json.Unmarshal(key.PublicKeys, &public); err != nil {
+		return nil, fmt.Errorf("%w: invalid public keys: %v", ErrInvalidMessage, err)
+	}
+	if public.Threshold != Threshold(len(custodians)) || len(public.Shares) != len(custodians) {
+		return nil, fmt.Errorf("%w: public keys do not fit the %d custodians of epoch %d", ErrInvalidMessage, len(custodians), epoch.Number)
+	}
+	for id := 1; id <= len(custodians); id++ {
+		if public.Shares[id] == nil {
+			return nil, fmt.Errorf("%w: no verifying share for custodian %d", ErrInvalidMessage, id)
+		}
+	}
+	if key.GroupKey != hex.EncodeToString(public.XOnly()) {
+		return nil, fmt.Errorf("%w: group key does not match the public keys", ErrInvalidMessage)
+	}
+	hash, err := publicKeysHash(&public)
+	if err != nil {
+		return nil, err
+	}
+
+	var confirmations []Confirmation
+	if err := json.Unmarshal(key.Certificate, &confirmations); err != nil {
+		return nil, fmt.Errorf("%w: invalid certificate: %v", ErrInvalidMessage, err)
+	}
+	confirmed := make(map[string]bool)
+	for _, c := range confirmations {
+		id := signerID(custodians, c.Custodian)
+		if id == 0 || c.Epoch != key.Epoch || c.Transcript != key.Transcript || c.PublicKeys != hash {
+			return nil, fmt.Errorf("%w: certificate holds a confirmation of something else", ErrInvalidMessage)
+		}
+		if err := cryptoUtils.VerifyMessage(custodians[id-1].PublicKey, c.SignBytes(), c.Signature); err != nil {
+			return nil, fmt.Errorf("%w: confirmation from %s: %v", ErrInvalidMessage, c.Custodian, err)
+		}
+		confirmed[c.Custodian] = true
+	}
+	if len(confirmed) < public.Threshold {
+		return nil, fmt.Errorf("%w: %d confirmations, %d needed", ErrInvalidMessage, len(confirmed), public.Threshold)
+	}
+	return &public, nil
+}
+
+// shareContext binds a sealed share to its handoff, dealer and recipient.
+func shareContext(epoch int64, dealer, recipient int) []byte {
+	return []byte(fmt.Sprintf("peg custody share: epoch %d, dealer %d, recipient %d", epoch, dealer, recipient))
+}
+
+// sealKey derives the AES key shared by a node key and a peer's public key.
+func sealKey(key *btcec.PrivateKey, peerB64 string, context []byte) (cipher.AEAD, error) {
+	peerBytes, err := base64.StdEncoding.DecodeString(peerB64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+	peer, err := btcec.ParsePubKey(peerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	h := sha256.New()
+	h.Write(btcec.GenerateSharedSecret(key, peer))
+	h.Write(context)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts a share for the node with public key peerB64.
+func seal(key *btcec.PrivateKey, peerB64 string, context []byte, share btcec.ModNScalar, random io.Reader) (string, error) {
+	aead, err := sealKey(key, peerB64, context)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return "", fmt.Errorf("failed to read randomness: %w", err)
+	}
+	plain := share.Bytes()
+	return hex.EncodeToString(aead.Seal(nonce, nonce, plain[:], context)), nil
+}
+
+// unseal decrypts a share sealed by the node with public key peerB64.
+func unseal(key *btcec.PrivateKey, peerB64 string, context []byte, sealed string) (btcec.ModNScalar, error) {
+	var share btcec.ModNScalar
+	aead, err := sealKey(key, peerB64, context)
+	if err != nil {
+		return share, err
+	}
+	data, err := hex.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return share, errors.New("invalid sealed share")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], context)
+	if err != nil {
+		return share, fmt.Errorf("failed to open sealed share: %w", err)
+	}
+	return frost.DecodeScalar(hex.EncodeToString(plain))
+}
@@ -0,0 +1,122 @@
+package custody
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"bitcoin-sidechain/networkUtils"
+	"bitcoin-sidechain/storage"
+)
+
+// maxMessageSize bounds the body of a custody message; a transcript carries
+// every dealing.
+const maxMessageSize = 8 << 20
+
+// HTTPTransport posts messages to POST /custody on each peer and fetches
+// handoffs from GET /custody/latest.
+type HTTPTransport struct {
+	Outbound *networkUtils.Outbound
+}
+
+// NewHTTPTransport returns a transport that reaches peers through outbound.
+func NewHTTPTransport(outbound *networkUtils.Outbound) *HTTPTransport {
+	return &HTTPTransport{Outbound: outbound}
+}
+
+// Send sends the message to every peer concurrently.
+func (t *HTTPTransport) Send(peers []storage.EpochMember, message Message) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		fmt.Println("Custody: error encoding message:", err)
+		return
+	}
+	for _, peer := range peers {
+		go func(peer storage.EpochMember) {
+			req, err := t.Outbound.NewRequest(http.MethodPost, peer.IPAddress, "/custody", bytes.NewReader(body))
+			if err != nil {
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := t.Outbound.Open(req)
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}(peer)
+	}
+}
+
+// FetchLatest gets the latest completed handoff from a peer.
+func (t *HTTPTransport) FetchLatest(peer storage.EpochMember) (storage.CustodyKey, error) {
+	req, err := t.Outbound.NewRequest(http.MethodGet, peer.IPAddress, "/custody/latest", nil)
+	if err != nil {
+		return storage.CustodyKey{}, err
+	}
+	resp, err := t.Outbound.Open(req)
+	if err != nil {
+		return storage.CustodyKey{}, fmt.Errorf("failed to fetch the latest handoff from %s: %w", peer.IPAddress, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return storage.CustodyKey{}, storage.ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return storage.CustodyKey{}, fmt.Errorf("failed to fetch the latest handoff from %s: status %d", peer.IPAddress, resp.StatusCode)
+	}
+	var key storage.CustodyKey
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxMessageSize)).Decode(&key); err != nil {
+		return storage.CustodyKey{}, fmt.Errorf("failed to decode the latest handoff from %s: %w", peer.IPAddress, err)
+	}
+	return key, nil
+}
+
+// Handler returns the POST /custody endpoint that feeds messages to a manager.
+func Handler(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var message Message
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxMessageSize)).Decode(&message); err != nil {
+			http.Error(w, "Invalid custody message", http.StatusBadRequest)
+			return
+		}
+		if message.parts() != 1 {
+			http.Error(w, "Expected a dealing, a transcript, a complaint, a confirmation or a completion", http.StatusBadRequest)
+			return
+		}
+		if err := m.Receive(message); err != nil {
+			fmt.Println("Custody:", err)
+			if errors.Is(err, ErrInvalidMessage) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// LatestHandler returns the GET /custody/latest endpoint: the latest
+// completed handoff with the group key, the verifying shares and the
+// confirmations of the custodians.
+func LatestHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := store.LatestCustodyKey()
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "No handoff completed yet", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println("Custody: error reading the latest handoff:", err)
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(key); err != nil {
+			fmt.Println("Error encoding response:", err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Package epoch rotates the leader group. Epochs are counted in blocks so
+// every node agrees on where they start: epoch e begins with block e*length,
+// and its nodes are shuffled with the hash of that block as the seed (epoch 0
+// uses the zero hash). The nodes are the genesis nodes plus the admissions
+// and less the evictions of the blocks up to that one, so they do not depend
+// on when a node computes the epoch. Group 1 of each epoch starts as the
+// active leaders.
+package epoch
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/storage"
+)
+
+// Event is emitted when a new epoch starts.
+type Event struct {
+	Epoch    storage.Epoch
+	Previous int64 // number of the epoch it replaces, -1 for the first epoch
+}
+
+// Manager starts new epochs as the chain grows and notifies subscribers.
+type Manager struct {
+	store     storage.Store
+	length    int64
+	groupSize int
+
+	mu          sync.Mutex // serializes Advance
+	subscribers []func(Event)
+}
+
+// NewManager returns a manager for epochs of length blocks with groups of
+// groupSize nodes.
+func NewManager(store storage.Store, length int64, groupSize int) *Manager {
+	if length <= 0 {
+		length = 1
+	}
+	if groupSize <= 0 {
+		groupSize = 1
+	}
+	return &Manager{store: store, length: length, groupSize: groupSize}
+}
+
+// Length returns the number of blocks in an epoch.
+func (m *Manager) Length() int64 {
+	return m.length
+}
+
+// EpochAt returns the epoch that a block height belongs to.
+func (m *Manager) EpochAt(height int64) int64 {
+	return height / m.length
+}
+
+// Subscribe registers a handler called for every new epoch, in order. Handlers
+// run on the manager's goroutine and must not block or call Advance.
+func (m *Manager) Subscribe(handler func(Event)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscribers = append(m.subscribers, handler)
+}
+
+// Current returns the latest stored epoch.
+func (m *Manager) Current() (storage.Epoch, error) {
+	return m.store.LatestEpoch()
+}
+
+// Advance starts every epoch whose first block has been committed but which
+// is not stored yet, oldest first, and returns how many were started. A node
+// that was offline across several boundaries catches up in one call.
+func (m *Manager) Advance() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Find the epoch of the latest block
+	var height int64
+	block, err := m.store.LatestBlock()
+	switch {
+	case err == nil:
+		height = block.Height
+	case !errors.Is(err, storage.ErrNotFound):
+		return 0, fmt.Errorf("failed to read latest block: %w", err)
+	}
+	target := m.EpochAt(height)
+
+	// Find the first epoch that is not stored yet
+	previous := int64(-1)
+	latest, err := m.store.LatestEpoch()
+	switch {
+	case err == nil:
+		previous = latest.Number
+	case !errors.Is(err, storage.ErrNotFound):
+		return 0, fmt.Errorf("failed to read latest epoch: %w", err)
+	}
+
+	started := 0
+	for number := previous + 1; number <= target; number++ {
+		epoch, err := m.startEpoch(number)
+		if err != nil {
+			return started, err
+		}
+		started++
+		for _, handler := range m.subscribers {
+			handler(Event{Epoch: epoch, Previous: number - 1})
+		}
+	}
+	return started, nil
+}
+
+// startEpoch shuffles the nodes for an epoch and stores the assignment.
+func (m *Manager) startEpoch(number int64) (storage.Epoch, error) {
+	startHeight := number * m.length
+
+	// Seed the shuffle with the hash of the epoch's first block
+	seed := storage.ZeroHash
+	var first storage.Block
+	if startHeight > 0 {
+		block, err := m.store.GetBlock(startHeight)
+		if err != nil {
+			return storage.Epoch{}, fmt.Errorf("failed to read block %d: %w", startHeight, err)
+		}
+		seed, first = block.Hash, block
+	}
+	seedBytes, err := hex.DecodeString(seed)
+	if err != nil {
+		return storage.Epoch{}, fmt.Errorf("invalid seed for epoch %d: %w", number, err)
+	}
+
+	// The members are the nodes of the chain as of the epoch's first block,
+	// less the nodes that block leaves out for poor liveness
+	members, err := m.members(number)
+	if err != nil {
+		return storage.Epoch{}, err
+	}
+	excluded := make(map[string]bool)
+	for _, computerID := range first.Excluded {
+		excluded[computerID] = true
+	}
+	var nodes []storage.Node
+	for _, node := range members {
+		if !excluded[node.ComputerID] {
+			nodes = append(nodes, node)
+		}
+	}
+	assigned := cryptoUtils.ShuffleNodes(nodes, seedBytes, m.groupSize)
+
+	epoch := storage.Epoch{
+		Number:      number,
+		StartHeight: startHeight,
+		Seed:        seed,
+		GroupSize:   m.groupSize,
+		ActiveGroup: 1,
+	}
+	if err := m.store.SaveEpoch(epoch, assigned); err != nil {
+		return storage.Epoch{}, err
+	}
+	return m.store.GetEpoch(number)
+}
+
+// members returns the nodes of the chain as of the first block of an epoch.
+// Epoch 0 takes the genesis nodes from the nodes table, which still holds
+// them all since the epoch is started before any block is committed. Every
+// later epoch takes the members of epoch 0 and replays the admissions and
+// evictions of the blocks that started the epochs since, the only blocks
+// that carry them. The nodes table is not used past epoch 0: a node catching
+// up on several epochs at once has already applied the later evictions to it.
+func (m *Manager) members(number int64) ([]storage.Node, error) {
+	if number == 0 {
+		listed, err := m.store.ListNodes()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read nodes: %w", err)
+		}
+		var nodes []storage.Node
+		for _, node := range listed {
+			if node.AdmittedHeight == 0 {
+				nodes = append(nodes, node)
+			}
+		}
+		return nodes, nil
+	}
+
+	genesis, err := m.store.GetEpoch(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read epoch 0: %w", err)
+	}
+	byID := make(map[string]storage.Node, len(genesis.Members))
+	for _, member := range genesis.Members {
+		byID[member.ComputerID] = storage.Node{ComputerID: member.ComputerID, IPAddress: member.IPAddress, PublicKey: member.PublicKey}
+	}
+	for n := int64(1); n <= number; n++ {
+		height := n * m.length
+		block, err := m.store.GetBlock(height)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read block %d: %w", height, err)
+		}
+		for _, admission := range block.Admissions {
+			byID[admission.ComputerID] = storage.Node{ComputerID: admission.ComputerID, IPAddress: admission.IPAddress, PublicKey: admission.PublicKey, AdmittedHeight: height}
+		}
+		for _, computerID := range block.Evictions {
+			delete(byID, computerID)
+		}
+	}
+
+	nodes := make([]storage.Node, 0, len(byID))
+	for _, node := range byID {
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// Run calls Advance on every tick until stop is closed.
+func (m *Manager) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := m.Advance(); err != nil {
+			fmt.Println("Error advancing epoch:", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package epoch
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"bitcoin-sidechain/storage"
+)
+
+func openStore(t *testing.T, name string) storage.Store {
+	t.Helper()
+	store, err := storage.Open("sqlite3", filepath.Join(t.TempDir(), name+".db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	genesis := storage.Genesis{}
+	for i := 1; i <= 4; i++ {
+		genesis.Nodes = append(genesis.Nodes, storage.GenesisNode{
+			ComputerID: fmt.Sprintf("%064x", i),
+			IPAddress:  fmt.Sprintf("10.0.0.%d:8080", i),
+			PublicKey:  fmt.Sprintf("key%d", i),
+		})
+	}
+	if _, err := store.ApplyGenesis(genesis); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func memberIDs(epoch storage.Epoch) []string {
+	var ids []string
+	for _, member := range epoch.Members {
+		ids = append(ids, fmt.Sprintf("%s/%d/%d", member.ComputerID, member.NodeGroup, member.SortOrder))
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// A node that catches up on several epochs at once must shuffle them from the
+// same members as the node that started each epoch as its first block came.
+func TestCatchUpShufflesTheSameMembers(t *testing.T) {
+	live, late := openStore(t, "live"), openStore(t, "late")
+	liveEpochs, lateEpochs := NewManager(live, 2, 2), NewManager(late, 2, 2)
+	for _, m := range []*Manager{liveEpochs, lateEpochs} {
+		if _, err := m.Advance(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	admitted := storage.Admission{ComputerID: fmt.Sprintf("%064x", 5), IPAddress: "10.0.0.5:8080", PublicKey: "key5"}
+	changes := map[int64]storage.MembershipChanges{
+		2: {Admissions: []storage.Admission{admitted}},
+		4: {Evictions: []string{fmt.Sprintf("%064x", 1)}, Excluded: []string{fmt.Sprintf("%064x", 2)}},
+	}
+	var blocks []storage.Block
+	for height := int64(1); height <= 5; height++ {
+		block, _, err := live.ProduceBlock("live", time.Now().Unix(), nil, changes[height], storage.PegChanges{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := liveEpochs.Advance(); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+
+	for _, block := range blocks {
+		if err := late.CommitBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if started, err := lateEpochs.Advance(); err != nil || started != 2 {
+		t.Fatalf("catching up started %d epochs: %v", started, err)
+	}
+
+	for number, want := range map[int64]int{1: 5, 2: 3} {
+		expected, err := live.GetEpoch(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := late.GetEpoch(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expected.Members) != want {
+			t.Errorf("epoch %d has %d members, expected %d", number, len(expected.Members), want)
+		}
+		if got.Seed != expected.Seed || !slices.Equal(memberIDs(got), memberIDs(expected)) {
+			t.Errorf("epoch %d differs after catching up:\n got %v\nwant %v", number, memberIDs(got), memberIDs(expected))
+		}
+	}
+}
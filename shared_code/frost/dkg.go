@@ -0,0 +1,355 @@
+package frost
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+const tagProof = "FROST-secp256k1/pok"
+
+// Handoff describes one run of key generation or of resharing, so that every
+// participant checks the same things:
+//
+//   - Key generation (Previous is nil, Pedersen's DKG with Feldman VSS): every
+//     recipient also deals. Dealer i picks a random polynomial f_i of degree
+//     t-1, publishes the commitments C_ik = a_ik·G to its coefficients with a
+//     proof that it knows a_i0, and hands f_i(j) to recipient j. The secret
+//     is Σ f_i(0) over the dealings used and nobody ever holds it.
+//   - Resharing: dealers are t or more holders of a share of Previous. Dealer
+//     i deals its share s_i with a polynomial g_i where g_i(0) = s_i, so
+//     C_i0 must be its verifying share Y_i. Recipient j gets Σ λ_i·g_i(j),
+//     which is a share of the same key on a new polynomial. Old and new
+//     shares do not combine, and the key is never rebuilt.
+//
+// Recipient j checks f_i(j) against the commitments: f_i(j)·G = Σ j^k·C_ik.
+// A dealing that fails the check is pinned on its dealer. Every recipient
+// must finish with the same dealings for the shares to fit together; picking
+// them is up to the caller.
+type Handoff struct {
+	Context    []byte            // binds the proofs to this run
+	Previous   *PublicKeyPackage // key being reshared, nil for a new key
+	Threshold  int               // threshold of the new shares
+	Recipients []int             // signer ids of the new shares
+}
+
+// Dealing is the public part of what a dealer hands out.
+type Dealing struct {
+	Dealer      int
+	Commitments []*btcec.PublicKey // C_k = a_k·G, constant term first
+	Proof       *Proof             // knowledge of a_0, for key generation only
+}
+
+// Proof is a Schnorr proof of knowledge of the discrete log of a commitment.
+type Proof struct {
+	R *btcec.PublicKey
+	Z btcec.ModNScalar
+}
+
+// Dealers returns how many dealings a run needs at least: the old threshold
+// for a resharing, the new one for a key generation so that at least one of
+// them is honest.
+func (h Handoff) Dealers() int {
+	if h.Previous != nil {
+		return h.Previous.Threshold
+	}
+	return h.Threshold
+}
+
+// Deal makes the dealing of dealer and the share of each recipient. share is
+// the dealer's share of Previous for a resharing and nil for a key generation.
+func (h Handoff) Deal(dealer int, share *KeyShare, random io.Reader) (Dealing, map[int]btcec.ModNScalar, error) {
+	if err := h.check(); err != nil {
+		return Dealing{}, nil, err
+	}
+	var secret *btcec.ModNScalar
+	if h.Previous != nil {
+		if share == nil || share.ID != dealer || share.Public.GroupKey == nil || !share.Public.GroupKey.IsEqual(h.Previous.GroupKey) {
+			return Dealing{}, nil, fmt.Errorf("dealer %d has no share of the key being reshared", dealer)
+		}
+		secret = &share.Secret
+	}
+	f, err := randomPolynomial(secret, h.Threshold-1, random)
+	if err != nil {
+		return Dealing{}, nil, err
+	}
+
+	dealing := Dealing{Dealer: dealer, Commitments: make([]*btcec.PublicKey, len(f))}
+	for k := range f {
+		dealing.Commitments[k] = publicKey(base(&f[k]))
+	}
+	if h.Previous == nil {
+		if dealing.Proof, err = h.prove(dealer, &f[0], dealing.Commitments[0], random); err != nil {
+			return Dealing{}, nil, err
+		}
+	}
+	shares := make(map[int]btcec.ModNScalar, len(h.Recipients))
+	for _, id := range h.Recipients {
+		shares[id] = f.evaluate(id)
+	}
+	return dealing, shares, nil
+}
+
+// Check verifies the public part of a dealing: its size, and its proof for a
+// key generation or its constant term for a resharing.
+func (h Handoff) Check(d Dealing) error {
+	if err := h.check(); err != nil {
+		return err
+	}
+	if len(d.Commitments) != h.Threshold {
+		return fmt.Errorf("dealer %d committed to %d coefficients, %d expected", d.Dealer, len(d.Commitments), h.Threshold)
+	}
+	for _, c := range d.Commitments {
+		if c == nil {
+			return fmt.Errorf("dealer %d sent an empty commitment", d.Dealer)
+		}
+	}
+	if h.Previous != nil {
+		old, ok := h.Previous.Shares[d.Dealer]
+		if !ok {
+			return fmt.Errorf("dealer %d has no share of the key being reshared", d.Dealer)
+		}
+		if !d.Commitments[0].IsEqual(old) {
+			return fmt.Errorf("dealer %d did not deal its own share", d.Dealer)
+		}
+		return nil
+	}
+	if d.Proof == nil || d.Proof.R == nil {
+		return fmt.Errorf("dealer %d sent no proof of knowledge", d.Dealer)
+	}
+	c := h.proofChallenge(d.Dealer, d.Commitments[0], d.Proof.R)
+	if !equal(base(&d.Proof.Z), add(jacobian(d.Proof.R), mul(&c, jacobian(d.Commitments[0])))) {
+		return fmt.Errorf("dealer %d sent an invalid proof of knowledge", d.Dealer)
+	}
+	return nil
+}
+
+// CheckShare verifies a recipient's share against the dealing's commitments.
+func (h Handoff) CheckShare(d Dealing, recipient int, share btcec.ModNScalar) error {
+	if len(d.Commitments) == 0 {
+		return fmt.Errorf("dealer %d committed to nothing", d.Dealer)
+	}
+	if !equal(base(&share), d.shareKey(recipient)) {
+		return fmt.Errorf("share of recipient %d from dealer %d does not match its commitments", recipient, d.Dealer)
+	}
+	return nil
+}
+
+// Result returns the public key package that the dealings lead to. Anyone can
+// compute it, recipient or not.
+func (h Handoff) Result(dealings []Dealing) (*PublicKeyPackage, error) {
+	dealers, err := h.dealers(dealings)
+	if err != nil {
+		return nil, err
+	}
+	weights := h.weights(dealers)
+
+	// Combine the weighted commitments into the commitments of the new
+	// polynomial, then evaluate that for each recipient
+	combined := make([]btcec.JacobianPoint, h.Threshold)
+	for i, d := range dealings {
+		for k := range combined {
+			combined[k] = add(combined[k], mul(&weights[i], jacobian(d.Commitments[k])))
+		}
+	}
+	shares := make(map[int]*btcec.PublicKey, len(h.Recipients))
+	for _, id := range h.Recipients {
+		x := scalar(id)
+		var key btcec.JacobianPoint
+		for k := len(combined) - 1; k >= 0; k-- {
+			key = add(mul(&x, key), combined[k])
+		}
+		shares[id] = publicKey(key)
+	}
+	groupKey := combined[0]
+	if infinity(groupKey) {
+		return nil, errors.New("group key is the point at infinity")
+	}
+
+	public := &PublicKeyPackage{Threshold: h.Threshold, GroupKey: publicKey(groupKey), Shares: shares}
+	if h.Previous != nil && !public.GroupKey.IsEqual(h.Previous.GroupKey) {
+		return nil, errors.New("resharing changed the group key")
+	}
+	return public, nil
+}
+
+// Finish returns the key share of recipient from the dealings and the shares
+// it got from their dealers, by dealer. It checks every share first.
+func (h Handoff) Finish(recipient int, dealings []Dealing, shares map[int]btcec.ModNScalar) (*KeyShare, error) {
+	public, err := h.Result(dealings)
+	if err != nil {
+		return nil, err
+	}
+	if public.Shares[recipient] == nil {
+		return nil, fmt.Errorf("%d is not a recipient", recipient)
+	}
+	dealers, _ := h.dealers(dealings)
+	weights := h.weights(dealers)
+
+	var secret btcec.ModNScalar
+	for i, d := range dealings {
+		share, ok := shares[d.Dealer]
+		if !ok {
+			return nil, fmt.Errorf("no share from dealer %d", d.Dealer)
+		}
+		if err := h.CheckShare(d, recipient, share); err != nil {
+			return nil, &MisbehaviorError{Signers: []int{d.Dealer}}
+		}
+		share.Mul(&weights[i])
+		secret.Add(&share)
+	}
+	return &KeyShare{ID: recipient, Secret: secret, Public: public}, nil
+}
+
+// check verifies the run itself.
+func (h Handoff) check() error {
+	if h.Threshold < 1 || h.Threshold > len(h.Recipients) {
+		return fmt.Errorf("threshold %d with %d recipients", h.Threshold, len(h.Recipients))
+	}
+	seen := make(map[int]bool)
+	for _, id := range h.Recipients {
+		if id < 1 || id >= MaxSigners || seen[id] {
+			return fmt.Errorf("invalid recipient %d", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// dealers checks a set of dealings and returns their dealers in order.
+func (h Handoff) dealers(dealings []Dealing) ([]int, error) {
+	if len(dealings) < h.Dealers() {
+		return nil, fmt.Errorf("%d dealings, %d needed", len(dealings), h.Dealers())
+	}
+	dealers := make([]int, len(dealings))
+	var invalid []int
+	for i, d := range dealings {
+		if i > 0 && d.Dealer <= dealings[i-1].Dealer {
+			return nil, errors.New("dealings must be sorted by dealer without repeats")
+		}
+		if err := h.Check(d); err != nil {
+			invalid = append(invalid, d.Dealer)
+		}
+		dealers[i] = d.Dealer
+	}
+	if len(invalid) > 0 {
+		return nil, &MisbehaviorError{Signers: invalid}
+	}
+	return dealers, nil
+}
+
+// weights returns the factor of each dealing: 1 for a key generation, the
+// dealer's Lagrange coefficient for a resharing.
+func (h Handoff) weights(dealers []int) []btcec.ModNScalar {
+	weights := make([]btcec.ModNScalar, len(dealers))
+	for i, dealer := range dealers {
+		if h.Previous != nil {
+			weights[i] = lagrange(dealers, dealer)
+		} else {
+			weights[i] = scalar(1)
+		}
+	}
+	return weights
+}
+
+// prove returns a proof of knowledge of secret, bound to the run and dealer.
+func (h Handoff) prove(dealer int, secret *btcec.ModNScalar, commitment *btcec.PublicKey, random io.Reader) (*Proof, error) {
+	k, err := randomScalar(random)
+	if err != nil {
+		return nil, err
+	}
+	r := publicKey(base(&k))
+	c := h.proofChallenge(dealer, commitment, r)
+	z := *c.Mul(secret).Add(&k)
+	return &Proof{R: r, Z: z}, nil
+}
+
+func (h Handoff) proofChallenge(dealer int, commitment, r *btcec.PublicKey) btcec.ModNScalar {
+	return hashToScalar(tagProof, h.Context, idBytes(dealer), commitment.SerializeCompressed(), r.SerializeCompressed())
+}
+
+// shareKey returns f(id)·G from the commitments: Σ id^k·C_k.
+func (d Dealing) shareKey(id int) btcec.JacobianPoint {
+	x := scalar(id)
+	var key btcec.JacobianPoint
+	for k := len(d.Commitments) - 1; k >= 0; k-- {
+		key = add(mul(&x, key), jacobian(d.Commitments[k]))
+	}
+	return key
+}
+
+// SortDealings sorts dealings by dealer, as Result and Finish expect.
+func SortDealings(dealings []Dealing) {
+	sort.Slice(dealings, func(i, j int) bool { return dealings[i].Dealer < dealings[j].Dealer })
+}
+
+type dealingJSON struct {
+	Dealer      int      `json:"dealer"`
+	Commitments []string `json:"commitments"`
+	Proof       *struct {
+		R string `json:"r"`
+		Z string `json:"z"`
+	} `json:"proof,omitempty"`
+}
+
+// MarshalJSON encodes the commitments as compressed hex points.
+func (d Dealing) MarshalJSON() ([]byte, error) {
+	out := dealingJSON{Dealer: d.Dealer, Commitments: make([]string, len(d.Commitments))}
+	for k, c := range d.Commitments {
+		if c == nil {
+			return nil, errors.New("empty commitment")
+		}
+		out.Commitments[k] = encodePoint(c)
+	}
+	if d.Proof != nil {
+		out.Proof = &struct {
+			R string `json:"r"`
+			Z string `json:"z"`
+		}{encodePoint(d.Proof.R), encodeScalar(&d.Proof.Z)}
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes a dealing written by MarshalJSON.
+func (d *Dealing) UnmarshalJSON(data []byte) error {
+	var in dealingJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	out := Dealing{Dealer: in.Dealer, Commitments: make([]*btcec.PublicKey, len(in.Commitments))}
+	for k, s := range in.Commitments {
+		c, err := decodePoint(s)
+		if err != nil {
+			return err
+		}
+		out.Commitments[k] = c
+	}
+	if in.Proof != nil {
+		r, err := decodePoint(in.Proof.R)
+		if err != nil {
+			return err
+		}
+		z, err := decodeScalar(in.Proof.Z)
+		if err != nil {
+			return err
+		}
+		out.Proof = &Proof{R: r, Z: z}
+	}
+	*d = out
+	return nil
+}
+
+// EncodeScalar returns the 32-byte hex form of a scalar, for shares sent
+// between nodes.
+func EncodeScalar(k btcec.ModNScalar) string {
+	return encodeScalar(&k)
+}
+
+// DecodeScalar parses a scalar written by EncodeScalar.
+func DecodeScalar(s string) (btcec.ModNScalar, error) {
+	return decodeScalar(s)
+}
@@ -0,0 +1,86 @@
+package frost_test
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"bitcoin-sidechain/frost"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// A dealer that hands out a bad share is named, and resharing 3 of 4 to 2 of
+// 3 keeps the group key.
+func TestHandoff(t *testing.T) {
+	generate := frost.Handoff{Context: []byte("check"), Threshold: 3, Recipients: []int{1, 2, 3, 4}}
+	dealings := make([]frost.Dealing, 4)
+	shares := make(map[int]map[int]btcec.ModNScalar) // by recipient, then dealer
+	for _, id := range generate.Recipients {
+		shares[id] = make(map[int]btcec.ModNScalar)
+	}
+	for i, dealer := range generate.Recipients {
+		dealing, dealt, err := generate.Deal(dealer, nil, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dealings[i] = dealing
+		for id, share := range dealt {
+			shares[id][dealer] = share
+		}
+	}
+
+	// Dealer 2 hands recipient 1 a bad share
+	bad := shares[1][2]
+	bad.Add(new(btcec.ModNScalar).SetInt(1))
+	shares[1][2] = bad
+	var misbehavior *frost.MisbehaviorError
+	if _, err := generate.Finish(1, dealings, shares[1]); !errors.As(err, &misbehavior) || misbehavior.Signers[0] != 2 {
+		t.Fatalf("bad share from dealer 2 not named: %v", err)
+	}
+
+	// The others finish and reshare
+	var old []*frost.KeyShare
+	for _, id := range []int{2, 3, 4} {
+		share, err := generate.Finish(id, dealings, shares[id])
+		if err != nil {
+			t.Fatal(err)
+		}
+		old = append(old, share)
+	}
+	reshare := frost.Handoff{Context: []byte("check reshare"), Previous: old[0].Public, Threshold: 2, Recipients: []int{1, 2, 3}}
+	var redealings []frost.Dealing
+	reshares := make(map[int]map[int]btcec.ModNScalar)
+	for _, share := range old {
+		dealing, dealt, err := reshare.Deal(share.ID, share, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		redealings = append(redealings, dealing)
+		for id, s := range dealt {
+			if reshares[id] == nil {
+				reshares[id] = make(map[int]btcec.ModNScalar)
+			}
+			reshares[id][share.ID] = s
+		}
+	}
+	var fresh []*frost.KeyShare
+	for _, id := range reshare.Recipients {
+		share, err := reshare.Finish(id, redealings, reshares[id])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fresh = append(fresh, share)
+	}
+	if !fresh[0].Public.GroupKey.IsEqual(old[0].Public.GroupKey) {
+		t.Fatal("resharing changed the group key")
+	}
+	if err := fresh[0].Public.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new shares sign for the old key
+	if _, err := sign(fresh[:2], randomMessage(), nil); err != nil {
+		t.Fatalf("signing with reshared shares: %v", err)
+	}
+}
@@ -0,0 +1,371 @@
+// Package frost implements FROST threshold Schnorr signatures over secp256k1
+// that verify as plain BIP340 signatures. The peg wallet key is shared among
+// the n members of the active group so that any t of them can sign for it and
+// no fewer than t learn anything about it.
+//
+// Keys: the group key is Y = s·G for a secret s that is never assembled. Signer
+// i (i = 1..n) holds the share s_i = f(i) of a polynomial f of degree t-1 with
+// f(0) = s, and everyone knows the verifying shares Y_i = s_i·G. Deal splits a
+// key with a trusted dealer that knows it. A Handoff generates a key with no
+// dealer at all, or passes an existing key to a new set of signers.
+//
+// Signing takes two rounds, run by a coordinator that may be any node:
+//
+//  1. Every signer picks fresh nonces d_i and e_i with Commit and publishes
+//     the commitments D_i = d_i·G and E_i = e_i·G.
+//  2. The coordinator picks t or more commitments and sends them with the
+//     32-byte message to those signers as a SigningPackage. Each signer
+//     answers with a SignatureShare z_i from Sign, which consumes its nonces.
+//
+// Aggregate checks every share against the signer's commitments and Y_i, names
+// the signers whose shares are invalid, and adds the shares up into a 64-byte
+// BIP340 signature that is verified against the x-only group key.
+//
+// The binding factor of signer i is ρ_i = H(Y, H(m), H(commitments), i), the
+// group nonce is R = Σ D_i + ρ_i·E_i, the challenge is the BIP340 challenge
+// c = H(x(R), x(Y), m) and z_i = d_i + ρ_i·e_i + λ_i·c·s_i, where λ_i is the
+// Lagrange coefficient of i in the signing set. BIP340 only knows points with
+// an even y, so signers negate their nonces if R has an odd y and their share
+// if Y has one.
+package frost
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// Tags of the hashes used by the protocol.
+const (
+	tagNonce     = "FROST-secp256k1/nonce"
+	tagRho       = "FROST-secp256k1/rho"
+	tagMessage   = "FROST-secp256k1/msg"
+	tagCommit    = "FROST-secp256k1/com"
+	tagChallenge = "BIP0340/challenge"
+)
+
+// MaxSigners is the largest number of shares a key can be split into.
+const MaxSigners = 1 << 16
+
+// PublicKeyPackage is what everyone knows about a shared key.
+type PublicKeyPackage struct {
+	Threshold int                      // signers needed for a signature
+	GroupKey  *btcec.PublicKey         // Y
+	Shares    map[int]*btcec.PublicKey // verifying share Y_i of each signer
+}
+
+// XOnly returns the 32-byte BIP340 form of the group key.
+func (p *PublicKeyPackage) XOnly() []byte {
+	return schnorr.SerializePubKey(p.GroupKey)
+}
+
+// Check verifies that the verifying shares belong to the group key: any
+// Threshold of them interpolate to Y. It checks the first Threshold signers.
+func (p *PublicKeyPackage) Check() error {
+	if p.Threshold < 1 || p.Threshold > len(p.Shares) {
+		return fmt.Errorf("threshold %d with %d signers", p.Threshold, len(p.Shares))
+	}
+	ids := sortedIDs(p.Shares)[:p.Threshold]
+	var sum btcec.JacobianPoint
+	for _, id := range ids {
+		lambda := lagrange(ids, id)
+		term := mul(&lambda, jacobian(p.Shares[id]))
+		sum = add(sum, term)
+	}
+	if !equal(sum, jacobian(p.GroupKey)) {
+		return errors.New("verifying shares do not match the group key")
+	}
+	return nil
+}
+
+// KeyShare is one signer's part of a shared key.
+type KeyShare struct {
+	ID     int
+	Secret btcec.ModNScalar // s_i
+	Public *PublicKeyPackage
+}
+
+// Deal splits secret among n signers so that any threshold of them can sign.
+// A random secret is used if secret is nil. Whoever runs Deal knows the key,
+// so it is meant for keys that already exist in one place and for checks.
+func Deal(secret *btcec.ModNScalar, threshold, n int, random io.Reader) ([]*KeyShare, error) {
+	if threshold < 1 || threshold > n || n >= MaxSigners {
+		return nil, fmt.Errorf("cannot split a key %d of %d", threshold, n)
+	}
+	f, err := randomPolynomial(secret, threshold-1, random)
+	if err != nil {
+		return nil, err
+	}
+
+	public := &PublicKeyPackage{
+		Threshold: threshold,
+		GroupKey:  publicKey(base(&f[0])),
+		Shares:    make(map[int]*btcec.PublicKey, n),
+	}
+	shares := make([]*KeyShare, n)
+	for i := range shares {
+		id := i + 1
+		shares[i] = &KeyShare{ID: id, Secret: f.evaluate(id), Public: public}
+		public.Shares[id] = publicKey(base(&shares[i].Secret))
+	}
+	return shares, nil
+}
+
+// polynomial holds coefficients from the constant term up.
+type polynomial []btcec.ModNScalar
+
+// randomPolynomial returns a random polynomial of the given degree whose
+// constant term is secret, or random if secret is nil.
+func randomPolynomial(secret *btcec.ModNScalar, degree int, random io.Reader) (polynomial, error) {
+	f := make(polynomial, degree+1)
+	for i := range f {
+		if i == 0 && secret != nil {
+			f[0].Set(secret)
+			continue
+		}
+		k, err := randomScalar(random)
+		if err != nil {
+			return nil, err
+		}
+		f[i] = k
+	}
+	if f[0].IsZero() {
+		return nil, errors.New("secret is zero")
+	}
+	return f, nil
+}
+
+// evaluate returns f(x).
+func (f polynomial) evaluate(x int) btcec.ModNScalar {
+	xs := scalar(x)
+	var y btcec.ModNScalar
+	for i := len(f) - 1; i >= 0; i-- {
+		y.Mul(&xs).Add(&f[i])
+	}
+	return y
+}
+
+// lagrange returns the coefficient of id when interpolating f(0) from the
+// values of the signers in ids: the product of j/(j-id) over the other j.
+func lagrange(ids []int, id int) btcec.ModNScalar {
+	num, den := scalar(1), scalar(1)
+	x := scalar(id)
+	for _, j := range ids {
+		if j == id {
+			continue
+		}
+		xj := scalar(j)
+		var diff btcec.ModNScalar
+		diff.NegateVal(&x).Add(&xj)
+		num.Mul(&xj)
+		den.Mul(&diff)
+	}
+	den.InverseNonConst()
+	return *num.Mul(&den)
+}
+
+func scalar(i int) btcec.ModNScalar {
+	var s btcec.ModNScalar
+	s.SetInt(uint32(i))
+	return s
+}
+
+// randomScalar reads a uniform non-zero scalar from random.
+func randomScalar(random io.Reader) (btcec.ModNScalar, error) {
+	var k btcec.ModNScalar
+	var buf [32]byte
+	for {
+		if _, err := io.ReadFull(random, buf[:]); err != nil {
+			return k, fmt.Errorf("failed to read randomness: %w", err)
+		}
+		if overflow := k.SetBytes(&buf); overflow == 0 && !k.IsZero() {
+			return k, nil
+		}
+	}
+}
+
+// taggedHash is the BIP340 tagged hash SHA-256(SHA-256(tag) || SHA-256(tag) || parts).
+func taggedHash(tag string, parts ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// hashToScalar reduces a tagged hash modulo the group order.
+func hashToScalar(tag string, parts ...[]byte) btcec.ModNScalar {
+	var k btcec.ModNScalar
+	k.SetByteSlice(taggedHash(tag, parts...))
+	return k
+}
+
+// idBytes encodes a signer id as 4 bytes big-endian.
+func idBytes(id int) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(id))
+	return b[:]
+}
+
+func jacobian(key *btcec.PublicKey) btcec.JacobianPoint {
+	var p btcec.JacobianPoint
+	key.AsJacobian(&p)
+	return p
+}
+
+func publicKey(p btcec.JacobianPoint) *btcec.PublicKey {
+	p.ToAffine()
+	return btcec.NewPublicKey(&p.X, &p.Y)
+}
+
+func base(k *btcec.ModNScalar) btcec.JacobianPoint {
+	var p btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(k, &p)
+	return p
+}
+
+func mul(k *btcec.ModNScalar, p btcec.JacobianPoint) btcec.JacobianPoint {
+	var r btcec.JacobianPoint
+	btcec.ScalarMultNonConst(k, &p, &r)
+	return r
+}
+
+func add(a, b btcec.JacobianPoint) btcec.JacobianPoint {
+	var r btcec.JacobianPoint
+	btcec.AddNonConst(&a, &b, &r)
+	return r
+}
+
+// negate returns -p, which must be in affine form.
+func negate(p btcec.JacobianPoint) btcec.JacobianPoint {
+	p.Y.Negate(1).Normalize()
+	return p
+}
+
+func infinity(p btcec.JacobianPoint) bool {
+	return (p.X.IsZero() && p.Y.IsZero()) || p.Z.IsZero()
+}
+
+func equal(a, b btcec.JacobianPoint) bool {
+	if infinity(a) || infinity(b) {
+		return infinity(a) && infinity(b)
+	}
+	a.ToAffine()
+	b.ToAffine()
+	return a.X.Equals(&b.X) && a.Y.Equals(&b.Y)
+}
+
+// The wire forms use hex: points compressed, scalars as 32 bytes.
+
+func encodePoint(key *btcec.PublicKey) string {
+	return hex.EncodeToString(key.SerializeCompressed())
+}
+
+func decodePoint(s string) (*btcec.PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid point: %w", err)
+	}
+	return btcec.ParsePubKey(b)
+}
+
+func encodeScalar(k *btcec.ModNScalar) string {
+	b := k.Bytes()
+	return hex.EncodeToString(b[:])
+}
+
+func decodeScalar(s string) (btcec.ModNScalar, error) {
+	var k btcec.ModNScalar
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		return k, fmt.Errorf("invalid scalar %q", s)
+	}
+	if k.SetByteSlice(b) {
+		return k, fmt.Errorf("scalar %q is not below the group order", s)
+	}
+	return k, nil
+}
+
+type publicKeyPackageJSON struct {
+	Threshold int            `json:"threshold"`
+	GroupKey  string         `json:"group_key"`
+	Shares    map[int]string `json:"shares"`
+}
+
+// MarshalJSON encodes the keys as compressed hex points.
+func (p *PublicKeyPackage) MarshalJSON() ([]byte, error) {
+	out := publicKeyPackageJSON{
+		Threshold: p.Threshold,
+		GroupKey:  encodePoint(p.GroupKey),
+		Shares:    make(map[int]string, len(p.Shares)),
+	}
+	for id, key := range p.Shares {
+		out.Shares[id] = encodePoint(key)
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes a package written by MarshalJSON.
+func (p *PublicKeyPackage) UnmarshalJSON(data []byte) error {
+	var in publicKeyPackageJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	groupKey, err := decodePoint(in.GroupKey)
+	if err != nil {
+		return err
+	}
+	shares := make(map[int]*btcec.PublicKey, len(in.Shares))
+	for id, s := range in.Shares {
+		if id < 1 || id >= MaxSigners {
+			return fmt.Errorf("invalid signer id %d", id)
+		}
+		if shares[id], err = decodePoint(s); err != nil {
+			return err
+		}
+	}
+	*p = PublicKeyPackage{Threshold: in.Threshold, GroupKey: groupKey, Shares: shares}
+	return nil
+}
+
+type keyShareJSON struct {
+	ID     int               `json:"id"`
+	Secret string            `json:"secret"`
+	Public *PublicKeyPackage `json:"public"`
+}
+
+// MarshalJSON encodes the share with its public package.
+func (k *KeyShare) MarshalJSON() ([]byte, error) {
+	return json.Marshal(keyShareJSON{ID: k.ID, Secret: encodeScalar(&k.Secret), Public: k.Public})
+}
+
+// UnmarshalJSON decodes a share written by MarshalJSON and checks that its
+// secret matches its verifying share.
+func (k *KeyShare) UnmarshalJSON(data []byte) error {
+	var in keyShareJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	secret, err := decodeScalar(in.Secret)
+	if err != nil {
+		return err
+	}
+	if in.Public == nil || in.Public.Shares[in.ID] == nil {
+		return fmt.Errorf("no verifying share for signer %d", in.ID)
+	}
+	if !equal(base(&secret), jacobian(in.Public.Shares[in.ID])) {
+		return fmt.Errorf("secret of signer %d does not match its verifying share", in.ID)
+	}
+	*k = KeyShare{ID: in.ID, Secret: secret, Public: in.Public}
+	return nil
+}
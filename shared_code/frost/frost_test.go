@@ -0,0 +1,220 @@
+package frost_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"reflect"
+	"testing"
+
+	"bitcoin-sidechain/frost"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+const threshold, signers = 7, 10
+
+func deal(t *testing.T, threshold, n int) []*frost.KeyShare {
+	t.Helper()
+	shares, err := frost.Deal(nil, threshold, n, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shares[0].Public.Check(); err != nil {
+		t.Fatal(err)
+	}
+	return shares
+}
+
+// Random sets of t signers make signatures a plain BIP340 verifier accepts.
+func TestSignaturesVerifyAsBIP340(t *testing.T) {
+	for _, size := range [][2]int{{1, 1}, {2, 3}, {threshold, signers}} {
+		t.Run(fmt.Sprintf("%d of %d", size[0], size[1]), func(t *testing.T) {
+			shares := deal(t, size[0], size[1])
+			groupKey, err := schnorr.ParsePubKey(shares[0].Public.XOnly())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for round := 0; round < 10; round++ {
+				message := randomMessage()
+				signature, err := sign(pick(shares, size[0]), message, nil)
+				if err != nil {
+					t.Fatalf("round %d: %v", round, err)
+				}
+				verify(t, signature, message, groupKey)
+			}
+		})
+	}
+}
+
+func TestKeyShareJSON(t *testing.T) {
+	shares := deal(t, threshold, signers)
+	encoded, err := json.Marshal(shares[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded frost.KeyShare
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("decoding a key share: %v", err)
+	}
+	if !decoded.Secret.Equals(&shares[0].Secret) || !decoded.Public.GroupKey.IsEqual(shares[0].Public.GroupKey) {
+		t.Fatal("key share changed in a JSON round trip")
+	}
+}
+
+// Tweaked shares sign for the taproot output key, with or without a script
+// root; several keys so that both signs of y come up.
+func TestTweakedSharesSignForOutputKey(t *testing.T) {
+	for key := 0; key < 8; key++ {
+		withRoot := key%2 == 0
+		shares := deal(t, threshold, signers)
+		internal := shares[0].Public.GroupKey
+		var root []byte
+		if withRoot {
+			root = randomMessage()
+		}
+		tweak := frost.TaprootTweak(internal, root)
+		tweaked := make([]*frost.KeyShare, len(shares))
+		for i, share := range shares {
+			tweaked[i] = share.Tweak(tweak)
+		}
+		if err := tweaked[0].Public.Check(); err != nil {
+			t.Fatalf("tweaked shares: %v", err)
+		}
+
+		var output *btcec.PublicKey
+		if withRoot {
+			output = txscript.ComputeTaprootOutputKey(internal, root)
+		} else {
+			output = txscript.ComputeTaprootKeyNoScript(internal)
+		}
+		if !bytes.Equal(tweaked[0].Public.XOnly(), schnorr.SerializePubKey(output)) {
+			t.Fatal("tweaked group key is not the taproot output key")
+		}
+		message := randomMessage()
+		signature, err := sign(pick(tweaked, threshold), message, nil)
+		if err != nil {
+			t.Fatalf("signing with tweaked shares: %v", err)
+		}
+		verify(t, signature, message, output)
+	}
+}
+
+func TestTamperedShareIsPinnedOnSigner(t *testing.T) {
+	chosen := pick(deal(t, threshold, signers), threshold)
+	cheater := chosen[mrand.Intn(len(chosen))].ID
+	_, err := sign(chosen, randomMessage(), func(share *frost.SignatureShare) {
+		if share.ID == cheater {
+			one := new(btcec.ModNScalar).SetInt(1)
+			share.Z.Add(one)
+		}
+	})
+	var misbehavior *frost.MisbehaviorError
+	if !errors.As(err, &misbehavior) || !reflect.DeepEqual(misbehavior.Signers, []int{cheater}) {
+		t.Fatalf("tampered share of signer %d: got %v", cheater, err)
+	}
+}
+
+// Nonces are good for one signature only, and fewer than t signers cannot
+// sign.
+func TestSigningRules(t *testing.T) {
+	shares := deal(t, threshold, signers)
+	nonces, err := frost.Commit(shares[0], rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitments := []frost.Commitment{nonces.Commitment()}
+	others := make([]*frost.Nonces, 0, threshold-1)
+	for _, share := range shares[1:threshold] {
+		other, err := frost.Commit(share, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		others = append(others, other)
+		commitments = append(commitments, other.Commitment())
+	}
+	if _, err := frost.Sign(shares[0], nonces, frost.NewSigningPackage(randomMessage(), commitments)); err != nil {
+		t.Fatal(err)
+	}
+	second := frost.NewSigningPackage(randomMessage(), commitments)
+	if _, err := frost.Sign(shares[0], nonces, second); !errors.Is(err, frost.ErrNonceUsed) {
+		t.Errorf("second use of nonces: got %v, expected ErrNonceUsed", err)
+	}
+
+	short := frost.NewSigningPackage(randomMessage(), commitments[1:])
+	if _, err := frost.Sign(shares[1], others[0], short); err == nil {
+		t.Error("signed with fewer than t signers")
+	}
+}
+
+// sign runs both rounds with signers over JSON, as between nodes. tamper, if
+// set, changes the shares before they are aggregated.
+func sign(signers []*frost.KeyShare, message []byte, tamper func(*frost.SignatureShare)) ([]byte, error) {
+	nonces := make([]*frost.Nonces, len(signers))
+	commitments := make([]frost.Commitment, len(signers))
+	for i, share := range signers {
+		var err error
+		if nonces[i], err = frost.Commit(share, rand.Reader); err != nil {
+			return nil, err
+		}
+		if err := roundTrip(nonces[i].Commitment(), &commitments[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var pkg frost.SigningPackage
+	if err := roundTrip(frost.NewSigningPackage(message, commitments), &pkg); err != nil {
+		return nil, err
+	}
+	shares := make([]frost.SignatureShare, len(signers))
+	for i, share := range signers {
+		z, err := frost.Sign(share, nonces[i], pkg)
+		if err != nil {
+			return nil, err
+		}
+		if err := roundTrip(z, &shares[i]); err != nil {
+			return nil, err
+		}
+		if tamper != nil {
+			tamper(&shares[i])
+		}
+	}
+	return frost.Aggregate(signers[0].Public, pkg, shares)
+}
+
+func verify(t *testing.T, signature, message []byte, key *btcec.PublicKey) {
+	t.Helper()
+	parsed, err := schnorr.ParseSignature(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Verify(message, key) {
+		t.Fatal("signature does not verify")
+	}
+}
+
+func roundTrip(in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// pick returns t shares at random.
+func pick(shares []*frost.KeyShare, t int) []*frost.KeyShare {
+	picked := append([]*frost.KeyShare(nil), shares...)
+	mrand.Shuffle(len(picked), func(i, j int) { picked[i], picked[j] = picked[j], picked[i] })
+	return picked[:t]
+}
+
+func randomMessage() []byte {
+	message := make([]byte, 32)
+	rand.Read(message)
+	return message
+}
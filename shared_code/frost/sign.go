@@ -0,0 +1,364 @@
+package frost
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// ErrNonceUsed is returned when nonces are used for a second signature.
+// Signing two messages with the same nonces reveals the key share.
+var ErrNonceUsed = errors.New("nonces were already used")
+
+// Commitment is what a signer publishes in round one.
+type Commitment struct {
+	ID      int
+	Hiding  *btcec.PublicKey // D_i
+	Binding *btcec.PublicKey // E_i
+}
+
+// Nonces are a signer's secret nonces for one signature. They are kept by the
+// signer between the rounds and can only be used once.
+type Nonces struct {
+	commitment Commitment
+	hiding     btcec.ModNScalar
+	binding    btcec.ModNScalar
+	used       bool
+}
+
+// Commitment returns the commitment to publish for the nonces.
+func (n *Nonces) Commitment() Commitment {
+	return n.commitment
+}
+
+// Commit runs round one for a signer. Nonces are hashed together with the
+// secret share, so a weak random source alone does not expose the share.
+func Commit(share *KeyShare, random io.Reader) (*Nonces, error) {
+	n := &Nonces{}
+	for _, k := range []*btcec.ModNScalar{&n.hiding, &n.binding} {
+		secret := share.Secret.Bytes()
+		for k.IsZero() {
+			var buf [32]byte
+			if _, err := io.ReadFull(random, buf[:]); err != nil {
+				return nil, fmt.Errorf("failed to read randomness: %w", err)
+			}
+			*k = hashToScalar(tagNonce, buf[:], secret[:])
+		}
+	}
+	n.commitment = Commitment{
+		ID:      share.ID,
+		Hiding:  publicKey(base(&n.hiding)),
+		Binding: publicKey(base(&n.binding)),
+	}
+	return n, nil
+}
+
+// SigningPackage is what the coordinator sends to the signers in round two.
+type SigningPackage struct {
+	Message     []byte       `json:"message"`     // 32-byte hash to sign
+	Commitments []Commitment `json:"commitments"` // one per signer, by ID
+}
+
+// NewSigningPackage returns the package for message with the commitments
+// sorted by signer.
+func NewSigningPackage(message []byte, commitments []Commitment) SigningPackage {
+	sorted := append([]Commitment(nil), commitments...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return SigningPackage{Message: append([]byte(nil), message...), Commitments: sorted}
+}
+
+// Signers returns the ids of the signers in the package.
+func (p SigningPackage) Signers() []int {
+	ids := make([]int, len(p.Commitments))
+	for i, c := range p.Commitments {
+		ids[i] = c.ID
+	}
+	return ids
+}
+
+// SignatureShare is a signer's answer in round two.
+type SignatureShare struct {
+	ID int
+	Z  btcec.ModNScalar
+}
+
+// MisbehaviorError names the signers whose shares did not verify.
+type MisbehaviorError struct {
+	Signers []int
+}
+
+func (e *MisbehaviorError) Error() string {
+	return fmt.Sprintf("invalid signature shares from signers %v", e.Signers)
+}
+
+// session is what signers and the aggregator derive alike from a package.
+type session struct {
+	ids       []int
+	nonces    map[int]btcec.JacobianPoint // D_i + ρ_i·E_i
+	rho       map[int]btcec.ModNScalar
+	lambda    map[int]btcec.ModNScalar
+	r         btcec.FieldVal // x(R)
+	challenge btcec.ModNScalar
+	oddNonce  bool // R has an odd y
+	oddKey    bool // Y has an odd y
+}
+
+func newSession(public *PublicKeyPackage, pkg SigningPackage) (*session, error) {
+	// Check the message and the signers
+	if len(pkg.Message) != 32 {
+		return nil, fmt.Errorf("message must be 32 bytes, not %d", len(pkg.Message))
+	}
+	if len(pkg.Commitments) < public.Threshold {
+		return nil, fmt.Errorf("%d signers, %d needed", len(pkg.Commitments), public.Threshold)
+	}
+	encoded := make([]byte, 0, len(pkg.Commitments)*70)
+	for i, c := range pkg.Commitments {
+		if i > 0 && c.ID <= pkg.Commitments[i-1].ID {
+			return nil, errors.New("commitments must be sorted by signer without repeats")
+		}
+		if public.Shares[c.ID] == nil {
+			return nil, fmt.Errorf("signer %d has no share of the key", c.ID)
+		}
+		if c.Hiding == nil || c.Binding == nil {
+			return nil, fmt.Errorf("incomplete commitment from signer %d", c.ID)
+		}
+		encoded = append(encoded, idBytes(c.ID)...)
+		encoded = append(encoded, c.Hiding.SerializeCompressed()...)
+		encoded = append(encoded, c.Binding.SerializeCompressed()...)
+	}
+
+	// Bind every nonce to the message and to the whole set of commitments
+	s := &session{
+		ids:    pkg.Signers(),
+		nonces: make(map[int]btcec.JacobianPoint, len(pkg.Commitments)),
+		rho:    make(map[int]btcec.ModNScalar, len(pkg.Commitments)),
+		lambda: make(map[int]btcec.ModNScalar, len(pkg.Commitments)),
+	}
+	groupKey := public.GroupKey.SerializeCompressed()
+	message := taggedHash(tagMessage, pkg.Message)
+	commitments := taggedHash(tagCommit, encoded)
+	var r btcec.JacobianPoint
+	for _, c := range pkg.Commitments {
+		rho := hashToScalar(tagRho, groupKey, message, commitments, idBytes(c.ID))
+		nonce := add(jacobian(c.Hiding), mul(&rho, jacobian(c.Binding)))
+		nonce.ToAffine()
+		s.rho[c.ID] = rho
+		s.nonces[c.ID] = nonce
+		s.lambda[c.ID] = lagrange(s.ids, c.ID)
+		r = add(r, nonce)
+	}
+	if infinity(r) {
+		return nil, errors.New("group nonce is the point at infinity")
+	}
+	r.ToAffine()
+	s.r = r.X
+	s.oddNonce = r.Y.IsOdd()
+	s.oddKey = groupKey[0] == 0x03
+
+	x := s.r.Bytes()
+	s.challenge = hashToScalar(tagChallenge, x[:], public.XOnly(), pkg.Message)
+	return s, nil
+}
+
+// Sign runs round two for a signer and consumes its nonces. The package must
+// carry the signer's own commitment unchanged.
+func Sign(share *KeyShare, nonces *Nonces, pkg SigningPackage) (SignatureShare, error) {
+	if nonces.used {
+		return SignatureShare{}, ErrNonceUsed
+	}
+	own := nonces.commitment
+	found := false
+	for _, c := range pkg.Commitments {
+		if c.ID == share.ID {
+			found = own.ID == share.ID && c.Hiding != nil && c.Binding != nil &&
+				c.Hiding.IsEqual(own.Hiding) && c.Binding.IsEqual(own.Binding)
+		}
+	}
+	if !found {
+		return SignatureShare{}, fmt.Errorf("package does not carry the commitment of signer %d", share.ID)
+	}
+	s, err := newSession(share.Public, pkg)
+	if err != nil {
+		return SignatureShare{}, err
+	}
+
+	// The nonces are gone whatever happens next
+	nonces.used = true
+	defer func() {
+		nonces.hiding.Zero()
+		nonces.binding.Zero()
+	}()
+
+	// z_i = ±(d_i + ρ_i·e_i) + λ_i·c·(±s_i)
+	rho := s.rho[share.ID]
+	var k btcec.ModNScalar
+	k.Mul2(&nonces.binding, &rho).Add(&nonces.hiding)
+	if s.oddNonce {
+		k.Negate()
+	}
+	var secret btcec.ModNScalar
+	secret.Set(&share.Secret)
+	if s.oddKey {
+		secret.Negate()
+	}
+	lambda := s.lambda[share.ID]
+	var z btcec.ModNScalar
+	z.Mul2(&lambda, &s.challenge).Mul(&secret).Add(&k)
+	secret.Zero()
+	k.Zero()
+	return SignatureShare{ID: share.ID, Z: z}, nil
+}
+
+// verify checks z_i·G = ±(D_i + ρ_i·E_i) + λ_i·c·(±Y_i).
+func (s *session) verify(public *PublicKeyPackage, share SignatureShare) bool {
+	nonce, ok := s.nonces[share.ID]
+	if !ok {
+		return false
+	}
+	if s.oddNonce {
+		nonce = negate(nonce)
+	}
+	key := jacobian(public.Shares[share.ID])
+	if s.oddKey {
+		key = negate(key)
+	}
+	lambda := s.lambda[share.ID]
+	var factor btcec.ModNScalar
+	factor.Mul2(&lambda, &s.challenge)
+	return equal(base(&share.Z), add(nonce, mul(&factor, key)))
+}
+
+// VerifyShare checks one signer's share against its commitments and its
+// verifying share.
+func VerifyShare(public *PublicKeyPackage, pkg SigningPackage, share SignatureShare) error {
+	s, err := newSession(public, pkg)
+	if err != nil {
+		return err
+	}
+	if !s.verify(public, share) {
+		return &MisbehaviorError{Signers: []int{share.ID}}
+	}
+	return nil
+}
+
+// Aggregate checks the shares of every signer in the package and returns
+// the 64-byte BIP340 signature of the message under the group key. If any
+// share is invalid it returns a *MisbehaviorError naming all such signers, so
+// the coordinator can start over without them.
+func Aggregate(public *PublicKeyPackage, pkg SigningPackage, shares []SignatureShare) ([]byte, error) {
+	s, err := newSession(public, pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check there is one share per signer
+	byID := make(map[int]SignatureShare, len(shares))
+	for _, share := range shares {
+		if _, ok := s.nonces[share.ID]; !ok {
+			return nil, fmt.Errorf("share from signer %d who is not in the package", share.ID)
+		}
+		if _, ok := byID[share.ID]; ok {
+			return nil, fmt.Errorf("two shares from signer %d", share.ID)
+		}
+		byID[share.ID] = share
+	}
+	var missing []int
+	for _, id := range s.ids {
+		if _, ok := byID[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no shares from signers %v", missing)
+	}
+
+	// Check every share, then add them up
+	var invalid []int
+	var z btcec.ModNScalar
+	for _, id := range s.ids {
+		share := byID[id]
+		if !s.verify(public, share) {
+			invalid = append(invalid, id)
+		}
+		z.Add(&share.Z)
+	}
+	if len(invalid) > 0 {
+		return nil, &MisbehaviorError{Signers: invalid}
+	}
+
+	signature := schnorr.NewSignature(&s.r, &z)
+	if !signature.Verify(pkg.Message, public.GroupKey) {
+		return nil, errors.New("aggregate signature does not verify")
+	}
+	return signature.Serialize(), nil
+}
+
+func sortedIDs(shares map[int]*btcec.PublicKey) []int {
+	ids := make([]int, 0, len(shares))
+	for id := range shares {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+type commitmentJSON struct {
+	ID      int    `json:"id"`
+	Hiding  string `json:"hiding"`
+	Binding string `json:"binding"`
+}
+
+// MarshalJSON encodes the commitments as compressed hex points.
+func (c Commitment) MarshalJSON() ([]byte, error) {
+	if c.Hiding == nil || c.Binding == nil {
+		return nil, errors.New("incomplete commitment")
+	}
+	return json.Marshal(commitmentJSON{ID: c.ID, Hiding: encodePoint(c.Hiding), Binding: encodePoint(c.Binding)})
+}
+
+// UnmarshalJSON decodes a commitment written by MarshalJSON.
+func (c *Commitment) UnmarshalJSON(data []byte) error {
+	var in commitmentJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	hiding, err := decodePoint(in.Hiding)
+	if err != nil {
+		return err
+	}
+	binding, err := decodePoint(in.Binding)
+	if err != nil {
+		return err
+	}
+	*c = Commitment{ID: in.ID, Hiding: hiding, Binding: binding}
+	return nil
+}
+
+type signatureShareJSON struct {
+	ID int    `json:"id"`
+	Z  string `json:"z"`
+}
+
+// MarshalJSON encodes the share as a 32-byte hex scalar.
+func (s SignatureShare) MarshalJSON() ([]byte, error) {
+	return json.Marshal(signatureShareJSON{ID: s.ID, Z: encodeScalar(&s.Z)})
+}
+
+// UnmarshalJSON decodes a share written by MarshalJSON.
+func (s *SignatureShare) UnmarshalJSON(data []byte) error {
+	var in signatureShareJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	z, err := decodeScalar(in.Z)
+	if err != nil {
+		return err
+	}
+	*s = SignatureShare{ID: in.ID, Z: z}
+	return nil
+}
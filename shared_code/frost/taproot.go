@@ -0,0 +1,55 @@
+package frost
+
+import (
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// tagTapTweak is the BIP341 tag of the hash that tweaks an internal key into
+// a taproot output key.
+const tagTapTweak = "TapTweak"
+
+// TaprootTweak returns the BIP341 tweak t = H(x(P) || root) of the group key
+// P for a script root, or for no scripts at all if root is nil.
+func TaprootTweak(groupKey *btcec.PublicKey, root []byte) btcec.ModNScalar {
+	return hashToScalar(tagTapTweak, schnorr.SerializePubKey(groupKey), root)
+}
+
+// Tweak returns the package of the taproot output key Q = P + t·G, P being
+// the group key with an even y as BIP341 takes it. The signers of the
+// package sign for Q with their tweaked shares.
+func (p *PublicKeyPackage) Tweak(t btcec.ModNScalar) *PublicKeyPackage {
+	odd := p.GroupKey.SerializeCompressed()[0] == 0x03
+	tG := base(&t)
+	tweak := func(key *btcec.PublicKey) *btcec.PublicKey {
+		point := jacobian(key)
+		if odd {
+			point = negate(point)
+		}
+		return publicKey(add(point, tG))
+	}
+
+	tweaked := &PublicKeyPackage{
+		Threshold: p.Threshold,
+		GroupKey:  tweak(p.GroupKey),
+		Shares:    make(map[int]*btcec.PublicKey, len(p.Shares)),
+	}
+	for id, share := range p.Shares {
+		tweaked.Shares[id] = tweak(share)
+	}
+	return tweaked
+}
+
+// Tweak returns the share of the taproot output key Q = P + t·G: ±s_i + t,
+// negated if P has an odd y. The tweaked shares still interpolate to the
+// secret of Q because the Lagrange coefficients of any signing set add up to
+// one.
+func (k *KeyShare) Tweak(t btcec.ModNScalar) *KeyShare {
+	var secret btcec.ModNScalar
+	secret.Set(&k.Secret)
+	if k.Public.GroupKey.SerializeCompressed()[0] == 0x03 {
+		secret.Negate()
+	}
+	secret.Add(&t)
+	return &KeyShare{ID: k.ID, Secret: secret, Public: k.Public.Tweak(t)}
+}
@@ -0,0 +1,411 @@
+// Package gossip lets nodes find each other without anyone registering them
+// by hand. A node starts from the seed addresses in its config and the nodes
+// table, and every interval it swaps a random sample of its address book
+// with a few random peers through
+//
+//	POST /peers/exchange {"sender": {...}, "peers": [{...}, ...]}
+//
+// which answers with a sample of the receiver's book in the same form. Each
+// side announces its own public address and key as sender, which is how a
+// new node gets known.
+//
+// Gossip is only a hint. The address book is bounded, dropping the entries
+// heard of longest ago, and each source may add or refresh only so many
+// addresses per window, so it cannot keep its own entries the freshest. An
+// address is trusted only once it answers a registration challenge with the
+// key it was announced with: every round the node challenges a few book
+// entries that are not nodes, queued or buffered yet, and puts those that
+// pass into nodes_buffer, from where they go through probation like any
+// other applicant (see package membership). An address that fails is dropped
+// from the book until it is heard of again.
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/networkUtils"
+	"bitcoin-sidechain/probe"
+	"bitcoin-sidechain/storage"
+)
+
+// maxExchangeSize bounds the body of an exchange request or answer.
+const maxExchangeSize = 1 << 20
+
+// Config holds the gossip settings.
+type Config struct {
+	Self        string        // public host:port of this node, not announced if empty
+	PublicKey   string        // base64 identity key of this node
+	Seeds       []string      // host:port addresses to start from
+	Interval    time.Duration // time between two rounds
+	Fanout      int           // peers contacted per round
+	SampleSize  int           // entries sent per exchange, and taken from one at most
+	MaxPeers    int           // size of the address book
+	SourceLimit int           // addresses accepted from one source per window
+	Window      time.Duration // window of the per source limit
+	Registers   int           // registration challenges per round
+}
+
+// DefaultConfig is used for any value left at zero.
+var DefaultConfig = Config{
+	Interval:    30 * time.Second,
+	Fanout:      3,
+	SampleSize:  16,
+	MaxPeers:    1000,
+	SourceLimit: 32,
+	Window:      10 * time.Minute,
+	Registers:   4,
+}
+
+// Registrar challenges an address to prove it holds a key.
+type Registrar interface {
+	ChallengeContext(ctx context.Context, address, publicKey string) (storage.Registration, error)
+}
+
+// Entry is an address and the key it is announced with.
+type Entry struct {
+	IPAddress string `json:"ip_address"`
+	PublicKey string `json:"public_key"`
+}
+
+// Exchange is the body of an exchange request and of its answer.
+type Exchange struct {
+	Sender *Entry  `json:"sender,omitempty"`
+	Peers  []Entry `json:"peers"`
+}
+
+// Agent keeps the address book, gossips and registers new peers.
+type Agent struct {
+	store     storage.Store
+	outbound  *networkUtils.Outbound
+	registrar Registrar
+	pool      *probe.Pool
+	config    Config
+
+	mu          sync.Mutex
+	windowStart time.Time
+	added       map[string]int // addresses accepted per source in this window
+}
+
+// New returns an agent. Exchanges and challenges of a round run on pool.
+// Zero values in config are taken from DefaultConfig.
+func New(store storage.Store, outbound *networkUtils.Outbound, registrar Registrar, pool *probe.Pool, config Config) *Agent {
+	if config.Interval <= 0 {
+		config.Interval = DefaultConfig.Interval
+	}
+	if config.Fanout <= 0 {
+		config.Fanout = DefaultConfig.Fanout
+	}
+	if config.SampleSize <= 0 {
+		config.SampleSize = DefaultConfig.SampleSize
+	}
+	if config.MaxPeers <= 0 {
+		config.MaxPeers = DefaultConfig.MaxPeers
+	}
+	if config.SourceLimit <= 0 {
+		config.SourceLimit = DefaultConfig.SourceLimit
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultConfig.Window
+	}
+	if config.Registers <= 0 {
+		config.Registers = DefaultConfig.Registers
+	}
+	return &Agent{
+		store:     store,
+		outbound:  outbound,
+		registrar: registrar,
+		pool:      pool,
+		config:    config,
+		added:     make(map[string]int),
+	}
+}
+
+// Round merges the seeds and the nodes table into the address book, swaps
+// samples with Fanout random peers and challenges the unregistered ones.
+func (a *Agent) Round() error {
+	now := time.Now().Unix()
+	var known []storage.Peer
+	for _, seed := range a.config.Seeds {
+		if seed == a.config.Self {
+			continue
+		}
+		known = append(known, storage.Peer{IPAddress: seed, Source: "seed", LastSeen: now})
+	}
+	nodes, err := a.store.ListNodes()
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if node.IPAddress != "" && node.IPAddress != a.config.Self {
+			known = append(known, storage.Peer{IPAddress: node.IPAddress, PublicKey: node.PublicKey, Source: "nodes", LastSeen: now})
+		}
+	}
+	if err := a.store.SavePeers(known, a.config.MaxPeers); err != nil {
+		return err
+	}
+
+	book, err := a.store.ListPeers()
+	if err != nil {
+		return err
+	}
+	targets := sample(book, a.config.Fanout)
+	answers := make([]Exchange, len(targets))
+	errs := a.pool.Sweep(context.Background(), len(targets), func(ctx context.Context, i int) error {
+		var err error
+		answers[i], err = a.exchange(ctx, targets[i].IPAddress, book)
+		return err
+	})
+	var learned []storage.Peer
+	for i, target := range targets {
+		if errs[i] != nil {
+			fmt.Printf("Gossip: exchange with %s failed: %v\n", target.IPAddress, errs[i])
+			continue
+		}
+		learned = append(learned, a.accept(target.IPAddress, answers[i])...)
+	}
+	if err := a.store.SavePeers(learned, a.config.MaxPeers); err != nil {
+		return err
+	}
+	return a.register()
+}
+
+// exchange sends a sample of the book to the peer at address and returns its
+// answer.
+func (a *Agent) exchange(ctx context.Context, address string, book []storage.Peer) (Exchange, error) {
+	payload, err := json.Marshal(a.offer(book))
+	if err != nil {
+		return Exchange{}, fmt.Errorf("failed to encode exchange: %w", err)
+	}
+	req, err := a.outbound.NewRequestContext(ctx, http.MethodPost, address, "/peers/exchange", bytes.NewReader(payload))
+	if err != nil {
+		return Exchange{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, body, err := a.outbound.Do(req)
+	if err != nil {
+		return Exchange{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Exchange{}, fmt.Errorf("%s answered with status %d", address, resp.StatusCode)
+	}
+	var answer Exchange
+	if err := json.Unmarshal(body, &answer); err != nil {
+		return Exchange{}, fmt.Errorf("invalid answer from %s: %w", address, err)
+	}
+	return answer, nil
+}
+
+// offer returns this node as sender and a random sample of the book.
+func (a *Agent) offer(book []storage.Peer) Exchange {
+	offer := Exchange{Peers: []Entry{}}
+	if a.config.Self != "" {
+		offer.Sender = &Entry{IPAddress: a.config.Self, PublicKey: a.config.PublicKey}
+	}
+	for _, peer := range sample(book, a.config.SampleSize) {
+		offer.Peers = append(offer.Peers, Entry{IPAddress: peer.IPAddress, PublicKey: peer.PublicKey})
+	}
+	return offer
+}
+
+// accept returns the entries of an exchange worth adding to the book: valid
+// addresses with a valid key, other than this node, up to SampleSize. Each
+// counts against the limit of the source, whether it is new or refreshes the
+// last_seen of an entry already in the book, since eviction drops the entries
+// seen longest ago.
+func (a *Agent) accept(source string, exchange Exchange) []storage.Peer {
+	entries := exchange.Peers
+	if len(entries) > a.config.SampleSize {
+		entries = entries[:a.config.SampleSize]
+	}
+	if exchange.Sender != nil {
+		entries = append([]Entry{*exchange.Sender}, entries...)
+	}
+
+	now := time.Now()
+	var accepted []storage.Peer
+	for _, entry := range entries {
+		if entry.IPAddress == a.config.Self || a.outbound.CheckAddress(entry.IPAddress) != nil {
+			continue
+		}
+		if _, err := cryptoUtils.NodeIDFromBase64(entry.PublicKey); err != nil {
+			continue
+		}
+		if !a.allow(source, now) {
+			continue
+		}
+		accepted = append(accepted, storage.Peer{IPAddress: entry.IPAddress, PublicKey: entry.PublicKey, Source: source, LastSeen: now.Unix()})
+	}
+	return accepted
+}
+
+// allow counts an address from source against its limit for the window.
+func (a *Agent) allow(source string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.windowStart) >= a.config.Window {
+		a.windowStart = now
+		a.added = make(map[string]int)
+	}
+	if a.added[source] >= a.config.SourceLimit {
+		return false
+	}
+	a.added[source]++
+	return true
+}
+
+// register challenges up to Registers book entries that are not known to
+// the membership tables and were not tried within the window, and buffers
+// those that pass.
+func (a *Agent) register() error {
+	book, err := a.store.ListPeers()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var candidates []storage.Peer
+	for _, peer := range rand.Perm(len(book)) {
+		p := book[peer]
+		if p.PublicKey == "" || p.IPAddress == a.config.Self || now.Sub(time.Unix(p.LastAttempt, 0)) < a.config.Window {
+			continue
+		}
+		known, err := a.known(p.IPAddress)
+		if err != nil {
+			return err
+		}
+		if !known {
+			candidates = append(candidates, p)
+		}
+		if len(candidates) == a.config.Registers {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	registrations := make([]storage.Registration, len(candidates))
+	errs := a.pool.Sweep(context.Background(), len(candidates), func(ctx context.Context, i int) error {
+		var err error
+		registrations[i], err = a.registrar.ChallengeContext(ctx, candidates[i].IPAddress, candidates[i].PublicKey)
+		return err
+	})
+
+	var attempted, forget []string
+	var passed []storage.Registration
+	for i, candidate := range candidates {
+		attempted = append(attempted, candidate.IPAddress)
+		if errs[i] != nil {
+			fmt.Printf("Gossip: %s did not prove its key: %v\n", candidate.IPAddress, errs[i])
+			forget = append(forget, candidate.IPAddress)
+			continue
+		}
+		fmt.Printf("Gossip: %s registered, added to the buffer\n", candidate.IPAddress)
+		passed = append(passed, registrations[i])
+	}
+	if err := a.store.AddAllToBuffer(passed); err != nil {
+		return err
+	}
+	return a.store.RecordPeerAttempts(attempted, forget, now.Unix())
+}
+
+// known reports whether an address is a node, queued or buffered.
+func (a *Agent) known(ipAddress string) (bool, error) {
+	for _, contains := range []func(string) (bool, error){a.store.NodeExists, a.store.QueueContains, a.store.BufferContains} {
+		found, err := contains(ipAddress)
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// Run gossips every interval until stop is closed.
+func (a *Agent) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.Round(); err != nil {
+			fmt.Println("Gossip: error in gossip round:", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ExchangeHandler is the POST /peers/exchange endpoint. Addresses are
+// limited per remote IP.
+func (a *Agent) ExchangeHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxExchangeSize))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	var offer Exchange
+	if err := json.Unmarshal(body, &offer); err != nil {
+		http.Error(w, "Invalid exchange", http.StatusBadRequest)
+		return
+	}
+	source, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		source = r.RemoteAddr
+	}
+
+	book, err := a.store.ListPeers()
+	if err != nil {
+		fmt.Println("Gossip: error listing peers:", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+	if learned := a.accept(source, offer); len(learned) > 0 {
+		if err := a.store.SavePeers(learned, a.config.MaxPeers); err != nil {
+			fmt.Println("Gossip: error saving peers:", err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.offer(book)); err != nil {
+		fmt.Println("Error encoding response:", err)
+	}
+}
+
+// PeersHandler is the GET /peers endpoint that returns the address book.
+func (a *Agent) PeersHandler(w http.ResponseWriter, r *http.Request) {
+	book, err := a.store.ListPeers()
+	if err != nil {
+		fmt.Println("Gossip: error listing peers:", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+	if book == nil {
+		book = []storage.Peer{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(book); err != nil {
+		fmt.Println("Error encoding response:", err)
+	}
+}
+
+// sample returns up to n random peers of the book.
+func sample(book []storage.Peer, n int) []storage.Peer {
+	if n > len(book) {
+		n = len(book)
+	}
+	picked := make([]storage.Peer, n)
+	for i, j := range rand.Perm(len(book))[:n] {
+		picked[i] = book[j]
+	}
+	return picked
+}
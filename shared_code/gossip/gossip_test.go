@@ -0,0 +1,224 @@
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/networkUtils"
+	"bitcoin-sidechain/probe"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// fakeRegistrar passes the challenge of the addresses in pass and records
+// every address it was asked about.
+type fakeRegistrar struct {
+	mu     sync.Mutex
+	pass   map[string]bool
+	called []string
+}
+
+func (f *fakeRegistrar) ChallengeContext(ctx context.Context, address, publicKey string) (storage.Registration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.called = append(f.called, address)
+	if !f.pass[address] {
+		return storage.Registration{}, errors.New("wrong key")
+	}
+	return storage.Registration{IPAddress: address, PublicKey: publicKey, RegisteredBy: "self", Nonce: "nonce", Signature: "signature"}, nil
+}
+
+func newAgent(t *testing.T, registrar Registrar, config Config) (*Agent, storage.Store) {
+	t.Helper()
+	store, err := storage.Open("sqlite3", filepath.Join(t.TempDir(), "node.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return New(store, networkUtils.NewOutbound(networkUtils.OutboundConfig{}), registrar, probe.New(probe.Config{}), config), store
+}
+
+func publicKey(t *testing.T) string {
+	t.Helper()
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cryptoUtils.PublicKeyBase64(key)
+}
+
+// entries returns n valid entries with public addresses from 198.51.100.first on.
+func entries(t *testing.T, first, n int) []Entry {
+	var list []Entry
+	for i := first; i < first+n; i++ {
+		list = append(list, Entry{IPAddress: fmt.Sprintf("198.51.100.%d:8080", i), PublicKey: publicKey(t)})
+	}
+	return list
+}
+
+func TestAcceptLimitsEachSource(t *testing.T) {
+	agent, store := newAgent(t, nil, Config{Self: "198.51.100.250:8080", SourceLimit: 3})
+	offered := entries(t, 1, 10)
+
+	accepted := agent.accept("203.0.113.1", Exchange{Peers: offered})
+	if len(accepted) != 3 {
+		t.Fatalf("accepted %d entries from one source, expected 3", len(accepted))
+	}
+	if err := store.SavePeers(accepted, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refreshing entries already in the book counts as well
+	if again := agent.accept("203.0.113.1", Exchange{Peers: offered[:3]}); len(again) != 0 {
+		t.Errorf("source over its limit refreshed %d entries", len(again))
+	}
+
+	// Entries that are not valid do not use up the limit of a source
+	invalid := []Entry{
+		{IPAddress: "10.0.0.1:8080", PublicKey: publicKey(t)},
+		{IPAddress: "198.51.100.99:8080", PublicKey: "not a key"},
+		{IPAddress: "198.51.100.250:8080", PublicKey: publicKey(t)},
+	}
+	other := agent.accept("203.0.113.2", Exchange{Peers: append(invalid, offered[3:]...)})
+	if len(other) != 3 || other[0].IPAddress != offered[3].IPAddress {
+		t.Errorf("another source got %d entries, starting with %v; expected 3 starting with %s", len(other), other, offered[3].IPAddress)
+	}
+
+	// The limit starts over with the next window
+	agent.windowStart = time.Now().Add(-agent.config.Window)
+	if later := agent.accept("203.0.113.1", Exchange{Peers: offered}); len(later) != 3 {
+		t.Errorf("accepted %d entries in a new window, expected 3", len(later))
+	}
+}
+
+func TestSavePeersEvictsLeastRecentlySeen(t *testing.T) {
+	_, store := newAgent(t, nil, Config{})
+	var peers []storage.Peer
+	for i, entry := range entries(t, 1, 5) {
+		peers = append(peers, storage.Peer{IPAddress: entry.IPAddress, PublicKey: entry.PublicKey, Source: "test", LastSeen: int64(100 + i)})
+	}
+	if err := store.SavePeers(peers, 3); err != nil {
+		t.Fatal(err)
+	}
+	book, err := store.ListPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(book) != 3 || book[0].IPAddress != peers[4].IPAddress || book[2].IPAddress != peers[2].IPAddress {
+		t.Fatalf("book is %v, expected the 3 seen last", book)
+	}
+
+	// A refresh moves an entry up, and an older sighting does not move it down
+	refreshed := peers[2]
+	refreshed.LastSeen = 200
+	if err := store.SavePeers([]storage.Peer{refreshed, {IPAddress: peers[4].IPAddress, LastSeen: 1}}, 3); err != nil {
+		t.Fatal(err)
+	}
+	newest := storage.Peer{IPAddress: "198.51.100.20:8080", Source: "test", LastSeen: 150}
+	if err := store.SavePeers([]storage.Peer{newest}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if book, err = store.ListPeers(); err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, peer := range book {
+		kept = append(kept, peer.IPAddress)
+	}
+	want := []string{peers[2].IPAddress, newest.IPAddress, peers[4].IPAddress}
+	if fmt.Sprint(kept) != fmt.Sprint(want) {
+		t.Errorf("book is %v, expected %v", kept, want)
+	}
+	if book[0].PublicKey != peers[2].PublicKey {
+		t.Error("a refresh replaced the key of a known address")
+	}
+}
+
+// Exchanges from many sources never grow the book past MaxPeers.
+func TestExchangeKeepsBookBounded(t *testing.T) {
+	agent, store := newAgent(t, nil, Config{MaxPeers: 5, SourceLimit: 3})
+	for source := 1; source <= 4; source++ {
+		payload, err := json.Marshal(Exchange{Peers: entries(t, source*10, 3)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/peers/exchange", bytes.NewReader(payload))
+		req.RemoteAddr = fmt.Sprintf("203.0.113.%d:40000", source)
+		recorder := httptest.NewRecorder()
+		agent.ExchangeHandler(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("exchange answered %d", recorder.Code)
+		}
+		book, err := store.ListPeers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(book) > 5 {
+			t.Fatalf("book holds %d entries after %d exchanges, limit is 5", len(book), source)
+		}
+	}
+}
+
+func TestRegisterBuffersPeersThatProveTheirKey(t *testing.T) {
+	passing, failing, member, keyless := "198.51.100.1:8080", "198.51.100.2:8080", "198.51.100.3:8080", "198.51.100.4:8080"
+	registrar := &fakeRegistrar{pass: map[string]bool{passing: true, member: true}}
+	agent, store := newAgent(t, registrar, Config{})
+
+	now := time.Now().Unix()
+	book := []storage.Peer{
+		{IPAddress: passing, PublicKey: publicKey(t), Source: "test", LastSeen: now},
+		{IPAddress: failing, PublicKey: publicKey(t), Source: "test", LastSeen: now},
+		{IPAddress: member, PublicKey: publicKey(t), Source: "test", LastSeen: now},
+		{IPAddress: keyless, Source: "seed", LastSeen: now},
+	}
+	if err := store.SavePeers(book, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertNode(storage.Node{ComputerID: "member", IPAddress: member, Reachable: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := agent.register(); err != nil {
+		t.Fatal(err)
+	}
+	if len(registrar.called) != 2 {
+		t.Fatalf("challenged %v, expected %s and %s", registrar.called, passing, failing)
+	}
+	if buffered, err := store.BufferContains(passing); err != nil || !buffered {
+		t.Errorf("%s passed its challenge but is not buffered: %v", passing, err)
+	}
+	if buffered, err := store.BufferContains(failing); err != nil || buffered {
+		t.Errorf("%s failed its challenge but is buffered: %v", failing, err)
+	}
+	left, err := store.ListPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range left {
+		if peer.IPAddress == failing {
+			t.Errorf("%s failed its challenge but is still in the book", failing)
+		}
+		if peer.IPAddress == passing && peer.LastAttempt == 0 {
+			t.Errorf("the challenge of %s was not recorded", passing)
+		}
+	}
+
+	// Nothing is challenged again within the window
+	if err := agent.register(); err != nil {
+		t.Fatal(err)
+	}
+	if len(registrar.called) != 2 {
+		t.Errorf("challenged %v on the second round", registrar.called[2:])
+	}
+}
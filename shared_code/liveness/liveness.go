@@ -0,0 +1,167 @@
+// Package liveness probes every node of the nodes table with a signed /ping
+// on a schedule and keeps its uptime history in node_health: when it was last
+// seen, how many probes in a row it failed and its success rate over the
+// latest storage.HealthWindow probes.
+//
+// The scores are this node's own view. They only take effect through the
+// block that starts an epoch, whose proposer leaves the nodes scoring below
+// the threshold out of the leader groups and evicts the nodes that did not
+// answer for a whole epoch (see package membership).
+package liveness
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"bitcoin-sidechain/probe"
+	"bitcoin-sidechain/storage"
+)
+
+// Config holds the probe schedule and the scoring rules.
+type Config struct {
+	Interval   time.Duration // time between two probes of a node
+	MinChecks  int           // probes needed before a node can score as unhealthy
+	Threshold  float64       // success rate below which a node is unhealthy
+	EvictAfter time.Duration // time without an answer after which a node is evicted
+}
+
+// DefaultConfig is used for any value left at zero.
+var DefaultConfig = Config{
+	Interval:   30 * time.Second,
+	MinChecks:  5,
+	Threshold:  0.5,
+	EvictAfter: 4 * time.Hour,
+}
+
+// Pinger sends a signed GET to a node and checks that the answer is signed by
+// the node listed at that address.
+type Pinger interface {
+	GetContext(ctx context.Context, ipAddress, path string) (int, []byte, error)
+}
+
+// Score is the health of a node with the verdicts drawn from it.
+type Score struct {
+	storage.NodeHealth
+	SuccessRate float64 `json:"success_rate"`
+	Healthy     bool    `json:"healthy"`     // may lead
+	Unreachable bool    `json:"unreachable"` // due for eviction
+}
+
+// Monitor probes the nodes and scores them.
+type Monitor struct {
+	store  storage.Store
+	pinger Pinger
+	pool   *probe.Pool
+	self   string
+	config Config
+}
+
+// New returns a monitor for the node with computer_id self, which is never
+// probed. The pings of a sweep run on pool. Zero values in config are taken
+// from DefaultConfig.
+func New(store storage.Store, pinger Pinger, pool *probe.Pool, self string, config Config) *Monitor {
+	if config.Interval <= 0 {
+		config.Interval = DefaultConfig.Interval
+	}
+	if config.MinChecks <= 0 {
+		config.MinChecks = DefaultConfig.MinChecks
+	}
+	if config.Threshold <= 0 {
+		config.Threshold = DefaultConfig.Threshold
+	}
+	if config.EvictAfter <= 0 {
+		config.EvictAfter = DefaultConfig.EvictAfter
+	}
+	return &Monitor{store: store, pinger: pinger, pool: pool, self: self, config: config}
+}
+
+// Score draws the verdicts from a node's health at a time. A node is healthy
+// until it has MinChecks probes and while its success rate is at least the
+// threshold. It is unreachable once it has not answered for EvictAfter since
+// it was last seen, or since it was first probed if it never answered.
+func (m *Monitor) Score(health storage.NodeHealth, now time.Time) Score {
+	score := Score{NodeHealth: health, SuccessRate: health.SuccessRate()}
+	score.Healthy = health.Checks < m.config.MinChecks || score.SuccessRate >= m.config.Threshold
+	if health.Since > 0 {
+		seen := health.LastSeen
+		if seen < health.Since {
+			seen = health.Since
+		}
+		score.Unreachable = now.Sub(time.Unix(seen, 0)) >= m.config.EvictAfter
+	}
+	return score
+}
+
+// Scores returns the score of every node in the nodes table.
+func (m *Monitor) Scores() ([]Score, error) {
+	list, err := m.store.ListNodeHealth()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	scores := make([]Score, len(list))
+	for i, health := range list {
+		scores[i] = m.Score(health, now)
+	}
+	return scores, nil
+}
+
+// Probe pings every node other than this one that was not probed for an
+// interval, all at once on the pool, and records the results in one batch.
+func (m *Monitor) Probe() error {
+	list, err := m.store.ListNodeHealth()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var due []storage.NodeHealth
+	for _, health := range list {
+		if health.ComputerID == m.self || health.IPAddress == "" {
+			continue
+		}
+		if now.Sub(time.Unix(health.LastCheck, 0)) < m.config.Interval {
+			continue
+		}
+		due = append(due, health)
+	}
+	if len(due) == 0 {
+		return nil
+	}
+
+	errs := m.pool.Sweep(context.Background(), len(due), func(ctx context.Context, i int) error {
+		status, _, err := m.pinger.GetContext(ctx, due[i].IPAddress, "/ping")
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("status %d", status)
+		}
+		return err
+	})
+
+	probes := make([]storage.NodeProbe, len(due))
+	for i, health := range due {
+		if errs[i] != nil {
+			fmt.Printf("Liveness: node %s at %s did not answer: %v\n", health.ComputerID, health.IPAddress, errs[i])
+		}
+		probes[i] = storage.NodeProbe{ComputerID: health.ComputerID, OK: errs[i] == nil, At: now.Unix()}
+	}
+	return m.store.RecordNodeProbes(probes)
+}
+
+// Run probes the nodes until stop is closed.
+func (m *Monitor) Run(stop <-chan struct{}) {
+	// Tick faster than the interval so probes stay close to it
+	ticker := time.NewTicker(m.config.Interval / 4)
+	defer ticker.Stop()
+
+	for {
+		if err := m.Probe(); err != nil {
+			fmt.Println("Liveness: error probing nodes:", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
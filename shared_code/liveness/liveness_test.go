@@ -0,0 +1,159 @@
+package liveness_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bitcoin-sidechain/liveness"
+	"bitcoin-sidechain/probe"
+	"bitcoin-sidechain/storage"
+)
+
+// fakePinger answers with the status set for an address, or fails.
+type fakePinger struct {
+	mu       sync.Mutex
+	statuses map[string]int
+	pinged   []string
+}
+
+func (f *fakePinger) GetContext(ctx context.Context, ipAddress, path string) (int, []byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pinged = append(f.pinged, ipAddress)
+	status, ok := f.statuses[ipAddress]
+	if !ok {
+		return 0, nil, errors.New("connection refused")
+	}
+	return status, nil, nil
+}
+
+func openStore(t *testing.T, nodes ...storage.Node) storage.Store {
+	t.Helper()
+	store, err := storage.Open("sqlite3", filepath.Join(t.TempDir(), "node.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	for _, node := range nodes {
+		if err := store.InsertNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func healthOf(t *testing.T, store storage.Store) map[string]storage.NodeHealth {
+	t.Helper()
+	list, err := store.ListNodeHealth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := make(map[string]storage.NodeHealth)
+	for _, health := range list {
+		byID[health.ComputerID] = health
+	}
+	return byID
+}
+
+func TestProbeRecordsResults(t *testing.T) {
+	store := openStore(t,
+		storage.Node{ComputerID: "self", IPAddress: "10.0.0.1:80", Reachable: true},
+		storage.Node{ComputerID: "up", IPAddress: "10.0.0.2:80", Reachable: true},
+		storage.Node{ComputerID: "down", IPAddress: "10.0.0.3:80", Reachable: true},
+		storage.Node{ComputerID: "failing", IPAddress: "10.0.0.4:80", Reachable: true},
+		storage.Node{ComputerID: "unlisted", Reachable: true},
+	)
+	pinger := &fakePinger{statuses: map[string]int{"10.0.0.2:80": http.StatusOK, "10.0.0.4:80": http.StatusInternalServerError}}
+	monitor := liveness.New(store, pinger, probe.New(probe.Config{}), "self", liveness.Config{})
+
+	if err := monitor.Probe(); err != nil {
+		t.Fatal(err)
+	}
+	health := healthOf(t, store)
+	if up := health["up"]; up.LastSeen == 0 || up.Failures != 0 || up.Checks != 1 || up.History != "1" || !up.Reachable {
+		t.Errorf("node that answered: %+v", up)
+	}
+	for _, id := range []string{"down", "failing"} {
+		if h := health[id]; h.LastSeen != 0 || h.Failures != 1 || h.History != "0" || h.Reachable || h.Since == 0 {
+			t.Errorf("node %s that did not answer: %+v", id, h)
+		}
+	}
+	for _, id := range []string{"self", "unlisted"} {
+		if h := health[id]; h.Since != 0 {
+			t.Errorf("node %s was probed: %+v", id, h)
+		}
+	}
+
+	// Nodes are not probed again within the interval
+	if err := monitor.Probe(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pinger.pinged) != 3 {
+		t.Errorf("pinged %v, expected each of the 3 other nodes once", pinger.pinged)
+	}
+}
+
+func TestScore(t *testing.T) {
+	monitor := liveness.New(nil, nil, nil, "self", liveness.Config{MinChecks: 5, Threshold: 0.5, EvictAfter: 4 * time.Hour})
+	now := time.Now()
+	recent := now.Add(-time.Minute).Unix()
+
+	tests := []struct {
+		name        string
+		health      storage.NodeHealth
+		healthy     bool
+		unreachable bool
+	}{
+		{"never probed", storage.NodeHealth{}, true, false},
+		{"failing within the grace", storage.NodeHealth{Since: recent, Checks: 4, History: "0000"}, true, false},
+		{"failing after the grace", storage.NodeHealth{Since: recent, Checks: 5, History: "00000"}, false, false},
+		{"below the threshold", storage.NodeHealth{Since: recent, LastSeen: recent, Checks: 5, History: "00011"}, false, false},
+		{"at the threshold", storage.NodeHealth{Since: recent, LastSeen: recent, Checks: 6, History: "000111"}, true, false},
+		{"never answered for a while", storage.NodeHealth{Since: now.Add(-5 * time.Hour).Unix(), Checks: 600, History: "0"}, false, true},
+		{"never answered lately", storage.NodeHealth{Since: now.Add(-time.Hour).Unix(), Checks: 120, History: "0"}, false, false},
+		{"silent since answering", storage.NodeHealth{Since: now.Add(-9 * time.Hour).Unix(), LastSeen: now.Add(-5 * time.Hour).Unix(), Checks: 600, History: "0"}, false, true},
+		{"answered lately", storage.NodeHealth{Since: now.Add(-9 * time.Hour).Unix(), LastSeen: recent, Checks: 600, History: "01"}, true, false},
+	}
+	for _, test := range tests {
+		score := monitor.Score(test.health, now)
+		if score.Healthy != test.healthy || score.Unreachable != test.unreachable {
+			t.Errorf("%s: healthy %v, unreachable %v; expected %v, %v", test.name, score.Healthy, score.Unreachable, test.healthy, test.unreachable)
+		}
+	}
+}
+
+// The success rate only covers the latest HealthWindow probes.
+func TestHealthWindowRolls(t *testing.T) {
+	store := openStore(t, storage.Node{ComputerID: "node", IPAddress: "10.0.0.2:80", Reachable: true})
+	at := time.Now().Unix()
+	record := func(ok bool, n int) {
+		for i := 0; i < n; i++ {
+			at++
+			if err := store.RecordNodeProbes([]storage.NodeProbe{{ComputerID: "node", OK: ok, At: at}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	record(false, 10)
+	record(true, storage.HealthWindow)
+	health := healthOf(t, store)["node"]
+	if health.History != strings.Repeat("1", storage.HealthWindow) || health.SuccessRate() != 1 {
+		t.Errorf("history %q has rate %v, expected only the latest %d passes", health.History, health.SuccessRate(), storage.HealthWindow)
+	}
+	if health.Checks != 10+storage.HealthWindow || health.Failures != 0 {
+		t.Errorf("%d checks and %d failures, expected %d and 0", health.Checks, health.Failures, 10+storage.HealthWindow)
+	}
+
+	record(false, 3)
+	health = healthOf(t, store)["node"]
+	if len(health.History) != storage.HealthWindow || !strings.HasSuffix(health.History, "1000") || health.Failures != 3 {
+		t.Errorf("after 3 failures: history %q, %d failures", health.History, health.Failures)
+	}
+}
@@ -1,11 +1,25 @@
 package main
 
 import (
+	"bitcoin-sidechain/chain"
+	"bitcoin-sidechain/consensus"
 	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/custody"
+	"bitcoin-sidechain/epoch"
+	"bitcoin-sidechain/gossip"
+	"bitcoin-sidechain/liveness"
+	"bitcoin-sidechain/membership"
+	"bitcoin-sidechain/mempool"
 	"bitcoin-sidechain/networkUtils"
+	"bitcoin-sidechain/peg"
+	"bitcoin-sidechain/probe"
+	"bitcoin-sidechain/reconcile"
+	"bitcoin-sidechain/reserves"
+	"bitcoin-sidechain/storage"
 	"bufio"
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,6 +28,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -26,8 +41,219 @@ func main() {
 		fmt.Printf("Error loading config: %v\n", err)
 		os.Exit(1)
 	}
+	// The DEVNET and CONSENSUS environment variables override config.txt, so
+	// a devnet can allow private addresses and run a single node without
+	// changing the shipped config
+	for _, key := range []string{"DEVNET", "CONSENSUS"} {
+		if value := os.Getenv(key); value != "" {
+			config[key] = value
+		}
+	}
+	// Blocks are agreed on by the leader groups unless CONSENSUS=false lets
+	// the node produce them on its own
+	bft := config["CONSENSUS"] != "false"
 	port := config["PORT"]
 
+	// Open the storage backend (MySQL by default, SQLite with DB_DRIVER=sqlite3)
+	store, err = openStore(config)
+	if err != nil {
+		fmt.Printf("Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	// Load the node identity key, generating it on first start. The node's
+	// computer_id is the hash of its public key.
+	keyFile := config["NODE_KEY_FILE"]
+	if keyFile == "" {
+		keyFile = "node.key"
+	}
+	nodeKey, err := cryptoUtils.LoadOrCreateNodeKey(keyFile)
+	if err != nil {
+		fmt.Printf("Error loading node key: %v\n", err)
+		os.Exit(1)
+	}
+	identity = networkUtils.NewIdentity(nodeKey)
+
+	// Calls to other nodes only reach public addresses, unless DEVNET=true
+	// lets them reach private, loopback and link-local ones
+	outbound = networkUtils.NewOutbound(networkUtils.OutboundConfig{
+		AllowPrivate: config["DEVNET"] == "true",
+	})
+	nodeClient = networkUtils.NewClient(store, identity, outbound)
+	nodeAuth = networkUtils.NewVerifier(store, identity)
+	fmt.Printf("Node identity: computer_id %s, public key %s\n", identity.ID, cryptoUtils.PublicKeyBase64(nodeKey))
+
+	// Seed a fresh database from the genesis file, if one is configured
+	if genesisFile := config["GENESIS_FILE"]; genesisFile != "" {
+		if err := applyGenesis(genesisFile); err != nil {
+			fmt.Printf("Error applying genesis: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Hold signed transfers in the mempool until they are applied
+	pool = mempool.New(mempool.Config{
+		MaxTxs:       configInt(config, "MEMPOOL_MAX_TXS"),
+		MaxBytes:     configInt(config, "MEMPOOL_MAX_BYTES"),
+		MaxPerSender: configInt(config, "MEMPOOL_MAX_PER_SENDER"),
+	})
+
+	// Blocks are BLOCK_INTERVAL seconds apart
+	blockInterval := configInt(config, "BLOCK_INTERVAL")
+	if blockInterval <= 0 {
+		blockInterval = 10
+	}
+
+	// Rotate the leader group every EPOCH_LENGTH blocks, four hours by default
+	epochLength := int64(configInt(config, "EPOCH_LENGTH"))
+	if epochLength <= 0 {
+		epochLength = int64((4 * time.Hour) / (time.Duration(blockInterval) * time.Second))
+	}
+	groupSize := configInt(config, "EPOCH_GROUP_SIZE")
+	if groupSize <= 0 {
+		groupSize = 10
+	}
+	epochs = epoch.NewManager(store, epochLength, groupSize)
+	epochs.Subscribe(logEpoch)
+
+	// Requests to every peer at once run on PROBE_WORKERS goroutines, each
+	// with a deadline of PROBE_TIMEOUT seconds
+	peers = probe.New(probe.Config{
+		Workers: configInt(config, "PROBE_WORKERS"),
+		Timeout: time.Duration(configInt(config, "PROBE_TIMEOUT")) * time.Second,
+	})
+
+	// Ping every node each LIVENESS_INTERVAL seconds. A node answering fewer
+	// than LIVENESS_THRESHOLD percent of its pings is left out of the leader
+	// groups, and a node silent for a whole epoch is evicted
+	monitor = liveness.New(store, nodeClient, peers, identity.ID, liveness.Config{
+		Interval:   time.Duration(configInt(config, "LIVENESS_INTERVAL")) * time.Second,
+		Threshold:  float64(configInt(config, "LIVENESS_THRESHOLD")) / 100,
+		EvictAfter: time.Duration(epochLength*int64(blockInterval)) * time.Second,
+	})
+	go monitor.Run(nil)
+
+	// New nodes wait in the buffer until the next epoch, are probed in the
+	// queue for PROBATION_EPOCHS epochs and are admitted by the block that
+	// starts a later epoch
+	members := membership.New(store, epochs, nodeClient, peers, monitor, membership.Config{
+		ProbationEpochs: configInt(config, "PROBATION_EPOCHS"),
+		ProbeInterval:   time.Duration(configInt(config, "PROBE_INTERVAL")) * time.Second,
+		MinPasses:       configInt(config, "PROBATION_CHECKS"),
+		MaxAdmissions:   configInt(config, "MAX_ADMISSIONS"),
+	})
+	epochs.Subscribe(members.OnEpoch)
+
+	// The custodians of each epoch, its group 1, take over the peg key at
+	// the epoch boundary. A custodian that sends nothing for CUSTODY_TIMEOUT
+	// seconds is passed over
+	if bft {
+		custodyOutbound := networkUtils.NewOutbound(networkUtils.OutboundConfig{
+			AllowPrivate:    config["DEVNET"] == "true",
+			Timeout:         5 * time.Second,
+			MaxResponseSize: 8 << 20,
+		})
+		custodian = custody.New(store, nodeKey, custody.NewHTTPTransport(custodyOutbound), custody.Config{
+			Timeout: time.Duration(configInt(config, "CUSTODY_TIMEOUT")) * time.Second,
+		})
+		epochs.Subscribe(custodian.OnEpoch)
+		http.HandleFunc("POST /custody", custody.Handler(custodian))
+	}
+	go epochs.Run(time.Duration(blockInterval)*time.Second, nil)
+	go members.Run(nil)
+
+	// Find peers by gossip, starting from the SEEDS addresses, and register
+	// the new ones. PUBLIC_ADDRESS is the host:port other nodes reach this
+	// node at; without it the node learns peers but does not announce itself
+	agent := gossip.New(store, outbound, nodeClient, peers, gossip.Config{
+		Self:        config["PUBLIC_ADDRESS"],
+		PublicKey:   cryptoUtils.PublicKeyBase64(nodeKey),
+		Seeds:       configList(config, "SEEDS"),
+		Interval:    time.Duration(configInt(config, "GOSSIP_INTERVAL")) * time.Second,
+		MaxPeers:    configInt(config, "ADDRESS_BOOK_SIZE"),
+		SourceLimit: configInt(config, "GOSSIP_SOURCE_LIMIT"),
+	})
+	go agent.Run(nil)
+
+	// With BITCOIN_RPC_URL configured, watch Bitcoin through that bitcoind
+	// for deposits to the peg and credit them once PEGIN_CONFIRMATIONS deep.
+	// Scanning starts at PEGIN_START_HEIGHT, or at the tip on first start.
+	// Withdrawals are paid in batches the custodians sign, one coordinator
+	// turn every PEGOUT_INTERVAL seconds, at PEGOUT_FEE_RATE sats per vbyte
+	if config["BITCOIN_RPC_URL"] != "" {
+		network, err := peg.Network(config["BITCOIN_NETWORK"])
+		if err != nil {
+			fmt.Printf("Error loading config: %v\n", err)
+			os.Exit(1)
+		}
+		backend := peg.NewRPCBackend(config["BITCOIN_RPC_URL"], config["BITCOIN_RPC_USER"], config["BITCOIN_RPC_PASSWORD"], 30*time.Second)
+		bitcoin = peg.NewWatcher(store, backend, peg.NewHTTPAnnouncer(store, outbound, peers, identity.ID), peg.Config{
+			Network:       network,
+			Confirmations: configInt(config, "PEGIN_CONFIRMATIONS"),
+			Interval:      time.Duration(configInt(config, "PEGIN_INTERVAL")) * time.Second,
+			StartHeight:   int64(configInt(config, "PEGIN_START_HEIGHT")),
+		})
+		go bitcoin.Run(nil)
+		http.HandleFunc("GET /deposit/{wallet}", peg.AddressHandler(bitcoin))
+		http.HandleFunc("POST /deposit/addresses", peg.AnnounceHandler(bitcoin))
+		http.HandleFunc("POST /pegout/payouts", peg.PayoutHandler(bitcoin))
+
+		if bft {
+			signingOutbound := networkUtils.NewOutbound(networkUtils.OutboundConfig{
+				AllowPrivate:    config["DEVNET"] == "true",
+				Timeout:         10 * time.Second,
+				MaxResponseSize: 4 << 20,
+			})
+			payer = peg.NewPayer(store, bitcoin, nodeKey, peg.NewHTTPPayoutTransport(store, signingOutbound, peers, identity.ID), peg.PayerConfig{
+				Interval: time.Duration(configInt(config, "PEGOUT_INTERVAL")) * time.Second,
+				FeeRate:  int64(configInt(config, "PEGOUT_FEE_RATE")),
+			})
+			go payer.Run(nil)
+			http.HandleFunc("POST /pegout/commit", peg.CommitHandler(payer))
+			http.HandleFunc("POST /pegout/sign", peg.SignHandler(payer))
+		}
+		http.HandleFunc("POST /withdraw", withdrawHandler)
+		http.HandleFunc("GET /withdraw/{txid}", peg.WithdrawalHandler(bitcoin, payer))
+	}
+
+	// Report the reserves backing the supply, attested by the leaders of the
+	// active group. Leaders remember their report of each block for a while
+	reservesOutbound := networkUtils.NewOutbound(networkUtils.OutboundConfig{
+		AllowPrivate:    config["DEVNET"] == "true",
+		Timeout:         5 * time.Second,
+		MaxResponseSize: 4 << 10,
+	})
+	auditor := reserves.New(store, epochs, bitcoin, nodeKey, reserves.NewHTTPTransport(reservesOutbound))
+	go auditor.Run(time.Duration(blockInterval)*time.Second, nil)
+	http.HandleFunc("GET /reserves", reserves.Handler(auditor))
+	http.HandleFunc("POST /reserves/attest", reserves.AttestHandler(auditor))
+
+	// Blocks are agreed on by the active leader group. With CONSENSUS=false
+	// the node produces blocks on its own, for local development.
+	if bft {
+		// Leaders answer within seconds, and a proposal can carry a whole block
+		consensusOutbound := networkUtils.NewOutbound(networkUtils.OutboundConfig{
+			AllowPrivate:    config["DEVNET"] == "true",
+			Timeout:         5 * time.Second,
+			MaxResponseSize: 32 << 20,
+		})
+		engine := consensus.NewEngine(store, pool, epochs, members, bitcoin, nodeKey, consensus.NewHTTPTransport(consensusOutbound), consensus.Config{
+			CommitDelay:     time.Duration(blockInterval) * time.Second,
+			FailoverTimeout: time.Duration(configInt(config, "FAILOVER_TIMEOUT")) * time.Second,
+			MaxBlockTxs:     configInt(config, "BLOCK_MAX_TXS"),
+		})
+		http.HandleFunc("POST /consensus", consensus.Handler(engine))
+		go engine.Run(nil)
+	} else {
+		producerID := config["PRODUCER_ID"]
+		if producerID == "" {
+			producerID, _ = os.Hostname()
+		}
+		producer := chain.NewProducer(store, pool, members, bitcoin, producerID, configInt(config, "BLOCK_MAX_TXS"))
+		go producer.Run(time.Duration(blockInterval)*time.Second, nil)
+	}
+
 	// Front End Pages
 	http.HandleFunc("/", rootHandler)
 	http.HandleFunc("/sendTransaction", sendTransactionHandler)
@@ -36,17 +262,31 @@ func main() {
 
 	// API Endpoints ------
 	http.HandleFunc("/addNodeRequest", addNodeRequest)
-	http.HandleFunc("/ping", pingHandler)
+	http.HandleFunc("/ping", nodeAuth.Require(pingHandler))
+	http.HandleFunc("GET /nodeChallenge", networkUtils.ChallengeHandler(identity, config["PUBLIC_ADDRESS"]))
 
 	// Work In Progress
 	http.HandleFunc("/walletbalance", checkWalletBalance)
+	http.HandleFunc("GET /wallet/{address}/transactions", walletTransactions)
 	http.HandleFunc("/verifysignature", VerifySignatureHandler)
+	http.HandleFunc("GET /mempool", mempoolHandler)
+	http.HandleFunc("GET /block/latest", latestBlockHandler)
+	http.HandleFunc("GET /block/{height}", blockHandler)
+	http.HandleFunc("GET /epoch/current", currentEpochHandler)
+	http.HandleFunc("GET /epoch/{number}", epochHandler)
+	http.HandleFunc("GET /nodes/health", nodeHealthHandler)
+	http.HandleFunc("POST /peers/exchange", agent.ExchangeHandler)
+	http.HandleFunc("GET /peers", agent.PeersHandler)
+	http.HandleFunc("GET /custody/latest", custody.LatestHandler(store))
 	http.HandleFunc("/makewallet", insertNewWallet)
 	http.HandleFunc("/talkToOtherServer", TalkToOtherServers)
 	http.HandleFunc("/database", serveDatabaseHandler("nodes.db"))
 	http.HandleFunc("/downloadData", fileDownloadHandler)
-	http.HandleFunc("/syncNodeList", syncNodeList)
-	http.HandleFunc("/queData", queData)
+	http.HandleFunc("/syncNodeList", nodeAuth.Require(syncNodeList))
+	http.HandleFunc("/queData", nodeAuth.Require(queData))
+	http.HandleFunc("GET /sync/digest", nodeAuth.Require(reconcile.DigestHandler(store)))
+	http.HandleFunc("GET /sync/{set}/buckets", nodeAuth.Require(reconcile.BucketsHandler(store)))
+	http.HandleFunc("GET /sync/{set}/entries", nodeAuth.Require(reconcile.EntriesHandler(store)))
 
 	// internal node functions (not for use as an API endpoint)
 	http.HandleFunc("/shuffleDatabase", shuffleDatabase)
@@ -65,6 +305,94 @@ func main() {
 
 }
 
+// store is the node's storage backend, opened in main from config.txt.
+var store storage.Store
+
+// pool holds signed transfers that are validated but not yet applied.
+var pool *mempool.Pool
+
+// epochs rotates the leader group as blocks are produced.
+var epochs *epoch.Manager
+
+// peers runs the requests that go to every node at once.
+var peers *probe.Pool
+
+// monitor probes the other nodes and scores their liveness.
+var monitor *liveness.Monitor
+
+// custodian takes part in the peg key handoffs; nil with CONSENSUS=false.
+var custodian *custody.Manager
+
+// bitcoin watches Bitcoin for peg-ins and payouts; nil without
+// BITCOIN_RPC_URL.
+var bitcoin *peg.Watcher
+
+// payer signs and coordinates payouts of withdrawals; nil without
+// BITCOIN_RPC_URL or with CONSENSUS=false.
+var payer *peg.Payer
+
+// identity is the node's key and the computer_id derived from it.
+var identity networkUtils.Identity
+
+// outbound makes every HTTP call to an address given by a client or a peer.
+var outbound *networkUtils.Outbound
+
+// nodeClient sends signed requests to other nodes and checks their answers.
+var nodeClient *networkUtils.Client
+
+// nodeAuth checks the signature of requests from other nodes.
+var nodeAuth *networkUtils.Verifier
+
+// openStore opens the storage backend named by DB_DRIVER and DB_DSN in the
+// config. Without them the node uses the docker-compose MySQL container.
+func openStore(config map[string]string) (storage.Store, error) {
+	driver := config["DB_DRIVER"]
+	if driver == "" {
+		driver = "mysql"
+	}
+	dsn := config["DB_DSN"]
+	if dsn == "" {
+		switch driver {
+		case "mysql":
+			dsn = "node:test@tcp(node-1-database:3306)/node"
+		default:
+			dsn = "node.db"
+		}
+	}
+	return storage.Open(driver, dsn)
+}
+
+// applyGenesis loads the genesis file and seeds the database with it. It is
+// skipped on a database that already has wallets or nodes. A node with a
+// public key gets the hash of that key as its computer_id.
+func applyGenesis(filename string) error {
+	genesis, err := storage.LoadGenesis(filename)
+	if err != nil {
+		return err
+	}
+	for i, node := range genesis.Nodes {
+		if node.PublicKey == "" {
+			continue
+		}
+		computerID, err := cryptoUtils.NodeIDFromBase64(node.PublicKey)
+		if err != nil {
+			return fmt.Errorf("invalid public key of genesis node %s: %w", node.IPAddress, err)
+		}
+		if node.ComputerID != "" && node.ComputerID != computerID {
+			return fmt.Errorf("computer_id of genesis node %s must be %s, the hash of its public key", node.IPAddress, computerID)
+		}
+		genesis.Nodes[i].ComputerID = computerID
+	}
+	applied, err := store.ApplyGenesis(genesis)
+	if err != nil {
+		return err
+	}
+	if applied {
+		fmt.Printf("Genesis applied: %d wallets, %d nodes\n", len(genesis.Wallets), len(genesis.Nodes))
+	}
+	return nil
+}
+
 // Copy to a function where you want to simulate a delay.
 // Generate a random duration between 500 ms and 1 second
 // duration := time.Duration(rand.Intn(501)+2000) * time.Millisecond
@@ -109,14 +437,28 @@ func LoadConfig(filename string) (map[string]string, error) {
 	return config, nil
 }
 
-func FetchJSON(url string) (map[string]interface{}, error) {
-	resp, err := http.Get(url)
+// configInt returns an integer config value, or 0 if it is missing or invalid.
+func configInt(config map[string]string, key string) int {
+	value, err := strconv.Atoi(config[key])
 	if err != nil {
-		return nil, err
+		return 0
 	}
-	defer resp.Body.Close()
+	return value
+}
+
+// configList returns the comma separated values of a config key.
+func configList(config map[string]string, key string) []string {
+	var values []string
+	for _, value := range strings.Split(config[key], ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+func FetchJSON(url string) (map[string]interface{}, error) {
+	_, body, err := outbound.Get(url)
 	if err != nil {
 		return nil, err
 	}
@@ -150,16 +492,9 @@ func walletBalance(w http.ResponseWriter, r *http.Request) {
 
 // API Endpoints
 func VerifySignatureHandler(w http.ResponseWriter, r *http.Request) {
-	type Transaction struct {
-		From   string `json:"from"`
-		To     string `json:"to"`
-		Amount string `json:"amount"`
-		Nonce  string `json:"nonce"`
-	}
-
 	type KeySignRequest struct {
-		Signature   string      `json:"signature"`
-		Transaction Transaction `json:"transaction"`
+		Signature   string                  `json:"signature"`
+		Transaction cryptoUtils.Transaction `json:"transaction"`
 	}
 
 	// Decode the incoming JSON request
@@ -172,80 +507,266 @@ func VerifySignatureHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close() // Close the request body
 
-	// Convert the Transaction back to a JSON string
-	transactionJSON, err := json.Marshal(req.Transaction)
-	if err != nil {
+	// Verify the signature and queue the transfer in the mempool
+	response := map[string]string{}
+	status := http.StatusOK
+	tx, err := admitTransaction(req.Signature, req.Transaction)
+	switch {
+	case err == nil:
+		response["message"] = "Valid"
+		response["status"] = "pending"
+		response["tx_id"] = tx.TxID
+	case errors.Is(err, cryptoUtils.ErrInvalidSignature),
+		errors.Is(err, storage.ErrNonceUsed),
+		errors.Is(err, storage.ErrNotFound),
+		errors.Is(err, storage.ErrInsufficientFunds),
+		errors.Is(err, storage.ErrInvalidAmount),
+		errors.Is(err, peg.ErrInvalidWithdrawal),
+		errors.Is(err, mempool.ErrDuplicate),
+		errors.Is(err, mempool.ErrNonceInPool):
+		// Log for debugging
+		fmt.Println("Transaction rejected:", err)
+		response["message"] = "Invalid"
+		response["reason"] = err.Error()
+		status = http.StatusBadRequest
+	case errors.Is(err, mempool.ErrPoolFull):
+		fmt.Println("Transaction rejected:", err)
+		response["message"] = "Invalid"
+		response["reason"] = err.Error()
+		status = http.StatusServiceUnavailable
+	default:
 		// Print error to the console
-		fmt.Println("Error converting transaction to JSON:", err)
+		fmt.Println("Error processing transaction:", err)
 		http.Error(w, "Error processing request", http.StatusInternalServerError)
 		return
 	}
 
-	// Assuming cryptoUtils.VerifySignature is your verification function
-	publicKey := req.Transaction.From
-	toAddress := req.Transaction.To
-	amount := req.Transaction.Amount
-	nonce := req.Transaction.Nonce
-
-	signature := req.Signature
-	message := string(transactionJSON) // The JSON string of the transaction
-
-	// Check if the signature is valid
-	verificationResult, err := cryptoUtils.VerifySignature(signature, publicKey, message)
-	if err != nil {
+	// Set the content type and encode the response as JSON
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
 		// Print error to the console
-		fmt.Println("Error verifying signature:", err)
-		http.Error(w, "Error processing request", http.StatusInternalServerError)
-		return
+		fmt.Println("Error encoding response:", err)
 	}
+}
 
-	// Make wallet if it doesn't exist (convert to use MySQL)
-	databaseFile := "node-1-database" // Update to use MySQL (use the DSN from your Docker config)
-	nonceValidation, nonceError := cryptoUtils.CheckNonce(databaseFile, nonce)
-	if nonceError != nil {
-		// Print error to the console
-		fmt.Println("Error checking nonce:", nonceError)
-		http.Error(w, "Error processing request", http.StatusInternalServerError)
+// withdrawHandler queues a signed transfer to a Bitcoin address. The amount
+// is burnt when a block applies the transfer and paid out by the custodians
+// in a later batch; GET /withdraw/{txid} follows it.
+func withdrawHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Signature   string                  `json:"signature"`
+		Transaction cryptoUtils.Transaction `json:"transaction"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	defer r.Body.Close()
 
-	// Convert to use MySQL for NewWallet
-	_, walletError := cryptoUtils.NewWallet(toAddress, databaseFile)
-	if walletError != nil {
-		// Print error to the console
-		fmt.Println("Error creating wallet:", walletError)
-		http.Error(w, "Error processing request", http.StatusInternalServerError)
+	// Check the transfer pays a Bitcoin address
+	if _, ok := storage.WithdrawalAddress(req.Transaction.To); !ok {
+		http.Error(w, fmt.Sprintf("destination must start with %q", storage.WithdrawalPrefix), http.StatusBadRequest)
 		return
 	}
 
-	// Convert to use MySQL for MoveSats
-	moveError := cryptoUtils.MoveSats(publicKey, toAddress, amount, databaseFile)
-	if moveError != nil {
-		// Print error to the console
-		fmt.Println("Error moving sats:", moveError)
+	tx, err := admitTransaction(req.Signature, req.Transaction)
+	switch {
+	case err == nil:
+	case errors.Is(err, cryptoUtils.ErrInvalidSignature),
+		errors.Is(err, storage.ErrNonceUsed),
+		errors.Is(err, storage.ErrNotFound),
+		errors.Is(err, storage.ErrInsufficientFunds),
+		errors.Is(err, storage.ErrInvalidAmount),
+		errors.Is(err, peg.ErrInvalidWithdrawal),
+		errors.Is(err, mempool.ErrDuplicate),
+		errors.Is(err, mempool.ErrNonceInPool):
+		fmt.Println("Withdrawal rejected:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, mempool.ErrPoolFull):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		fmt.Println("Error processing withdrawal:", err)
 		http.Error(w, "Error processing request", http.StatusInternalServerError)
 		return
 	}
 
-	// Create the response object
-	response := map[string]string{}
-	if verificationResult == "valid" && !nonceValidation {
-		response["message"] = "Valid"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"tx_id":  tx.TxID,
+		"status": "pending",
+		"track":  "/withdraw/" + tx.TxID,
+	})
+}
+
+// admitTransaction validates a signed transaction against the ledger and the
+// transfers already pending from the same wallet, then adds it to the mempool.
+// A transfer to a Bitcoin address must be one the peg can pay. The checks are
+// repeated when the transfer is applied.
+func admitTransaction(signature string, transaction cryptoUtils.Transaction) (*mempool.Tx, error) {
+	transfer, err := cryptoUtils.ValidateTransaction(signature, transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check a withdrawal can be paid
+	if _, ok := storage.WithdrawalAddress(transfer.To); ok {
+		if bitcoin == nil {
+			return nil, fmt.Errorf("%w: this node has no Bitcoin backend", peg.ErrInvalidWithdrawal)
+		}
+		if err := bitcoin.CheckWithdrawal(transfer); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check the transfer is not already pending
+	if _, ok := pool.Get(transfer.TxID); ok {
+		return nil, mempool.ErrDuplicate
+	}
+
+	// Check the nonce has not been consumed by an applied transfer
+	used, err := store.NonceUsed(transfer.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if used {
+		return nil, fmt.Errorf("%w: %s", storage.ErrNonceUsed, transfer.Nonce)
+	}
+
+	// Check the sender can cover this transfer on top of its pending ones
+	balance, err := store.GetBalance(transfer.From)
+	if err != nil {
+		return nil, err
+	}
+	if balance < pool.PendingAmount(transfer.From)+transfer.Amount {
+		return nil, storage.ErrInsufficientFunds
+	}
+
+	return pool.Add(transfer)
+}
+
+// mempoolHandler lists the pending transactions in arrival order. The
+// optional sender query parameter limits the list to one wallet.
+func mempoolHandler(w http.ResponseWriter, r *http.Request) {
+	type MempoolResponse struct {
+		Count        int          `json:"count"`
+		Bytes        int          `json:"bytes"`
+		Transactions []mempool.Tx `json:"transactions"`
+	}
+
+	var pending []mempool.Tx
+	if sender := r.URL.Query().Get("sender"); sender != "" {
+		pending = pool.BySender(sender)
 	} else {
-		// Log for debugging
-		fmt.Println("Verification Result:", verificationResult)
-		fmt.Println("Nonce already used:", nonceValidation, "nonceError?", nonceError)
-		response["message"] = "Invalid"
+		pending = pool.Pending(0)
 	}
 
-	// Set the content type and encode the response as JSON
+	response := MempoolResponse{
+		Count:        pool.Len(),
+		Bytes:        pool.Bytes(),
+		Transactions: pending,
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		// Print error to the console
 		fmt.Println("Error encoding response:", err)
-		http.Error(w, "Error processing request", http.StatusInternalServerError)
+	}
+}
+
+// blockHandler returns the block at the height in the path, with its transfers.
+func blockHandler(w http.ResponseWriter, r *http.Request) {
+	height, err := strconv.ParseInt(r.PathValue("height"), 10, 64)
+	if err != nil || height <= 0 {
+		http.Error(w, "Invalid block height", http.StatusBadRequest)
 		return
 	}
+	writeBlock(w, func() (storage.Block, error) { return store.GetBlock(height) })
+}
+
+// latestBlockHandler returns the highest block, with its transfers.
+func latestBlockHandler(w http.ResponseWriter, r *http.Request) {
+	writeBlock(w, store.LatestBlock)
+}
+
+// writeBlock loads a block and encodes it as JSON, or answers 404 if there is
+// no such block.
+func writeBlock(w http.ResponseWriter, load func() (storage.Block, error)) {
+	block, err := load()
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Block not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading block:", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(block); err != nil {
+		fmt.Println("Error encoding response:", err)
+	}
+}
+
+// logEpoch prints the leaders of a new epoch.
+func logEpoch(event epoch.Event) {
+	var leaders []string
+	for _, member := range event.Epoch.Leaders() {
+		leaders = append(leaders, member.IPAddress)
+	}
+	fmt.Printf("Epoch %d started at block %d, leaders: %s\n", event.Epoch.Number, event.Epoch.StartHeight, strings.Join(leaders, ", "))
+}
+
+// epochHandler returns the epoch with the number in the path and its groups.
+func epochHandler(w http.ResponseWriter, r *http.Request) {
+	number, err := strconv.ParseInt(r.PathValue("number"), 10, 64)
+	if err != nil || number < 0 {
+		http.Error(w, "Invalid epoch number", http.StatusBadRequest)
+		return
+	}
+	writeEpoch(w, func() (storage.Epoch, error) { return store.GetEpoch(number) })
+}
+
+// currentEpochHandler returns the latest epoch and its groups.
+func currentEpochHandler(w http.ResponseWriter, r *http.Request) {
+	writeEpoch(w, epochs.Current)
+}
+
+// writeEpoch loads an epoch and encodes it as JSON, or answers 404 if there is
+// no such epoch.
+func writeEpoch(w http.ResponseWriter, load func() (storage.Epoch, error)) {
+	current, err := load()
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Epoch not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading epoch:", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(current); err != nil {
+		fmt.Println("Error encoding response:", err)
+	}
+}
+
+// nodeHealthHandler returns the liveness score of every node as this node
+// sees it.
+func nodeHealthHandler(w http.ResponseWriter, r *http.Request) {
+	scores, err := monitor.Scores()
+	if err != nil {
+		fmt.Println("Error loading node health:", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(scores); err != nil {
+		fmt.Println("Error encoding response:", err)
+	}
 }
 
 func checkWalletBalance(w http.ResponseWriter, r *http.Request) {
@@ -270,20 +791,10 @@ func checkWalletBalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Open the SQLite database
-	db, err := sql.Open("sqlite3", "nodeList1.db")
-	if err != nil {
-		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
-		log.Println("Database connection error:", err)
-		return
-	}
-	defer db.Close()
-
 	// Query the wallet balance
-	var balance float64
-	err = db.QueryRow("SELECT balance FROM wallet_balances WHERE wallet = ?", req.Wallet).Scan(&balance)
+	balance, err := store.GetBalance(req.Wallet)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, storage.ErrNotFound) {
 			// Wallet not found
 			response := WalletBalanceResponse{
 				Status:  "error",
@@ -301,8 +812,114 @@ func checkWalletBalance(w http.ResponseWriter, r *http.Request) {
 	// Wallet found, send the balance
 	response := WalletBalanceResponse{
 		Status:  "success",
-		Balance: balance,
+		Balance: float64(balance),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// walletTransactions returns the transfers into and out of a wallet, newest
+// first. Wallet addresses contain "/" and "+", so the address must be URL
+// encoded. Query parameters:
+//
+//	direction  "in", "out" or empty for both
+//	since      only transfers at or after this unix time
+//	until      only transfers at or before this unix time
+//	limit      page size, 50 by default and at most 200
+//	cursor     next_cursor from the previous page
+func walletTransactions(w http.ResponseWriter, r *http.Request) {
+	type HistoryEntry struct {
+		TxID         string `json:"tx_id"`
+		Seq          int64  `json:"seq"`
+		Direction    string `json:"direction"`
+		Counterparty string `json:"counterparty"`
+		Amount       int64  `json:"amount"`
+		Nonce        string `json:"nonce"`
+		Timestamp    int64  `json:"timestamp"`
+	}
+
+	type HistoryResponse struct {
+		Wallet       string         `json:"wallet"`
+		Transactions []HistoryEntry `json:"transactions"`
+		NextCursor   string         `json:"next_cursor,omitempty"`
+	}
+
+	query := storage.HistoryQuery{
+		Wallet:    r.PathValue("address"),
+		Direction: r.URL.Query().Get("direction"),
+		Limit:     50,
+	}
+	if query.Direction != "" && query.Direction != "in" && query.Direction != "out" {
+		http.Error(w, "direction must be in or out", http.StatusBadRequest)
+		return
+	}
+
+	// Parse the optional numeric parameters
+	for name, target := range map[string]*int64{
+		"since":  &query.Since,
+		"until":  &query.Until,
+		"cursor": &query.BeforeSeq,
+	} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid "+name, http.StatusBadRequest)
+			return
+		}
+		*target = parsed
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 200 {
+			http.Error(w, "limit must be between 1 and 200", http.StatusBadRequest)
+			return
+		}
+		query.Limit = limit
+	}
+
+	// Ask for one extra entry to know whether there is another page
+	pageSize := query.Limit
+	query.Limit++
+	transfers, err := store.ListWalletTransfers(query)
+	if err != nil {
+		http.Error(w, "Failed to query transactions", http.StatusInternalServerError)
+		log.Println("Query error:", err)
+		return
 	}
+
+	response := HistoryResponse{
+		Wallet:       query.Wallet,
+		Transactions: []HistoryEntry{},
+	}
+	if len(transfers) > pageSize {
+		transfers = transfers[:pageSize]
+		response.NextCursor = strconv.FormatInt(transfers[pageSize-1].Seq, 10)
+	}
+	for _, t := range transfers {
+		entry := HistoryEntry{
+			TxID:      t.TxID,
+			Seq:       t.Seq,
+			Amount:    t.Amount,
+			Nonce:     t.Nonce,
+			Timestamp: t.Timestamp,
+		}
+		switch {
+		case t.From == t.To:
+			entry.Direction = "self"
+			entry.Counterparty = t.To
+		case t.To == query.Wallet:
+			entry.Direction = "in"
+			entry.Counterparty = t.From
+		default:
+			entry.Direction = "out"
+			entry.Counterparty = t.To
+		}
+		response.Transactions = append(response.Transactions, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -310,7 +927,7 @@ func pingHandler(w http.ResponseWriter, r *http.Request) {
 	// PingResponse represents the structure of the JSON response
 	type PingResponse struct {
 		LocalIP  string `json:"local_ip"`
-		GlobalIP string `json:"global_ip"`
+		GlobalIP string `json:"global_ip,omitempty"`
 	}
 
 	localIP, err := networkUtils.GetLocalIP()
@@ -319,10 +936,11 @@ func pingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The answer is what liveness probes check, so it must not depend on
+	// reaching the outside service that reports the global IP
 	globalIP, err := networkUtils.GetGlobalIP()
 	if err != nil {
-		http.Error(w, "Error getting global IP", http.StatusInternalServerError)
-		return
+		fmt.Println("Error getting global IP:", err)
 	}
 
 	response := PingResponse{
@@ -336,7 +954,12 @@ func pingHandler(w http.ResponseWriter, r *http.Request) {
 
 // Work In Progress
 func hashDatabaseHandler(w http.ResponseWriter, r *http.Request) {
-	hash := cryptoUtils.ComputeDatabaseHash()
+	hash, err := cryptoUtils.ComputeDatabaseHash(store)
+	if err != nil {
+		log.Println("Error hashing nodes table:", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
 	response := map[string]string{"hash": hash}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -344,8 +967,7 @@ func hashDatabaseHandler(w http.ResponseWriter, r *http.Request) {
 
 func insertNewWallet(w http.ResponseWriter, r *http.Request) {
 
-	databaseFile := "nodeList1.db"
-	cryptoUtils.NewWallet("Gasp, can it be!", databaseFile)
+	cryptoUtils.NewWallet(store, "Gasp, can it be!")
 }
 
 func TalkToOtherServers(w http.ResponseWriter, r *http.Request) {
@@ -353,10 +975,11 @@ func TalkToOtherServers(w http.ResponseWriter, r *http.Request) {
 	time.Sleep(5 * time.Second)
 
 	// URL to fetch JSON data from
-	url := "http://node-1/ping"
+	url := "http://node-1:80/ping"
 	data, err := FetchJSON(url)
 	if err != nil {
-		log.Fatalf("Error fetching JSON: %v", err)
+		log.Printf("Error fetching JSON: %v", err)
+		return
 	}
 
 	fmt.Println("Received JSON:", data)
@@ -380,7 +1003,11 @@ func serveDatabaseHandler(filePath string) http.HandlerFunc {
 
 func downloadFileFromEndpoint(endpoint, directory string) error {
 	// Send GET request to the endpoint
-	resp, err := http.Get(endpoint)
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := outbound.Open(req)
 	if err != nil {
 		return fmt.Errorf("failed to fetch file from endpoint: %w", err)
 	}
@@ -397,10 +1024,11 @@ func downloadFileFromEndpoint(endpoint, directory string) error {
 	if contentDisposition != "" {
 		_, params, err := mime.ParseMediaType(contentDisposition)
 		if err == nil {
-			filename = params["filename"]
+			// Never let the server pick a path outside the directory
+			filename = filepath.Base(params["filename"])
 		}
 	}
-	if filename == "" {
+	if filename == "" || filename == "." || filename == ".." || filename == string(filepath.Separator) {
 		return fmt.Errorf("could not determine filename from response headers")
 	}
 
@@ -426,8 +1054,8 @@ func downloadFileFromEndpoint(endpoint, directory string) error {
 
 func fileDownloadHandler(w http.ResponseWriter, r *http.Request) {
 	// Example usage
-	endpoint := "http://node-1/database" // Replace with the actual endpoint
-	directory := "./database_downloads"  // Replace with your desired directory
+	endpoint := "http://node-1:80/database" // Replace with the actual endpoint
+	directory := "./database_downloads"     // Replace with your desired directory
 
 	// Create the directory if it doesn't exist
 	if err := os.MkdirAll(directory, os.ModePerm); err != nil {
@@ -442,36 +1070,42 @@ func fileDownloadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // internal node functions (not for use as an API endpoint)
+// shuffleDatabase starts any epoch that is due. The nodes table is only
+// reshuffled at epoch boundaries, so every node keeps the same groups.
 func shuffleDatabase(w http.ResponseWriter, r *http.Request) {
-	groupSize := 2
-	shuffleSeed := 8574848843759384334
-
-	data, _ := cryptoUtils.GetDataFromDatabase()
-	shuffledData := cryptoUtils.ShuffleResults(data, int64(shuffleSeed))
-	orderedData := cryptoUtils.AssignNewOrderBy(shuffledData)
-	groupedData := cryptoUtils.AssignNodeGroups(orderedData, groupSize)
-	cryptoUtils.UpdateNodesTable(groupedData)
+	started, err := epochs.Advance()
+	if err != nil {
+		fmt.Println("Error advancing epoch:", err)
+		http.Error(w, "Failed to shuffle nodes", http.StatusInternalServerError)
+		return
+	}
 
 	// Respond to the client
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "Shuffle done!")
+	fmt.Fprintf(w, "Shuffle done! %d new epochs\n", started)
 }
 
 func addDummyNodes(w http.ResponseWriter, r *http.Request) {
-	cryptoUtils.InsertRandomData(2)
+	cryptoUtils.InsertRandomData(store, 2)
 	// Respond to the client
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintln(w, "insert Dummy Data Done")
 }
 
+// addNodeRequest registers a node that wants to join. The node must prove it
+// runs at the host:port it gives and holds the public key it gives, by
+// signing a challenge this node sends to that address; only then is the
+// address and key added to nodes_buffer.
 func addNodeRequest(w http.ResponseWriter, r *http.Request) {
 
 	type IncomingRequest struct {
 		IPAddress string `json:"ipaddress"`
+		PublicKey string `json:"public_key"`
 	}
 
 	type Response struct {
 		Message       string `json:"message"`
+		ComputerID    string `json:"computer_id,omitempty"`
 		InNodes       bool   `json:"in_nodes"`
 		InNodesQue    bool   `json:"in_nodes_que"`
 		InNodesBuffer bool   `json:"in_nodes_buffer"`
@@ -521,10 +1155,10 @@ func addNodeRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate the IPAddress field
-	if incoming.IPAddress == "" {
+	// Validate the IPAddress and PublicKey fields
+	if incoming.IPAddress == "" || incoming.PublicKey == "" {
 		errorResponse := ErrorResponse{
-			Message: "IP address is required",
+			Message: "IP address and public key are required",
 			Code:    http.StatusBadRequest,
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -532,59 +1166,45 @@ func addNodeRequest(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(errorResponse)
 		return
 	}
-
-	// Construct the /ping endpoint URL
-	pingURL := fmt.Sprintf("http://%s/ping", incoming.IPAddress)
-
-	// Perform the GET request to the /ping endpoint
-	resp, err := http.Get(pingURL)
-	if err != nil {
+	if err := networkUtils.ValidateAddress(incoming.IPAddress); err != nil {
 		errorResponse := ErrorResponse{
-			Message: fmt.Sprintf("Failed to reach %s: %v", pingURL, err),
-			Code:    http.StatusBadGateway,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
 		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadGateway)
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(errorResponse)
 		return
 	}
-	defer resp.Body.Close()
 
-	// Database connection setup
-	dsn := "node:test@tcp(node-1-database:3306)/node"
-	db, err := sql.Open("mysql", dsn)
+	// Challenge the node at the claimed address to sign a fresh nonce with
+	// the claimed key. The signed answer is kept as the registration other
+	// nodes check before they take the address from us
+	registration, err := nodeClient.Challenge(incoming.IPAddress, incoming.PublicKey)
 	if err != nil {
-		errorResponse := ErrorResponse{
-			Message: "Failed to connect to the database",
-			Code:    http.StatusInternalServerError,
+		fmt.Printf("Node registration of %s rejected: %v\n", incoming.IPAddress, err)
+		code := http.StatusBadGateway
+		switch {
+		case errors.Is(err, networkUtils.ErrChallengeFailed):
+			code = http.StatusForbidden
+		case errors.Is(err, networkUtils.ErrBlockedAddress):
+			code = http.StatusBadRequest
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(errorResponse)
-		return
-	}
-	defer db.Close()
-
-	// Check the database connection
-	err = db.Ping()
-	if err != nil {
 		errorResponse := ErrorResponse{
-			Message: "Failed to ping the database",
-			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+			Code:    code,
 		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(code)
 		json.NewEncoder(w).Encode(errorResponse)
 		return
 	}
 
 	// Variables to track IP presence
 	var inNodes, inNodesQue, inNodesBuffer bool
-	var count int
 
 	// Step 1: Check if the IP is in the nodes table
-	query := `SELECT COUNT(*) FROM nodes WHERE ip_address = ?`
-	err = db.QueryRow(query, incoming.IPAddress).Scan(&count)
+	inNodes, err = store.NodeExists(incoming.IPAddress)
 	if err != nil {
 		errorResponse := ErrorResponse{
 			Message: fmt.Sprintf("Error querying the database: %v", err),
@@ -595,7 +1215,6 @@ func addNodeRequest(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(errorResponse)
 		return
 	}
-	inNodes = count > 0
 
 	// Step 2: If IP is in nodes, return that information
 	if inNodes {
@@ -612,8 +1231,7 @@ func addNodeRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Step 3: Check if the IP is in the nodes_que table
-	query = `SELECT COUNT(*) FROM nodes_que WHERE ip_address = ?`
-	err = db.QueryRow(query, incoming.IPAddress).Scan(&count)
+	inNodesQue, err = store.QueueContains(incoming.IPAddress)
 	if err != nil {
 		errorResponse := ErrorResponse{
 			Message: fmt.Sprintf("Error querying the database: %v", err),
@@ -624,7 +1242,6 @@ func addNodeRequest(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(errorResponse)
 		return
 	}
-	inNodesQue = count > 0
 
 	// Step 4: If IP is in nodes_que, return that information
 	if inNodesQue {
@@ -640,9 +1257,9 @@ func addNodeRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Step 5: If IP is not in nodes or nodes_que, add it to the nodes_buffer
-	insertQuery := `INSERT INTO nodes_buffer (ip_address) VALUES (?)`
-	_, err = db.Exec(insertQuery, incoming.IPAddress)
+	// Step 5: If IP is not in nodes or nodes_que, add it and its registration
+	// to the nodes_buffer
+	err = store.AddToBuffer(registration)
 	if err != nil {
 		errorResponse := ErrorResponse{
 			Message: fmt.Sprintf("Failed to add IP to the buffer: %v", err),
@@ -655,8 +1272,7 @@ func addNodeRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify the IP is now in the buffer
-	query = `SELECT COUNT(*) FROM nodes_buffer WHERE ip_address = ?`
-	err = db.QueryRow(query, incoming.IPAddress).Scan(&count)
+	inNodesBuffer, err = store.BufferContains(incoming.IPAddress)
 	if err != nil {
 		errorResponse := ErrorResponse{
 			Message: fmt.Sprintf("Error verifying IP in buffer: %v", err),
@@ -667,11 +1283,13 @@ func addNodeRequest(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(errorResponse)
 		return
 	}
-	inNodesBuffer = count > 0
 
-	// Prepare the response
+	// Prepare the response; the challenge checked that the key hashes to a
+	// valid computer_id
+	computerID, _ := cryptoUtils.NodeIDFromBase64(registration.PublicKey)
 	response := Response{
 		Message:       "IP successfully added to nodes buffer",
+		ComputerID:    computerID,
 		InNodes:       false,
 		InNodesQue:    false,
 		InNodesBuffer: inNodesBuffer,
@@ -816,42 +1434,25 @@ func addNodeRequest(w http.ResponseWriter, r *http.Request) {
 // 	fmt.Println("Sync operation completed successfully.")
 // }
 
-func queData(w http.ResponseWriter, r *http.Request) {
-	// Database connection
-	db, err := sql.Open("mysql", "node:test@tcp(node-1-database:3306)/node")
-	if err != nil {
-		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
-		log.Printf("Database connection error: %v", err)
-		return
-	}
-	defer db.Close()
+// queuedNode is an address in nodes_que and its public key, as exchanged
+// between nodes.
+type queuedNode struct {
+	IPAddress string `json:"ip_address"`
+	PublicKey string `json:"public_key"`
+}
 
+func queData(w http.ResponseWriter, r *http.Request) {
 	// Fetch data from nodes_que table
-	rows, err := db.Query("SELECT ip_address FROM nodes_que")
+	entries, err := store.ListQueue()
 	if err != nil {
 		http.Error(w, "Failed to fetch queue data", http.StatusInternalServerError)
 		log.Printf("Error fetching queue data: %v", err)
 		return
 	}
-	defer rows.Close()
 
-	var queue []struct {
-		IPAddress string `json:"ip_address"`
-	}
-	for rows.Next() {
-		var data struct {
-			IPAddress string `json:"ip_address"`
-		}
-		if err := rows.Scan(&data.IPAddress); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-		queue = append(queue, data)
-	}
-	if err := rows.Err(); err != nil {
-		http.Error(w, "Error iterating rows", http.StatusInternalServerError)
-		log.Printf("Row iteration error: %v", err)
-		return
+	queue := []queuedNode{}
+	for _, entry := range entries {
+		queue = append(queue, queuedNode{IPAddress: entry.IPAddress, PublicKey: entry.PublicKey})
 	}
 
 	// Set Content-Type and encode response
@@ -862,251 +1463,58 @@ func queData(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// -------------------------------------------------------
-func connectToDatabase() (*sql.DB, error) {
-	fmt.Println("Attempting to connect to the database...")
-	db, err := sql.Open("mysql", "root:test@tcp(node-1-database:3306)/node")
-	if err != nil {
-		fmt.Println("Error connecting to database:", err)
-		return nil, err
-	}
-	fmt.Println("Database connection established.")
-	return db, nil
-}
-
-func moveDataToQueue(db *sql.DB) error {
-	fmt.Println("Moving data from nodes_buffer to nodes_que...")
-	_, err := db.Exec("INSERT INTO nodes_que SELECT * FROM nodes_buffer")
-	if err != nil {
-		return fmt.Errorf("error moving data from nodes_buffer to nodes_que: %v", err)
-	}
-	_, err = db.Exec("DELETE FROM nodes_buffer")
-	if err != nil {
-		return fmt.Errorf("error clearing nodes_buffer: %v", err)
-	}
-	fmt.Println("Data successfully moved and buffer cleared.")
-	return nil
-}
-
-func fetchNodes(db *sql.DB) (*sql.Rows, error) {
-	fmt.Println("Fetching all nodes from the nodes table...")
-	nodes, err := db.Query("SELECT ip_address, reachable FROM nodes")
-	if err != nil {
-		return nil, fmt.Errorf("error fetching nodes: %v", err)
-	}
-	fmt.Println("Nodes fetched successfully.")
-	return nodes, nil
-}
+// --------------------------------------------------------------------
 
-func pingNode(db *sql.DB, id int, ipAddress string) {
-	url := fmt.Sprintf("http://%s/ping", ipAddress)
-	fmt.Printf("Pinging node %s...\n", ipAddress)
-	client := http.Client{Timeout: 7 * time.Second}
-	resp, err := client.Get(url)
+// syncNodeList reconciles the queue and the buffer with every node at once
+// and adds the registered addresses it did not know in one batch.
+func syncNodeList(w http.ResponseWriter, r *http.Request) {
+	nodes, err := store.ListNodes()
 	if err != nil {
-		fmt.Printf("Node %s is unreachable. Error: %v\n", ipAddress, err)
-		db.Exec("UPDATE nodes SET reachable = 0 WHERE id = ?", id)
+		log.Println("Error fetching nodes:", err)
+		http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		fmt.Printf("Node %s is reachable.\n", ipAddress)
-		db.Exec("UPDATE nodes SET reachable = 1 WHERE id = ?", id)
-	}
-}
-
-func updateReachableNodes(db *sql.DB) error {
-	nodes, err := fetchNodes(db)
-	if err != nil {
-		return err
-	}
-	defer nodes.Close()
-	fmt.Println("Pinging nodes and updating reachable status...")
-	for nodes.Next() {
-		var id int
-		var ipAddress string
-		var reachable bool
-		if err := nodes.Scan(&id, &ipAddress, &reachable); err != nil {
-			fmt.Println("Error scanning node record:", err)
-			continue
+	var addresses []string
+	for _, node := range nodes {
+		if node.IPAddress != "" && node.ComputerID != identity.ID {
+			addresses = append(addresses, node.IPAddress)
 		}
-		pingNode(db, id, ipAddress)
-	}
-	fmt.Println("Node reachability updated.")
-	return nil
-}
-
-func fetchReachableNodes(db *sql.DB) (*sql.Rows, error) {
-	fmt.Println("Fetching reachable nodes...")
-	nodes, err := db.Query("SELECT ip_address FROM nodes WHERE reachable = 1")
-	if err != nil {
-		return nil, fmt.Errorf("error fetching reachable nodes: %v", err)
 	}
-	fmt.Println("Reachable nodes fetched successfully.")
-	return nodes, nil
-}
 
-func syncQueueData(db *sql.DB, ipAddress string) {
-	url := fmt.Sprintf("http://%s/queData", ipAddress)
-	fmt.Printf("Requesting queue data from node %s...\n", ipAddress)
-	resp, err := http.Get(url)
+	// Compare every node against the same snapshot of our tables
+	snapshot, err := reconcile.Take(store)
 	if err != nil {
-		fmt.Printf("Error fetching queue data from node %s: %v\n", ipAddress, err)
-		db.Exec("UPDATE nodes SET reachable = 0 WHERE ip_address = ?", ipAddress)
-		return
-	}
-	defer resp.Body.Close()
-	var remoteQueue []struct {
-		Data string `json:"ip_address"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&remoteQueue); err != nil {
-		fmt.Printf("Error decoding queue data from node %s: %v\n", ipAddress, err)
+		log.Println("Error reading membership tables:", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
 		return
 	}
-	for _, data := range remoteQueue {
-		_, insertErr := db.Exec("INSERT IGNORE INTO nodes_que (ip_address) VALUES (?)", data.Data)
-		if insertErr != nil {
-			fmt.Printf("Error inserting data into nodes_que for node %s: %v\n", ipAddress, insertErr)
-		}
-	}
-}
-
-func requestQueueDataFromNodes(db *sql.DB) error {
-	reachableNodes, err := fetchReachableNodes(db)
-	if err != nil {
+	results := make([]reconcile.Result, len(addresses))
+	errs := peers.Sweep(r.Context(), len(addresses), func(ctx context.Context, i int) error {
+		var err error
+		results[i], err = snapshot.Pull(ctx, nodeClient, nodeClient, addresses[i])
 		return err
-	}
-	defer reachableNodes.Close()
-	fmt.Println("Requesting and comparing queue data from reachable nodes...")
-	for reachableNodes.Next() {
-		var ipAddress string
-		reachableNodes.Scan(&ipAddress)
-		syncQueueData(db, ipAddress)
-	}
-	fmt.Println("Queue data comparison complete.")
-	return nil
-}
-
-func syncNodeListOLD(w http.ResponseWriter, r *http.Request) {
-	db, err := connectToDatabase()
-	if err != nil {
-		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
-	if err := moveDataToQueue(db); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if err := updateReachableNodes(db); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if err := requestQueueDataFromNodes(db); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Sync complete"))
-	fmt.Println("Sync operation completed successfully.")
-}
-
-// --------------------------------------------------------------------
-func pullQueFromEndpoint(ipAddress string) {
-	// Define the endpoint
-	urlpart1 := "http://"
-	urlpart2 := "/queData"
-
-	url := urlpart1 + ipAddress + urlpart2
-
-	// Make the GET request to the endpoint
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("Error fetching data from %s: %v", url, err)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return
-	}
-
-	// Check if the response is valid JSON array
-	var nodes []map[string]interface{} // Use a slice of maps to represent the JSON array
-	if err := json.Unmarshal(body, &nodes); err != nil {
-		log.Printf("Error unmarshalling JSON: %v", err)
-		return
-	}
-
-	// Connect to the MySQL database
-	dsn := "root:test@tcp(node-1-database:3306)/node"
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		log.Printf("Error connecting to the database: %v", err)
-		return
-	}
-	defer db.Close()
-
-	// Prepare the insert statement
-	stmt, err := db.Prepare("INSERT INTO `nodes_que` (ip_address) VALUES (?)")
-	if err != nil {
-		log.Printf("Error preparing the insert statement: %v", err)
-		return
-	}
-	defer stmt.Close()
-
-	// Iterate through the nodes and insert the ip_address into the database
-	for _, node := range nodes {
-		ipAddress, ok := node["ip_address"].(string)
-		if !ok {
-			log.Printf("Skipping invalid ip_address: %v", node["ip_address"])
-			continue
+	})
+	for i, address := range addresses {
+		switch {
+		case errs[i] != nil:
+			log.Printf("Error reconciling with %s: %v", address, errs[i])
+		case results[i].NodesDiffer:
+			log.Printf("Nodes table of %s differs from ours; it follows the chain", address)
 		}
-
-		_, err := stmt.Exec(ipAddress)
-		if err != nil {
-			log.Printf("Error inserting ip_address %s: %v", ipAddress, err)
-			continue
+		if results[i].Rejected > 0 {
+			log.Printf("Ignored %d entries from %s that did not prove their key", results[i].Rejected, address)
 		}
 	}
-}
 
-func syncNodeList(w http.ResponseWriter, r *http.Request) {
-	// Replace with your database connection details
-	dsn := "root:test@tcp(node-1-database:3306)/node"
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		log.Fatal(err)
+	var number int64
+	if current, err := epochs.Current(); err == nil {
+		number = current.Number
 	}
-	defer db.Close()
-
-	rows, err := db.Query("SELECT ip_address FROM nodes")
+	queued, buffered, err := reconcile.Apply(store, results, number)
 	if err != nil {
-		log.Fatal(err)
-	}
-	defer rows.Close()
-
-	// Iterate through rows and process each IP address
-	for rows.Next() {
-		var ipAddress string
-		if err := rows.Scan(&ipAddress); err != nil {
-			log.Fatal(err)
-		}
-		log.Println(ipAddress)
-
-		// Call the pullQueFromEndpoint function with the ip_address
-		pullQueFromEndpoint(ipAddress)
-	}
-
-	// Check for any errors after iterating
-	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+		log.Println("Error updating nodes_que and nodes_buffer:", err)
+		http.Error(w, "Failed to update queue", http.StatusInternalServerError)
+		return
 	}
+	log.Printf("Reconciled with %d nodes: %d addresses queued, %d buffered", len(addresses), queued, buffered)
 }
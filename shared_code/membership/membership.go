@@ -0,0 +1,420 @@
+// Package membership admits new nodes in three stages tied to epochs:
+//
+//   - buffer: an address that proved it holds its key (see /addNodeRequest)
+//     waits in nodes_buffer until the next epoch starts.
+//   - queue: at the start of an epoch the buffer moves to nodes_que, where
+//     every address serves a probation of whole epochs while it is probed
+//     with a fresh signed challenge every probe interval. An address that
+//     fails too many probes in a row is dropped.
+//   - nodes: the block that starts an epoch admits the queued addresses that
+//     finished their probation with enough passed probes and whose last probe
+//     passed. They are ranked by SHA-256 of the previous block hash followed
+//     by their computer_id, and only the first MaxAdmissions are admitted.
+//
+// The same block leaves out of the leader groups of the epoch the nodes that
+// the proposer's liveness monitor scores as unhealthy, and evicts the nodes it
+// has not heard from for EvictAfter. At most a third of the nodes, rounded
+// down and not counting one, are left out or evicted by one block.
+//
+// These changes are part of the block, so every node applies the same ones at
+// the same height whatever its own queue and scores hold. Each epoch is
+// shuffled from the nodes admitted up to its first block, less the ones it
+// leaves out.
+package membership
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/epoch"
+	"bitcoin-sidechain/liveness"
+	"bitcoin-sidechain/networkUtils"
+	"bitcoin-sidechain/probe"
+	"bitcoin-sidechain/storage"
+)
+
+// Config holds the probation rules.
+type Config struct {
+	ProbationEpochs int           // whole epochs an address spends in the queue
+	ProbeInterval   time.Duration // time between two probes of an address
+	MinPasses       int           // probes an address must pass during probation
+	MaxFailures     int           // failed probes in a row after which it is dropped
+	MaxAdmissions   int           // nodes admitted per epoch at most
+}
+
+// DefaultConfig is used for any value left at zero.
+var DefaultConfig = Config{
+	ProbationEpochs: 1,
+	ProbeInterval:   time.Minute,
+	MinPasses:       3,
+	MaxFailures:     5,
+	MaxAdmissions:   10,
+}
+
+// Prober checks that the node at an address still holds a key.
+type Prober interface {
+	ChallengeContext(ctx context.Context, address, publicKey string) (storage.Registration, error)
+}
+
+// Pipeline moves applicants from the buffer to the queue, probes the queue
+// and picks the membership changes of the blocks that start an epoch.
+type Pipeline struct {
+	store   storage.Store
+	epochs  *epoch.Manager
+	prober  Prober
+	pool    *probe.Pool
+	monitor *liveness.Monitor
+	config  Config
+}
+
+// New returns a pipeline that probes the queue on pool and scores the nodes
+// with monitor. Zero values in config are taken from DefaultConfig.
+func New(store storage.Store, epochs *epoch.Manager, prober Prober, pool *probe.Pool, monitor *liveness.Monitor, config Config) *Pipeline {
+	if config.ProbationEpochs <= 0 {
+		config.ProbationEpochs = DefaultConfig.ProbationEpochs
+	}
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = DefaultConfig.ProbeInterval
+	}
+	if config.MinPasses <= 0 {
+		config.MinPasses = DefaultConfig.MinPasses
+	}
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = DefaultConfig.MaxFailures
+	}
+	if config.MaxAdmissions <= 0 {
+		config.MaxAdmissions = DefaultConfig.MaxAdmissions
+	}
+	return &Pipeline{store: store, epochs: epochs, prober: prober, pool: pool, monitor: monitor, config: config}
+}
+
+// OnEpoch starts the probation of every buffered address. It is subscribed
+// to the epoch manager.
+func (p *Pipeline) OnEpoch(event epoch.Event) {
+	if err := p.store.MoveBufferToQueue(event.Epoch.Number); err != nil {
+		fmt.Println("Membership: error moving the buffer to the queue:", err)
+	}
+}
+
+// Rank returns the key admissions are ordered by: SHA-256 of the previous
+// block hash followed by the computer_id, both as bytes.
+func Rank(prevHash, computerID string) []byte {
+	prev, _ := hex.DecodeString(prevHash)
+	id, _ := hex.DecodeString(computerID)
+	hash := sha256.Sum256(append(prev, id...))
+	return hash[:]
+}
+
+// MaxRemovals returns how many of n nodes one block may leave out of the
+// leader groups or evict: fewer than a third, so the groups keep a quorum of
+// the nodes that were left in.
+func MaxRemovals(n int) int {
+	if n < 1 {
+		return 0
+	}
+	return (n - 1) / 3
+}
+
+// Changes returns the membership changes of the next block: none unless it
+// starts an epoch.
+func (p *Pipeline) Changes() (storage.MembershipChanges, error) {
+	height, prevHash := int64(1), storage.ZeroHash
+	latest, err := p.store.LatestBlock()
+	switch {
+	case err == nil:
+		height, prevHash = latest.Height+1, latest.Hash
+	case !errors.Is(err, storage.ErrNotFound):
+		return storage.MembershipChanges{}, fmt.Errorf("failed to read latest block: %w", err)
+	}
+	if height%p.epochs.Length() != 0 {
+		return storage.MembershipChanges{}, nil
+	}
+
+	admissions, err := p.admissions(height, prevHash)
+	if err != nil {
+		return storage.MembershipChanges{}, err
+	}
+	evictions, excluded, err := p.removals()
+	if err != nil {
+		return storage.MembershipChanges{}, err
+	}
+	return storage.MembershipChanges{Admissions: admissions, Evictions: evictions, Excluded: excluded}, nil
+}
+
+// removals returns the nodes to evict, those unreachable for longest first,
+// and then the unhealthy nodes to leave out, lowest success rate first, up to
+// MaxRemovals in all. Both lists are returned sorted by computer_id.
+func (p *Pipeline) removals() ([]string, []string, error) {
+	scores, err := p.monitor.Scores()
+	if err != nil {
+		return nil, nil, err
+	}
+	limit := MaxRemovals(len(scores))
+
+	var unreachable, unhealthy []liveness.Score
+	for _, score := range scores {
+		switch {
+		case score.Unreachable:
+			unreachable = append(unreachable, score)
+		case !score.Healthy:
+			unhealthy = append(unhealthy, score)
+		}
+	}
+	sort.Slice(unreachable, func(i, j int) bool {
+		if unreachable[i].LastSeen != unreachable[j].LastSeen {
+			return unreachable[i].LastSeen < unreachable[j].LastSeen
+		}
+		return unreachable[i].ComputerID < unreachable[j].ComputerID
+	})
+	sort.Slice(unhealthy, func(i, j int) bool {
+		if unhealthy[i].SuccessRate != unhealthy[j].SuccessRate {
+			return unhealthy[i].SuccessRate < unhealthy[j].SuccessRate
+		}
+		return unhealthy[i].ComputerID < unhealthy[j].ComputerID
+	})
+
+	var evictions, excluded []string
+	for _, score := range unreachable {
+		if len(evictions) < limit {
+			evictions = append(evictions, score.ComputerID)
+		}
+	}
+	for _, score := range unhealthy {
+		if len(evictions)+len(excluded) < limit {
+			excluded = append(excluded, score.ComputerID)
+		}
+	}
+	sort.Strings(evictions)
+	sort.Strings(excluded)
+	return evictions, excluded, nil
+}
+
+// admissions returns the nodes admitted by the block at height, which starts
+// an epoch: the queued addresses that finished their probation, ranked and
+// capped.
+func (p *Pipeline) admissions(height int64, prevHash string) ([]storage.Admission, error) {
+	number := p.epochs.EpochAt(height)
+
+	entries, err := p.store.ListQueue()
+	if err != nil {
+		return nil, err
+	}
+	var admissions []storage.Admission
+	for _, entry := range entries {
+		if !p.ready(entry, number) {
+			continue
+		}
+		computerID, err := cryptoUtils.NodeIDFromBase64(entry.PublicKey)
+		if err != nil {
+			continue
+		}
+		if _, err := p.store.GetNode(computerID); err == nil {
+			continue
+		}
+		if exists, err := p.store.NodeExists(entry.IPAddress); err != nil || exists {
+			continue
+		}
+		admissions = append(admissions, storage.Admission{
+			ComputerID: computerID,
+			IPAddress:  entry.IPAddress,
+			PublicKey:  entry.PublicKey,
+		})
+	}
+
+	sort.Slice(admissions, func(i, j int) bool {
+		return bytes.Compare(Rank(prevHash, admissions[i].ComputerID), Rank(prevHash, admissions[j].ComputerID)) < 0
+	})
+	if len(admissions) > p.config.MaxAdmissions {
+		admissions = admissions[:p.config.MaxAdmissions]
+	}
+	return admissions, nil
+}
+
+// ready reports whether a queued address finished its probation by epoch
+// number with enough passed probes and passed its last probe.
+func (p *Pipeline) ready(entry storage.QueueEntry, number int64) bool {
+	return entry.QueuedEpoch+int64(p.config.ProbationEpochs) <= number &&
+		entry.Passes >= p.config.MinPasses && entry.Failures == 0
+}
+
+// CheckChanges checks the membership changes of a proposed block. Only a
+// block that starts an epoch may carry them.
+//
+// Admissions must be at most MaxAdmissions, in rank order, each with a
+// computer_id that is the hash of its key and a valid address. Each must also
+// be in this node's queue with the same key and ready to be admitted, so the
+// proposer cannot admit a key at an address that never proved to hold it.
+//
+// Evictions and exclusions must be sorted, distinct and at most MaxRemovals
+// of the nodes in all. Liveness is judged by the proposer, but the eviction
+// of a node this node has heard from within EvictAfter is refused.
+func (p *Pipeline) CheckChanges(block storage.Block) error {
+	if len(block.Admissions) == 0 && len(block.Evictions) == 0 && len(block.Excluded) == 0 {
+		return nil
+	}
+	if block.Height%p.epochs.Length() != 0 {
+		return fmt.Errorf("%w: block %d does not start an epoch and cannot change the nodes", storage.ErrInvalidBlock, block.Height)
+	}
+	if err := p.checkRemovals(block); err != nil {
+		return err
+	}
+	if len(block.Admissions) == 0 {
+		return nil
+	}
+	if len(block.Admissions) > p.config.MaxAdmissions {
+		return fmt.Errorf("%w: block admits %d nodes, at most %d allowed", storage.ErrInvalidBlock, len(block.Admissions), p.config.MaxAdmissions)
+	}
+
+	entries, err := p.store.ListQueue()
+	if err != nil {
+		return err
+	}
+	number := p.epochs.EpochAt(block.Height)
+	queued := make(map[string]storage.QueueEntry)
+	for _, entry := range entries {
+		queued[entry.IPAddress] = entry
+	}
+
+	var previous []byte
+	for _, admission := range block.Admissions {
+		computerID, err := cryptoUtils.NodeIDFromBase64(admission.PublicKey)
+		if err != nil || computerID != admission.ComputerID {
+			return fmt.Errorf("%w: computer_id %s does not match its public key", storage.ErrInvalidBlock, admission.ComputerID)
+		}
+		if err := networkUtils.ValidateAddress(admission.IPAddress); err != nil {
+			return fmt.Errorf("%w: %v", storage.ErrInvalidBlock, err)
+		}
+		entry, ok := queued[admission.IPAddress]
+		if !ok || entry.PublicKey != admission.PublicKey {
+			return fmt.Errorf("%w: %s is not queued with that key", storage.ErrInvalidBlock, admission.IPAddress)
+		}
+		if !p.ready(entry, number) {
+			return fmt.Errorf("%w: %s has not passed its probation", storage.ErrInvalidBlock, admission.IPAddress)
+		}
+		rank := Rank(block.PrevHash, admission.ComputerID)
+		if previous != nil && bytes.Compare(previous, rank) >= 0 {
+			return fmt.Errorf("%w: admissions are not in rank order", storage.ErrInvalidBlock)
+		}
+		previous = rank
+	}
+	return nil
+}
+
+// checkRemovals checks the evictions and exclusions of a proposed block.
+func (p *Pipeline) checkRemovals(block storage.Block) error {
+	if len(block.Evictions) == 0 && len(block.Excluded) == 0 {
+		return nil
+	}
+	scores, err := p.monitor.Scores()
+	if err != nil {
+		return err
+	}
+	if n := len(block.Evictions) + len(block.Excluded); n > MaxRemovals(len(scores)) {
+		return fmt.Errorf("%w: block removes %d of %d nodes", storage.ErrInvalidBlock, n, len(scores))
+	}
+
+	named := make(map[string]bool)
+	for _, list := range [][]string{block.Evictions, block.Excluded} {
+		for i, computerID := range list {
+			if i > 0 && list[i-1] >= computerID {
+				return fmt.Errorf("%w: evictions and exclusions must be sorted", storage.ErrInvalidBlock)
+			}
+			if named[computerID] {
+				return fmt.Errorf("%w: node %s is both evicted and left out", storage.ErrInvalidBlock, computerID)
+			}
+			named[computerID] = true
+		}
+	}
+
+	// Refuse to evict a node this node has seen recently
+	reachable := make(map[string]bool)
+	for _, score := range scores {
+		if !score.Unreachable && score.LastSeen > 0 {
+			reachable[score.ComputerID] = true
+		}
+	}
+	for _, computerID := range block.Evictions {
+		if reachable[computerID] {
+			return fmt.Errorf("%w: node %s answered within the eviction time", storage.ErrInvalidBlock, computerID)
+		}
+	}
+	return nil
+}
+
+// LogChanges prints the membership changes of a stored block.
+func LogChanges(block storage.Block) {
+	for _, admission := range block.Admissions {
+		fmt.Printf("Node %s at %s admitted in block %d\n", admission.ComputerID, admission.IPAddress, block.Height)
+	}
+	for _, computerID := range block.Evictions {
+		fmt.Printf("Node %s evicted in block %d\n", computerID, block.Height)
+	}
+	for _, computerID := range block.Excluded {
+		fmt.Printf("Node %s left out of the leader groups from block %d\n", computerID, block.Height)
+	}
+}
+
+// Probe challenges every queued address that was not probed for a probe
+// interval, all at once on the pool, and records the results in one batch.
+// Addresses that failed MaxFailures probes in a row are dropped from the
+// queue.
+func (p *Pipeline) Probe() error {
+	entries, err := p.store.ListQueue()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var due []storage.QueueEntry
+	for _, entry := range entries {
+		if now.Sub(time.Unix(entry.LastCheck, 0)) >= p.config.ProbeInterval {
+			due = append(due, entry)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+
+	errs := p.pool.Sweep(context.Background(), len(due), func(ctx context.Context, i int) error {
+		_, err := p.prober.ChallengeContext(ctx, due[i].IPAddress, due[i].PublicKey)
+		return err
+	})
+
+	probes := make([]storage.QueueProbe, len(due))
+	for i, entry := range due {
+		probes[i] = storage.QueueProbe{IPAddress: entry.IPAddress, OK: errs[i] == nil, At: now.Unix()}
+		if errs[i] == nil {
+			continue
+		}
+		fmt.Printf("Membership: probe of %s failed: %v\n", entry.IPAddress, errs[i])
+		if entry.Failures+1 >= p.config.MaxFailures {
+			fmt.Printf("Membership: dropping %s from the queue after %d failed probes\n", entry.IPAddress, entry.Failures+1)
+			probes[i].Drop = true
+		}
+	}
+	return p.store.RecordProbes(probes)
+}
+
+// Run probes the queue until stop is closed.
+func (p *Pipeline) Run(stop <-chan struct{}) {
+	// Tick faster than the probe interval so probes stay close to it
+	ticker := time.NewTicker(p.config.ProbeInterval / 4)
+	defer ticker.Stop()
+
+	for {
+		if err := p.Probe(); err != nil {
+			fmt.Println("Membership: error probing the queue:", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package membership_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/epoch"
+	"bitcoin-sidechain/membership"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+func newKey(t *testing.T) string {
+	t.Helper()
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cryptoUtils.PublicKeyBase64(key)
+}
+
+func admissionOf(t *testing.T, address, publicKey string) storage.Admission {
+	t.Helper()
+	computerID, err := cryptoUtils.NodeIDFromBase64(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage.Admission{ComputerID: computerID, IPAddress: address, PublicKey: publicKey}
+}
+
+func TestCheckChangesAdmitsOnlyReadyQueueEntries(t *testing.T) {
+	store, err := storage.Open("sqlite3", filepath.Join(t.TempDir(), "node.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := store.ApplyGenesis(storage.Genesis{Nodes: []storage.GenesisNode{{IPAddress: "10.0.0.1:8080", PublicKey: newKey(t)}}}); err != nil {
+		t.Fatal(err)
+	}
+	// Block 2 starts epoch 1, which ends the probation of addresses queued in epoch 0
+	members := membership.New(store, epoch.NewManager(store, 2, 4), nil, nil, nil, membership.Config{ProbationEpochs: 1, MinPasses: 3})
+
+	ready, fresh, failing := newKey(t), newKey(t), newKey(t)
+	queue := []storage.QueueEntry{
+		{Registration: storage.Registration{IPAddress: "10.0.0.2:8080", PublicKey: ready}, QueuedEpoch: 0},
+		{Registration: storage.Registration{IPAddress: "10.0.0.3:8080", PublicKey: fresh}, QueuedEpoch: 1},
+		{Registration: storage.Registration{IPAddress: "10.0.0.4:8080", PublicKey: failing}, QueuedEpoch: 0},
+	}
+	if err := store.AddAllToQueue(queue); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		var probes []storage.QueueProbe
+		for _, entry := range queue {
+			probes = append(probes, storage.QueueProbe{IPAddress: entry.IPAddress, OK: true, At: int64(i)})
+		}
+		if err := store.RecordProbes(probes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.RecordProbes([]storage.QueueProbe{{IPAddress: "10.0.0.4:8080", At: 3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		admission storage.Admission
+		valid     bool
+	}{
+		{"ready", admissionOf(t, "10.0.0.2:8080", ready), true},
+		{"not queued", admissionOf(t, "10.0.0.9:8080", newKey(t)), false},
+		{"queued with another key", admissionOf(t, "10.0.0.2:8080", newKey(t)), false},
+		{"queued key at another address", admissionOf(t, "10.0.0.9:8080", ready), false},
+		{"probation not over", admissionOf(t, "10.0.0.3:8080", fresh), false},
+		{"failed last probe", admissionOf(t, "10.0.0.4:8080", failing), false},
+	}
+	for _, test := range tests {
+		block := storage.Block{Height: 2, PrevHash: storage.ZeroHash, Admissions: []storage.Admission{test.admission}}
+		err := members.CheckChanges(block)
+		switch {
+		case test.valid && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case !test.valid && !errors.Is(err, storage.ErrInvalidBlock):
+			t.Errorf("%s: got %v, expected ErrInvalidBlock", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package mempool
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"bitcoin-sidechain/storage"
+)
+
+// ErrDuplicate is returned by Add when the transaction is already pending.
+var ErrDuplicate = errors.New("transaction already in mempool")
+
+// ErrNonceInPool is returned by Add when another pending transaction uses the same nonce.
+var ErrNonceInPool = errors.New("nonce already used by a pending transaction")
+
+// ErrPoolFull is returned by Add when the transaction would be the one evicted.
+var ErrPoolFull = errors.New("mempool is full")
+
+// entryOverhead is a rough per-transaction cost of the indexes, added to the
+// size of the strings when accounting for memory.
+const entryOverhead = 256
+
+// Tx is a validated transfer waiting to be applied.
+type Tx struct {
+	storage.Transfer
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// size estimates the memory held by a transaction.
+func (tx *Tx) size() int {
+	return entryOverhead + len(tx.TxID) + len(tx.From) + len(tx.To) + len(tx.Nonce) + len(tx.Signature)
+}
+
+// Config limits the size of the pool.
+type Config struct {
+	MaxTxs       int // total number of pending transactions
+	MaxBytes     int // estimated memory used by pending transactions
+	MaxPerSender int // pending transactions from a single wallet
+}
+
+// DefaultConfig is used for any limit left at zero.
+var DefaultConfig = Config{
+	MaxTxs:       10000,
+	MaxBytes:     16 << 20,
+	MaxPerSender: 100,
+}
+
+// Pool holds validated but unapplied transactions, indexed by tx id, sender
+// and nonce. It is safe for concurrent use.
+type Pool struct {
+	mu       sync.Mutex
+	config   Config
+	byID     map[string]*Tx
+	bySender map[string][]*Tx // in arrival order
+	byNonce  map[string]string
+	order    []*Tx // arrival order across all senders
+	bytes    int
+}
+
+// New returns an empty pool.
+func New(config Config) *Pool {
+	if config.MaxTxs <= 0 {
+		config.MaxTxs = DefaultConfig.MaxTxs
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = DefaultConfig.MaxBytes
+	}
+	if config.MaxPerSender <= 0 {
+		config.MaxPerSender = DefaultConfig.MaxPerSender
+	}
+	return &Pool{
+		config:   config,
+		byID:     make(map[string]*Tx),
+		bySender: make(map[string][]*Tx),
+		byNonce:  make(map[string]string),
+	}
+}
+
+// Add puts a transaction in the pool. When the pool is over its limits the
+// newest transaction of the sender with the most pending transactions is
+// evicted, so one busy wallet cannot push everyone else out.
+func (p *Pool) Add(transfer storage.Transfer) (*Tx, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.byID[transfer.TxID]; ok {
+		return nil, ErrDuplicate
+	}
+	if _, ok := p.byNonce[transfer.Nonce]; ok {
+		return nil, ErrNonceInPool
+	}
+	if len(p.bySender[transfer.From]) >= p.config.MaxPerSender {
+		return nil, ErrPoolFull
+	}
+
+	tx := &Tx{Transfer: transfer, ReceivedAt: time.Now()}
+	p.insert(tx)
+
+	for len(p.byID) > p.config.MaxTxs || p.bytes > p.config.MaxBytes {
+		victim := p.evictionCandidate()
+		p.remove(victim)
+		if victim == tx {
+			return nil, ErrPoolFull
+		}
+	}
+	return tx, nil
+}
+
+// Remove drops transactions from the pool, for example once they are applied.
+func (p *Pool) Remove(txIDs ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, id := range txIDs {
+		if tx, ok := p.byID[id]; ok {
+			p.remove(tx)
+		}
+	}
+}
+
+// Pending returns up to limit transactions in arrival order. A limit of 0
+// returns all of them.
+func (p *Pool) Pending(limit int) []Tx {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if limit <= 0 || limit > len(p.order) {
+		limit = len(p.order)
+	}
+	pending := make([]Tx, limit)
+	for i := 0; i < limit; i++ {
+		pending[i] = *p.order[i]
+	}
+	return pending
+}
+
+// Get returns a pending transaction by tx id.
+func (p *Pool) Get(txID string) (Tx, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tx, ok := p.byID[txID]
+	if !ok {
+		return Tx{}, false
+	}
+	return *tx, true
+}
+
+// BySender returns the pending transactions of a wallet in arrival order.
+func (p *Pool) BySender(sender string) []Tx {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending := make([]Tx, len(p.bySender[sender]))
+	for i, tx := range p.bySender[sender] {
+		pending[i] = *tx
+	}
+	return pending
+}
+
+// PendingAmount returns the total amount a wallet is already spending in the pool.
+func (p *Pool) PendingAmount(sender string) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var total int64
+	for _, tx := range p.bySender[sender] {
+		total += tx.Amount
+	}
+	return total
+}
+
+// Len returns the number of pending transactions.
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.byID)
+}
+
+// Bytes returns the estimated memory used by pending transactions.
+func (p *Pool) Bytes() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.bytes
+}
+
+func (p *Pool) insert(tx *Tx) {
+	p.byID[tx.TxID] = tx
+	p.bySender[tx.From] = append(p.bySender[tx.From], tx)
+	p.byNonce[tx.Nonce] = tx.TxID
+	p.order = append(p.order, tx)
+	p.bytes += tx.size()
+}
+
+func (p *Pool) remove(tx *Tx) {
+	delete(p.byID, tx.TxID)
+	delete(p.byNonce, tx.Nonce)
+	p.bySender[tx.From] = without(p.bySender[tx.From], tx)
+	if len(p.bySender[tx.From]) == 0 {
+		delete(p.bySender, tx.From)
+	}
+	p.order = without(p.order, tx)
+	p.bytes -= tx.size()
+}
+
+// evictionCandidate returns the newest transaction of the sender with the
+// most pending transactions. Ties go to the sender whose newest transaction
+// arrived last.
+func (p *Pool) evictionCandidate() *Tx {
+	var victim *Tx
+	most := 0
+	for _, txs := range p.bySender {
+		newest := txs[len(txs)-1]
+		if len(txs) > most || (len(txs) == most && newest.ReceivedAt.After(victim.ReceivedAt)) {
+			victim, most = newest, len(txs)
+		}
+	}
+	return victim
+}
+
+// without returns the slice with tx removed, keeping the order of the rest.
+func without(txs []*Tx, tx *Tx) []*Tx {
+	for i, candidate := range txs {
+		if candidate == tx {
+			return append(txs[:i], txs[i+1:]...)
+		}
+	}
+	return txs
+}
@@ -0,0 +1,117 @@
+package mempool
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"bitcoin-sidechain/storage"
+)
+
+func transfer(id, from string) storage.Transfer {
+	return storage.Transfer{TxID: id, From: from, To: "carol", Amount: 1, Nonce: "nonce-" + id}
+}
+
+func ids(txs []Tx) []string {
+	var list []string
+	for _, tx := range txs {
+		list = append(list, tx.TxID)
+	}
+	return list
+}
+
+func TestAddRejectsDuplicatesAndNonces(t *testing.T) {
+	pool := New(Config{})
+	if _, err := pool.Add(transfer("a1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pool.Add(transfer("a1", "alice")); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("same tx id: got %v, expected ErrDuplicate", err)
+	}
+	reused := transfer("b1", "bob")
+	reused.Nonce = "nonce-a1"
+	if _, err := pool.Add(reused); !errors.Is(err, ErrNonceInPool) {
+		t.Errorf("nonce of a pending transaction: got %v, expected ErrNonceInPool", err)
+	}
+	if pool.Len() != 1 {
+		t.Errorf("pool holds %d transactions, expected 1", pool.Len())
+	}
+
+	// Both are free again once the transaction leaves the pool
+	pool.Remove("a1")
+	if _, err := pool.Add(reused); err != nil {
+		t.Errorf("nonce of a removed transaction: %v", err)
+	}
+	again := transfer("a1", "alice")
+	again.Nonce = "nonce-a2"
+	if _, err := pool.Add(again); err != nil {
+		t.Errorf("tx id of a removed transaction: %v", err)
+	}
+
+	pool.Remove("a1", "b1")
+	if pool.Len() != 0 || pool.Bytes() != 0 {
+		t.Errorf("empty pool holds %d transactions, %d bytes", pool.Len(), pool.Bytes())
+	}
+}
+
+func TestPendingKeepsArrivalOrder(t *testing.T) {
+	pool := New(Config{})
+	for _, tx := range []storage.Transfer{transfer("1", "alice"), transfer("2", "bob"), transfer("3", "alice"), transfer("4", "carol"), transfer("5", "bob")} {
+		if _, err := pool.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := fmt.Sprint(ids(pool.Pending(0))); got != "[1 2 3 4 5]" {
+		t.Errorf("pending %s, expected [1 2 3 4 5]", got)
+	}
+	if got := fmt.Sprint(ids(pool.Pending(2))); got != "[1 2]" {
+		t.Errorf("first 2 pending %s, expected [1 2]", got)
+	}
+	if got := fmt.Sprint(ids(pool.BySender("alice"))); got != "[1 3]" {
+		t.Errorf("pending of alice %s, expected [1 3]", got)
+	}
+	if amount := pool.PendingAmount("bob"); amount != 2 {
+		t.Errorf("bob spends %d in the pool, expected 2", amount)
+	}
+
+	pool.Remove("2", "3", "unknown")
+	if got := fmt.Sprint(ids(pool.Pending(0))); got != "[1 4 5]" {
+		t.Errorf("pending after removal %s, expected [1 4 5]", got)
+	}
+	if _, ok := pool.Get("3"); ok {
+		t.Error("removed transaction still found")
+	}
+}
+
+// A full pool evicts the newest transaction of the busiest sender.
+func TestAddEvictsBusiestSender(t *testing.T) {
+	pool := New(Config{MaxTxs: 4, MaxPerSender: 3})
+	for _, tx := range []storage.Transfer{transfer("a1", "alice"), transfer("a2", "alice"), transfer("b1", "bob")} {
+		if _, err := pool.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pool.Add(transfer("a3", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Add(transfer("a4", "alice")); !errors.Is(err, ErrPoolFull) {
+		t.Errorf("sender at its limit: got %v, expected ErrPoolFull", err)
+	}
+
+	// A transaction of another sender takes the place of the newest of alice
+	if _, err := pool.Add(transfer("c1", "carol")); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(ids(pool.Pending(0))); got != "[a1 a2 b1 c1]" {
+		t.Errorf("pending %s, expected [a1 a2 b1 c1]", got)
+	}
+
+	// A sender that would be the busiest is refused instead
+	if _, err := pool.Add(transfer("a5", "alice")); !errors.Is(err, ErrPoolFull) {
+		t.Errorf("busiest sender in a full pool: got %v, expected ErrPoolFull", err)
+	}
+	if pool.Len() != 4 {
+		t.Errorf("pool holds %d transactions, expected 4", pool.Len())
+	}
+}
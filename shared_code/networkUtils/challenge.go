@@ -0,0 +1,159 @@
+package networkUtils
+
+// A node asking to join proves that it runs at the address it claims and
+// holds the key it claims. The server picks a random nonce and fetches
+//
+//	GET http://<address>/nodeChallenge?server=<computer_id>&address=<address>&nonce=<nonce>
+//
+// The node answers with its computer_id, public key and a signature of
+//
+//	"node-challenge\n" + server computer_id + "\n" + address + "\n" + nonce
+//
+// made with its identity key. Only an address whose answer carries the claimed
+// key and a valid signature of a nonce the server just picked is accepted.
+
+import (
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/storage"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ErrChallengeFailed is returned when a node does not prove control of the
+// address and key it registers with.
+var ErrChallengeFailed = errors.New("challenge failed")
+
+// ChallengeResponse is a node's answer to a registration challenge.
+type ChallengeResponse struct {
+	ComputerID string `json:"computer_id"`
+	PublicKey  string `json:"public_key"`
+	Signature  string `json:"signature"`
+}
+
+// challengeMessage returns the message a node signs to answer a challenge.
+func challengeMessage(server, address, nonce string) []byte {
+	return []byte("node-challenge\n" + server + "\n" + address + "\n" + nonce)
+}
+
+// AnswerChallenge signs a challenge from a server.
+func (id Identity) AnswerChallenge(server, address, nonce string) ChallengeResponse {
+	return ChallengeResponse{
+		ComputerID: id.ID,
+		PublicKey:  cryptoUtils.PublicKeyBase64(id.Key),
+		Signature:  cryptoUtils.SignMessage(id.Key, challengeMessage(server, address, nonce)),
+	}
+}
+
+// ChallengeHandler returns the GET /nodeChallenge endpoint that answers
+// registration challenges as identity. It only signs for self, the address
+// this node is reached at, so it cannot be used to register its key at
+// another address. Without self it answers no challenge.
+func ChallengeHandler(identity Identity, self string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		server, address, nonce := query.Get("server"), query.Get("address"), query.Get("nonce")
+		if server == "" || address == "" || len(nonce) != 64 {
+			http.Error(w, "server, address and a 32 byte hex nonce are required", http.StatusBadRequest)
+			return
+		}
+		if self == "" || address != self {
+			http.Error(w, "address is not this node's address", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(identity.AnswerChallenge(server, address, nonce))
+	}
+}
+
+// VerifyChallenge checks that a challenge response is signed by publicKey for
+// this server, address and nonce, and that its computer_id is the hash of
+// that key.
+func VerifyChallenge(response ChallengeResponse, server, address, nonce, publicKey string) error {
+	if response.PublicKey != publicKey {
+		return fmt.Errorf("%w: %s answered with another public key", ErrChallengeFailed, address)
+	}
+	computerID, err := cryptoUtils.NodeIDFromBase64(publicKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrChallengeFailed, err)
+	}
+	if response.ComputerID != computerID {
+		return fmt.Errorf("%w: computer_id does not match the public key", ErrChallengeFailed)
+	}
+	if err := cryptoUtils.VerifyMessage(publicKey, challengeMessage(server, address, nonce), response.Signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrChallengeFailed, err)
+	}
+	return nil
+}
+
+// VerifyRegistration checks a registration taken from another node: the
+// address must be valid and the signature must answer the challenge of the
+// node it names with the registration's key. It cannot tell whether that
+// node picked the nonce, only that the key holder asked to join at the
+// address.
+func VerifyRegistration(registration storage.Registration) error {
+	if err := ValidateAddress(registration.IPAddress); err != nil {
+		return fmt.Errorf("%w: %v", ErrChallengeFailed, err)
+	}
+	if registration.RegisteredBy == "" || len(registration.Nonce) != 64 {
+		return fmt.Errorf("%w: registration of %s is incomplete", ErrChallengeFailed, registration.IPAddress)
+	}
+	computerID, err := cryptoUtils.NodeIDFromBase64(registration.PublicKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrChallengeFailed, err)
+	}
+	response := ChallengeResponse{ComputerID: computerID, PublicKey: registration.PublicKey, Signature: registration.Signature}
+	return VerifyChallenge(response, registration.RegisteredBy, registration.IPAddress, registration.Nonce, registration.PublicKey)
+}
+
+// Challenge asks the node at address to sign a fresh nonce and checks that
+// it did so with publicKey. It returns the signed answer as a registration.
+func (c *Client) Challenge(address, publicKey string) (storage.Registration, error) {
+	return c.ChallengeContext(context.Background(), address, publicKey)
+}
+
+// ChallengeContext is Challenge for a request that is cancelled with ctx.
+func (c *Client) ChallengeContext(ctx context.Context, address, publicKey string) (storage.Registration, error) {
+	nonceBytes := make([]byte, 32)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return storage.Registration{}, fmt.Errorf("failed to generate challenge: %w", err)
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+
+	path := "/nodeChallenge?" + url.Values{
+		"server":  {c.identity.ID},
+		"address": {address},
+		"nonce":   {nonce},
+	}.Encode()
+	recipient, err := cryptoUtils.NodeIDFromBase64(publicKey)
+	if err != nil {
+		return storage.Registration{}, fmt.Errorf("%w: %v", ErrChallengeFailed, err)
+	}
+	resp, body, err := c.send(ctx, http.MethodGet, recipient, address, path, nil)
+	if err != nil {
+		return storage.Registration{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return storage.Registration{}, fmt.Errorf("%w: %s answered with status %d", ErrChallengeFailed, address, resp.StatusCode)
+	}
+
+	var response ChallengeResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return storage.Registration{}, fmt.Errorf("%w: invalid answer from %s: %v", ErrChallengeFailed, address, err)
+	}
+	if err := VerifyChallenge(response, c.identity.ID, address, nonce, publicKey); err != nil {
+		return storage.Registration{}, err
+	}
+	return storage.Registration{
+		IPAddress:    address,
+		PublicKey:    publicKey,
+		RegisteredBy: c.identity.ID,
+		Nonce:        nonce,
+		Signature:    response.Signature,
+	}, nil
+}
@@ -0,0 +1,50 @@
+package networkUtils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"bitcoin-sidechain/cryptoUtils"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+func TestChallengeHandlerOnlySignsOwnAddress(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := NewIdentity(key)
+	nonce := strings.Repeat("ab", 32)
+
+	challenge := func(self, address string) *httptest.ResponseRecorder {
+		query := url.Values{"server": {"server-id"}, "address": {address}, "nonce": {nonce}}
+		recorder := httptest.NewRecorder()
+		ChallengeHandler(identity, self)(recorder, httptest.NewRequest(http.MethodGet, "/nodeChallenge?"+query.Encode(), nil))
+		return recorder
+	}
+
+	recorder := challenge("10.0.0.1:80", "10.0.0.1:80")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("challenge for its own address answered %d", recorder.Code)
+	}
+	var response ChallengeResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyChallenge(response, "server-id", "10.0.0.1:80", nonce, cryptoUtils.PublicKeyBase64(key)); err != nil {
+		t.Errorf("answer for its own address does not verify: %v", err)
+	}
+
+	// Signing for another address would register this key there
+	if code := challenge("10.0.0.1:80", "10.6.6.6:80").Code; code != http.StatusBadRequest {
+		t.Errorf("challenge for another address answered %d, expected 400", code)
+	}
+	if code := challenge("", "10.6.6.6:80").Code; code != http.StatusBadRequest {
+		t.Errorf("challenge without a configured address answered %d, expected 400", code)
+	}
+}
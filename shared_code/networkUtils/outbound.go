@@ -0,0 +1,293 @@
+package networkUtils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrInvalidAddress is returned for an address that is not host:port.
+var ErrInvalidAddress = errors.New("invalid node address")
+
+// ErrBlockedAddress is returned when an outbound call would reach a private,
+// loopback, link-local or otherwise internal address.
+var ErrBlockedAddress = errors.New("address is not allowed")
+
+// ErrResponseTooLarge is returned when a response body is over the limit.
+var ErrResponseTooLarge = errors.New("response too large")
+
+// maxAddressLength is the width of the ip_address columns.
+const maxAddressLength = 45
+
+// OutboundConfig sets the limits of outbound calls.
+type OutboundConfig struct {
+	AllowPrivate    bool          // devnet: allow private, loopback and link-local addresses
+	Timeout         time.Duration // for the whole request, from dialing to reading the body
+	MaxResponseSize int64
+}
+
+// DefaultOutboundConfig is used for any limit left at zero.
+var DefaultOutboundConfig = OutboundConfig{
+	Timeout:         7 * time.Second,
+	MaxResponseSize: 16 << 20,
+}
+
+// Outbound is the HTTP client for every call a node makes to an address it
+// was given by a client or another node. Addresses must be host:port, and the
+// address actually dialed is checked after DNS resolution, so a name cannot
+// point the node at an internal host. Redirects are not followed.
+type Outbound struct {
+	HTTP   *http.Client
+	config OutboundConfig
+}
+
+// NewOutbound returns an outbound client with the given limits.
+func NewOutbound(config OutboundConfig) *Outbound {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultOutboundConfig.Timeout
+	}
+	if config.MaxResponseSize <= 0 {
+		config.MaxResponseSize = DefaultOutboundConfig.MaxResponseSize
+	}
+
+	dialer := &net.Dialer{
+		Timeout: config.Timeout,
+		// Check the resolved address right before connecting
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrBlockedAddress, err)
+			}
+			return checkIP(net.ParseIP(host), config.AllowPrivate)
+		},
+	}
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   config.Timeout,
+		ResponseHeaderTimeout: config.Timeout,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	client := &http.Client{
+		Timeout:   config.Timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &Outbound{HTTP: client, config: config}
+}
+
+// ValidateAddress checks that an address is host:port, where host is an IP
+// address or a DNS name and port is between 1 and 65535.
+func ValidateAddress(address string) error {
+	if len(address) > maxAddressLength {
+		return fmt.Errorf("%w: longer than %d characters", ErrInvalidAddress, maxAddressLength)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%w: bad port %q", ErrInvalidAddress, port)
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if !validHostname(host) {
+		return fmt.Errorf("%w: bad host %q", ErrInvalidAddress, host)
+	}
+	return nil
+}
+
+// validHostname reports whether host is a DNS name made of letters, digits
+// and inner hyphens.
+func validHostname(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// reservedNetworks are never reachable as a node: "this network" and the
+// old class E range, with the broadcast address.
+var reservedNetworks = parseNetworks("0.0.0.0/8", "240.0.0.0/4")
+
+// internalNetworks are not public either, though a devnet may use them:
+// carrier-grade NAT, IETF protocol assignments and benchmarking.
+var internalNetworks = parseNetworks("100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15")
+
+// NAT64 and 6to4 addresses carry an IPv4 address, which is checked in turn.
+var (
+	nat64Network   = parseNetworks("64:ff9b::/96")[0]
+	sixToFourRange = parseNetworks("2002::/16")[0]
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIP refuses addresses that are not public unicast addresses, unless
+// allowPrivate lets private, loopback, link-local and other internal ones
+// through. An IPv6 address wrapping an IPv4 one is checked as that address.
+func checkIP(ip net.IP, allowPrivate bool) error {
+	switch {
+	case ip == nil:
+		return fmt.Errorf("%w: not an IP address", ErrBlockedAddress)
+	case nat64Network.Contains(ip):
+		return checkIP(net.IP(ip[12:16]), allowPrivate)
+	case sixToFourRange.Contains(ip):
+		return checkIP(net.IP(ip[2:6]), allowPrivate)
+	case ip.IsUnspecified(), ip.IsMulticast(), inNetworks(ip, reservedNetworks):
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, ip)
+	case allowPrivate:
+		return nil
+	case ip.IsLoopback(), ip.IsPrivate(), ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast(), inNetworks(ip, internalNetworks):
+		return fmt.Errorf("%w: %s is private, loopback, link-local or internal", ErrBlockedAddress, ip)
+	}
+	return nil
+}
+
+// CheckAddress validates the syntax of host:port and, if host is an IP
+// address, that it may be called. Names are checked once resolved, when they
+// are dialed.
+func (o *Outbound) CheckAddress(address string) error {
+	if err := ValidateAddress(address); err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(address)
+	if ip := net.ParseIP(host); ip != nil {
+		return checkIP(ip, o.config.AllowPrivate)
+	}
+	return nil
+}
+
+// NewRequest builds a request for path on the node at address, after
+// checking the address.
+func (o *Outbound) NewRequest(method, address, path string, body io.Reader) (*http.Request, error) {
+	return o.NewRequestContext(context.Background(), method, address, path, body)
+}
+
+// NewRequestContext is NewRequest for a request that is cancelled with ctx.
+func (o *Outbound) NewRequestContext(ctx context.Context, method, address, path string, body io.Reader) (*http.Request, error) {
+	if err := o.CheckAddress(address); err != nil {
+		return nil, err
+	}
+	return http.NewRequestWithContext(ctx, method, "http://"+address+path, body)
+}
+
+// ParseURL checks that a URL is plain http or https to host:port, with no
+// credentials, and returns the host:port.
+func (o *Outbound) ParseURL(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", fmt.Errorf("%w: scheme must be http or https", ErrInvalidAddress)
+	}
+	if parsed.User != nil {
+		return "", fmt.Errorf("%w: credentials are not allowed", ErrInvalidAddress)
+	}
+	if err := o.CheckAddress(parsed.Host); err != nil {
+		return "", err
+	}
+	return parsed.Host, nil
+}
+
+// Open sends a request and returns the response with its body limited to
+// the maximum response size. The caller closes the body.
+func (o *Outbound) Open(req *http.Request) (*http.Response, error) {
+	if _, err := o.ParseURL(req.URL.String()); err != nil {
+		return nil, err
+	}
+	resp, err := o.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %w", req.URL.Host, err)
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: o.config.MaxResponseSize}
+	return resp, nil
+}
+
+// Do sends a request and reads the whole response body.
+func (o *Outbound) Do(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := o.Open(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response from %s: %w", req.URL.Host, err)
+	}
+	return resp, body, nil
+}
+
+// Get fetches a URL and reads the whole response body.
+func (o *Outbound) Get(rawURL string) (*http.Response, []byte, error) {
+	if _, err := o.ParseURL(rawURL); err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request for %s: %w", rawURL, err)
+	}
+	return o.Do(req)
+}
+
+// limitedBody fails a read once more than the allowed bytes were read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, ErrResponseTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,110 @@
+package networkUtils
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckIP(t *testing.T) {
+	blocked := []string{
+		"0.0.0.0", "0.1.2.3", "255.255.255.255", "240.0.0.1", "224.0.0.1",
+		"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254",
+		"100.64.0.1", "100.127.255.254", "192.0.0.8", "198.18.0.1", "198.19.255.254",
+		"::", "::1", "fc00::1", "fe80::1", "ff02::1", "::ffff:127.0.0.1",
+		"64:ff9b::7f00:1", "64:ff9b::a9fe:a9fe", "64:ff9b::a00:1",
+		"2002:7f00:1::", "2002:a9fe:a9fe::1", "2002:c0a8:101::",
+	}
+	for _, address := range blocked {
+		if err := checkIP(net.ParseIP(address), false); !errors.Is(err, ErrBlockedAddress) {
+			t.Errorf("%s: got %v, expected ErrBlockedAddress", address, err)
+		}
+	}
+
+	allowed := []string{"8.8.8.8", "1.1.1.1", "100.128.0.1", "198.20.0.1", "2001:4860:4860::8888", "64:ff9b::808:808", "2002:808:808::"}
+	for _, address := range allowed {
+		if err := checkIP(net.ParseIP(address), false); err != nil {
+			t.Errorf("%s: %v", address, err)
+		}
+	}
+
+	// A devnet reaches private addresses, but never reserved ones
+	if err := checkIP(net.ParseIP("10.1.2.3"), true); err != nil {
+		t.Errorf("private address on a devnet: %v", err)
+	}
+	for _, address := range []string{"0.0.0.0", "240.0.0.1", "64:ff9b::", "2002::"} {
+		if err := checkIP(net.ParseIP(address), true); !errors.Is(err, ErrBlockedAddress) {
+			t.Errorf("%s on a devnet: got %v, expected ErrBlockedAddress", address, err)
+		}
+	}
+}
+
+// A name passes the address check and is refused once it resolves to a
+// blocked address, right before connecting.
+func TestOutboundChecksResolvedAddress(t *testing.T) {
+	reached := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer server.Close()
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outbound := NewOutbound(OutboundConfig{})
+	address := net.JoinHostPort("localhost", port)
+	if err := outbound.CheckAddress(address); err != nil {
+		t.Fatalf("name was refused before resolving: %v", err)
+	}
+	if _, _, err := outbound.Get("http://" + address + "/"); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("name resolving to loopback: got %v, expected ErrBlockedAddress", err)
+	}
+	if _, _, err := outbound.Get(server.URL); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("loopback address: got %v, expected ErrBlockedAddress", err)
+	}
+	if reached {
+		t.Error("a blocked address was reached")
+	}
+}
+
+func TestOutboundDoesNotFollowRedirects(t *testing.T) {
+	reached := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusFound)
+	}))
+	defer server.Close()
+
+	resp, _, err := NewOutbound(OutboundConfig{AllowPrivate: true}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("got status %d, expected the redirect itself", resp.StatusCode)
+	}
+	if reached {
+		t.Error("the redirect was followed")
+	}
+}
+
+func TestOutboundLimitsResponseSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", len(r.URL.Path)-1)))
+	}))
+	defer server.Close()
+	outbound := NewOutbound(OutboundConfig{AllowPrivate: true, MaxResponseSize: 10})
+
+	if _, body, err := outbound.Get(server.URL + "/" + strings.Repeat("a", 10)); err != nil || len(body) != 10 {
+		t.Errorf("response at the limit: got %d bytes, %v", len(body), err)
+	}
+	if _, _, err := outbound.Get(server.URL + "/" + strings.Repeat("a", 11)); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("response over the limit: got %v, expected ErrResponseTooLarge", err)
+	}
+}
@@ -0,0 +1,317 @@
+package networkUtils
+
+// Requests between nodes (/ping, /queData, /syncNodeList, /sync/...) and
+// their responses are signed with the node identity key. A signed message
+// carries these headers:
+//
+//	X-Node-Id         computer_id of the sender, the SHA-256 of its public key
+//	X-Node-Timestamp  unix time the message was signed
+//	X-Node-Nonce      16 random bytes in hex, on requests only
+//	X-Node-Signature  base64 DER signature of the canonical message
+//
+// The canonical form of a request names the computer_id of its recipient, so
+// a request signed for one node is refused by every other:
+//
+//	"request\n" + recipient + "\n" + method + "\n" + request URI + "\n" + timestamp + "\n" + nonce + "\n" + hex(SHA-256(body))
+//
+// and that of a response, which is bound to the request it answers, is
+//
+//	"response\n" + request signature + "\n" + status + "\n" + timestamp + "\n" + hex(SHA-256(body))
+//
+// Receivers look the sender up in the nodes table by computer_id and check
+// the signature against its public_key. Only low-S signatures are accepted. A
+// request is accepted once: its sender and nonce are remembered for as long as
+// its timestamp is acceptable.
+
+import (
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/storage"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+const (
+	HeaderNodeID    = "X-Node-Id"
+	HeaderTimestamp = "X-Node-Timestamp"
+	HeaderNonce     = "X-Node-Nonce"
+	HeaderSignature = "X-Node-Signature"
+)
+
+// MaxMessageAge is how far the timestamp of a signed message may be from the
+// receiver's clock.
+const MaxMessageAge = time.Minute
+
+// maxBodySize bounds the body of a signed message.
+const maxBodySize = 16 << 20
+
+// ErrUnsignedMessage is returned when a message is not signed, or not signed
+// by the node it claims to come from.
+var ErrUnsignedMessage = errors.New("message is not signed by a known node")
+
+// Identity is the key a node signs its messages with and the computer_id
+// derived from it.
+type Identity struct {
+	Key *btcec.PrivateKey
+	ID  string
+}
+
+// NewIdentity returns the identity of the node holding key.
+func NewIdentity(key *btcec.PrivateKey) Identity {
+	return Identity{Key: key, ID: cryptoUtils.NodeID(key.PubKey())}
+}
+
+// SignRequest adds the signature headers to an outgoing request with body,
+// for the node with computer_id recipient.
+func (id Identity) SignRequest(req *http.Request, recipient string, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	req.Header.Set(HeaderNodeID, id.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, hex.EncodeToString(nonce))
+	req.Header.Set(HeaderSignature, cryptoUtils.SignMessage(id.Key, requestMessage(recipient, req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(nonce), body)))
+}
+
+// requestMessage returns the canonical form of a request that is signed.
+func requestMessage(recipient, method, uri, timestamp, nonce string, body []byte) []byte {
+	return []byte("request\n" + recipient + "\n" + method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + bodyHash(body))
+}
+
+// responseMessage returns the canonical form of a response that is signed.
+func responseMessage(requestSignature string, status int, timestamp string, body []byte) []byte {
+	return []byte("response\n" + requestSignature + "\n" + strconv.Itoa(status) + "\n" + timestamp + "\n" + bodyHash(body))
+}
+
+func bodyHash(body []byte) string {
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+// knownNode returns the node that signed a message, from the nodes table. Its
+// computer_id must be the hash of its public key.
+func knownNode(store storage.Store, header http.Header) (storage.Node, error) {
+	computerID := header.Get(HeaderNodeID)
+	if computerID == "" || header.Get(HeaderSignature) == "" {
+		return storage.Node{}, fmt.Errorf("%w: no signature", ErrUnsignedMessage)
+	}
+	node, err := store.GetNode(computerID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return storage.Node{}, fmt.Errorf("%w: unknown node %s", ErrUnsignedMessage, computerID)
+	}
+	if err != nil {
+		return storage.Node{}, err
+	}
+	if node.PublicKey == "" {
+		return storage.Node{}, fmt.Errorf("%w: node %s has no public key", ErrUnsignedMessage, computerID)
+	}
+	if derived, err := cryptoUtils.NodeIDFromBase64(node.PublicKey); err != nil || derived != node.ComputerID {
+		return storage.Node{}, fmt.Errorf("%w: computer_id of node %s does not match its public key", ErrUnsignedMessage, computerID)
+	}
+	return node, nil
+}
+
+// checkTimestamp checks that a message was signed within MaxMessageAge.
+func checkTimestamp(value string) error {
+	timestamp, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp", ErrUnsignedMessage)
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > MaxMessageAge || age < -MaxMessageAge {
+		return fmt.Errorf("%w: timestamp is %v off", ErrUnsignedMessage, age.Round(time.Second))
+	}
+	return nil
+}
+
+// Verifier checks signed requests against the nodes table and signs the
+// responses to them.
+type Verifier struct {
+	store    storage.Store
+	identity Identity
+
+	mu   sync.Mutex
+	seen map[string]time.Time // sender and nonce of the requests accepted recently
+}
+
+// NewVerifier returns a verifier that answers as identity.
+func NewVerifier(store storage.Store, identity Identity) *Verifier {
+	return &Verifier{store: store, identity: identity, seen: make(map[string]time.Time)}
+}
+
+// VerifyRequest checks that a request with body was signed for us by a node
+// in the nodes table within MaxMessageAge and was not seen before, and
+// returns that node.
+func (v *Verifier) VerifyRequest(r *http.Request, body []byte) (storage.Node, error) {
+	node, err := knownNode(v.store, r.Header)
+	if err != nil {
+		return storage.Node{}, err
+	}
+	timestamp := r.Header.Get(HeaderTimestamp)
+	if err := checkTimestamp(timestamp); err != nil {
+		return storage.Node{}, err
+	}
+	nonce := r.Header.Get(HeaderNonce)
+	if decoded, err := hex.DecodeString(nonce); err != nil || len(decoded) != 16 {
+		return storage.Node{}, fmt.Errorf("%w: invalid nonce", ErrUnsignedMessage)
+	}
+	message := requestMessage(v.identity.ID, r.Method, r.RequestURI, timestamp, nonce, body)
+	if err := cryptoUtils.VerifyMessage(node.PublicKey, message, r.Header.Get(HeaderSignature)); err != nil {
+		return storage.Node{}, fmt.Errorf("%w: request from %s: %v", ErrUnsignedMessage, node.ComputerID, err)
+	}
+
+	// Reject a replay of a request within the window its timestamp allows
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	for seen, at := range v.seen {
+		if now.Sub(at) > 2*MaxMessageAge {
+			delete(v.seen, seen)
+		}
+	}
+	key := node.ComputerID + " " + nonce
+	if _, ok := v.seen[key]; ok {
+		return storage.Node{}, fmt.Errorf("%w: request from %s was replayed", ErrUnsignedMessage, node.ComputerID)
+	}
+	v.seen[key] = now
+	return node, nil
+}
+
+// Require wraps a handler so that it only serves requests signed by a known
+// node, and signs its response.
+func (v *Verifier) Require(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if _, err := v.VerifyRequest(r, body); err != nil {
+			fmt.Printf("Rejected %s %s from %s: %v\n", r.Method, r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, "Request must be signed by a known node", http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Run the handler against a buffer so the whole response can be signed
+		response := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		handler(response, r)
+
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		signature := cryptoUtils.SignMessage(v.identity.Key, responseMessage(r.Header.Get(HeaderSignature), response.status, timestamp, response.body.Bytes()))
+		for key, values := range response.header {
+			w.Header()[key] = values
+		}
+		w.Header().Set(HeaderNodeID, v.identity.ID)
+		w.Header().Set(HeaderTimestamp, timestamp)
+		w.Header().Set(HeaderSignature, signature)
+		w.WriteHeader(response.status)
+		w.Write(response.body.Bytes())
+	}
+}
+
+// bufferedResponse collects a handler's response before it is signed.
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if !b.wroteHeader {
+		b.status = status
+		b.wroteHeader = true
+	}
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(data)
+}
+
+// Client sends signed requests to other nodes through an outbound client,
+// which does not follow redirects, so a response always answers the request
+// that was signed.
+type Client struct {
+	outbound *Outbound
+	store    storage.Store
+	identity Identity
+}
+
+// NewClient returns a client that signs as identity.
+func NewClient(store storage.Store, identity Identity, outbound *Outbound) *Client {
+	return &Client{outbound: outbound, store: store, identity: identity}
+}
+
+// Get sends a GET for path to the node at ipAddress, signed for the node the
+// nodes table lists at that address. The response is only returned if it is
+// signed by that node.
+func (c *Client) Get(ipAddress, path string) (int, []byte, error) {
+	return c.GetContext(context.Background(), ipAddress, path)
+}
+
+// GetContext is Get for a request that is cancelled with ctx.
+func (c *Client) GetContext(ctx context.Context, ipAddress, path string) (int, []byte, error) {
+	node, err := c.store.GetNodeAt(ipAddress)
+	if errors.Is(err, storage.ErrNotFound) {
+		return 0, nil, fmt.Errorf("%w: no node is listed at %s", ErrUnsignedMessage, ipAddress)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, body, err := c.send(ctx, http.MethodGet, node.ComputerID, ipAddress, path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := c.verifyResponse(resp, body, node.ComputerID); err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// send signs a request for recipient, sends it to ipAddress and reads the
+// response body.
+func (c *Client) send(ctx context.Context, method, recipient, ipAddress, path string, body []byte) (*http.Response, []byte, error) {
+	req, err := c.outbound.NewRequestContext(ctx, method, ipAddress, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	c.identity.SignRequest(req, recipient, body)
+	return c.outbound.Do(req)
+}
+
+// verifyResponse checks that a response was signed by recipient in answer to
+// our request.
+func (c *Client) verifyResponse(resp *http.Response, body []byte, recipient string) error {
+	node, err := knownNode(c.store, resp.Header)
+	if err != nil {
+		return err
+	}
+	if node.ComputerID != recipient {
+		return fmt.Errorf("%w: response from %s instead of %s", ErrUnsignedMessage, node.ComputerID, recipient)
+	}
+	timestamp := resp.Header.Get(HeaderTimestamp)
+	if err := checkTimestamp(timestamp); err != nil {
+		return err
+	}
+	message := responseMessage(resp.Request.Header.Get(HeaderSignature), resp.StatusCode, timestamp, body)
+	if err := cryptoUtils.VerifyMessage(node.PublicKey, message, resp.Header.Get(HeaderSignature)); err != nil {
+		return fmt.Errorf("%w: response from %s: %v", ErrUnsignedMessage, node.ComputerID, err)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package networkUtils
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// signingNode is a node identity listed in a nodes table at address.
+type signingNode struct {
+	identity Identity
+	address  string
+}
+
+func newSigningNode(t *testing.T, store storage.Store, address string) signingNode {
+	t.Helper()
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := NewIdentity(key)
+	if err := store.InsertNode(storage.Node{ComputerID: identity.ID, IPAddress: address, Reachable: true, PublicKey: cryptoUtils.PublicKeyBase64(key)}); err != nil {
+		t.Fatal(err)
+	}
+	return signingNode{identity: identity, address: address}
+}
+
+func openSigningStore(t *testing.T) storage.Store {
+	t.Helper()
+	store, err := storage.Open("sqlite3", filepath.Join(t.TempDir(), "nodes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// signedRequest returns a request from sender signed for recipient.
+func signedRequest(sender Identity, recipient, path, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	sender.SignRequest(req, recipient, []byte(body))
+	return req
+}
+
+// highS returns the same signature with S replaced by N - S, which verifies
+// against the same message and key.
+func highS(t *testing.T, signatureB64 string) string {
+	t.Helper()
+	der, err := base64.StdEncoding.DecodeString(signatureB64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 0x30 <length> 0x02 <length of R> <R> 0x02 <length of S> <S>
+	rLen := int(der[3])
+	r := der[4 : 4+rLen]
+	s := new(big.Int).SetBytes(der[6+rLen:])
+	s.Sub(btcec.S256().N, s)
+
+	integer := func(value []byte) []byte {
+		for len(value) > 1 && value[0] == 0 && value[1] < 0x80 {
+			value = value[1:]
+		}
+		if value[0] >= 0x80 {
+			value = append([]byte{0}, value...)
+		}
+		return append([]byte{0x02, byte(len(value))}, value...)
+	}
+	body := append(integer(r), integer(s.Bytes())...)
+	return base64.StdEncoding.EncodeToString(append([]byte{0x30, byte(len(body))}, body...))
+}
+
+func TestVerifyRequest(t *testing.T) {
+	store := openSigningStore(t)
+	sender := newSigningNode(t, store, "10.0.0.1:80")
+	receiver := newSigningNode(t, store, "10.0.0.2:80")
+	verifier := NewVerifier(store, receiver.identity)
+
+	node, err := verifier.VerifyRequest(signedRequest(sender.identity, receiver.identity.ID, "/queData", "data"), []byte("data"))
+	if err != nil {
+		t.Fatalf("signed request was refused: %v", err)
+	}
+	if node.ComputerID != sender.identity.ID {
+		t.Errorf("request attributed to %s, expected %s", node.ComputerID, sender.identity.ID)
+	}
+
+	// A request signed for another node cannot be relayed to us
+	other := newSigningNode(t, store, "10.0.0.3:80")
+	if _, err := verifier.VerifyRequest(signedRequest(sender.identity, other.identity.ID, "/queData", "data"), []byte("data")); !errors.Is(err, ErrUnsignedMessage) {
+		t.Errorf("request signed for another node: got %v, expected ErrUnsignedMessage", err)
+	}
+
+	req := signedRequest(sender.identity, receiver.identity.ID, "/queData", "data")
+	if _, err := verifier.VerifyRequest(req, []byte("changed")); !errors.Is(err, ErrUnsignedMessage) {
+		t.Errorf("request with a changed body: got %v, expected ErrUnsignedMessage", err)
+	}
+
+	unknown := NewIdentity(other.identity.Key)
+	unknown.ID = strings.Repeat("0", 64)
+	if _, err := verifier.VerifyRequest(signedRequest(unknown, receiver.identity.ID, "/queData", ""), nil); !errors.Is(err, ErrUnsignedMessage) {
+		t.Errorf("request from an unknown node: got %v, expected ErrUnsignedMessage", err)
+	}
+
+	req = signedRequest(sender.identity, receiver.identity.ID, "/queData", "")
+	req.Header.Set(HeaderSignature, highS(t, req.Header.Get(HeaderSignature)))
+	if _, err := verifier.VerifyRequest(req, nil); !errors.Is(err, ErrUnsignedMessage) {
+		t.Errorf("request with a high-S signature: got %v, expected ErrUnsignedMessage", err)
+	}
+}
+
+func TestVerifyRequestRefusesReplays(t *testing.T) {
+	store := openSigningStore(t)
+	sender := newSigningNode(t, store, "10.0.0.1:80")
+	second := newSigningNode(t, store, "10.0.0.3:80")
+	receiver := newSigningNode(t, store, "10.0.0.2:80")
+	verifier := NewVerifier(store, receiver.identity)
+
+	req := signedRequest(sender.identity, receiver.identity.ID, "/ping", "")
+	if _, err := verifier.VerifyRequest(req, nil); err != nil {
+		t.Fatalf("first request was refused: %v", err)
+	}
+	if _, err := verifier.VerifyRequest(req, nil); !errors.Is(err, ErrUnsignedMessage) {
+		t.Errorf("replayed request: got %v, expected ErrUnsignedMessage", err)
+	}
+
+	// A new signature over the same nonce is still a replay
+	nonce := req.Header.Get(HeaderNonce)
+	again := signedRequest(sender.identity, receiver.identity.ID, "/ping", "")
+	again.Header.Set(HeaderNonce, nonce)
+	again.Header.Set(HeaderSignature, cryptoUtils.SignMessage(sender.identity.Key,
+		requestMessage(receiver.identity.ID, again.Method, again.RequestURI, again.Header.Get(HeaderTimestamp), nonce, nil)))
+	if _, err := verifier.VerifyRequest(again, nil); !errors.Is(err, ErrUnsignedMessage) {
+		t.Errorf("request reusing a nonce: got %v, expected ErrUnsignedMessage", err)
+	}
+
+	// Nonces are only unique per sender
+	other := signedRequest(second.identity, receiver.identity.ID, "/ping", "")
+	other.Header.Set(HeaderNonce, nonce)
+	other.Header.Set(HeaderSignature, cryptoUtils.SignMessage(second.identity.Key,
+		requestMessage(receiver.identity.ID, other.Method, other.RequestURI, other.Header.Get(HeaderTimestamp), nonce, nil)))
+	if _, err := verifier.VerifyRequest(other, nil); err != nil {
+		t.Errorf("another node using the same nonce was refused: %v", err)
+	}
+}
+
+// serve runs handler behind a verifier answering as the node listed at the
+// server's address.
+func serve(t *testing.T, store storage.Store, handler http.HandlerFunc) (*httptest.Server, signingNode) {
+	t.Helper()
+	var verifier *Verifier
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifier.Require(handler)(w, r)
+	}))
+	t.Cleanup(server.Close)
+	node := newSigningNode(t, store, strings.TrimPrefix(server.URL, "http://"))
+	verifier = NewVerifier(store, node.identity)
+	return server, node
+}
+
+func TestClientChecksResponses(t *testing.T) {
+	store := openSigningStore(t)
+	client := newSigningNode(t, store, "10.0.0.1:80")
+	outbound := NewOutbound(OutboundConfig{AllowPrivate: true})
+	nodes := NewClient(store, client.identity, outbound)
+
+	_, node := serve(t, store, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	})
+	status, body, err := nodes.Get(node.address, "/ping")
+	if err != nil || status != http.StatusOK || string(body) != "pong" {
+		t.Fatalf("signed ping: got %d %q, %v", status, body, err)
+	}
+
+	if _, _, err := nodes.Get("10.0.0.9:80", "/ping"); !errors.Is(err, ErrUnsignedMessage) {
+		t.Errorf("ping to an unlisted address: got %v, expected ErrUnsignedMessage", err)
+	}
+
+	// A response must answer our request, with the body that was signed
+	req, err := outbound.NewRequest(http.MethodGet, node.address, "/ping", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.identity.SignRequest(req, node.identity.ID, nil)
+	resp, body, err := outbound.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes.verifyResponse(resp, body, node.identity.ID); err != nil {
+		t.Errorf("response to our request was refused: %v", err)
+	}
+	if err := nodes.verifyResponse(resp, []byte("tampered"), node.identity.ID); !errors.Is(err, ErrUnsignedMessage) {
+		t.Errorf("response with a changed body: got %v, expected ErrUnsignedMessage", err)
+	}
+	resp.Request.Header.Set(HeaderSignature, cryptoUtils.SignMessage(client.identity.Key, []byte("another request")))
+	if err := nodes.verifyResponse(resp, body, node.identity.ID); !errors.Is(err, ErrUnsignedMessage) {
+		t.Errorf("response to another request: got %v, expected ErrUnsignedMessage", err)
+	}
+}
+
+// The node answering at an address is not the one the nodes table lists
+// there: it refuses a request signed for the listed node, and the client
+// refuses its answer.
+func TestClientRefusesResponseFromAnotherNode(t *testing.T) {
+	store := openSigningStore(t)
+	client := newSigningNode(t, store, "10.0.0.1:80")
+	nodes := NewClient(store, client.identity, NewOutbound(OutboundConfig{AllowPrivate: true}))
+
+	served := 0
+	_, node := serve(t, store, func(w http.ResponseWriter, r *http.Request) {
+		served++
+		io.WriteString(w, "pong")
+	})
+	address := node.address
+	listed, err := store.ListNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range listed {
+		if listed[i].ComputerID == node.identity.ID {
+			listed[i].IPAddress = "10.0.0.8:80"
+		}
+	}
+	if err := store.ReplaceNodes(listed); err != nil {
+		t.Fatal(err)
+	}
+	newSigningNode(t, store, address)
+
+	if _, _, err := nodes.Get(address, "/ping"); !errors.Is(err, ErrUnsignedMessage) {
+		t.Errorf("answer from another node: got %v, expected ErrUnsignedMessage", err)
+	}
+	if served != 0 {
+		t.Error("request signed for the listed node was served by another")
+	}
+}
@@ -0,0 +1,75 @@
+package peg
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// depositTag separates the tweaks of deposit addresses from any other use of
+// the peg key.
+var depositTag = []byte("bitcoin-sidechain/deposit")
+
+// ErrNoPegKey is returned while no handoff has completed, so there is no peg
+// key to derive deposit addresses from.
+var ErrNoPegKey = errors.New("no peg key yet")
+
+// DepositTweak returns the taproot script root committed to in the deposit
+// address of a wallet. The output key is the peg key tweaked by it, so the
+// custodians can spend the deposit with a key path signature and every node
+// can derive the address on its own.
+func DepositTweak(wallet string) chainhash.Hash {
+	return *chainhash.TaggedHash(depositTag, []byte(wallet))
+}
+
+// DeriveDepositAddress returns the deposit address of a wallet for the peg key
+// groupKey, an x-only key in hex.
+func DeriveDepositAddress(groupKey, wallet string, params *chaincfg.Params) (storage.DepositAddress, error) {
+	if err := checkWallet(wallet); err != nil {
+		return storage.DepositAddress{}, err
+	}
+	internal, err := parseGroupKey(groupKey)
+	if err != nil {
+		return storage.DepositAddress{}, err
+	}
+	root := DepositTweak(wallet)
+	output := txscript.ComputeTaprootOutputKey(internal, root[:])
+	address, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(output), params)
+	if err != nil {
+		return storage.DepositAddress{}, fmt.Errorf("failed to encode deposit address: %w", err)
+	}
+	script, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		return storage.DepositAddress{}, fmt.Errorf("failed to build deposit script: %w", err)
+	}
+	return storage.DepositAddress{
+		Wallet:    wallet,
+		Address:   address.EncodeAddress(),
+		Script:    hex.EncodeToString(script),
+		CreatedAt: time.Now().Unix(),
+	}, nil
+}
+
+// checkWallet checks that a wallet address is a public key in base64, as the
+// wallets table holds them.
+func checkWallet(wallet string) error {
+	raw, err := base64.StdEncoding.DecodeString(wallet)
+	if err != nil {
+		return fmt.Errorf("invalid wallet address: %w", err)
+	}
+	if _, err := btcec.ParsePubKey(raw); err != nil {
+		return fmt.Errorf("invalid wallet address: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package peg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// BitcoinBackend is the node's view of the Bitcoin chain: its best chain by
+// height and the blocks in it, and its way to broadcast payouts. RPCBackend talks to bitcoind and FakeBackend
+// is a chain held in memory for checks.
+type BitcoinBackend interface {
+	// BlockCount returns the height of the tip of the best chain.
+	BlockCount() (int64, error)
+	// BlockHash returns the hash of the block at a height of the best chain.
+	BlockHash(height int64) (chainhash.Hash, error)
+	// Block returns a block by hash.
+	Block(hash chainhash.Hash) (*wire.MsgBlock, error)
+	// SendTransaction broadcasts a signed transaction. Sending one that is
+	// already in the mempool or the best chain is not an error.
+	SendTransaction(tx *wire.MsgTx) error
+}
+
+// Network returns the chain parameters of a network by name: mainnet,
+// testnet, signet or regtest.
+func Network(name string) (*chaincfg.Params, error) {
+	switch name {
+	case "mainnet", "":
+		return &chaincfg.MainNetParams, nil
+	case "testnet":
+		return &chaincfg.TestNet3Params, nil
+	case "signet":
+		return &chaincfg.SigNetParams, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	}
+	return nil, fmt.Errorf("unknown bitcoin network %q", name)
+}
+
+// Outpoint formats an output as txid:vout.
+func Outpoint(txid chainhash.Hash, vout uint32) string {
+	return fmt.Sprintf("%s:%d", txid, vout)
+}
+
+// ParseOutpoint parses an output written as txid:vout.
+func ParseOutpoint(outpoint string) (chainhash.Hash, uint32, error) {
+	txid, vout, ok := strings.Cut(outpoint, ":")
+	if !ok {
+		return chainhash.Hash{}, 0, fmt.Errorf("invalid outpoint %q", outpoint)
+	}
+	hash, err := chainhash.NewHashFromStr(txid)
+	if err != nil || len(txid) != 2*chainhash.HashSize {
+		return chainhash.Hash{}, 0, fmt.Errorf("invalid outpoint %q", outpoint)
+	}
+	index, err := strconv.ParseUint(vout, 10, 32)
+	if err != nil {
+		return chainhash.Hash{}, 0, fmt.Errorf("invalid outpoint %q", outpoint)
+	}
+	return *hash, uint32(index), nil
+}
@@ -0,0 +1,186 @@
+package peg
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// FakeBackend is a Bitcoin chain held in memory, for checks and local
+// development. Payments and sent transactions wait in a mempool until a block
+// is mined, and the last blocks can be dropped to stage a reorganization.
+// Scripts are not checked, but an output is spent only once.
+type FakeBackend struct {
+	mu      sync.Mutex
+	chain   []*wire.MsgBlock // best chain, by height
+	blocks  map[chainhash.Hash]*wire.MsgBlock
+	mempool []*wire.MsgTx
+	mined   uint32 // blocks ever mined, so that every block gets its own hash
+}
+
+// NewFakeBackend returns a chain with only a genesis block.
+func NewFakeBackend() *FakeBackend {
+	f := &FakeBackend{blocks: make(map[chainhash.Hash]*wire.MsgBlock)}
+	f.mine(nil)
+	return f
+}
+
+// Pay adds a transaction to the mempool that pays amount sats to a script,
+// spending an output that is made up. It returns the transaction.
+func (f *FakeBackend) Pay(script []byte, amount int64) *wire.MsgTx {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	var source chainhash.Hash
+	copy(source[:], fmt.Sprintf("fake payment %d.%d", f.mined, len(f.mempool)))
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&source, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(amount, script))
+	f.mempool = append(f.mempool, tx)
+	return tx
+}
+
+// Mine mines n blocks on the tip. The first one takes the whole mempool.
+func (f *FakeBackend) Mine(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		f.mine(f.mempool)
+		f.mempool = nil
+	}
+}
+
+// Reorg drops the last depth blocks of the best chain, as if a longer chain
+// without them had won. Their transactions go back to the mempool, so
+// mining depth+1 blocks gives a chain that is longer and confirms them again
+// at other heights.
+func (f *FakeBackend) Reorg(depth int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := 0; i < depth && len(f.chain) > 1; i++ {
+		last := f.chain[len(f.chain)-1]
+		f.chain = f.chain[:len(f.chain)-1]
+		f.mempool = append(append([]*wire.MsgTx{}, last.Transactions...), f.mempool...)
+	}
+}
+
+// mine appends a block with the given transactions. The caller holds f.mu.
+func (f *FakeBackend) mine(txs []*wire.MsgTx) {
+	var prev chainhash.Hash
+	if len(f.chain) > 0 {
+		prev = f.chain[len(f.chain)-1].BlockHash()
+	}
+	f.mined++
+	header := wire.NewBlockHeader(1, &prev, &chainhash.Hash{}, 0x207fffff, f.mined)
+	header.Timestamp = time.Unix(1700000000+int64(f.mined)*600, 0)
+	block := wire.NewMsgBlock(header)
+	for _, tx := range txs {
+		block.AddTransaction(tx)
+	}
+	f.chain = append(f.chain, block)
+	f.blocks[block.BlockHash()] = block
+}
+
+// BlockCount returns the height of the tip.
+func (f *FakeBackend) BlockCount() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return int64(len(f.chain) - 1), nil
+}
+
+// BlockHash returns the hash of the block at a height of the best chain.
+func (f *FakeBackend) BlockHash(height int64) (chainhash.Hash, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if height < 0 || height >= int64(len(f.chain)) {
+		return chainhash.Hash{}, fmt.Errorf("no block at height %d", height)
+	}
+	return f.chain[height].BlockHash(), nil
+}
+
+// Block returns a block by hash, including blocks that left the best chain.
+func (f *FakeBackend) Block(hash chainhash.Hash) (*wire.MsgBlock, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	block, ok := f.blocks[hash]
+	if !ok {
+		return nil, errors.New("block not found")
+	}
+	return block, nil
+}
+
+// SendTransaction adds a transaction to the mempool unless it is there or in
+// the best chain already. It fails if the transaction spends an output that
+// another one in the mempool or the best chain spends.
+func (f *FakeBackend) SendTransaction(tx *wire.MsgTx) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	txid := tx.TxHash()
+	txs := append([]*wire.MsgTx{}, f.mempool...)
+	for _, block := range f.chain {
+		txs = append(txs, block.Transactions...)
+	}
+	spends := make(map[wire.OutPoint]bool, len(tx.TxIn))
+	for _, in := range tx.TxIn {
+		spends[in.PreviousOutPoint] = true
+	}
+	for _, other := range txs {
+		if other.TxHash() == txid {
+			return nil
+		}
+		for _, in := range other.TxIn {
+			if spends[in.PreviousOutPoint] {
+				return fmt.Errorf("transaction %s spends %s, already spent by %s", txid, in.PreviousOutPoint, other.TxHash())
+			}
+		}
+	}
+	f.mempool = append(f.mempool, tx)
+	return nil
+}
+
+// Mempool returns the transactions waiting to be mined.
+func (f *FakeBackend) Mempool() []*wire.MsgTx {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*wire.MsgTx{}, f.mempool...)
+}
+
+// UnspentOutput returns an output of the best chain or the mempool that no
+// transaction of either spends, or nil, like RPCBackend.UnspentOutput.
+func (f *FakeBackend) UnspentOutput(txid chainhash.Hash, vout uint32) (*UnspentOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var found *UnspentOutput
+	spent := false
+	check := func(tx *wire.MsgTx, confirmations int64) {
+		if tx.TxHash() == txid && int(vout) < len(tx.TxOut) {
+			out := tx.TxOut[vout]
+			found = &UnspentOutput{Amount: out.Value, Script: out.PkScript, Confirmations: confirmations}
+		}
+		for _, in := range tx.TxIn {
+			if in.PreviousOutPoint.Hash == txid && in.PreviousOutPoint.Index == vout {
+				spent = true
+			}
+		}
+	}
+	for height, block := range f.chain {
+		for _, tx := range block.Transactions {
+			check(tx, int64(len(f.chain)-height))
+		}
+	}
+	for _, tx := range f.mempool {
+		check(tx, 0)
+	}
+	if spent {
+		return nil, nil
+	}
+	return found, nil
+}
@@ -0,0 +1,418 @@
+package peg
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/frost"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// PayerConfig sets the pace and the fee rate of payouts.
+type PayerConfig struct {
+	Interval       time.Duration // length of a coordinator turn
+	MaxWithdrawals int           // withdrawals paid by one payout
+	FeeRate        int64         // sats per virtual byte
+}
+
+// DefaultPayerConfig is used for any value left at zero.
+var DefaultPayerConfig = PayerConfig{
+	Interval:       time.Minute,
+	MaxWithdrawals: 50,
+	FeeRate:        2,
+}
+
+// Session bounds: the nonces a custodian keeps between the rounds, and how
+// many turns it holds the inputs and withdrawals of a payout it signed for.
+const (
+	maxSessions  = 64
+	reserveTurns = 5
+)
+
+// Virtual sizes used to price a payout: the fixed part, a key path input and
+// the largest standard output.
+const (
+	txOverheadVSize = 11
+	inputVSize      = 58
+	outputVSize     = 43
+)
+
+// PayoutTransport carries the signing rounds between the custodians and the
+// signed payouts to every node.
+type PayoutTransport interface {
+	// Commit asks a custodian for its commitments.
+	Commit(peer storage.EpochMember, request CommitRequest) (CommitResponse, error)
+	// Sign asks a custodian for its signature shares.
+	Sign(peer storage.EpochMember, request SignRequest) (SignResponse, error)
+	// Submit sends a signed payout to every other node without waiting.
+	Submit(payout storage.Payout)
+}
+
+// Payer runs this node's part in paying withdrawals: as a custodian it signs
+// the payouts other custodians coordinate, and in its turns it coordinates
+// one itself.
+type Payer struct {
+	store     storage.Store
+	watcher   *Watcher
+	key       *btcec.PrivateKey
+	self      string
+	transport PayoutTransport
+	config    PayerConfig
+	random    io.Reader
+
+	mu       sync.Mutex
+	sessions map[string]*signingSession // by coordinator and txid
+	reserved map[string]reservation     // by outpoint or withdrawal tx id
+	signing  map[string]string          // payout txid, by withdrawal tx id, while this node coordinates
+}
+
+// reservation holds an input or a withdrawal for a payout signed recently.
+type reservation struct {
+	txid  string
+	until time.Time
+}
+
+// NewPayer returns a payer for the node with the given key. Zero values in
+// config are taken from DefaultPayerConfig.
+func NewPayer(store storage.Store, watcher *Watcher, key *btcec.PrivateKey, transport PayoutTransport, config PayerConfig) *Payer {
+	if config.Interval <= 0 {
+		config.Interval = DefaultPayerConfig.Interval
+	}
+	if config.MaxWithdrawals <= 0 {
+		config.MaxWithdrawals = DefaultPayerConfig.MaxWithdrawals
+	}
+	if config.FeeRate <= 0 {
+		config.FeeRate = DefaultPayerConfig.FeeRate
+	}
+	return &Payer{
+		store:     store,
+		watcher:   watcher,
+		key:       key,
+		self:      cryptoUtils.NodeID(key.PubKey()),
+		transport: transport,
+		config:    config,
+		random:    rand.Reader,
+		sessions:  make(map[string]*signingSession),
+		reserved:  make(map[string]reservation),
+		signing:   make(map[string]string),
+	}
+}
+
+// Run coordinates a payout in each of this node's turns until stop is
+// closed. The turns go round the custodians, one per Interval.
+func (p *Payer) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			slot := now.UnixNano() / int64(p.config.Interval)
+			if err := p.Turn(slot); err != nil && !errors.Is(err, ErrNoPegKey) {
+				fmt.Println("Peg: error paying withdrawals:", err)
+			}
+		}
+	}
+}
+
+// Signing returns the payout this node is having signed for a withdrawal.
+func (p *Payer) Signing(withdrawal string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	txid, ok := p.signing[withdrawal]
+	return txid, ok
+}
+
+// Turn coordinates a payout if this node is the coordinator of slot: custodian
+// slot mod n. It does nothing when there is nothing to pay.
+func (p *Payer) Turn(slot int64) error {
+	k, err := p.loadKey()
+	if err != nil {
+		return err
+	}
+	_, id, ok := k.custodian(p.self)
+	if !ok || k.share == nil || len(k.custodians) == 0 || int(slot%int64(len(k.custodians)))+1 != id {
+		return nil
+	}
+
+	payout, tx, err := p.build(k)
+	if err != nil || payout == nil {
+		return err
+	}
+	p.mu.Lock()
+	for _, w := range payout.Withdrawals {
+		p.signing[w] = payout.TxID
+	}
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		for _, w := range payout.Withdrawals {
+			delete(p.signing, w)
+		}
+		p.mu.Unlock()
+	}()
+
+	fmt.Printf("Peg: signing payout %s of %d withdrawals\n", payout.TxID, len(payout.Withdrawals))
+	if err := p.sign(k, payout, tx); err != nil {
+		return fmt.Errorf("failed to sign payout %s: %w", payout.TxID, err)
+	}
+	if err := p.watcher.Submit(*payout); err != nil {
+		return fmt.Errorf("signed payout %s does not check: %w", payout.TxID, err)
+	}
+	p.transport.Submit(*payout)
+	fmt.Printf("Peg: payout %s signed\n", payout.TxID)
+	return nil
+}
+
+// build batches the queued withdrawals that no pooled payout pays into an
+// unsigned payout. It takes withdrawals oldest first and peg UTXOs oldest
+// first, and leaves out the newest withdrawals the peg cannot cover. It
+// returns nil if there is nothing to pay.
+func (p *Payer) build(k *custodyKey) (*storage.Payout, *wire.MsgTx, error) {
+	taken := make(map[string]bool)
+	for _, pooled := range p.watcher.Pooled() {
+		for _, item := range append(append([]string{}, pooled.Inputs...), pooled.Withdrawals...) {
+			taken[item] = true
+		}
+	}
+	queued, err := p.store.ListQueuedWithdrawals(p.config.MaxWithdrawals + len(taken))
+	if err != nil {
+		return nil, nil, err
+	}
+	var withdrawals []storage.Withdrawal
+	var scripts [][]byte
+	for _, w := range queued {
+		if taken[w.TxID] || len(withdrawals) == p.config.MaxWithdrawals {
+			continue
+		}
+		script, err := p.watcher.withdrawalScript(w.Address)
+		if err != nil {
+			fmt.Printf("Peg: cannot pay withdrawal %s: %v\n", w.TxID, err)
+			continue
+		}
+		withdrawals = append(withdrawals, w)
+		scripts = append(scripts, script)
+	}
+	all, err := p.store.ListUnspentPegUTXOs()
+	if err != nil {
+		return nil, nil, err
+	}
+	var utxos []storage.PegUTXO
+	for _, u := range all {
+		if !taken[u.Outpoint] && len(utxos) < maxPayoutInputs {
+			utxos = append(utxos, u)
+		}
+	}
+
+	// Cover the withdrawals with the oldest outputs, dropping the newest
+	// withdrawals until the peg can pay the rest without dust change
+	var inputs []storage.PegUTXO
+	var change int64
+	for len(withdrawals) > 0 {
+		var need, have int64
+		for _, w := range withdrawals {
+			need += w.Amount
+		}
+		inputs = inputs[:0]
+		for _, u := range utxos {
+			if have >= need && (have == need || have-need >= DustLimit) {
+				break
+			}
+			inputs = append(inputs, u)
+			have += u.Amount
+		}
+		if have >= need && (have == need || have-need >= DustLimit) {
+			change = have - need
+			break
+		}
+		withdrawals, scripts = withdrawals[:len(withdrawals)-1], scripts[:len(scripts)-1]
+	}
+	if len(withdrawals) == 0 {
+		return nil, nil, nil
+	}
+
+	// Share the fee among the withdrawals
+	outputs := len(withdrawals)
+	if change > 0 {
+		outputs++
+	}
+	vsize := int64(txOverheadVSize + inputVSize*len(inputs) + outputVSize*outputs)
+	n := int64(len(withdrawals))
+	fee := (p.config.FeeRate*vsize + n - 1) / n
+	if fee > MaxWithdrawalFee {
+		fmt.Printf("Peg: fee of %d sats per withdrawal capped at %d\n", fee, MaxWithdrawalFee)
+		fee = MaxWithdrawalFee
+	}
+
+	tx := wire.NewMsgTx(payoutTxVersion)
+	payout := &storage.Payout{Fee: fee, Change: change}
+	for _, u := range inputs {
+		txid, vout, err := ParseOutpoint(u.Outpoint)
+		if err != nil {
+			return nil, nil, err
+		}
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&txid, vout), nil, nil))
+		payout.Inputs = append(payout.Inputs, u.Outpoint)
+	}
+	for i, w := range withdrawals {
+		tx.AddTxOut(wire.NewTxOut(w.Amount-fee, scripts[i]))
+		payout.Withdrawals = append(payout.Withdrawals, w.TxID)
+	}
+	if change > 0 {
+		script, err := ChangeScript(k.key.GroupKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		tx.AddTxOut(wire.NewTxOut(change, script))
+	}
+	payout.TxID = tx.TxHash().String()
+	if payout.Tx, err = EncodeTx(tx); err != nil {
+		return nil, nil, err
+	}
+	return payout, tx, nil
+}
+
+// sign runs both FROST rounds with the custodians for every input of a
+// payout and sets the witnesses of its transaction.
+func (p *Payer) sign(k *custodyKey, payout *storage.Payout, tx *wire.MsgTx) error {
+	_, prevouts, err := p.watcher.checkPayout(*payout, false)
+	if err != nil {
+		return err
+	}
+	messages, _, err := sighashes(tx, prevouts)
+	if err != nil {
+		return err
+	}
+
+	// Round one: commitments from every custodian that answers
+	commitRequest := CommitRequest{Epoch: k.key.Epoch, Coordinator: p.self, Payout: *payout}
+	commitRequest.Signature = cryptoUtils.SignMessage(p.key, commitRequest.SignBytes())
+	commitments := make(map[int][]frost.Commitment)
+	var mu sync.Mutex
+	p.each(k, k.custodians, func(id int, peer storage.EpochMember) error {
+		var response CommitResponse
+		var err error
+		if peer.ComputerID == p.self {
+			response, err = p.Commit(commitRequest)
+		} else {
+			response, err = p.transport.Commit(peer, commitRequest)
+		}
+		if err != nil {
+			return err
+		}
+		if response.Custodian != peer.ComputerID || response.Epoch != k.key.Epoch || response.TxID != payout.TxID || len(response.Commitments) != len(messages) {
+			return errors.New("commitments for something else")
+		}
+		if err := cryptoUtils.VerifyMessage(peer.PublicKey, response.SignBytes(), response.Signature); err != nil {
+			return err
+		}
+		for _, c := range response.Commitments {
+			if c.ID != id {
+				return fmt.Errorf("commitment of signer %d", c.ID)
+			}
+		}
+		mu.Lock()
+		commitments[id] = response.Commitments
+		mu.Unlock()
+		return nil
+	})
+	if len(commitments) < k.public.Threshold {
+		return fmt.Errorf("%d custodians committed, %d needed", len(commitments), k.public.Threshold)
+	}
+
+	// Round two: shares from the first Threshold of them
+	var ids []int
+	for id := range commitments {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	ids = ids[:k.public.Threshold]
+	signers := make([]storage.EpochMember, len(ids))
+	packages := make([]frost.SigningPackage, len(messages))
+	for i, message := range messages {
+		round := make([]frost.Commitment, len(ids))
+		for j, id := range ids {
+			round[j] = commitments[id][i]
+		}
+		packages[i] = frost.NewSigningPackage(message, round)
+	}
+	for j, id := range ids {
+		signers[j] = k.custodians[id-1]
+	}
+	signRequest := SignRequest{Epoch: k.key.Epoch, Coordinator: p.self, Payout: *payout, Packages: packages}
+	signRequest.Signature = cryptoUtils.SignMessage(p.key, signRequest.SignBytes())
+	shares := make([][]frost.SignatureShare, len(messages))
+	failed := p.each(k, signers, func(_ int, peer storage.EpochMember) error {
+		var response SignResponse
+		var err error
+		if peer.ComputerID == p.self {
+			response, err = p.Sign(signRequest)
+		} else {
+			response, err = p.transport.Sign(peer, signRequest)
+		}
+		if err != nil {
+			return err
+		}
+		if response.Custodian != peer.ComputerID || response.Epoch != k.key.Epoch || response.TxID != payout.TxID || len(response.Shares) != len(messages) {
+			return errors.New("shares for something else")
+		}
+		if err := cryptoUtils.VerifyMessage(peer.PublicKey, response.SignBytes(), response.Signature); err != nil {
+			return err
+		}
+		mu.Lock()
+		for i, share := range response.Shares {
+			shares[i] = append(shares[i], share)
+		}
+		mu.Unlock()
+		return nil
+	})
+	if failed > 0 {
+		return fmt.Errorf("%d signers did not answer", failed)
+	}
+
+	// Aggregate each input under its tweaked output key
+	for i, pkg := range packages {
+		public := k.public.Tweak(frost.TaprootTweak(k.public.GroupKey, prevouts[i].root))
+		signature, err := frost.Aggregate(public, pkg, shares[i])
+		if err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		tx.TxIn[i].Witness = wire.TxWitness{signature}
+	}
+	payout.Tx, err = EncodeTx(tx)
+	return err
+}
+
+// each runs f for every peer at once, with its signer id among the
+// custodians, logs the failures and returns how many failed.
+func (p *Payer) each(k *custodyKey, peers []storage.EpochMember, f func(id int, peer storage.EpochMember) error) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for _, peer := range peers {
+		_, id, _ := k.custodian(peer.ComputerID)
+		wg.Add(1)
+		go func(id int, peer storage.EpochMember) {
+			defer wg.Done()
+			if err := f(id, peer); err != nil {
+				fmt.Printf("Peg: custodian %s: %v\n", peer.ComputerID, err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}(id, peer)
+	}
+	wg.Wait()
+	return failed
+}
@@ -0,0 +1,408 @@
+package peg
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Withdrawal limits, in sats. A withdrawal pays its share of the fee of the
+// payout, at most MaxWithdrawalFee, and what is left must not be dust.
+const (
+	MinWithdrawal    = 20000
+	MaxWithdrawalFee = 10000
+	DustLimit        = 546
+)
+
+// Bounds on payouts, so that one stays a standard transaction and a block
+// does not carry too many.
+const (
+	maxPayoutInputs  = 200
+	maxPayoutOutputs = 200
+	maxPayoutWeight  = 400000
+	maxBlockPayouts  = 4
+	maxPooledPayouts = 16
+)
+
+// payoutTxVersion is the version of payout transactions.
+const payoutTxVersion = 2
+
+// ErrInvalidWithdrawal is returned for a transfer to a Bitcoin address that
+// cannot be paid: the address is not one of the network or the amount is
+// below MinWithdrawal.
+var ErrInvalidWithdrawal = errors.New("invalid withdrawal")
+
+// CheckWithdrawal checks a transfer to a Bitcoin address. Transfers to a
+// wallet pass.
+func (w *Watcher) CheckWithdrawal(transfer storage.Transfer) error {
+	address, ok := storage.WithdrawalAddress(transfer.To)
+	if !ok {
+		return nil
+	}
+	if _, err := w.withdrawalScript(address); err != nil {
+		return err
+	}
+	if transfer.Amount < MinWithdrawal {
+		return fmt.Errorf("%w: %d sats, at least %d", ErrInvalidWithdrawal, transfer.Amount, MinWithdrawal)
+	}
+	return nil
+}
+
+// withdrawalScript returns the output script of a withdrawal address. The
+// address must be of this node's network and written the way it encodes.
+func (w *Watcher) withdrawalScript(address string) ([]byte, error) {
+	decoded, err := btcutil.DecodeAddress(address, w.config.Network)
+	if err != nil || !decoded.IsForNet(w.config.Network) || decoded.EncodeAddress() != address {
+		return nil, fmt.Errorf("%w: %q is not a %s address", ErrInvalidWithdrawal, address, w.config.Network.Name)
+	}
+	script, err := txscript.PayToAddrScript(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWithdrawal, err)
+	}
+	return script, nil
+}
+
+// ChangeScript returns the output script that takes the change of payouts
+// back to the peg: the peg key groupKey, x-only in hex, tweaked for no
+// scripts as BIP86 does.
+func ChangeScript(groupKey string) ([]byte, error) {
+	internal, err := parseGroupKey(groupKey)
+	if err != nil {
+		return nil, err
+	}
+	output := txscript.ComputeTaprootKeyNoScript(internal)
+	return txscript.PayToTaprootScript(output)
+}
+
+// prevout is a peg UTXO spent by a payout, with its output script and the
+// taproot script root its output key commits to: the deposit tweak of its
+// wallet, or nil for change.
+type prevout struct {
+	utxo   storage.PegUTXO
+	script []byte
+	root   []byte
+}
+
+// prevout returns what spending a peg UTXO takes under the peg key groupKey.
+func (w *Watcher) prevout(utxo storage.PegUTXO, groupKey string) (prevout, error) {
+	if utxo.Wallet == "" {
+		script, err := ChangeScript(groupKey)
+		if err != nil {
+			return prevout{}, err
+		}
+		return prevout{utxo: utxo, script: script}, nil
+	}
+	address, err := DeriveDepositAddress(groupKey, utxo.Wallet, w.config.Network)
+	if err != nil {
+		return prevout{}, err
+	}
+	script, err := hex.DecodeString(address.Script)
+	if err != nil {
+		return prevout{}, err
+	}
+	root := DepositTweak(utxo.Wallet)
+	return prevout{utxo: utxo, script: script, root: root[:]}, nil
+}
+
+// sighashes returns the BIP341 signature hash of every input of a payout,
+// and the fetcher of the outputs it spends.
+func sighashes(tx *wire.MsgTx, prevouts []prevout) ([][]byte, txscript.PrevOutputFetcher, error) {
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for i, in := range tx.TxIn {
+		fetcher.AddPrevOut(in.PreviousOutPoint, wire.NewTxOut(prevouts[i].utxo.Amount, prevouts[i].script))
+	}
+	hashes := txscript.NewTxSigHashes(tx, fetcher)
+	messages := make([][]byte, len(tx.TxIn))
+	for i := range tx.TxIn {
+		hash, err := txscript.CalcTaprootSignatureHash(hashes, txscript.SigHashDefault, tx, i, fetcher)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to hash input %d: %w", i, err)
+		}
+		messages[i] = hash
+	}
+	return messages, fetcher, nil
+}
+
+// DecodeTx decodes a transaction in hex.
+func DecodeTx(raw string) (*wire.MsgTx, error) {
+	data, err := hex.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction: %w", err)
+	}
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("invalid transaction: %w", err)
+	}
+	return &tx, nil
+}
+
+// EncodeTx encodes a transaction in hex, with its witnesses.
+func EncodeTx(tx *wire.MsgTx) (string, error) {
+	var raw bytes.Buffer
+	if err := tx.Serialize(&raw); err != nil {
+		return "", fmt.Errorf("failed to encode transaction: %w", err)
+	}
+	return hex.EncodeToString(raw.Bytes()), nil
+}
+
+// checkPayout checks a payout against the store: it spends unspent peg
+// UTXOs, pays queued withdrawals their amount less the fee, returns the rest
+// to the change script and adds up. With signed set, every input must carry
+// a valid key path signature. It returns the transaction and its prevouts.
+// A payout that is wrong gives an error wrapping storage.ErrInvalidBlock.
+func (w *Watcher) checkPayout(p storage.Payout, signed bool) (*wire.MsgTx, []prevout, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: payout %s: %s", storage.ErrInvalidBlock, p.TxID, fmt.Sprintf(format, args...))
+	}
+	groupKey, err := w.GroupKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, err := DecodeTx(p.Tx)
+	if err != nil {
+		return nil, nil, invalid("%v", err)
+	}
+	if tx.TxHash().String() != p.TxID {
+		return nil, nil, invalid("transaction has id %s", tx.TxHash())
+	}
+	if tx.Version != payoutTxVersion || tx.LockTime != 0 {
+		return nil, nil, invalid("transaction version %d with lock time %d", tx.Version, tx.LockTime)
+	}
+	if len(p.Inputs) == 0 || len(p.Inputs) > maxPayoutInputs || len(p.Withdrawals) == 0 || len(p.Withdrawals) >= maxPayoutOutputs {
+		return nil, nil, invalid("%d inputs for %d withdrawals", len(p.Inputs), len(p.Withdrawals))
+	}
+	if p.Fee <= 0 || p.Fee > MaxWithdrawalFee {
+		return nil, nil, invalid("fee of %d sats per withdrawal, at most %d", p.Fee, MaxWithdrawalFee)
+	}
+	if p.Change != 0 && p.Change < DustLimit {
+		return nil, nil, invalid("change of %d sats is dust", p.Change)
+	}
+
+	// Check the inputs are the unspent peg UTXOs listed, each once
+	if len(tx.TxIn) != len(p.Inputs) {
+		return nil, nil, invalid("%d inputs, %d listed", len(tx.TxIn), len(p.Inputs))
+	}
+	prevouts := make([]prevout, len(p.Inputs))
+	spent := make(map[string]bool, len(p.Inputs))
+	var in int64
+	for i, outpoint := range p.Inputs {
+		if spent[outpoint] {
+			return nil, nil, invalid("spends %s twice", outpoint)
+		}
+		spent[outpoint] = true
+		if Outpoint(tx.TxIn[i].PreviousOutPoint.Hash, tx.TxIn[i].PreviousOutPoint.Index) != outpoint {
+			return nil, nil, invalid("input %d is not %s", i, outpoint)
+		}
+		utxo, err := w.store.GetPegUTXO(outpoint)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil, invalid("%s is not a peg output", outpoint)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if utxo.SpentBy != "" {
+			return nil, nil, invalid("%s is already spent by %s", outpoint, utxo.SpentBy)
+		}
+		if prevouts[i], err = w.prevout(utxo, groupKey); err != nil {
+			return nil, nil, err
+		}
+		in += utxo.Amount
+	}
+
+	// Check output i pays queued withdrawal i, each once, and the last one
+	// returns the change
+	outputs := len(p.Withdrawals)
+	if p.Change > 0 {
+		outputs++
+	}
+	if len(tx.TxOut) != outputs {
+		return nil, nil, invalid("%d outputs, expected %d", len(tx.TxOut), outputs)
+	}
+	paid := make(map[string]bool, len(p.Withdrawals))
+	var withdrawn int64
+	for i, id := range p.Withdrawals {
+		if paid[id] {
+			return nil, nil, invalid("pays withdrawal %s twice", id)
+		}
+		paid[id] = true
+		withdrawal, err := w.store.GetWithdrawal(id)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil, invalid("withdrawal %s does not exist", id)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if withdrawal.Payout != "" {
+			return nil, nil, invalid("withdrawal %s is already paid by %s", id, withdrawal.Payout)
+		}
+		script, err := w.withdrawalScript(withdrawal.Address)
+		if err != nil {
+			return nil, nil, invalid("withdrawal %s: %v", id, err)
+		}
+		out := tx.TxOut[i]
+		if !bytes.Equal(out.PkScript, script) || out.Value != withdrawal.Amount-p.Fee || out.Value < DustLimit {
+			return nil, nil, invalid("output %d does not pay %d sats to %s", i, withdrawal.Amount-p.Fee, withdrawal.Address)
+		}
+		withdrawn += withdrawal.Amount
+	}
+	if p.Change > 0 {
+		script, err := ChangeScript(groupKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		out := tx.TxOut[len(p.Withdrawals)]
+		if !bytes.Equal(out.PkScript, script) || out.Value != p.Change {
+			return nil, nil, invalid("last output does not return %d sats of change to the peg", p.Change)
+		}
+	}
+	if in != withdrawn+p.Change {
+		return nil, nil, invalid("spends %d sats for %d withdrawn and %d change", in, withdrawn, p.Change)
+	}
+	if weight := tx.SerializeSizeStripped()*3 + tx.SerializeSize(); weight > maxPayoutWeight {
+		return nil, nil, invalid("weighs %d", weight)
+	}
+
+	if !signed {
+		return tx, prevouts, nil
+	}
+
+	// Check every input carries a valid key path signature
+	_, fetcher, err := sighashes(tx, prevouts)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := txscript.NewTxSigHashes(tx, fetcher)
+	for i := range tx.TxIn {
+		engine, err := txscript.NewEngine(prevouts[i].script, tx, i, txscript.StandardVerifyFlags, nil, hashes, prevouts[i].utxo.Amount, fetcher)
+		if err != nil {
+			return nil, nil, invalid("input %d: %v", i, err)
+		}
+		if err := engine.Execute(); err != nil {
+			return nil, nil, invalid("input %d is not signed by the peg: %v", i, err)
+		}
+	}
+	return tx, prevouts, nil
+}
+
+// Submit checks a signed payout and keeps it for the next blocks this node
+// proposes. A payout already recorded is dropped.
+func (w *Watcher) Submit(p storage.Payout) error {
+	if _, err := w.store.GetPayout(p.TxID); err == nil {
+		return nil
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if _, _, err := w.checkPayout(p, true); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.payouts[p.TxID]; !ok && len(w.payouts) >= maxPooledPayouts {
+		return fmt.Errorf("%d payouts are waiting for a block already", len(w.payouts))
+	}
+	w.payouts[p.TxID] = p
+	return nil
+}
+
+// Pooled returns the signed payouts waiting for a block, by txid.
+func (w *Watcher) Pooled() []storage.Payout {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	payouts := make([]storage.Payout, 0, len(w.payouts))
+	for _, p := range w.payouts {
+		payouts = append(payouts, p)
+	}
+	sort.Slice(payouts, func(i, j int) bool { return payouts[i].TxID < payouts[j].TxID })
+	return payouts
+}
+
+// readyPayouts returns the pooled payouts that still check, and drops the
+// ones that were recorded or can no longer be.
+func (w *Watcher) readyPayouts() []storage.Payout {
+	var ready []storage.Payout
+	for _, p := range w.Pooled() {
+		_, err := w.store.GetPayout(p.TxID)
+		if err == nil {
+			w.drop(p.TxID)
+			continue
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			fmt.Println("Peg: error reading payout:", err)
+			continue
+		}
+		if _, _, err := w.checkPayout(p, true); err != nil {
+			if errors.Is(err, storage.ErrInvalidBlock) {
+				fmt.Printf("Peg: dropping payout %s: %v\n", p.TxID, err)
+				w.drop(p.TxID)
+			}
+			continue
+		}
+		ready = append(ready, p)
+		if len(ready) == maxBlockPayouts {
+			break
+		}
+	}
+	return ready
+}
+
+func (w *Watcher) drop(txid string) {
+	w.mu.Lock()
+	delete(w.payouts, txid)
+	w.mu.Unlock()
+}
+
+// broadcast sends every recorded payout not seen confirmed to Bitcoin.
+func (w *Watcher) broadcast() {
+	payouts, err := w.store.ListUnconfirmedPayouts()
+	if err != nil {
+		fmt.Println("Peg: error listing payouts:", err)
+		return
+	}
+	for _, p := range payouts {
+		tx, err := DecodeTx(p.Tx)
+		if err != nil {
+			fmt.Printf("Peg: payout %s: %v\n", p.TxID, err)
+			continue
+		}
+		if err := w.backend.SendTransaction(tx); err != nil {
+			fmt.Printf("Peg: error broadcasting payout %s: %v\n", p.TxID, err)
+		}
+	}
+}
+
+// parseGroupKey parses the peg key, x-only in hex.
+func parseGroupKey(groupKey string) (*btcec.PublicKey, error) {
+	xonly, err := hex.DecodeString(groupKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peg key: %w", err)
+	}
+	key, err := schnorr.ParsePubKey(xonly)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peg key: %w", err)
+	}
+	return key, nil
+}
+
+// Depth returns the confirmations of a Bitcoin block at height in the chain
+// scanned so far, 0 for height 0 or a block not scanned yet.
+func (w *Watcher) Depth(height int64) int64 {
+	if height <= 0 {
+		return 0
+	}
+	scanned, _, err := w.store.LatestBitcoinBlock()
+	if err != nil || scanned < height {
+		return 0
+	}
+	return scanned - height + 1
+}
@@ -0,0 +1,190 @@
+package peg
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// maxRPCResponse bounds a bitcoind answer; a block in hex is at most 8 MB.
+const maxRPCResponse = 16 << 20
+
+// RPCBackend reads the Bitcoin chain from bitcoind over JSON-RPC. The URL
+// comes from the node's own config, so calls do not go through the outbound
+// checks for peer addresses.
+type RPCBackend struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+	id       atomic.Int64
+}
+
+// NewRPCBackend returns a backend for the bitcoind RPC server at url.
+func NewRPCBackend(url, user, password string, timeout time.Duration) *RPCBackend {
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &RPCBackend{url: url, user: user, password: password, client: &http.Client{Timeout: timeout}}
+}
+
+// rpcError is the error member of a JSON-RPC answer.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("bitcoind error %d: %s", e.Code, e.Message)
+}
+
+// call runs one RPC method and decodes its result into result.
+func (b *RPCBackend) call(method string, params []interface{}, result interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "1.0",
+		"id":      b.id.Add(1),
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode %s request: %w", method, err)
+	}
+	req, err := http.NewRequest(http.MethodPost, b.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %w", method, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.user != "" {
+		req.SetBasicAuth(b.user, b.password)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	// bitcoind answers RPC errors with a status of 500 and a JSON body
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("failed to call %s: bitcoind refused the credentials", method)
+	}
+	var answer struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRPCResponse)).Decode(&answer); err != nil {
+		return fmt.Errorf("failed to decode %s answer (status %d): %w", method, resp.StatusCode, err)
+	}
+	if answer.Error != nil {
+		return fmt.Errorf("failed to call %s: %w", method, answer.Error)
+	}
+	if err := json.Unmarshal(answer.Result, result); err != nil {
+		return fmt.Errorf("failed to decode %s result: %w", method, err)
+	}
+	return nil
+}
+
+// BlockCount returns the height of the tip of bitcoind's best chain.
+func (b *RPCBackend) BlockCount() (int64, error) {
+	var count int64
+	if err := b.call("getblockcount", nil, &count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// BlockHash returns the hash of the block at a height of the best chain.
+func (b *RPCBackend) BlockHash(height int64) (chainhash.Hash, error) {
+	var hash string
+	if err := b.call("getblockhash", []interface{}{height}, &hash); err != nil {
+		return chainhash.Hash{}, err
+	}
+	parsed, err := chainhash.NewHashFromStr(hash)
+	if err != nil {
+		return chainhash.Hash{}, fmt.Errorf("invalid block hash from bitcoind: %w", err)
+	}
+	return *parsed, nil
+}
+
+// Block returns a block by hash, fetched raw and decoded here.
+func (b *RPCBackend) Block(hash chainhash.Hash) (*wire.MsgBlock, error) {
+	var raw string
+	if err := b.call("getblock", []interface{}{hash.String(), 0}, &raw); err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block %s from bitcoind: %w", hash, err)
+	}
+	var block wire.MsgBlock
+	if err := block.Deserialize(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to decode block %s: %w", hash, err)
+	}
+	if block.BlockHash() != hash {
+		return nil, fmt.Errorf("bitcoind returned another block for %s", hash)
+	}
+	return &block, nil
+}
+
+// rpcAlreadyInChain is the bitcoind error for a transaction it has mined.
+const rpcAlreadyInChain = -27
+
+// SendTransaction broadcasts a signed transaction with sendrawtransaction.
+func (b *RPCBackend) SendTransaction(tx *wire.MsgTx) error {
+	var raw bytes.Buffer
+	if err := tx.Serialize(&raw); err != nil {
+		return fmt.Errorf("failed to encode transaction %s: %w", tx.TxHash(), err)
+	}
+	var txid string
+	err := b.call("sendrawtransaction", []interface{}{hex.EncodeToString(raw.Bytes())}, &txid)
+	var rpcErr *rpcError
+	if errors.As(err, &rpcErr) && rpcErr.Code == rpcAlreadyInChain {
+		return nil
+	}
+	return err
+}
+
+// UnspentOutput is an output bitcoind holds as unspent.
+type UnspentOutput struct {
+	Amount        int64 // sats
+	Script        []byte
+	Confirmations int64 // 0 for an output of a mempool transaction
+}
+
+// UnspentOutput returns an output of bitcoind's UTXO set with gettxout,
+// counting the mempool: an output a mempool transaction spends is missing
+// and one it creates is there. It returns nil for an output that is spent or
+// does not exist.
+func (b *RPCBackend) UnspentOutput(txid chainhash.Hash, vout uint32) (*UnspentOutput, error) {
+	var out *struct {
+		Confirmations int64   `json:"confirmations"`
+		Value         float64 `json:"value"`
+		ScriptPubKey  struct {
+			Hex string `json:"hex"`
+		} `json:"scriptPubKey"`
+	}
+	if err := b.call("gettxout", []interface{}{txid.String(), vout, true}, &out); err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return nil, nil
+	}
+	amount, err := btcutil.NewAmount(out.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount of %s:%d from bitcoind: %w", txid, vout, err)
+	}
+	script, err := hex.DecodeString(out.ScriptPubKey.Hex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid script of %s:%d from bitcoind: %w", txid, vout, err)
+	}
+	return &UnspentOutput{Amount: int64(amount), Script: script, Confirmations: out.Confirmations}, nil
+}
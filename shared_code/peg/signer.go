@@ -0,0 +1,281 @@
+package peg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/custody"
+	"bitcoin-sidechain/frost"
+	"bitcoin-sidechain/storage"
+)
+
+// ErrInvalidRequest is returned for a signing request that does not come from
+// a custodian of the peg key, is not signed by it or asks to sign a payout
+// this node does not agree with.
+var ErrInvalidRequest = errors.New("invalid payout signing request")
+
+// CommitRequest starts the signing of a payout: the coordinator asks each
+// custodian for one commitment per input.
+type CommitRequest struct {
+	Epoch       int64          `json:"epoch"` // of the peg key
+	Coordinator string         `json:"coordinator"`
+	Payout      storage.Payout `json:"payout"` // unsigned
+	Signature   string         `json:"signature"`
+}
+
+// SignBytes returns the canonical form of the request that is signed.
+func (r CommitRequest) SignBytes() []byte {
+	r.Signature = ""
+	payload, _ := json.Marshal(r)
+	return payload
+}
+
+// CommitResponse holds a custodian's commitments, one per input of the
+// payout.
+type CommitResponse struct {
+	Epoch       int64              `json:"epoch"`
+	Custodian   string             `json:"custodian"`
+	TxID        string             `json:"txid"`
+	Commitments []frost.Commitment `json:"commitments"`
+	Signature   string             `json:"signature"`
+}
+
+// SignBytes returns the canonical form of the response that is signed.
+func (r CommitResponse) SignBytes() []byte {
+	r.Signature = ""
+	payload, _ := json.Marshal(r)
+	return payload
+}
+
+// SignRequest asks the custodians picked as signers for their signature
+// shares, with one signing package per input.
+type SignRequest struct {
+	Epoch       int64                  `json:"epoch"`
+	Coordinator string                 `json:"coordinator"`
+	Payout      storage.Payout         `json:"payout"`
+	Packages    []frost.SigningPackage `json:"packages"`
+	Signature   string                 `json:"signature"`
+}
+
+// SignBytes returns the canonical form of the request that is signed.
+func (r SignRequest) SignBytes() []byte {
+	r.Signature = ""
+	payload, _ := json.Marshal(r)
+	return payload
+}
+
+// SignResponse holds a custodian's signature shares, one per input.
+type SignResponse struct {
+	Epoch     int64                  `json:"epoch"`
+	Custodian string                 `json:"custodian"`
+	TxID      string                 `json:"txid"`
+	Shares    []frost.SignatureShare `json:"shares"`
+	Signature string                 `json:"signature"`
+}
+
+// SignBytes returns the canonical form of the response that is signed.
+func (r SignResponse) SignBytes() []byte {
+	r.Signature = ""
+	payload, _ := json.Marshal(r)
+	return payload
+}
+
+// signingSession is what a custodian keeps between the two rounds.
+type signingSession struct {
+	txid    string
+	nonces  []*frost.Nonces // one per input
+	created time.Time
+}
+
+// custodyKey is the peg key as the custodians sign with it.
+type custodyKey struct {
+	key        storage.CustodyKey
+	public     *frost.PublicKeyPackage
+	custodians []storage.EpochMember
+	share      *frost.KeyShare // nil if this node is not a custodian
+}
+
+// loadKey returns the latest peg key with its custodians and this node's
+// share.
+func (p *Payer) loadKey() (*custodyKey, error) {
+	key, err := p.store.LatestCustodyKey()
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrNoPegKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	epoch, err := p.store.GetEpoch(key.Epoch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read epoch %d: %w", key.Epoch, err)
+	}
+	k := &custodyKey{key: key, custodians: custody.Custodians(epoch), public: &frost.PublicKeyPackage{}}
+	if err := json.Unmarshal(key.PublicKeys, k.public); err != nil {
+		return nil, fmt.Errorf("invalid public keys of epoch %d: %w", key.Epoch, err)
+	}
+	stored, err := p.store.GetCustodyShare(key.Epoch)
+	if errors.Is(err, storage.ErrNotFound) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	k.share = &frost.KeyShare{}
+	if err := json.Unmarshal(stored.KeyShare, k.share); err != nil {
+		return nil, fmt.Errorf("invalid share of the key of epoch %d: %w", key.Epoch, err)
+	}
+	return k, nil
+}
+
+// custodian returns a custodian of the key by computer_id.
+func (k *custodyKey) custodian(computerID string) (storage.EpochMember, int, bool) {
+	for i, member := range k.custodians {
+		if member.ComputerID == computerID {
+			return member, i + 1, true
+		}
+	}
+	return storage.EpochMember{}, 0, false
+}
+
+// checkRequest checks that a request for the key of epoch comes from one of
+// its custodians and that this node holds a share of it.
+func (p *Payer) checkRequest(epoch int64, coordinator string, signBytes []byte, signature string) (*custodyKey, error) {
+	k, err := p.loadKey()
+	if err != nil {
+		return nil, err
+	}
+	if k.key.Epoch != epoch {
+		return nil, fmt.Errorf("%w: request for the key of epoch %d, the latest is %d", ErrInvalidRequest, epoch, k.key.Epoch)
+	}
+	if k.share == nil {
+		return nil, fmt.Errorf("%w: this node holds no share of the key of epoch %d", ErrInvalidRequest, epoch)
+	}
+	member, _, ok := k.custodian(coordinator)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not a custodian of epoch %d", ErrInvalidRequest, coordinator, epoch)
+	}
+	if err := cryptoUtils.VerifyMessage(member.PublicKey, signBytes, signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	return k, nil
+}
+
+// Commit answers round one: it checks the payout against this node's own
+// state and commits to fresh nonces for each of its inputs.
+func (p *Payer) Commit(request CommitRequest) (CommitResponse, error) {
+	k, err := p.checkRequest(request.Epoch, request.Coordinator, request.SignBytes(), request.Signature)
+	if err != nil {
+		return CommitResponse{}, err
+	}
+	tx, _, err := p.watcher.checkPayout(request.Payout, false)
+	if err != nil {
+		return CommitResponse{}, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.reserve(request.Payout); err != nil {
+		return CommitResponse{}, err
+	}
+	session := &signingSession{txid: request.Payout.TxID, created: time.Now()}
+	response := CommitResponse{Epoch: request.Epoch, Custodian: p.self, TxID: request.Payout.TxID}
+	for range tx.TxIn {
+		nonces, err := frost.Commit(k.share, p.random)
+		if err != nil {
+			return CommitResponse{}, err
+		}
+		session.nonces = append(session.nonces, nonces)
+		response.Commitments = append(response.Commitments, nonces.Commitment())
+	}
+	p.keepSession(request.Coordinator+":"+request.Payout.TxID, session)
+	response.Signature = cryptoUtils.SignMessage(p.key, response.SignBytes())
+	return response, nil
+}
+
+// Sign answers round two: it checks the payout again, computes the signature
+// hash of every input itself and signs each with its share tweaked for the
+// output key of that input. The nonces of the session are used up either way.
+func (p *Payer) Sign(request SignRequest) (SignResponse, error) {
+	k, err := p.checkRequest(request.Epoch, request.Coordinator, request.SignBytes(), request.Signature)
+	if err != nil {
+		return SignResponse{}, err
+	}
+	id := request.Coordinator + ":" + request.Payout.TxID
+	p.mu.Lock()
+	session, ok := p.sessions[id]
+	delete(p.sessions, id)
+	p.mu.Unlock()
+	if !ok {
+		return SignResponse{}, fmt.Errorf("%w: no commitments for payout %s", ErrInvalidRequest, request.Payout.TxID)
+	}
+
+	tx, prevouts, err := p.watcher.checkPayout(request.Payout, false)
+	if err != nil {
+		return SignResponse{}, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	messages, _, err := sighashes(tx, prevouts)
+	if err != nil {
+		return SignResponse{}, err
+	}
+	if len(request.Packages) != len(messages) || len(session.nonces) != len(messages) {
+		return SignResponse{}, fmt.Errorf("%w: %d packages for %d inputs", ErrInvalidRequest, len(request.Packages), len(messages))
+	}
+
+	response := SignResponse{Epoch: request.Epoch, Custodian: p.self, TxID: request.Payout.TxID}
+	for i, pkg := range request.Packages {
+		if string(pkg.Message) != string(messages[i]) {
+			return SignResponse{}, fmt.Errorf("%w: package %d does not sign input %d of payout %s", ErrInvalidRequest, i, i, request.Payout.TxID)
+		}
+		share := k.share.Tweak(frost.TaprootTweak(k.public.GroupKey, prevouts[i].root))
+		signature, err := frost.Sign(share, session.nonces[i], pkg)
+		if err != nil {
+			return SignResponse{}, fmt.Errorf("%w: input %d: %v", ErrInvalidRequest, i, err)
+		}
+		response.Shares = append(response.Shares, signature)
+	}
+	response.Signature = cryptoUtils.SignMessage(p.key, response.SignBytes())
+	return response, nil
+}
+
+// reserve records that this node signs for the inputs and withdrawals of a
+// payout, and refuses if another payout it signed recently spends or pays
+// any of them. A payout is only broadcast once a block records it, but this
+// keeps a coordinator from collecting two conflicting signed payouts. The
+// caller holds p.mu.
+func (p *Payer) reserve(payout storage.Payout) error {
+	now := time.Now()
+	for item, r := range p.reserved {
+		if now.After(r.until) {
+			delete(p.reserved, item)
+		}
+	}
+	items := append(append([]string{}, payout.Inputs...), payout.Withdrawals...)
+	for _, item := range items {
+		if r, ok := p.reserved[item]; ok && r.txid != payout.TxID {
+			return fmt.Errorf("%w: %s is taken by payout %s", ErrInvalidRequest, item, r.txid)
+		}
+	}
+	until := now.Add(reserveTurns * p.config.Interval)
+	for _, item := range items {
+		p.reserved[item] = reservation{txid: payout.TxID, until: until}
+	}
+	return nil
+}
+
+// keepSession stores the nonces of a session, dropping the oldest one if
+// there are too many. The caller holds p.mu.
+func (p *Payer) keepSession(id string, session *signingSession) {
+	if len(p.sessions) >= maxSessions {
+		var oldest string
+		for other, s := range p.sessions {
+			if oldest == "" || s.created.Before(p.sessions[oldest].created) {
+				oldest = other
+			}
+		}
+		delete(p.sessions, oldest)
+	}
+	p.sessions[id] = session
+}
@@ -0,0 +1,402 @@
+package peg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"bitcoin-sidechain/networkUtils"
+	"bitcoin-sidechain/probe"
+	"bitcoin-sidechain/storage"
+)
+
+// maxAnnouncementSize bounds the body of POST /deposit/addresses.
+const maxAnnouncementSize = 4 << 10
+
+// Announcement names a wallet whose deposit address a node created.
+type Announcement struct {
+	Wallet string `json:"wallet"`
+}
+
+// HTTPAnnouncer posts new deposit addresses to POST /deposit/addresses on
+// every other node of the nodes table.
+type HTTPAnnouncer struct {
+	store    storage.Store
+	outbound *networkUtils.Outbound
+	pool     *probe.Pool
+	self     string
+}
+
+// NewHTTPAnnouncer returns an announcer for the node with computer_id self,
+// which reaches the others through outbound, all at once on pool.
+func NewHTTPAnnouncer(store storage.Store, outbound *networkUtils.Outbound, pool *probe.Pool, self string) *HTTPAnnouncer {
+	return &HTTPAnnouncer{store: store, outbound: outbound, pool: pool, self: self}
+}
+
+// Announce sends the wallet of a new deposit address to every other node.
+func (a *HTTPAnnouncer) Announce(address storage.DepositAddress) {
+	nodes, err := a.store.ListNodes()
+	if err != nil {
+		fmt.Println("Peg: error listing nodes:", err)
+		return
+	}
+	var targets []string
+	for _, node := range nodes {
+		if node.IPAddress != "" && node.ComputerID != a.self {
+			targets = append(targets, node.IPAddress)
+		}
+	}
+	body, err := json.Marshal(Announcement{Wallet: address.Wallet})
+	if err != nil {
+		fmt.Println("Peg: error encoding announcement:", err)
+		return
+	}
+
+	errs := a.pool.Sweep(context.Background(), len(targets), func(ctx context.Context, i int) error {
+		req, err := a.outbound.NewRequestContext(ctx, http.MethodPost, targets[i], "/deposit/addresses", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := a.outbound.Open(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	})
+	for i, err := range errs {
+		if err != nil {
+			fmt.Printf("Peg: error announcing the deposit address of %s to %s: %v\n", address.Wallet, targets[i], err)
+		}
+	}
+}
+
+// PendingDeposit is a deposit not credited yet with its depth.
+type PendingDeposit struct {
+	storage.Deposit
+	Confirmations int64 `json:"confirmations"`
+}
+
+// DepositStatus is the answer of GET /deposit/{wallet}.
+type DepositStatus struct {
+	storage.DepositAddress
+	ConfirmationsRequired int              `json:"confirmations_required"`
+	Credited              []storage.PegIn  `json:"credited"`
+	Pending               []PendingDeposit `json:"pending"`
+}
+
+// AddressHandler returns the GET /deposit/{wallet} endpoint: the deposit
+// address of a wallet, created on the first request, with the deposits to it
+// credited and still pending.
+func AddressHandler(w *Watcher) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		wallet := r.PathValue("wallet")
+		if err := checkWallet(wallet); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		address, err := w.Address(wallet)
+		if errors.Is(err, ErrNoPegKey) {
+			http.Error(rw, "No peg key yet; try again after the first custody handoff", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			fmt.Println("Peg: error creating deposit address:", err)
+			http.Error(rw, "Failed to create deposit address", http.StatusInternalServerError)
+			return
+		}
+
+		status := DepositStatus{
+			DepositAddress:        address,
+			ConfirmationsRequired: w.Confirmations(),
+			Credited:              []storage.PegIn{},
+			Pending:               []PendingDeposit{},
+		}
+		credited, err := w.store.ListWalletPegIns(wallet)
+		if err != nil {
+			fmt.Println("Peg: error listing peg-ins:", err)
+			http.Error(rw, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+		if credited != nil {
+			status.Credited = credited
+		}
+		deposits, depths, err := w.Pending()
+		if err != nil {
+			fmt.Println("Peg: error listing pending deposits:", err)
+			http.Error(rw, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+		for i, deposit := range deposits {
+			if deposit.Wallet == wallet {
+				status.Pending = append(status.Pending, PendingDeposit{Deposit: deposit, Confirmations: depths[i]})
+			}
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(status); err != nil {
+			fmt.Println("Error encoding response:", err)
+		}
+	}
+}
+
+// AnnounceHandler returns the POST /deposit/addresses endpoint, where other
+// nodes announce the deposit addresses they create.
+func AnnounceHandler(w *Watcher) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var announcement Announcement
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxAnnouncementSize)).Decode(&announcement); err != nil {
+			http.Error(rw, "Invalid announcement", http.StatusBadRequest)
+			return
+		}
+		if err := checkWallet(announcement.Wallet); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		address, err := w.Accept(announcement.Wallet)
+		if errors.Is(err, ErrNoPegKey) {
+			http.Error(rw, "No peg key yet", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			fmt.Println("Peg: error saving deposit address:", err)
+			http.Error(rw, "Failed to save deposit address", http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(address); err != nil {
+			fmt.Println("Error encoding response:", err)
+		}
+	}
+}
+
+// maxPayoutMessageSize bounds the body of the /pegout endpoints; a payout
+// carries up to maxPayoutInputs signing packages.
+const maxPayoutMessageSize = 4 << 20
+
+// HTTPPayoutTransport runs the signing rounds over POST /pegout/commit and
+// POST /pegout/sign, and posts signed payouts to POST /pegout/payouts on every
+// other node of the nodes table.
+type HTTPPayoutTransport struct {
+	store    storage.Store
+	outbound *networkUtils.Outbound
+	pool     *probe.Pool
+	self     string
+}
+
+// NewHTTPPayoutTransport returns a transport for the node with computer_id
+// self, which reaches the others through outbound, all at once on pool.
+func NewHTTPPayoutTransport(store storage.Store, outbound *networkUtils.Outbound, pool *probe.Pool, self string) *HTTPPayoutTransport {
+	return &HTTPPayoutTransport{store: store, outbound: outbound, pool: pool, self: self}
+}
+
+// Commit asks a custodian for its commitments.
+func (t *HTTPPayoutTransport) Commit(peer storage.EpochMember, request CommitRequest) (CommitResponse, error) {
+	var response CommitResponse
+	err := t.post(context.Background(), peer.IPAddress, "/pegout/commit", request, &response)
+	return response, err
+}
+
+// Sign asks a custodian for its signature shares.
+func (t *HTTPPayoutTransport) Sign(peer storage.EpochMember, request SignRequest) (SignResponse, error) {
+	var response SignResponse
+	err := t.post(context.Background(), peer.IPAddress, "/pegout/sign", request, &response)
+	return response, err
+}
+
+// Submit sends a signed payout to every other node.
+func (t *HTTPPayoutTransport) Submit(payout storage.Payout) {
+	nodes, err := t.store.ListNodes()
+	if err != nil {
+		fmt.Println("Peg: error listing nodes:", err)
+		return
+	}
+	var targets []string
+	for _, node := range nodes {
+		if node.IPAddress != "" && node.ComputerID != t.self {
+			targets = append(targets, node.IPAddress)
+		}
+	}
+	errs := t.pool.Sweep(context.Background(), len(targets), func(ctx context.Context, i int) error {
+		return t.post(ctx, targets[i], "/pegout/payouts", payout, nil)
+	})
+	for i, err := range errs {
+		if err != nil {
+			fmt.Printf("Peg: error sending payout %s to %s: %v\n", payout.TxID, targets[i], err)
+		}
+	}
+}
+
+// post sends a JSON body to a node and decodes the answer into response,
+// unless it is nil.
+func (t *HTTPPayoutTransport) post(ctx context.Context, address, path string, body, response interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := t.outbound.NewRequestContext(ctx, http.MethodPost, address, path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.outbound.Open(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	if response == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxPayoutMessageSize)).Decode(response); err != nil {
+		return fmt.Errorf("failed to decode answer: %w", err)
+	}
+	return nil
+}
+
+// CommitHandler returns the POST /pegout/commit endpoint, round one of
+// signing a payout.
+func CommitHandler(p *Payer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request CommitRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxPayoutMessageSize)).Decode(&request); err != nil {
+			http.Error(w, "Invalid commit request", http.StatusBadRequest)
+			return
+		}
+		response, err := p.Commit(request)
+		writeSigningAnswer(w, response, err)
+	}
+}
+
+// SignHandler returns the POST /pegout/sign endpoint, round two of signing a
+// payout.
+func SignHandler(p *Payer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request SignRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxPayoutMessageSize)).Decode(&request); err != nil {
+			http.Error(w, "Invalid sign request", http.StatusBadRequest)
+			return
+		}
+		response, err := p.Sign(request)
+		writeSigningAnswer(w, response, err)
+	}
+}
+
+func writeSigningAnswer(w http.ResponseWriter, response interface{}, err error) {
+	if errors.Is(err, ErrInvalidRequest) {
+		fmt.Println("Peg:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrNoPegKey) {
+		http.Error(w, "No peg key yet", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		fmt.Println("Peg: error signing payout:", err)
+		http.Error(w, "Failed to sign payout", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Println("Error encoding response:", err)
+	}
+}
+
+// PayoutHandler returns the POST /pegout/payouts endpoint, where the
+// coordinator of a payout hands it to the nodes that propose blocks.
+func PayoutHandler(watcher *Watcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payout storage.Payout
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxPayoutMessageSize)).Decode(&payout); err != nil {
+			http.Error(w, "Invalid payout", http.StatusBadRequest)
+			return
+		}
+		err := watcher.Submit(payout)
+		if errors.Is(err, storage.ErrInvalidBlock) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			fmt.Println("Peg: error taking payout:", err)
+			http.Error(w, "Failed to take payout", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// WithdrawalStatus is the answer of GET /withdraw/{txid}. Status is queued
+// until custodians sign a payout for it, signing until a block records the
+// payout, broadcast until the payout is Confirmations deep on Bitcoin, then
+// confirmed.
+type WithdrawalStatus struct {
+	storage.Withdrawal
+	Status                string `json:"status"`
+	PayoutTxID            string `json:"payout_txid,omitempty"`
+	Confirmations         int64  `json:"confirmations"`
+	ConfirmationsRequired int    `json:"confirmations_required"`
+}
+
+// WithdrawalHandler returns the GET /withdraw/{txid} endpoint. payer is nil
+// on nodes that are not custodians.
+func WithdrawalHandler(watcher *Watcher, payer *Payer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		withdrawal, err := watcher.store.GetWithdrawal(r.PathValue("txid"))
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "Withdrawal not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println("Peg: error reading withdrawal:", err)
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+
+		status := WithdrawalStatus{Withdrawal: withdrawal, Status: "queued", ConfirmationsRequired: watcher.Confirmations()}
+		if withdrawal.Payout == "" {
+			for _, pooled := range watcher.Pooled() {
+				for _, id := range pooled.Withdrawals {
+					if id == withdrawal.TxID {
+						status.Status, status.PayoutTxID = "signing", pooled.TxID
+					}
+				}
+			}
+			if payer != nil {
+				if txid, ok := payer.Signing(withdrawal.TxID); ok {
+					status.Status, status.PayoutTxID = "signing", txid
+				}
+			}
+		} else {
+			payout, err := watcher.store.GetPayout(withdrawal.Payout)
+			if err != nil {
+				fmt.Println("Peg: error reading payout:", err)
+				http.Error(w, "Failed to query database", http.StatusInternalServerError)
+				return
+			}
+			status.Status, status.PayoutTxID = "broadcast", payout.TxID
+			status.Confirmations = watcher.Depth(payout.BitcoinHeight)
+			if status.Confirmations >= int64(watcher.Confirmations()) {
+				status.Status = "confirmed"
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			fmt.Println("Error encoding response:", err)
+		}
+	}
+}
@@ -0,0 +1,515 @@
+// Package peg moves sats between Bitcoin and the sidechain. Peg-ins work as
+// follows:
+//
+//  1. A wallet asks any node for its deposit address (GET /deposit/{wallet}).
+//     The address is a taproot output of the peg key held by the custodians
+//     (see package custody), tweaked by the wallet, so every node derives the
+//     same one. The node stores it and announces it to the other nodes.
+//  2. A Watcher on every node scans the Bitcoin blocks from a BitcoinBackend
+//     for outputs paid to the stored addresses and keeps them as pending
+//     deposits. When Bitcoin reorganizes, the deposits of the blocks that
+//     left the best chain are dropped.
+//  3. Once a deposit is Confirmations deep, the next block proposer puts it in
+//     its block. The other leaders check it against their own backend before
+//     they vote, and the block credits the wallet. Credits are keyed by the
+//     outpoint, so no deposit is credited twice.
+//
+// Peg-outs work as follows:
+//
+//  1. A wallet signs a transfer to "bitcoin:<address>" (POST /withdraw). The
+//     block that applies it burns the amount and queues the withdrawal.
+//  2. A Payer on each custodian takes its turn as coordinator. It batches the
+//     queued withdrawals into one transaction that spends peg UTXOs, with the
+//     fee shared among the withdrawals and the change back to the peg, and
+//     has Threshold custodians sign every input with FROST. Each custodian
+//     builds the transaction's signature hashes itself before it signs.
+//  3. The signed payout goes to every node, and a block records it: its
+//     withdrawals are paid and its inputs spent, so neither is paid or
+//     spent twice. Every Watcher then broadcasts the recorded payouts until
+//     it sees them confirmed.
+package peg
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Config holds the network and the credit rules.
+type Config struct {
+	Network       *chaincfg.Params
+	Confirmations int           // depth a deposit needs to be credited
+	Interval      time.Duration // time between two scans
+	StartHeight   int64         // first Bitcoin block to scan; 0 for the tip at first start
+	MaxDeposits   int           // deposits credited by one block
+	MaxBlocks     int           // Bitcoin blocks read by one scan
+}
+
+// DefaultConfig is used for any value left at zero.
+var DefaultConfig = Config{
+	Network:       &chaincfg.MainNetParams,
+	Confirmations: 6,
+	Interval:      30 * time.Second,
+	MaxDeposits:   100,
+	MaxBlocks:     144,
+}
+
+// Announcer tells the other nodes about a new deposit address so that they
+// watch it too.
+type Announcer interface {
+	Announce(address storage.DepositAddress)
+}
+
+// Watcher finds deposits and payouts in the Bitcoin chain, checks the
+// deposits and payouts proposed for a block and keeps the signed payouts
+// until a block records them.
+type Watcher struct {
+	store     storage.Store
+	backend   BitcoinBackend
+	announcer Announcer
+	config    Config
+
+	scanning sync.Mutex
+
+	mu      sync.Mutex
+	blocks  map[chainhash.Hash]*wire.MsgBlock // read by Check, by hash
+	payouts map[string]storage.Payout         // signed, waiting for a block, by txid
+}
+
+// maxCachedBlocks bounds the Bitcoin blocks Check keeps between two blocks.
+const maxCachedBlocks = 32
+
+// NewWatcher returns a watcher that reads Bitcoin from backend. New deposit
+// addresses are announced through announcer, which may be nil. Zero values in
+// config are taken from DefaultConfig.
+func NewWatcher(store storage.Store, backend BitcoinBackend, announcer Announcer, config Config) *Watcher {
+	if config.Network == nil {
+		config.Network = DefaultConfig.Network
+	}
+	if config.Confirmations <= 0 {
+		config.Confirmations = DefaultConfig.Confirmations
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultConfig.Interval
+	}
+	if config.MaxDeposits <= 0 {
+		config.MaxDeposits = DefaultConfig.MaxDeposits
+	}
+	if config.MaxBlocks <= 0 {
+		config.MaxBlocks = DefaultConfig.MaxBlocks
+	}
+	return &Watcher{
+		store:     store,
+		backend:   backend,
+		announcer: announcer,
+		config:    config,
+		blocks:    make(map[chainhash.Hash]*wire.MsgBlock),
+		payouts:   make(map[string]storage.Payout),
+	}
+}
+
+// Confirmations returns the depth a deposit needs to be credited.
+func (w *Watcher) Confirmations() int {
+	return w.config.Confirmations
+}
+
+// GroupKey returns the peg key, x-only in hex, or ErrNoPegKey.
+func (w *Watcher) GroupKey() (string, error) {
+	key, err := w.store.LatestCustodyKey()
+	if errors.Is(err, storage.ErrNotFound) {
+		return "", ErrNoPegKey
+	}
+	if err != nil {
+		return "", err
+	}
+	return key.GroupKey, nil
+}
+
+// derive returns the deposit address of a wallet for the current peg key.
+func (w *Watcher) derive(wallet string) (storage.DepositAddress, error) {
+	groupKey, err := w.GroupKey()
+	if err != nil {
+		return storage.DepositAddress{}, err
+	}
+	return DeriveDepositAddress(groupKey, wallet, w.config.Network)
+}
+
+// Address returns the deposit address of a wallet, storing it and
+// announcing it to the other nodes the first time.
+func (w *Watcher) Address(wallet string) (storage.DepositAddress, error) {
+	if address, err := w.store.GetDepositAddress(wallet); err == nil {
+		return address, nil
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return storage.DepositAddress{}, err
+	}
+
+	address, err := w.derive(wallet)
+	if err != nil {
+		return storage.DepositAddress{}, err
+	}
+	created, err := w.store.SaveDepositAddress(address)
+	if err != nil {
+		return storage.DepositAddress{}, err
+	}
+	if created && w.announcer != nil {
+		go w.announcer.Announce(address)
+	}
+	return address, nil
+}
+
+// Accept stores the deposit address of a wallet announced by another node.
+// The address is derived here rather than taken from the announcement.
+func (w *Watcher) Accept(wallet string) (storage.DepositAddress, error) {
+	address, err := w.derive(wallet)
+	if err != nil {
+		return storage.DepositAddress{}, err
+	}
+	if _, err := w.store.SaveDepositAddress(address); err != nil {
+		return storage.DepositAddress{}, err
+	}
+	return address, nil
+}
+
+// Scan reads the Bitcoin blocks after the last one scanned, up to the tip
+// and at most MaxBlocks of them, and records the deposits and the payouts in
+// them. If the blocks scanned last are no longer in the best chain, it first
+// forgets them and what was found in them. Then it broadcasts the payouts not
+// confirmed yet.
+func (w *Watcher) Scan() error {
+	w.scanning.Lock()
+	defer w.scanning.Unlock()
+
+	tip, err := w.backend.BlockCount()
+	if err != nil {
+		return fmt.Errorf("failed to get the bitcoin tip: %w", err)
+	}
+	cursor, err := w.rewind(tip)
+	if err != nil {
+		return err
+	}
+	defer w.broadcast()
+
+	addresses, err := w.store.ListDepositAddresses()
+	if err != nil {
+		return err
+	}
+	watched := make(map[string]storage.DepositAddress, len(addresses))
+	for _, address := range addresses {
+		watched[address.Script] = address
+	}
+	unconfirmed, err := w.store.ListUnconfirmedPayouts()
+	if err != nil {
+		return err
+	}
+	recorded := make(map[string]bool, len(unconfirmed))
+	for _, p := range unconfirmed {
+		recorded[p.TxID] = true
+	}
+
+	var prev string
+	if cursor >= 0 {
+		if prev, err = w.store.GetBitcoinBlock(cursor); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	for height := cursor + 1; height <= tip && height <= cursor+int64(w.config.MaxBlocks); height++ {
+		hash, err := w.backend.BlockHash(height)
+		if err != nil {
+			return fmt.Errorf("failed to get bitcoin block %d: %w", height, err)
+		}
+		block, err := w.backend.Block(hash)
+		if err != nil {
+			return fmt.Errorf("failed to get bitcoin block %s: %w", hash, err)
+		}
+		// Check the block follows the last one, or Bitcoin reorganized
+		// since; the next scan rewinds
+		if prev != "" && block.Header.PrevBlock.String() != prev {
+			return nil
+		}
+
+		var deposits []storage.Deposit
+		var payouts []string
+		for _, tx := range block.Transactions {
+			txid := tx.TxHash()
+			if recorded[txid.String()] {
+				payouts = append(payouts, txid.String())
+			}
+			for vout, out := range tx.TxOut {
+				address, ok := watched[hex.EncodeToString(out.PkScript)]
+				if !ok || out.Value <= 0 {
+					continue
+				}
+				deposits = append(deposits, storage.Deposit{
+					Outpoint:      Outpoint(txid, uint32(vout)),
+					Wallet:        address.Wallet,
+					Address:       address.Address,
+					Amount:        out.Value,
+					BitcoinBlock:  hash.String(),
+					BitcoinHeight: height,
+				})
+			}
+		}
+		if err := w.store.RecordBitcoinBlock(height, hash.String(), deposits, payouts); err != nil {
+			return err
+		}
+		for _, deposit := range deposits {
+			fmt.Printf("Peg: found deposit %s of %d sats to %s at height %d\n", deposit.Outpoint, deposit.Amount, deposit.Wallet, height)
+		}
+		for _, txid := range payouts {
+			fmt.Printf("Peg: payout %s confirmed at height %d\n", txid, height)
+		}
+		prev = hash.String()
+	}
+	return nil
+}
+
+// rewind returns the height of the last scanned block that is still in the
+// best chain, forgetting the ones above it. Before the first scan it returns
+// the height before StartHeight, or before the tip.
+func (w *Watcher) rewind(tip int64) (int64, error) {
+	height, hash, err := w.store.LatestBitcoinBlock()
+	if errors.Is(err, storage.ErrNotFound) {
+		if w.config.StartHeight > 0 {
+			return w.config.StartHeight - 1, nil
+		}
+		return tip - 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	latest := height
+	for height >= 0 {
+		if height <= tip {
+			current, err := w.backend.BlockHash(height)
+			if err != nil {
+				return 0, fmt.Errorf("failed to get bitcoin block %d: %w", height, err)
+			}
+			if current.String() == hash {
+				break
+			}
+		}
+		height--
+		hash, err = w.store.GetBitcoinBlock(height)
+		if errors.Is(err, storage.ErrNotFound) {
+			// Every block scanned left the chain; start over below them
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if height < latest {
+		fmt.Printf("Peg: bitcoin reorganized, forgetting blocks above height %d\n", height)
+		if err := w.store.RewindBitcoin(height); err != nil {
+			return 0, err
+		}
+	}
+	return height, nil
+}
+
+// Run scans every interval until stop is closed.
+func (w *Watcher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Scan(); err != nil {
+			fmt.Println("Peg: error scanning bitcoin:", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Pending returns the deposits not credited yet with their depth in the
+// chain scanned so far.
+func (w *Watcher) Pending() ([]storage.Deposit, []int64, error) {
+	deposits, err := w.store.ListPendingDeposits()
+	if err != nil {
+		return nil, nil, err
+	}
+	scanned, _, err := w.store.LatestBitcoinBlock()
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	depths := make([]int64, len(deposits))
+	for i, deposit := range deposits {
+		depths[i] = scanned - deposit.BitcoinHeight + 1
+	}
+	return deposits, depths, nil
+}
+
+// Ready returns what the next block should carry: the deposits deep enough to
+// be credited, oldest first and at most MaxDeposits of them, and the signed
+// payouts that still check. Errors are logged and leave deposits out, so
+// that blocks go on without them.
+func (w *Watcher) Ready() storage.PegChanges {
+	return storage.PegChanges{Deposits: w.readyDeposits(), Payouts: w.readyPayouts()}
+}
+
+func (w *Watcher) readyDeposits() []storage.Deposit {
+	deposits, depths, err := w.Pending()
+	if err != nil {
+		fmt.Println("Peg: error listing pending deposits:", err)
+		return nil
+	}
+	var ready []storage.Deposit
+	for i, deposit := range deposits {
+		if depths[i] < int64(w.config.Confirmations) {
+			continue
+		}
+		ready = append(ready, deposit)
+		if len(ready) == w.config.MaxDeposits {
+			break
+		}
+	}
+	return ready
+}
+
+// Check checks the deposits and payouts of a proposed block. Each deposit
+// must pay the amount it claims to the deposit address of its wallet, in a
+// block of this node's best Bitcoin chain at least Confirmations deep, and
+// each payout must pass checkPayout. Whether a deposit was already credited,
+// or two payouts of the block conflict, is left to the store. A deposit or
+// payout that is wrong gives an error wrapping storage.ErrInvalidBlock; other
+// errors mean the node could not tell.
+func (w *Watcher) Check(changes storage.PegChanges) error {
+	if err := w.checkDeposits(changes.Deposits); err != nil {
+		return err
+	}
+	if len(changes.Payouts) > maxBlockPayouts {
+		return fmt.Errorf("%w: %d payouts, at most %d", storage.ErrInvalidBlock, len(changes.Payouts), maxBlockPayouts)
+	}
+	for _, p := range changes.Payouts {
+		if _, _, err := w.checkPayout(p, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Watcher) checkDeposits(deposits []storage.Deposit) error {
+	if len(deposits) == 0 {
+		return nil
+	}
+	if len(deposits) > w.config.MaxDeposits {
+		return fmt.Errorf("%w: %d deposits, at most %d", storage.ErrInvalidBlock, len(deposits), w.config.MaxDeposits)
+	}
+	tip, err := w.backend.BlockCount()
+	if err != nil {
+		return fmt.Errorf("failed to get the bitcoin tip: %w", err)
+	}
+
+	seen := make(map[string]bool, len(deposits))
+	for _, deposit := range deposits {
+		if seen[deposit.Outpoint] {
+			return fmt.Errorf("%w: deposit %s appears twice", storage.ErrInvalidBlock, deposit.Outpoint)
+		}
+		seen[deposit.Outpoint] = true
+		if err := w.checkDeposit(deposit, tip); err != nil {
+			return err
+		}
+	}
+
+	// Watch the addresses from now on, in case their announcement missed
+	// this node
+	for _, deposit := range deposits {
+		if _, err := w.Accept(deposit.Wallet); err != nil {
+			fmt.Println("Peg: error saving deposit address:", err)
+		}
+	}
+	return nil
+}
+
+// checkDeposit checks one deposit against the chain with the given tip.
+func (w *Watcher) checkDeposit(deposit storage.Deposit, tip int64) error {
+	txid, vout, err := ParseOutpoint(deposit.Outpoint)
+	if err != nil {
+		return fmt.Errorf("%w: %v", storage.ErrInvalidBlock, err)
+	}
+	if deposit.Amount <= 0 {
+		return fmt.Errorf("%w: deposit %s has no amount", storage.ErrInvalidBlock, deposit.Outpoint)
+	}
+	if err := checkWallet(deposit.Wallet); err != nil {
+		return fmt.Errorf("%w: deposit %s: %v", storage.ErrInvalidBlock, deposit.Outpoint, err)
+	}
+
+	// Check the address is the wallet's
+	address, err := w.derive(deposit.Wallet)
+	if err != nil {
+		return err
+	}
+	if deposit.Address != address.Address {
+		return fmt.Errorf("%w: deposit %s is not paid to the address of %s", storage.ErrInvalidBlock, deposit.Outpoint, deposit.Wallet)
+	}
+
+	// Check the block is deep enough in the best chain. This node's
+	// backend may be behind, so a shallow deposit is not invalid
+	if tip-deposit.BitcoinHeight+1 < int64(w.config.Confirmations) {
+		return fmt.Errorf("deposit %s has fewer than %d confirmations here", deposit.Outpoint, w.config.Confirmations)
+	}
+	hash, err := w.backend.BlockHash(deposit.BitcoinHeight)
+	if err != nil {
+		return fmt.Errorf("failed to get bitcoin block %d: %w", deposit.BitcoinHeight, err)
+	}
+	if hash.String() != deposit.BitcoinBlock {
+		return fmt.Errorf("%w: deposit %s is not in the best bitcoin chain", storage.ErrInvalidBlock, deposit.Outpoint)
+	}
+
+	// Check the output pays what the deposit claims
+	block, err := w.block(hash)
+	if err != nil {
+		return err
+	}
+	for _, tx := range block.Transactions {
+		if tx.TxHash() != txid {
+			continue
+		}
+		if int(vout) >= len(tx.TxOut) {
+			break
+		}
+		out := tx.TxOut[vout]
+		if hex.EncodeToString(out.PkScript) != address.Script || out.Value != deposit.Amount {
+			return fmt.Errorf("%w: output %s does not pay %d sats to %s", storage.ErrInvalidBlock, deposit.Outpoint, deposit.Amount, address.Address)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: output %s is not in bitcoin block %s", storage.ErrInvalidBlock, deposit.Outpoint, hash)
+}
+
+// block returns a Bitcoin block, from the cache if Check read it before.
+func (w *Watcher) block(hash chainhash.Hash) (*wire.MsgBlock, error) {
+	w.mu.Lock()
+	block, ok := w.blocks[hash]
+	w.mu.Unlock()
+	if ok {
+		return block, nil
+	}
+
+	block, err := w.backend.Block(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bitcoin block %s: %w", hash, err)
+	}
+	w.mu.Lock()
+	if len(w.blocks) >= maxCachedBlocks {
+		w.blocks = make(map[chainhash.Hash]*wire.MsgBlock)
+	}
+	w.blocks[hash] = block
+	w.mu.Unlock()
+	return block, nil
+}
@@ -0,0 +1,237 @@
+package peg_test
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bitcoin-sidechain/peg"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+const confirmations = 3
+
+// openStore opens a fresh SQLite database holding a peg key as a completed
+// handoff would leave it.
+func openStore(t *testing.T, pegKey *btcec.PrivateKey) storage.Store {
+	t.Helper()
+	store, err := storage.Open("sqlite3", filepath.Join(t.TempDir(), "node.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	_, err = store.CompleteHandoff(storage.CustodyKey{
+		Epoch:       1,
+		GroupKey:    hex.EncodeToString(schnorr.SerializePubKey(pegKey.PubKey())),
+		PublicKeys:  json.RawMessage(`{}`),
+		Certificate: json.RawMessage(`[]`),
+		CreatedAt:   time.Now().Unix(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// Deposits are credited once, at the required depth and never before, also
+// after a reorganization and a restart of the watcher, and the credits replay
+// from the transactions log.
+func TestWatcherCreditsDeposits(t *testing.T) {
+	pegKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := openStore(t, pegKey)
+	bitcoin := peg.NewFakeBackend()
+	bitcoin.Mine(10)
+	config := peg.Config{Network: &chaincfg.RegressionNetParams, Confirmations: confirmations, StartHeight: 1}
+	watcher := peg.NewWatcher(store, bitcoin, nil, config)
+
+	alice, bob := newWallet(t), newWallet(t)
+	address, err := watcher.Address(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := peg.DeriveDepositAddress(hex.EncodeToString(schnorr.SerializePubKey(pegKey.PubKey())), bob, config.Network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Address == address.Address {
+		t.Fatal("two wallets got the same deposit address")
+	}
+	script, _ := hex.DecodeString(address.Script)
+
+	// A deposit one block deep is pending and not credited
+	payment := bitcoin.Pay(script, 50000)
+	bitcoin.Mine(1)
+	produce(t, store, watcher, alice, 0)
+	if pending, _, _ := watcher.Pending(); len(pending) != 1 {
+		t.Fatalf("expected 1 pending deposit, got %d", len(pending))
+	}
+
+	// Bitcoin drops the block with the deposit
+	bitcoin.Reorg(1)
+	produce(t, store, watcher, alice, 0)
+	if pending, _, _ := watcher.Pending(); len(pending) != 0 {
+		t.Fatal("deposit of a dropped block still pending")
+	}
+
+	// The deposit confirms again at the same height in another block, and is
+	// credited once it is deep enough
+	bitcoin.Mine(confirmations - 1)
+	produce(t, store, watcher, alice, 0)
+	bitcoin.Mine(1)
+	ready := scanReady(t, watcher)
+	if len(ready) != 1 || ready[0].Outpoint != peg.Outpoint(payment.TxHash(), 0) {
+		t.Fatalf("expected the deposit to be ready, got %v", ready)
+	}
+	if err := watcher.Check(storage.PegChanges{Deposits: ready}); err != nil {
+		t.Fatalf("valid deposit refused: %v", err)
+	}
+	produce(t, store, watcher, alice, 50000)
+
+	// No second credit, from the same watcher, a new one or a proposer that
+	// includes the deposit again
+	bitcoin.Mine(2)
+	produce(t, store, watcher, alice, 50000)
+	watcher = peg.NewWatcher(store, bitcoin, nil, config)
+	produce(t, store, watcher, alice, 50000)
+	block, rejected, err := store.ProduceBlock("watchertest", time.Now().Unix(), nil, storage.MembershipChanges{}, storage.PegChanges{Deposits: ready})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Deposits) != 0 || !errors.Is(rejected[ready[0].Outpoint], storage.ErrInvalidBlock) {
+		t.Fatal("a credited deposit was accepted again")
+	}
+	if balance := balanceOf(store, alice); balance != 50000 {
+		t.Fatalf("expected a balance of 50000 after a replayed deposit, got %d", balance)
+	}
+	pegin, err := store.GetPegIn(ready[0].Outpoint)
+	if err != nil {
+		t.Fatalf("peg-in not recorded: %v", err)
+	}
+	if pegin.Wallet != alice || pegin.Amount != 50000 {
+		t.Fatalf("peg-in recorded as %+v", pegin)
+	}
+
+	// The credits are in the transactions log
+	replayed, err := storage.ReplayLedger(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balances, err := store.ListBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for wallet, balance := range balances {
+		if replayed[wallet] != balance {
+			t.Errorf("wallet %s has %d but the log gives %d", wallet, balance, replayed[wallet])
+		}
+	}
+}
+
+// Check refuses changed copies of a valid deposit as invalid, and a deposit
+// that is only shallow here as not known yet.
+func TestWatcherRefusesForgedDeposits(t *testing.T) {
+	pegKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := openStore(t, pegKey)
+	bitcoin := peg.NewFakeBackend()
+	bitcoin.Mine(10)
+	config := peg.Config{Network: &chaincfg.RegressionNetParams, Confirmations: confirmations, StartHeight: 1}
+	watcher := peg.NewWatcher(store, bitcoin, nil, config)
+
+	address, err := watcher.Address(newWallet(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := peg.DeriveDepositAddress(hex.EncodeToString(schnorr.SerializePubKey(pegKey.PubKey())), newWallet(t), config.Network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, _ := hex.DecodeString(address.Script)
+	bitcoin.Pay(script, 50000)
+	bitcoin.Mine(confirmations)
+	ready := scanReady(t, watcher)
+	if len(ready) != 1 {
+		t.Fatalf("expected 1 ready deposit, got %d", len(ready))
+	}
+	deposit := ready[0]
+
+	forged := map[string]func(d *storage.Deposit){
+		"a larger amount":        func(d *storage.Deposit) { d.Amount++ },
+		"another wallet":         func(d *storage.Deposit) { d.Wallet, d.Address = other.Wallet, other.Address },
+		"another address":        func(d *storage.Deposit) { d.Address = other.Address },
+		"another output":         func(d *storage.Deposit) { d.Outpoint = d.Outpoint[:len(d.Outpoint)-1] + "1" },
+		"another bitcoin block":  func(d *storage.Deposit) { d.BitcoinHeight-- },
+		"an invalid wallet name": func(d *storage.Deposit) { d.Wallet = "alice" },
+	}
+	for name, change := range forged {
+		d := deposit
+		change(&d)
+		if err := watcher.Check(storage.PegChanges{Deposits: []storage.Deposit{d}}); !errors.Is(err, storage.ErrInvalidBlock) {
+			t.Errorf("deposit with %s: expected an invalid block, got %v", name, err)
+		}
+	}
+	if err := watcher.Check(storage.PegChanges{Deposits: []storage.Deposit{deposit, deposit}}); !errors.Is(err, storage.ErrInvalidBlock) {
+		t.Errorf("deposit listed twice: expected an invalid block, got %v", err)
+	}
+
+	shallow := deposit
+	shallow.BitcoinHeight += 5
+	if err := watcher.Check(storage.PegChanges{Deposits: []storage.Deposit{shallow}}); err == nil || errors.Is(err, storage.ErrInvalidBlock) {
+		t.Errorf("deposit above the tip: expected to be unknown yet, got %v", err)
+	}
+}
+
+// produce scans Bitcoin, produces a block with the deposits that are ready
+// and checks the balance of wallet afterwards.
+func produce(t *testing.T, store storage.Store, watcher *peg.Watcher, wallet string, want int64) {
+	t.Helper()
+	ready := scanReady(t, watcher)
+	block, rejected, err := store.ProduceBlock("watchertest", time.Now().Unix(), nil, storage.MembershipChanges{}, storage.PegChanges{Deposits: ready})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, reason := range rejected {
+		t.Fatalf("%s left out of block %d: %v", id, block.Height, reason)
+	}
+	if balance := balanceOf(store, wallet); balance != want {
+		t.Fatalf("expected a balance of %d, got %d", want, balance)
+	}
+}
+
+func scanReady(t *testing.T, watcher *peg.Watcher) []storage.Deposit {
+	t.Helper()
+	if err := watcher.Scan(); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	return watcher.Ready().Deposits
+}
+
+func balanceOf(store storage.Store, wallet string) int64 {
+	balance, err := store.GetBalance(wallet)
+	if err != nil {
+		return 0
+	}
+	return balance
+}
+
+func newWallet(t *testing.T) string {
+	t.Helper()
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key.PubKey().SerializeCompressed())
+}
@@ -0,0 +1,93 @@
+// Package probe runs requests to many peers at once. A sweep hands one task
+// per peer to a fixed number of workers, and every task gets its own context
+// that expires after the timeout, so a slow or silent peer holds up one
+// worker for at most one timeout. A sweep of up to Workers peers finishes
+// within a single timeout.
+//
+// Tasks only do the network call and keep their result; the caller writes
+// the results of a whole sweep back in one batch once it returns.
+package probe
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Config sets how many requests run at once and how long each may take.
+type Config struct {
+	Workers int           // requests in flight at most
+	Timeout time.Duration // deadline of each request
+}
+
+// DefaultConfig is used for any value left at zero.
+var DefaultConfig = Config{
+	Workers: 64,
+	Timeout: 7 * time.Second,
+}
+
+// Pool runs sweeps. It can be shared: each sweep starts its own workers.
+type Pool struct {
+	config Config
+}
+
+// New returns a pool. Zero values in config are taken from DefaultConfig.
+func New(config Config) *Pool {
+	if config.Workers <= 0 {
+		config.Workers = DefaultConfig.Workers
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultConfig.Timeout
+	}
+	return &Pool{config: config}
+}
+
+// Timeout returns the deadline of each request.
+func (p *Pool) Timeout() time.Duration {
+	return p.config.Timeout
+}
+
+// Sweep runs task for every index in [0, n) and returns their errors by
+// index once all of them are done. Each task is called with a context that
+// is cancelled after the timeout or when ctx is. Tasks that did not start
+// before ctx was cancelled are not run and get its error.
+func (p *Pool) Sweep(ctx context.Context, n int, task func(ctx context.Context, i int) error) []error {
+	errs := make([]error, n)
+	indexes := make(chan int)
+
+	workers := p.config.Workers
+	if workers > n {
+		workers = n
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = p.run(ctx, i, task)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	return errs
+}
+
+// run calls one task with its own deadline.
+func (p *Pool) run(ctx context.Context, i int, task func(ctx context.Context, i int) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+	return task(ctx, i)
+}
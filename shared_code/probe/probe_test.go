@@ -0,0 +1,83 @@
+package probe_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bitcoin-sidechain/probe"
+)
+
+// silent is a task for a peer that never answers: it returns only once its
+// context is done.
+func silent(started *atomic.Int64) func(ctx context.Context, i int) error {
+	return func(ctx context.Context, i int) error {
+		started.Add(1)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+}
+
+func TestSweepOfSilentPeersTakesOneTimeout(t *testing.T) {
+	const workers, timeout = 16, 200 * time.Millisecond
+	pool := probe.New(probe.Config{Workers: workers, Timeout: timeout})
+
+	var started atomic.Int64
+	begin := time.Now()
+	errs := pool.Sweep(context.Background(), workers, silent(&started))
+	elapsed := time.Since(begin)
+
+	if elapsed < timeout || elapsed > timeout+timeout/2 {
+		t.Errorf("sweep of %d silent peers took %v, expected one timeout of %v", workers, elapsed, timeout)
+	}
+	if started.Load() != workers {
+		t.Errorf("%d tasks ran, expected %d", started.Load(), workers)
+	}
+	for i, err := range errs {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("task %d: got %v, expected DeadlineExceeded", i, err)
+		}
+	}
+
+	// Twice as many peers take two timeouts
+	begin = time.Now()
+	pool.Sweep(context.Background(), 2*workers, silent(&started))
+	if elapsed := time.Since(begin); elapsed < 2*timeout || elapsed > 2*timeout+timeout/2 {
+		t.Errorf("sweep of %d silent peers took %v, expected two timeouts", 2*workers, elapsed)
+	}
+}
+
+func TestSweepCancelsTasksThatDidNotStart(t *testing.T) {
+	pool := probe.New(probe.Config{Workers: 2, Timeout: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	var started atomic.Int64
+	begin := time.Now()
+	errs := pool.Sweep(ctx, 10, silent(&started))
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("cancelled sweep took %v", elapsed)
+	}
+	if started.Load() != 2 {
+		t.Errorf("%d tasks ran, expected only the 2 the workers took before the cancel", started.Load())
+	}
+	for i, err := range errs {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("task %d: got %v, expected Canceled", i, err)
+		}
+	}
+
+	// A sweep on a cancelled context runs nothing
+	started.Store(0)
+	errs = pool.Sweep(ctx, 5, silent(&started))
+	if started.Load() != 0 {
+		t.Errorf("%d tasks ran on a cancelled context", started.Load())
+	}
+	for i, err := range errs {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("task %d on a cancelled context: got %v, expected Canceled", i, err)
+		}
+	}
+}
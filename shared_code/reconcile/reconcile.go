@@ -0,0 +1,373 @@
+// Package reconcile brings the nodes_que and nodes_buffer of a node up to
+// date with a peer's by exchanging hashes first and entries only where they
+// differ:
+//
+//  1. GET /sync/digest returns a digest: the hash of the nodes table (see
+//     cryptoUtils.ComputeDatabaseHash) and the root of the queue and of the
+//     buffer. Sets with the same root are done.
+//  2. GET /sync/{set}/buckets returns the 256 bucket hashes of a set that
+//     differs. An address is in the bucket given by the first byte of the
+//     SHA-256 of the address.
+//  3. GET /sync/{set}/entries?buckets=<hex>,<hex> returns the entries of the
+//     buckets that differ, each with its signed registration.
+//
+// An entry hashes as SHA-256 of its address and public key joined by a
+// newline. A bucket hashes as SHA-256 of the hashes of its entries in address
+// order, and a root as SHA-256 of the 256 bucket hashes.
+//
+// Only addresses the node does not know yet are taken, and only if they carry
+// a valid registration and then answer a fresh challenge from this node: a
+// registration alone proves the key holder asked to join at the address, not
+// that it still runs there. At most MaxChallenges addresses are challenged
+// per peer and sync; the rest are taken by a later one. The registration
+// this node's challenge returns is the one stored. Queued addresses start
+// their probation over. The
+// nodes table only changes through blocks, so a node whose nodes digest
+// differs is reported but not copied from.
+package reconcile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/networkUtils"
+	"bitcoin-sidechain/storage"
+)
+
+// Buckets is the number of buckets each set is split into.
+const Buckets = 256
+
+// MaxChallenges is how many addresses taken from one peer are challenged in
+// one sync.
+const MaxChallenges = 16
+
+// Sets that are reconciled entry by entry.
+const (
+	Queue  = "queue"
+	Buffer = "buffer"
+)
+
+// Digest is the top level summary of a node's membership tables.
+type Digest struct {
+	Nodes  string `json:"nodes"`
+	Queue  string `json:"queue"`
+	Buffer string `json:"buffer"`
+}
+
+// Getter sends a signed GET to a node and checks that the answer is signed by
+// the node listed at that address.
+type Getter interface {
+	GetContext(ctx context.Context, ipAddress, path string) (int, []byte, error)
+}
+
+// Challenger checks that the node at an address holds a key and returns its
+// signed answer as a registration.
+type Challenger interface {
+	ChallengeContext(ctx context.Context, address, publicKey string) (storage.Registration, error)
+}
+
+// Bucket returns the bucket of an address.
+func Bucket(ipAddress string) int {
+	hash := sha256.Sum256([]byte(ipAddress))
+	return int(hash[0])
+}
+
+// set is one table split into buckets.
+type set struct {
+	buckets [Buckets][]storage.Registration // in address order
+	hashes  [Buckets]string
+	root    string
+}
+
+func newSet(registrations []storage.Registration) *set {
+	s := &set{}
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].IPAddress < registrations[j].IPAddress
+	})
+	for _, registration := range registrations {
+		b := Bucket(registration.IPAddress)
+		s.buckets[b] = append(s.buckets[b], registration)
+	}
+
+	root := sha256.New()
+	for b, entries := range s.buckets {
+		bucket := sha256.New()
+		for _, entry := range entries {
+			hash := sha256.Sum256([]byte(entry.IPAddress + "\n" + entry.PublicKey))
+			bucket.Write(hash[:])
+		}
+		sum := bucket.Sum(nil)
+		s.hashes[b] = hex.EncodeToString(sum)
+		root.Write(sum)
+	}
+	s.root = hex.EncodeToString(root.Sum(nil))
+	return s
+}
+
+// Snapshot is the state of a node's membership tables at one time. A sweep
+// takes one snapshot and compares every peer against it.
+type Snapshot struct {
+	nodes string
+	sets  map[string]*set
+}
+
+// Take reads the membership tables of store.
+func Take(store storage.Store) (*Snapshot, error) {
+	entries, err := store.ListQueue()
+	if err != nil {
+		return nil, err
+	}
+	queue := make([]storage.Registration, len(entries))
+	for i, entry := range entries {
+		queue[i] = entry.Registration
+	}
+	buffer, err := store.ListBuffer()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := cryptoUtils.ComputeDatabaseHash(store)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		nodes: nodes,
+		sets:  map[string]*set{Queue: newSet(queue), Buffer: newSet(buffer)},
+	}, nil
+}
+
+// Digest returns the digest of the snapshot.
+func (s *Snapshot) Digest() Digest {
+	return Digest{Nodes: s.nodes, Queue: s.sets[Queue].root, Buffer: s.sets[Buffer].root}
+}
+
+// contains reports whether an address is in the queue or the buffer.
+func (s *Snapshot) contains(ipAddress string) bool {
+	b := Bucket(ipAddress)
+	for _, set := range s.sets {
+		for _, entry := range set.buckets[b] {
+			if entry.IPAddress == ipAddress {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Result is what a peer has that a node lacks.
+type Result struct {
+	NodesDiffer bool
+	Queue       []storage.Registration
+	Buffer      []storage.Registration
+	Rejected    int // entries that did not prove their key
+}
+
+// Pull compares the snapshot with the node at ipAddress and fetches the
+// entries of the buckets that differ. It returns those that are not in the
+// snapshot, carry a valid registration and answer a challenge sent through
+// challenger, with the registration of that answer.
+func (s *Snapshot) Pull(ctx context.Context, getter Getter, challenger Challenger, ipAddress string) (Result, error) {
+	var result Result
+	challenges := 0
+	var remote Digest
+	if err := getJSON(ctx, getter, ipAddress, "/sync/digest", &remote); err != nil {
+		return result, err
+	}
+	result.NodesDiffer = remote.Nodes != s.nodes
+
+	for name, root := range map[string]string{Queue: remote.Queue, Buffer: remote.Buffer} {
+		local := s.sets[name]
+		if root == local.root {
+			continue
+		}
+		var hashes []string
+		if err := getJSON(ctx, getter, ipAddress, "/sync/"+name+"/buckets", &hashes); err != nil {
+			return result, err
+		}
+		if len(hashes) != Buckets {
+			return result, fmt.Errorf("%s sent %d %s buckets", ipAddress, len(hashes), name)
+		}
+		var differ []string
+		for b, hash := range hashes {
+			if hash != local.hashes[b] {
+				differ = append(differ, fmt.Sprintf("%02x", b))
+			}
+		}
+		if len(differ) == 0 {
+			continue
+		}
+
+		var entries []storage.Registration
+		path := "/sync/" + name + "/entries?" + url.Values{"buckets": {strings.Join(differ, ",")}}.Encode()
+		if err := getJSON(ctx, getter, ipAddress, path, &entries); err != nil {
+			return result, err
+		}
+		for _, entry := range entries {
+			if s.contains(entry.IPAddress) {
+				continue
+			}
+			if err := networkUtils.VerifyRegistration(entry); err != nil {
+				result.Rejected++
+				continue
+			}
+			if challenges == MaxChallenges {
+				continue
+			}
+			challenges++
+			registration, err := challenger.ChallengeContext(ctx, entry.IPAddress, entry.PublicKey)
+			if err != nil {
+				result.Rejected++
+				continue
+			}
+			if name == Queue {
+				result.Queue = append(result.Queue, registration)
+			} else {
+				result.Buffer = append(result.Buffer, registration)
+			}
+		}
+	}
+	return result, nil
+}
+
+// Apply writes what a sweep pulled from its peers: each address once, unless
+// it is a node by now. Queued addresses start their probation with epoch.
+// It returns how many addresses were queued and buffered.
+func Apply(store storage.Store, results []Result, epoch int64) (int, int, error) {
+	seen := make(map[string]bool)
+	fresh := func(registration storage.Registration) (bool, error) {
+		if seen[registration.IPAddress] {
+			return false, nil
+		}
+		seen[registration.IPAddress] = true
+		exists, err := store.NodeExists(registration.IPAddress)
+		return !exists, err
+	}
+
+	var queue []storage.QueueEntry
+	var buffer []storage.Registration
+	for _, result := range results {
+		for _, registration := range result.Queue {
+			ok, err := fresh(registration)
+			if err != nil {
+				return 0, 0, err
+			}
+			if ok {
+				queue = append(queue, storage.QueueEntry{Registration: registration, QueuedEpoch: epoch})
+			}
+		}
+		for _, registration := range result.Buffer {
+			ok, err := fresh(registration)
+			if err != nil {
+				return 0, 0, err
+			}
+			if ok {
+				buffer = append(buffer, registration)
+			}
+		}
+	}
+
+	if err := store.AddAllToQueue(queue); err != nil {
+		return 0, 0, err
+	}
+	if err := store.AddAllToBuffer(buffer); err != nil {
+		return 0, 0, err
+	}
+	return len(queue), len(buffer), nil
+}
+
+// getJSON fetches path from a node and decodes its JSON answer.
+func getJSON(ctx context.Context, getter Getter, ipAddress, path string, v interface{}) error {
+	status, body, err := getter.GetContext(ctx, ipAddress, path)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("%s answered %s with status %d", ipAddress, path, status)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid answer from %s to %s: %w", ipAddress, path, err)
+	}
+	return nil
+}
+
+// DigestHandler returns the GET /sync/digest endpoint.
+func DigestHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshot, ok := take(w, store)
+		if ok {
+			writeJSON(w, snapshot.Digest())
+		}
+	}
+}
+
+// BucketsHandler returns the GET /sync/{set}/buckets endpoint.
+func BucketsHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshot, ok := take(w, store)
+		if !ok {
+			return
+		}
+		set, ok := snapshot.sets[r.PathValue("set")]
+		if !ok {
+			http.Error(w, "Unknown set", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, set.hashes[:])
+	}
+}
+
+// EntriesHandler returns the GET /sync/{set}/entries endpoint. The buckets
+// query parameter lists the buckets as comma separated hex bytes.
+func EntriesHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var buckets []int
+		for _, field := range strings.Split(r.URL.Query().Get("buckets"), ",") {
+			b, err := strconv.ParseUint(field, 16, 8)
+			if err != nil {
+				http.Error(w, "buckets must be comma separated hex bytes", http.StatusBadRequest)
+				return
+			}
+			buckets = append(buckets, int(b))
+		}
+		snapshot, ok := take(w, store)
+		if !ok {
+			return
+		}
+		set, ok := snapshot.sets[r.PathValue("set")]
+		if !ok {
+			http.Error(w, "Unknown set", http.StatusNotFound)
+			return
+		}
+		entries := []storage.Registration{}
+		for _, b := range buckets {
+			entries = append(entries, set.buckets[b]...)
+		}
+		writeJSON(w, entries)
+	}
+}
+
+// take takes a snapshot for a handler, or answers 500.
+func take(w http.ResponseWriter, store storage.Store) (*Snapshot, bool) {
+	snapshot, err := Take(store)
+	if err != nil {
+		fmt.Println("Reconcile: error reading membership tables:", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return nil, false
+	}
+	return snapshot, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Println("Error encoding response:", err)
+	}
+}
@@ -0,0 +1,120 @@
+package reconcile_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/networkUtils"
+	"bitcoin-sidechain/reconcile"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+func openStore(t *testing.T, name string) storage.Store {
+	t.Helper()
+	store, err := storage.Open("sqlite3", filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// peer answers sync requests from the handlers of its store.
+type peer struct {
+	mux *http.ServeMux
+}
+
+func newPeer(store storage.Store) peer {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sync/digest", reconcile.DigestHandler(store))
+	mux.HandleFunc("GET /sync/{set}/buckets", reconcile.BucketsHandler(store))
+	mux.HandleFunc("GET /sync/{set}/entries", reconcile.EntriesHandler(store))
+	return peer{mux: mux}
+}
+
+func (p peer) GetContext(ctx context.Context, ipAddress, path string) (int, []byte, error) {
+	recorder := httptest.NewRecorder()
+	p.mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder.Code, recorder.Body.Bytes(), nil
+}
+
+// challenger answers challenges for the addresses that are still up.
+type challenger struct {
+	up map[string]bool
+}
+
+func (c challenger) ChallengeContext(ctx context.Context, address, publicKey string) (storage.Registration, error) {
+	if !c.up[address] {
+		return storage.Registration{}, networkUtils.ErrChallengeFailed
+	}
+	return storage.Registration{IPAddress: address, PublicKey: publicKey, RegisteredBy: "local", Nonce: strings.Repeat("cd", 32), Signature: "fresh"}, nil
+}
+
+// registered returns a registration signed for address by a new key, as
+// answered to a challenge of the node server.
+func registered(t *testing.T, server, address string) storage.Registration {
+	t.Helper()
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := strings.Repeat("ab", 32)
+	answer := networkUtils.NewIdentity(key).AnswerChallenge(server, address, nonce)
+	return storage.Registration{IPAddress: address, PublicKey: cryptoUtils.PublicKeyBase64(key), RegisteredBy: server, Nonce: nonce, Signature: answer.Signature}
+}
+
+func TestPullChallengesRelayedRegistrations(t *testing.T) {
+	local, remote := openStore(t, "local.db"), openStore(t, "remote.db")
+	running, moved := registered(t, "remote", "10.0.0.2:8080"), registered(t, "remote", "10.0.0.3:8080")
+	forged := registered(t, "remote", "10.0.0.4:8080")
+	forged.Signature = running.Signature
+	if err := remote.AddAllToBuffer([]storage.Registration{running, moved, forged}); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := reconcile.Take(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := snapshot.Pull(context.Background(), newPeer(remote), challenger{up: map[string]bool{running.IPAddress: true, forged.IPAddress: true}}, "10.0.0.9:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the address that answered our own challenge is taken, with our registration
+	if len(result.Buffer) != 1 || result.Buffer[0].IPAddress != running.IPAddress || result.Buffer[0].RegisteredBy != "local" {
+		t.Fatalf("pulled %+v, expected %s as registered by us", result.Buffer, running.IPAddress)
+	}
+	if result.Rejected != 2 {
+		t.Errorf("rejected %d entries, expected the forged and the moved one", result.Rejected)
+	}
+}
+
+// brokenNodes fails to read the nodes table.
+type brokenNodes struct {
+	storage.Store
+}
+
+func (brokenNodes) ListNodes() ([]storage.Node, error) {
+	return nil, errors.New("connection lost")
+}
+
+func TestDigestHandlerAnswers500OnStoreError(t *testing.T) {
+	store := brokenNodes{openStore(t, "node.db")}
+	if _, err := reconcile.Take(store); err == nil {
+		t.Fatal("took a snapshot without the nodes table")
+	}
+	recorder := httptest.NewRecorder()
+	reconcile.DigestHandler(store)(recorder, httptest.NewRequest(http.MethodGet, "/sync/digest", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("digest answered %d, expected 500", recorder.Code)
+	}
+}
@@ -0,0 +1,296 @@
+package reserves
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"bitcoin-sidechain/consensus"
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/epoch"
+	"bitcoin-sidechain/peg"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// Bounds on what an auditor remembers: the digests of its recent reports, so
+// that it can attest a block it has already moved past, and how long a
+// statement is served before it is taken again.
+const (
+	maxDigests      = 64
+	statementMaxAge = 30 * time.Second
+)
+
+// Transport asks a leader to attest a report.
+type Transport interface {
+	Attest(peer storage.EpochMember, request Attestation) (Attestation, error)
+}
+
+// PendingPayout is a payout a block recorded that this node has not seen
+// confirm on Bitcoin yet.
+type PendingPayout struct {
+	TxID        string   `json:"txid"`
+	Withdrawals []string `json:"withdrawals"`
+	BlockHeight int64    `json:"block_height"`
+}
+
+// Statement is the answer of GET /reserves: a report with the attestations
+// of the leaders, and what this node sees of the UTXOs on Bitcoin, which the
+// leaders do not sign.
+type Statement struct {
+	Report        Report           `json:"report"`
+	Digest        string           `json:"digest"`
+	Backed        bool             `json:"backed"`
+	Problem       string           `json:"problem,omitempty"`
+	Confirmations map[string]int64 `json:"confirmations,omitempty"` // by outpoint
+	Payouts       []PendingPayout  `json:"payouts"`
+	Attestations  []Attestation    `json:"attestations"`
+	Quorum        int              `json:"quorum"`
+}
+
+// taken is what an auditor remembers of one of its reports.
+type taken struct {
+	digest string
+	epoch  int64
+	group  int
+}
+
+// Auditor reports the reserves of this node and, if it is a leader, attests
+// the reports of other nodes that match its own.
+type Auditor struct {
+	store     storage.Store
+	epochs    *epoch.Manager
+	watcher   *peg.Watcher // nil without a Bitcoin backend
+	key       *btcec.PrivateKey
+	self      string
+	transport Transport
+
+	mu        sync.Mutex
+	digests   map[int64]taken // by height
+	statement *Statement
+	at        time.Time // when statement was taken
+}
+
+// New returns an auditor for the node with the given key. watcher may be nil,
+// and then statements carry no confirmations.
+func New(store storage.Store, epochs *epoch.Manager, watcher *peg.Watcher, key *btcec.PrivateKey, transport Transport) *Auditor {
+	return &Auditor{
+		store:     store,
+		epochs:    epochs,
+		watcher:   watcher,
+		key:       key,
+		self:      cryptoUtils.NodeID(key.PubKey()),
+		transport: transport,
+		digests:   make(map[int64]taken),
+	}
+}
+
+// Run takes a report every interval until stop is closed, so that this node
+// can attest the recent blocks when another node asks later.
+func (a *Auditor) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := a.Take(); err != nil {
+				fmt.Println("Reserves: error taking report:", err)
+			}
+		}
+	}
+}
+
+// Take reports the reserves after the latest block, for the group that
+// decides the next one to attest, and remembers its digest.
+func (a *Auditor) Take() (Report, error) {
+	r, err := a.store.GetReserves()
+	if err != nil {
+		return Report{}, err
+	}
+	number := a.epochs.EpochAt(r.Height)
+	current, err := a.store.GetEpoch(number)
+	if err != nil {
+		return Report{}, fmt.Errorf("failed to read epoch %d: %w", number, err)
+	}
+	var pegKey string
+	key, err := a.store.LatestCustodyKey()
+	if err == nil {
+		pegKey = key.GroupKey
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return Report{}, err
+	}
+
+	report := NewReport(r, number, current.GroupAt(r.Height+1), pegKey)
+	a.mu.Lock()
+	a.digests[report.Height] = taken{digest: report.Digest(), epoch: report.Epoch, group: report.Group}
+	for len(a.digests) > maxDigests {
+		oldest := report.Height
+		for height := range a.digests {
+			if height < oldest {
+				oldest = height
+			}
+		}
+		delete(a.digests, oldest)
+	}
+	a.mu.Unlock()
+	return report, nil
+}
+
+// Attest signs a report digest if this node computed the same report at that
+// height and is a leader of the group that should sign it.
+func (a *Auditor) Attest(request Attestation) (Attestation, error) {
+	a.mu.Lock()
+	own, ok := a.digests[request.Height]
+	a.mu.Unlock()
+	if !ok {
+		report, err := a.Take()
+		if err != nil {
+			return Attestation{}, err
+		}
+		if report.Height != request.Height {
+			return Attestation{}, fmt.Errorf("%w: %d, this node is at %d", ErrUnknownHeight, request.Height, report.Height)
+		}
+		own = taken{digest: report.Digest(), epoch: report.Epoch, group: report.Group}
+	}
+	if own.digest != request.Digest {
+		return Attestation{}, fmt.Errorf("%w: the reserves at height %d differ here", ErrRefused, request.Height)
+	}
+	current, err := a.store.GetEpoch(own.epoch)
+	if err != nil {
+		return Attestation{}, fmt.Errorf("failed to read epoch %d: %w", own.epoch, err)
+	}
+	if _, ok := consensus.NewValidators(current, own.group).Get(a.self); !ok {
+		return Attestation{}, fmt.Errorf("%w: this node is not a leader of group %d of epoch %d", ErrRefused, own.group, own.epoch)
+	}
+
+	attestation := Attestation{Height: request.Height, Digest: request.Digest, Signer: a.self}
+	attestation.Signature = cryptoUtils.SignMessage(a.key, attestation.SignBytes())
+	return attestation, nil
+}
+
+// Statement returns the reserves after the latest block with the
+// attestations of the leaders that agree. A statement is reused while no
+// block is committed, for at most statementMaxAge.
+func (a *Auditor) Statement() (*Statement, error) {
+	latest, err := a.store.LatestBlock()
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	a.mu.Lock()
+	cached := a.statement
+	fresh := cached != nil && cached.Report.Height == latest.Height && time.Since(a.at) < statementMaxAge
+	a.mu.Unlock()
+	if fresh {
+		return cached, nil
+	}
+
+	report, err := a.Take()
+	if err != nil {
+		return nil, err
+	}
+	statement := &Statement{Report: report, Digest: report.Digest(), Backed: true, Payouts: []PendingPayout{}}
+	if err := report.Check(); err != nil {
+		statement.Backed, statement.Problem = false, err.Error()
+	}
+	if err := a.annotate(statement); err != nil {
+		return nil, err
+	}
+	statement.Attestations, statement.Quorum, err = a.collect(report)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.statement, a.at = statement, time.Now()
+	a.mu.Unlock()
+	return statement, nil
+}
+
+// annotate adds the confirmations of the UTXOs, as far as this node has
+// scanned Bitcoin, and the payouts it has not seen confirm.
+func (a *Auditor) annotate(statement *Statement) error {
+	unconfirmed, err := a.store.ListUnconfirmedPayouts()
+	if err != nil {
+		return err
+	}
+	for _, p := range unconfirmed {
+		statement.Payouts = append(statement.Payouts, PendingPayout{TxID: p.TxID, Withdrawals: p.Withdrawals, BlockHeight: p.BlockHeight})
+	}
+	if a.watcher == nil {
+		return nil
+	}
+
+	statement.Confirmations = make(map[string]int64, len(statement.Report.UTXOs))
+	for _, u := range statement.Report.UTXOs {
+		var height int64
+		if u.Wallet != "" {
+			pegin, err := a.store.GetPegIn(u.Outpoint)
+			if err != nil {
+				return fmt.Errorf("failed to read peg-in %s: %w", u.Outpoint, err)
+			}
+			height = pegin.BitcoinHeight
+		} else {
+			txid, _, err := peg.ParseOutpoint(u.Outpoint)
+			if err != nil {
+				return err
+			}
+			payout, err := a.store.GetPayout(txid.String())
+			if err != nil {
+				return fmt.Errorf("failed to read payout %s: %w", txid, err)
+			}
+			height = payout.BitcoinHeight
+		}
+		statement.Confirmations[u.Outpoint] = a.watcher.Depth(height)
+	}
+	return nil
+}
+
+// collect asks every leader of the report's group to attest it, and returns
+// the valid attestations, by signer, with the quorum of the group.
+func (a *Auditor) collect(report Report) ([]Attestation, int, error) {
+	current, err := a.store.GetEpoch(report.Epoch)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read epoch %d: %w", report.Epoch, err)
+	}
+	leaders := consensus.NewValidators(current, report.Group)
+	request := Attestation{Height: report.Height, Digest: report.Digest()}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	attestations := []Attestation{}
+	for _, leader := range leaders.Members() {
+		wg.Add(1)
+		go func(leader storage.EpochMember) {
+			defer wg.Done()
+			var attestation Attestation
+			var err error
+			if leader.ComputerID == a.self {
+				attestation, err = a.Attest(request)
+			} else {
+				attestation, err = a.transport.Attest(leader, request)
+			}
+			if err == nil && (attestation.Signer != leader.ComputerID || attestation.Height != request.Height || attestation.Digest != request.Digest) {
+				err = errors.New("attestation for something else")
+			}
+			if err == nil {
+				err = cryptoUtils.VerifyMessage(leader.PublicKey, attestation.SignBytes(), attestation.Signature)
+			}
+			if err != nil {
+				fmt.Printf("Reserves: leader %s did not attest height %d: %v\n", leader.ComputerID, report.Height, err)
+				return
+			}
+			mu.Lock()
+			attestations = append(attestations, attestation)
+			mu.Unlock()
+		}(leader)
+	}
+	wg.Wait()
+	sort.Slice(attestations, func(i, j int) bool { return attestations[i].Signer < attestations[j].Signer })
+	return attestations, leaders.Quorum(), nil
+}
@@ -0,0 +1,125 @@
+package reserves
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"bitcoin-sidechain/peg"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// OutputSource looks up outputs in the UTXO set of a Bitcoin node, mempool
+// included. peg.RPCBackend and peg.FakeBackend are both one.
+type OutputSource interface {
+	UnspentOutput(txid chainhash.Hash, vout uint32) (*peg.UnspentOutput, error)
+}
+
+// Holdings is what a Bitcoin node shows of the UTXOs of a report.
+type Holdings struct {
+	Held    int64    // sats found unspent with the right amount and script
+	Pending []string // change of payouts not on Bitcoin yet, whose inputs were found unspent instead
+	Missing []string // what was not found, or not as the report says
+}
+
+// CheckHoldings looks up every UTXO of a report on a Bitcoin node. A deposit
+// must pay the deposit address of its wallet and change the peg key itself.
+// The change of a payout recorded on the sidechain but not broadcast yet is
+// missing on Bitcoin, so the inputs of that payout, read from store, are
+// looked up instead: until the payout is broadcast the peg still holds them.
+func CheckHoldings(store storage.Store, report Report, source OutputSource, params *chaincfg.Params) (Holdings, error) {
+	var holdings Holdings
+	if len(report.UTXOs) > 0 && report.PegKey == "" {
+		return holdings, errors.New("report lists UTXOs but no peg key")
+	}
+	for _, u := range report.UTXOs {
+		script, err := expectedScript(report.PegKey, u, params)
+		if err != nil {
+			return holdings, err
+		}
+		txid, vout, err := peg.ParseOutpoint(u.Outpoint)
+		if err != nil {
+			return holdings, err
+		}
+		out, err := source.UnspentOutput(txid, vout)
+		if err != nil {
+			return holdings, err
+		}
+		if out != nil {
+			if out.Amount != u.Amount || !bytes.Equal(out.Script, script) {
+				holdings.Missing = append(holdings.Missing, fmt.Sprintf("%s holds %d sats, not %d to the peg", u.Outpoint, out.Amount, u.Amount))
+				continue
+			}
+			holdings.Held += out.Amount
+			continue
+		}
+		if u.Wallet != "" {
+			holdings.Missing = append(holdings.Missing, fmt.Sprintf("%s is spent or unknown", u.Outpoint))
+			continue
+		}
+
+		// The change of a payout not broadcast yet: count its inputs
+		payout, err := store.GetPayout(txid.String())
+		if errors.Is(err, storage.ErrNotFound) {
+			holdings.Missing = append(holdings.Missing, fmt.Sprintf("%s is the change of an unknown payout", u.Outpoint))
+			continue
+		}
+		if err != nil {
+			return holdings, err
+		}
+		inputs, err := heldInputs(store, report.PegKey, payout, source, params)
+		if err != nil {
+			holdings.Missing = append(holdings.Missing, fmt.Sprintf("%s: %v", u.Outpoint, err))
+			continue
+		}
+		holdings.Held += inputs
+		holdings.Pending = append(holdings.Pending, u.Outpoint)
+	}
+	return holdings, nil
+}
+
+// heldInputs returns the sats of the inputs of a payout, failing if any of
+// them is not unspent on Bitcoin.
+func heldInputs(store storage.Store, pegKey string, payout storage.PegOut, source OutputSource, params *chaincfg.Params) (int64, error) {
+	var held int64
+	for _, outpoint := range payout.Inputs {
+		utxo, err := store.GetPegUTXO(outpoint)
+		if err != nil {
+			return 0, fmt.Errorf("input %s: %w", outpoint, err)
+		}
+		script, err := expectedScript(pegKey, UTXO{Outpoint: utxo.Outpoint, Wallet: utxo.Wallet, Amount: utxo.Amount}, params)
+		if err != nil {
+			return 0, err
+		}
+		txid, vout, err := peg.ParseOutpoint(outpoint)
+		if err != nil {
+			return 0, err
+		}
+		out, err := source.UnspentOutput(txid, vout)
+		if err != nil {
+			return 0, err
+		}
+		if out == nil || out.Amount != utxo.Amount || !bytes.Equal(out.Script, script) {
+			return 0, fmt.Errorf("payout %s is not on Bitcoin and its input %s is not held either", payout.TxID, outpoint)
+		}
+		held += out.Amount
+	}
+	return held, nil
+}
+
+// expectedScript returns the script a peg UTXO pays: the deposit address of
+// its wallet, or the change script of the peg key.
+func expectedScript(pegKey string, u UTXO, params *chaincfg.Params) ([]byte, error) {
+	if u.Wallet == "" {
+		return peg.ChangeScript(pegKey)
+	}
+	address, err := peg.DeriveDepositAddress(pegKey, u.Wallet, params)
+	if err != nil {
+		return nil, fmt.Errorf("deposit address of %s: %w", u.Wallet, err)
+	}
+	return hex.DecodeString(address.Script)
+}
@@ -0,0 +1,162 @@
+// Package reserves proves that the sidechain supply is backed one to one by
+// the Bitcoin the peg holds. A Report states, as of one block, the supply,
+// every peg UTXO and every withdrawal burnt but not paid yet. Each credit
+// comes with a peg UTXO and each burn queues a withdrawal until a payout
+// spends UTXOs to pay it, so the UTXOs add up to the supply plus the queued
+// withdrawals.
+//
+// The leaders of the active group each compute the report of the same block
+// from their own database and sign its digest. Anyone can then check the
+// UTXOs of a report against a Bitcoin node with CheckHoldings, which is what
+// cmd/verifyreserves does with a snapshot of a node database.
+package reserves
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"bitcoin-sidechain/consensus"
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/storage"
+)
+
+// ErrUnbacked is returned by Report.Check when the peg UTXOs do not add up to
+// the supply and the queued withdrawals.
+var ErrUnbacked = errors.New("supply is not backed by the peg")
+
+// ErrRefused is returned by a leader asked to attest a report that differs
+// from its own, or that is not for its group.
+var ErrRefused = errors.New("reserves attestation refused")
+
+// ErrUnknownHeight is returned by a leader asked about a block it has not
+// reached or no longer remembers.
+var ErrUnknownHeight = errors.New("no reserves known at that height")
+
+// UTXO is a Bitcoin output the peg holds: a credited deposit, paid to the
+// deposit address of Wallet, or the change of a payout, with no wallet.
+type UTXO struct {
+	Outpoint string `json:"outpoint"`
+	Wallet   string `json:"wallet,omitempty"`
+	Amount   int64  `json:"amount"`
+}
+
+// Withdrawal is a withdrawal burnt on the sidechain and not paid yet.
+type Withdrawal struct {
+	TxID    string `json:"tx_id"`
+	Address string `json:"address"`
+	Amount  int64  `json:"amount"`
+}
+
+// Report is the statement the leaders sign: the reserves after the block at
+// Height, for the group Group of epoch Epoch to attest.
+type Report struct {
+	Height      int64        `json:"height"`
+	BlockHash   string       `json:"block_hash"`
+	Epoch       int64        `json:"epoch"`
+	Group       int          `json:"group"`
+	PegKey      string       `json:"peg_key"` // x-only, hex; empty before the first handoff
+	Supply      int64        `json:"supply"`
+	Reserves    int64        `json:"reserves"` // sum of the UTXOs
+	Pending     int64        `json:"pending"`  // sum of the withdrawals
+	UTXOs       []UTXO       `json:"utxos"`
+	Withdrawals []Withdrawal `json:"withdrawals"`
+}
+
+// NewReport returns the report of reserves read from a store, to be attested
+// by a group of an epoch.
+func NewReport(r storage.Reserves, epoch int64, group int, pegKey string) Report {
+	report := Report{
+		Height:      r.Height,
+		BlockHash:   r.BlockHash,
+		Epoch:       epoch,
+		Group:       group,
+		PegKey:      pegKey,
+		Supply:      r.Supply,
+		UTXOs:       []UTXO{},
+		Withdrawals: []Withdrawal{},
+	}
+	for _, u := range r.UTXOs {
+		report.UTXOs = append(report.UTXOs, UTXO{Outpoint: u.Outpoint, Wallet: u.Wallet, Amount: u.Amount})
+		report.Reserves += u.Amount
+	}
+	for _, w := range r.Withdrawals {
+		report.Withdrawals = append(report.Withdrawals, Withdrawal{TxID: w.TxID, Address: w.Address, Amount: w.Amount})
+		report.Pending += w.Amount
+	}
+	return report
+}
+
+// Digest returns the hex SHA-256 of the report as JSON, which is what the
+// leaders sign.
+func (r Report) Digest() string {
+	payload, _ := json.Marshal(r)
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// Check checks that the totals of the report match its lists and that the
+// UTXOs back the supply and the queued withdrawals.
+func (r Report) Check() error {
+	var reserves, pending int64
+	for _, u := range r.UTXOs {
+		reserves += u.Amount
+	}
+	for _, w := range r.Withdrawals {
+		pending += w.Amount
+	}
+	if reserves != r.Reserves || pending != r.Pending {
+		return fmt.Errorf("report lists %d sats of UTXOs and %d of withdrawals, its totals say %d and %d", reserves, pending, r.Reserves, r.Pending)
+	}
+	if r.Reserves != r.Supply+r.Pending {
+		return fmt.Errorf("%w: %d sats held for a supply of %d and %d to pay out", ErrUnbacked, r.Reserves, r.Supply, r.Pending)
+	}
+	return nil
+}
+
+// Attestation is a leader's signature over the digest of a report. A request
+// for one carries only the height and the digest.
+type Attestation struct {
+	Height    int64  `json:"height"`
+	Digest    string `json:"digest"`
+	Signer    string `json:"signer,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// SignBytes returns the canonical form of the attestation that is signed.
+func (a Attestation) SignBytes() []byte {
+	a.Signature = ""
+	payload, _ := json.Marshal(a)
+	return payload
+}
+
+// Verify checks the attestations of a report against the group of epoch that
+// should sign it, and returns how many distinct leaders signed. It fails if
+// any attestation is invalid or fewer than a quorum of the group signed.
+func Verify(report Report, epoch storage.Epoch, attestations []Attestation) (int, error) {
+	if epoch.Number != report.Epoch {
+		return 0, fmt.Errorf("report is for epoch %d, not %d", report.Epoch, epoch.Number)
+	}
+	leaders := consensus.NewValidators(epoch, report.Group)
+	digest := report.Digest()
+	signers := make(map[string]bool)
+	for _, a := range attestations {
+		if a.Height != report.Height || a.Digest != digest {
+			return 0, fmt.Errorf("attestation by %s is for another report", a.Signer)
+		}
+		member, ok := leaders.Get(a.Signer)
+		if !ok {
+			return 0, fmt.Errorf("%s is not a leader of group %d of epoch %d", a.Signer, report.Group, report.Epoch)
+		}
+		if err := cryptoUtils.VerifyMessage(member.PublicKey, a.SignBytes(), a.Signature); err != nil {
+			return 0, fmt.Errorf("attestation by %s: %w", a.Signer, err)
+		}
+		signers[a.Signer] = true
+	}
+	if len(signers) < leaders.Quorum() {
+		return len(signers), fmt.Errorf("%d of the %d leaders signed, %d needed", len(signers), leaders.Size(), leaders.Quorum())
+	}
+	return len(signers), nil
+}
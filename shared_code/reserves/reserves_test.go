@@ -0,0 +1,317 @@
+package reserves_test
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"bitcoin-sidechain/cryptoUtils"
+	"bitcoin-sidechain/epoch"
+	"bitcoin-sidechain/peg"
+	"bitcoin-sidechain/reserves"
+	"bitcoin-sidechain/storage"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+const confirmations = 3
+
+// fakeTransport reaches the auditors of the other nodes directly. Nodes in
+// down do not answer, and nodes in forge sign with the key given instead of
+// their own.
+type fakeTransport struct {
+	mu       sync.Mutex
+	auditors map[string]*reserves.Auditor
+	down     map[string]bool
+	forge    map[string]*btcec.PrivateKey
+}
+
+func (f *fakeTransport) Attest(peer storage.EpochMember, request reserves.Attestation) (reserves.Attestation, error) {
+	f.mu.Lock()
+	auditor, down, forger := f.auditors[peer.ComputerID], f.down[peer.ComputerID], f.forge[peer.ComputerID]
+	f.mu.Unlock()
+	if auditor == nil || down {
+		return reserves.Attestation{}, errors.New("connection refused")
+	}
+	attestation, err := auditor.Attest(request)
+	if err == nil && forger != nil {
+		attestation.Signature = cryptoUtils.SignMessage(forger, attestation.SignBytes())
+	}
+	return attestation, err
+}
+
+// network is a chain of 8 nodes in two groups of 4, with one deposit
+// credited, and the auditors of its nodes.
+type network struct {
+	store     storage.Store
+	bitcoin   *peg.FakeBackend
+	epochs    *epoch.Manager
+	watcher   *peg.Watcher
+	keys      map[string]*btcec.PrivateKey // by computer id
+	transport *fakeTransport
+	epoch     storage.Epoch
+}
+
+func newNetwork(t *testing.T) *network {
+	t.Helper()
+	store, err := storage.Open("sqlite3", filepath.Join(t.TempDir(), "node.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	n := &network{
+		store:     store,
+		bitcoin:   peg.NewFakeBackend(),
+		epochs:    epoch.NewManager(store, 100, 4),
+		keys:      make(map[string]*btcec.PrivateKey),
+		transport: &fakeTransport{auditors: make(map[string]*reserves.Auditor), down: make(map[string]bool), forge: make(map[string]*btcec.PrivateKey)},
+	}
+	genesis := storage.Genesis{}
+	for i := 1; i <= 8; i++ {
+		key := newKey(t)
+		id := cryptoUtils.NodeID(key.PubKey())
+		n.keys[id] = key
+		genesis.Nodes = append(genesis.Nodes, storage.GenesisNode{ComputerID: id, IPAddress: fmt.Sprintf("10.0.0.%d:8080", i), PublicKey: cryptoUtils.PublicKeyBase64(key)})
+	}
+	if _, err := store.ApplyGenesis(genesis); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.epochs.Advance(); err != nil {
+		t.Fatal(err)
+	}
+	if n.epoch, err = store.GetEpoch(0); err != nil {
+		t.Fatal(err)
+	}
+
+	pegKey := newKey(t)
+	_, err = store.CompleteHandoff(storage.CustodyKey{
+		Epoch:       1,
+		GroupKey:    hex.EncodeToString(schnorr.SerializePubKey(pegKey.PubKey())),
+		PublicKeys:  json.RawMessage(`{}`),
+		Certificate: json.RawMessage(`[]`),
+		CreatedAt:   time.Now().Unix(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Credit a deposit of 50000 sats
+	n.bitcoin.Mine(10)
+	n.watcher = peg.NewWatcher(store, n.bitcoin, nil, peg.Config{Network: &chaincfg.RegressionNetParams, Confirmations: confirmations, StartHeight: 1})
+	wallet := base64.StdEncoding.EncodeToString(newKey(t).PubKey().SerializeCompressed())
+	address, err := n.watcher.Address(wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, _ := hex.DecodeString(address.Script)
+	n.bitcoin.Pay(script, 50000)
+	n.bitcoin.Mine(confirmations)
+	if err := n.watcher.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	n.produce(t)
+	if balance, err := store.GetBalance(wallet); err != nil || balance != 50000 {
+		t.Fatalf("deposit credited %d, %v; expected 50000", balance, err)
+	}
+
+	for id, key := range n.keys {
+		n.transport.auditors[id] = n.auditor(key)
+	}
+	return n
+}
+
+// produce commits a block with the deposits that are ready.
+func (n *network) produce(t *testing.T) {
+	t.Helper()
+	if _, _, err := n.store.ProduceBlock("reservestest", time.Now().Unix(), nil, storage.MembershipChanges{}, n.watcher.Ready()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// auditor returns a new auditor for a node, with nothing remembered.
+func (n *network) auditor(key *btcec.PrivateKey) *reserves.Auditor {
+	return reserves.New(n.store, n.epochs, n.watcher, key, n.transport)
+}
+
+// member returns the computer id and key of the first member of a group.
+func (n *network) member(group int) (string, *btcec.PrivateKey) {
+	id := n.epoch.Group(group)[0].ComputerID
+	return id, n.keys[id]
+}
+
+func newKey(t *testing.T) *btcec.PrivateKey {
+	t.Helper()
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestReportCheck(t *testing.T) {
+	n := newNetwork(t)
+	_, key := n.member(1)
+	report, err := n.auditor(key).Take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Supply != 50000 || report.Reserves != 50000 || len(report.UTXOs) != 1 || report.Pending != 0 {
+		t.Fatalf("report is %+v, expected one UTXO of 50000 for a supply of 50000", report)
+	}
+	if err := report.Check(); err != nil {
+		t.Fatalf("report of a backed chain: %v", err)
+	}
+
+	withdrawal := reserves.Withdrawal{TxID: "burn", Address: "bcrt1qaddress", Amount: 1000}
+	tests := []struct {
+		name     string
+		change   func(r *reserves.Report)
+		unbacked bool
+		fails    bool
+	}{
+		{"supply above the reserves", func(r *reserves.Report) { r.Supply++ }, true, true},
+		{"withdrawal not held", func(r *reserves.Report) {
+			r.Withdrawals, r.Pending = append(r.Withdrawals, withdrawal), withdrawal.Amount
+		}, true, true},
+		{"withdrawal burnt from the supply", func(r *reserves.Report) {
+			r.Withdrawals, r.Pending, r.Supply = append(r.Withdrawals, withdrawal), withdrawal.Amount, r.Supply-withdrawal.Amount
+		}, false, false},
+		{"UTXO total that does not add up", func(r *reserves.Report) { r.Reserves++; r.Supply++ }, false, true},
+		{"withdrawal total that does not add up", func(r *reserves.Report) { r.Pending++ }, false, true},
+	}
+	for _, test := range tests {
+		changed := report
+		changed.UTXOs = append([]reserves.UTXO{}, report.UTXOs...)
+		changed.Withdrawals = append([]reserves.Withdrawal{}, report.Withdrawals...)
+		test.change(&changed)
+		err := changed.Check()
+		if (err != nil) != test.fails || errors.Is(err, reserves.ErrUnbacked) != test.unbacked {
+			t.Errorf("%s: got %v, expected failure %v, ErrUnbacked %v", test.name, err, test.fails, test.unbacked)
+		}
+	}
+
+	// The UTXO is on Bitcoin, and a report that claims more is not
+	holdings, err := reserves.CheckHoldings(n.store, report, n.bitcoin, &chaincfg.RegressionNetParams)
+	if err != nil || holdings.Held != 50000 || len(holdings.Missing) != 0 {
+		t.Errorf("holdings are %+v, %v; expected 50000 held", holdings, err)
+	}
+	inflated := report
+	inflated.UTXOs = []reserves.UTXO{report.UTXOs[0]}
+	inflated.UTXOs[0].Amount++
+	holdings, err = reserves.CheckHoldings(n.store, inflated, n.bitcoin, &chaincfg.RegressionNetParams)
+	if err != nil || holdings.Held != 0 || len(holdings.Missing) != 1 {
+		t.Errorf("holdings of an inflated UTXO are %+v, %v; expected it missing", holdings, err)
+	}
+}
+
+func TestAttestRefuses(t *testing.T) {
+	n := newNetwork(t)
+	leaderID, leaderKey := n.member(1)
+	_, standbyKey := n.member(2)
+	leader, standby := n.auditor(leaderKey), n.auditor(standbyKey)
+	report, err := leader.Take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := reserves.Attestation{Height: report.Height, Digest: report.Digest()}
+
+	attestation, err := leader.Attest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attestation.Signer != leaderID {
+		t.Errorf("attestation signed by %s, expected %s", attestation.Signer, leaderID)
+	}
+	if err := cryptoUtils.VerifyMessage(cryptoUtils.PublicKeyBase64(leaderKey), attestation.SignBytes(), attestation.Signature); err != nil {
+		t.Errorf("attestation signature: %v", err)
+	}
+
+	if _, err := leader.Attest(reserves.Attestation{Height: report.Height, Digest: "00"}); !errors.Is(err, reserves.ErrRefused) {
+		t.Errorf("other digest: got %v, expected ErrRefused", err)
+	}
+	if _, err := leader.Attest(reserves.Attestation{Height: report.Height + 1, Digest: request.Digest}); !errors.Is(err, reserves.ErrUnknownHeight) {
+		t.Errorf("height not reached: got %v, expected ErrUnknownHeight", err)
+	}
+	if _, err := standby.Attest(request); !errors.Is(err, reserves.ErrRefused) {
+		t.Errorf("node of the standby group: got %v, expected ErrRefused", err)
+	}
+
+	// A leader still attests a height it has moved past
+	n.produce(t)
+	if _, err := leader.Attest(request); err != nil {
+		t.Errorf("height the leader moved past: %v", err)
+	}
+	if _, err := n.auditor(leaderKey).Attest(request); !errors.Is(err, reserves.ErrUnknownHeight) {
+		t.Errorf("height a new leader never saw: got %v, expected ErrUnknownHeight", err)
+	}
+}
+
+// A statement carries the attestations of the leaders that agree, and Verify
+// accepts it only with a quorum of distinct leaders of the group.
+func TestStatementQuorum(t *testing.T) {
+	n := newNetwork(t)
+	leaders := n.epoch.Group(1)
+	asker, askerKey := n.member(2)
+
+	// One of the 4 leaders is down: 3 attest, which is a quorum
+	n.transport.down[leaders[0].ComputerID] = true
+	statement, err := n.auditor(askerKey).Statement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statement.Backed || statement.Quorum != 3 || len(statement.Attestations) != 3 {
+		t.Fatalf("statement is backed %v with %d attestations for a quorum of %d; expected backed with 3 of 3", statement.Backed, len(statement.Attestations), statement.Quorum)
+	}
+	outpoint := statement.Report.UTXOs[0].Outpoint
+	if depth := statement.Confirmations[outpoint]; depth < confirmations {
+		t.Errorf("deposit %s has %d confirmations, expected at least %d", outpoint, depth, confirmations)
+	}
+	if signers, err := reserves.Verify(statement.Report, n.epoch, statement.Attestations); err != nil || signers != 3 {
+		t.Errorf("verify: %d signers, %v; expected 3", signers, err)
+	}
+
+	// The same leader twice counts once
+	twice := append(append([]reserves.Attestation{}, statement.Attestations[:2]...), statement.Attestations[0])
+	if _, err := reserves.Verify(statement.Report, n.epoch, twice); err == nil {
+		t.Error("verify counted a leader twice")
+	}
+
+	// Attestations by a standby node or with a forged signature are refused
+	standby := reserves.Attestation{Height: statement.Report.Height, Digest: statement.Digest, Signer: asker}
+	standby.Signature = cryptoUtils.SignMessage(askerKey, standby.SignBytes())
+	if _, err := reserves.Verify(statement.Report, n.epoch, append(statement.Attestations, standby)); err == nil {
+		t.Error("verify accepted an attestation by a standby node")
+	}
+	forged := statement.Attestations[0]
+	forged.Signature = cryptoUtils.SignMessage(askerKey, forged.SignBytes())
+	if _, err := reserves.Verify(statement.Report, n.epoch, []reserves.Attestation{forged, statement.Attestations[1], statement.Attestations[2]}); err == nil {
+		t.Error("verify accepted a forged attestation")
+	}
+	other := statement.Report
+	other.Supply++
+	if _, err := reserves.Verify(other, n.epoch, statement.Attestations); err == nil {
+		t.Error("verify accepted the attestations of another report")
+	}
+
+	// With a forger as well, only 2 valid attestations are left
+	n.transport.forge[leaders[1].ComputerID] = askerKey
+	statement, err = n.auditor(askerKey).Statement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statement.Attestations) != 2 {
+		t.Fatalf("statement has %d attestations, expected the 2 valid ones", len(statement.Attestations))
+	}
+	if signers, err := reserves.Verify(statement.Report, n.epoch, statement.Attestations); err == nil || signers != 2 {
+		t.Errorf("verify without a quorum: %d signers, %v; expected 2 and an error", signers, err)
+	}
+}
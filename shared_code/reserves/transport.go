@@ -0,0 +1,99 @@
+package reserves
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"bitcoin-sidechain/networkUtils"
+	"bitcoin-sidechain/storage"
+)
+
+// maxAttestationSize bounds an attestation request or answer.
+const maxAttestationSize = 4 << 10
+
+// HTTPTransport asks leaders for attestations over POST /reserves/attest.
+type HTTPTransport struct {
+	Outbound *networkUtils.Outbound
+}
+
+// NewHTTPTransport returns a transport that reaches leaders through outbound.
+func NewHTTPTransport(outbound *networkUtils.Outbound) *HTTPTransport {
+	return &HTTPTransport{Outbound: outbound}
+}
+
+// Attest asks a leader to sign the digest of a report.
+func (t *HTTPTransport) Attest(peer storage.EpochMember, request Attestation) (Attestation, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return Attestation{}, fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := t.Outbound.NewRequest(http.MethodPost, peer.IPAddress, "/reserves/attest", bytes.NewReader(body))
+	if err != nil {
+		return Attestation{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.Outbound.Open(req)
+	if err != nil {
+		return Attestation{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return Attestation{}, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	var attestation Attestation
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxAttestationSize)).Decode(&attestation); err != nil {
+		return Attestation{}, fmt.Errorf("failed to decode answer: %w", err)
+	}
+	return attestation, nil
+}
+
+// AttestHandler returns the POST /reserves/attest endpoint, where a node asks
+// a leader to sign the digest of its report.
+func AttestHandler(a *Auditor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request Attestation
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxAttestationSize)).Decode(&request); err != nil {
+			http.Error(w, "Invalid attestation request", http.StatusBadRequest)
+			return
+		}
+		attestation, err := a.Attest(request)
+		switch {
+		case errors.Is(err, ErrRefused):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, ErrUnknownHeight):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			fmt.Println("Reserves: error attesting:", err)
+			http.Error(w, "Failed to attest", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(attestation); err != nil {
+			fmt.Println("Error encoding response:", err)
+		}
+	}
+}
+
+// Handler returns the GET /reserves endpoint: the supply, the peg UTXOs with
+// their confirmations and the pending peg-outs, attested by the leaders.
+func Handler(a *Auditor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statement, err := a.Statement()
+		if err != nil {
+			fmt.Println("Reserves: error taking statement:", err)
+			http.Error(w, "Failed to report reserves", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statement); err != nil {
+			fmt.Println("Error encoding response:", err)
+		}
+	}
+}
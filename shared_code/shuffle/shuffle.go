@@ -0,0 +1,102 @@
+// Package shuffle implements the deterministic shuffle used to pick leader
+// groups. Every node must produce byte-identical results from the same seed,
+// on any platform and any Go version, so the algorithm is fully specified
+// here and does not depend on math/rand or any other library generator.
+//
+// The stream: block i is SHA-256(seed || i), where i is a 64-bit big-endian
+// counter starting at 0. The stream is the concatenation of blocks 0, 1, 2, ...
+// and is read 8 bytes at a time as big-endian uint64 values.
+//
+// Uniform integers: to draw from [0, n), read values r from the stream until
+// r >= 2^64 mod n, then return r mod n. Rejecting the low values leaves a
+// range whose size is a multiple of n, so there is no modulo bias.
+//
+// The shuffle: Fisher-Yates from the end. For i from n-1 down to 1, draw j
+// from [0, i+1) and swap elements i and j.
+//
+// Leader groups use the hash of the block that starts their epoch as the
+// seed (64 zero hex digits for epoch 0) and shuffle the nodes sorted by
+// computer_id. vectors.json holds published test vectors;
+// cmd/shufflevectors checks this implementation against them.
+package shuffle
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Stream is the SHA-256 counter-mode byte stream over a seed.
+type Stream struct {
+	seed    []byte
+	counter uint64
+	block   []byte // unread bytes of the current block
+}
+
+// NewStream returns the stream for a seed.
+func NewStream(seed []byte) *Stream {
+	return &Stream{seed: append([]byte(nil), seed...)}
+}
+
+// Read fills p with the next bytes of the stream. It never fails.
+func (s *Stream) Read(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		if len(s.block) == 0 {
+			s.block = s.nextBlock()
+		}
+		copied := copy(p[n:], s.block)
+		s.block = s.block[copied:]
+		n += copied
+	}
+	return len(p), nil
+}
+
+// nextBlock hashes the seed with the next counter value.
+func (s *Stream) nextBlock() []byte {
+	input := make([]byte, len(s.seed)+8)
+	copy(input, s.seed)
+	binary.BigEndian.PutUint64(input[len(s.seed):], s.counter)
+	s.counter++
+	block := sha256.Sum256(input)
+	return block[:]
+}
+
+// Uint64 returns the next 8 bytes of the stream as a big-endian integer.
+func (s *Stream) Uint64() uint64 {
+	var buf [8]byte
+	s.Read(buf[:])
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// Intn returns a uniform integer in [0, n). It panics if n <= 0.
+func (s *Stream) Intn(n int) int {
+	if n <= 0 {
+		panic("shuffle: invalid argument to Intn")
+	}
+	bound := uint64(n)
+	threshold := -bound % bound // 2^64 mod n
+	for {
+		if r := s.Uint64(); r >= threshold {
+			return int(r % bound)
+		}
+	}
+}
+
+// Shuffle permutes n elements with Fisher-Yates driven by the stream over
+// seed. swap exchanges the elements with indexes i and j.
+func Shuffle(seed []byte, n int, swap func(i, j int)) {
+	stream := NewStream(seed)
+	for i := n - 1; i > 0; i-- {
+		j := stream.Intn(i + 1)
+		swap(i, j)
+	}
+}
+
+// Permutation returns the shuffled order of the indexes 0..n-1.
+func Permutation(seed []byte, n int) []int {
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	Shuffle(seed, n, func(i, j int) { perm[i], perm[j] = perm[j], perm[i] })
+	return perm
+}
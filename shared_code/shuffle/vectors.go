@@ -0,0 +1,68 @@
+package shuffle
+
+import (
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+//go:embed vectors.json
+var vectorsJSON []byte
+
+// Vector is one published test vector: the first 64 bytes of the stream over
+// Seed and the permutation of N elements.
+type Vector struct {
+	Seed        string `json:"seed"`
+	Stream      string `json:"stream"`
+	N           int    `json:"n"`
+	Permutation []int  `json:"permutation"`
+}
+
+// Compute builds the vector for a hex seed and a number of elements.
+func Compute(seedHex string, n int) (Vector, error) {
+	seed, err := hex.DecodeString(seedHex)
+	if err != nil {
+		return Vector{}, fmt.Errorf("invalid seed %q: %w", seedHex, err)
+	}
+	stream := make([]byte, 64)
+	NewStream(seed).Read(stream)
+	return Vector{
+		Seed:        seedHex,
+		Stream:      hex.EncodeToString(stream),
+		N:           n,
+		Permutation: Permutation(seed, n),
+	}, nil
+}
+
+// Vectors returns the published test vectors.
+func Vectors() ([]Vector, error) {
+	var vectors []Vector
+	if err := json.Unmarshal(vectorsJSON, &vectors); err != nil {
+		return nil, fmt.Errorf("failed to parse test vectors: %w", err)
+	}
+	return vectors, nil
+}
+
+// CheckVectors recomputes every published vector and returns an error
+// describing the first one that differs.
+func CheckVectors() error {
+	vectors, err := Vectors()
+	if err != nil {
+		return err
+	}
+	for i, want := range vectors {
+		got, err := Compute(want.Seed, want.N)
+		if err != nil {
+			return fmt.Errorf("vector %d: %w", i, err)
+		}
+		if got.Stream != want.Stream {
+			return fmt.Errorf("vector %d: stream %s, expected %s", i, got.Stream, want.Stream)
+		}
+		if !slices.Equal(got.Permutation, want.Permutation) {
+			return fmt.Errorf("vector %d: permutation %v, expected %v", i, got.Permutation, want.Permutation)
+		}
+	}
+	return nil
+}
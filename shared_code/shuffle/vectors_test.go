@@ -0,0 +1,16 @@
+package shuffle
+
+import "testing"
+
+func TestVectors(t *testing.T) {
+	vectors, err := Vectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("no published vectors")
+	}
+	if err := CheckVectors(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,492 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ZeroHash is the previous hash of the first block.
+var ZeroHash = strings.Repeat("0", 64)
+
+// Block is a batch of transfers applied to wallet_balances together. Blocks
+// are chained by PrevHash and numbered from 1.
+type Block struct {
+	Height    int64      `json:"height"`
+	Hash      string     `json:"hash"`
+	PrevHash  string     `json:"prev_hash"`
+	Timestamp int64      `json:"timestamp"`
+	TxRoot    string     `json:"tx_root"`
+	StateRoot string     `json:"state_root"`
+	Producer  string     `json:"producer"`
+	Transfers []Transfer `json:"transactions"`
+
+	// Admissions are the nodes the block admits into the nodes table. They
+	// are covered by the hash through their root. Evictions are the nodes it
+	// removes from the nodes table and Excluded the nodes it leaves out of
+	// the leader groups of the epoch it starts.
+	Admissions []Admission `json:"admissions,omitempty"`
+	Evictions  []string    `json:"evictions,omitempty"`
+	Excluded   []string    `json:"excluded,omitempty"`
+
+	// Deposits are the Bitcoin deposits the block credits, covered by the
+	// hash through their DepositRoot.
+	Deposits []Deposit `json:"deposits,omitempty"`
+
+	// Payouts are the signed Bitcoin transactions that pay withdrawals,
+	// covered by the hash through their PayoutRoot.
+	Payouts []Payout `json:"payouts,omitempty"`
+
+	// Certificate proves the block was committed by the leader group. It is
+	// not part of the hash; blocks produced without consensus have none.
+	Certificate json.RawMessage `json:"certificate,omitempty"`
+}
+
+// BlockHash returns the hex SHA-256 of the canonical block header. The
+// transfers are covered through TxRoot, and the admissions, deposits and
+// payouts, if there are any, through their AdmissionRoot, DepositRoot and
+// PayoutRoot. Evictions and exclusions are in the header when there are any.
+func BlockHash(block Block) string {
+	var admissionRoot, depositRoot, payoutRoot string
+	if len(block.Admissions) > 0 {
+		admissionRoot = AdmissionRoot(block.Admissions)
+	}
+	if len(block.Deposits) > 0 {
+		depositRoot = DepositRoot(block.Deposits)
+	}
+	if len(block.Payouts) > 0 {
+		payoutRoot = PayoutRoot(block.Payouts)
+	}
+	header, _ := json.Marshal(struct {
+		Height        int64    `json:"height"`
+		PrevHash      string   `json:"prev_hash"`
+		Timestamp     int64    `json:"timestamp"`
+		TxRoot        string   `json:"tx_root"`
+		StateRoot     string   `json:"state_root"`
+		Producer      string   `json:"producer"`
+		AdmissionRoot string   `json:"admission_root,omitempty"`
+		Evictions     []string `json:"evictions,omitempty"`
+		Excluded      []string `json:"excluded,omitempty"`
+		DepositRoot   string   `json:"deposit_root,omitempty"`
+		PayoutRoot    string   `json:"payout_root,omitempty"`
+	}{block.Height, block.PrevHash, block.Timestamp, block.TxRoot, block.StateRoot, block.Producer, admissionRoot, block.Evictions, block.Excluded, depositRoot, payoutRoot})
+	hash := sha256.Sum256(header)
+	return hex.EncodeToString(hash[:])
+}
+
+// TxRoot returns the hex SHA-256 of the JSON array of tx ids, in block order.
+func TxRoot(transfers []Transfer) string {
+	ids := make([]string, len(transfers))
+	for i, t := range transfers {
+		ids[i] = t.TxID
+	}
+	payload, _ := json.Marshal(ids)
+	hash := sha256.Sum256(payload)
+	return hex.EncodeToString(hash[:])
+}
+
+// StateRoot returns the hex SHA-256 of every non-zero wallet balance as a JSON
+// array of {"wallet","balance"} objects sorted by wallet. Sorting is done
+// here rather than in SQL because MySQL and SQLite collate differently, and
+// empty wallets are left out because any node can create one locally.
+func StateRoot(balances map[string]int64) string {
+	type entry struct {
+		Wallet  string `json:"wallet"`
+		Balance int64  `json:"balance"`
+	}
+	entries := []entry{}
+	for wallet, balance := range balances {
+		if balance != 0 {
+			entries = append(entries, entry{wallet, balance})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Wallet < entries[j].Wallet })
+	payload, _ := json.Marshal(entries)
+	hash := sha256.Sum256(payload)
+	return hex.EncodeToString(hash[:])
+}
+
+// ErrInvalidBlock is returned by VerifyBlock and CommitBlock when a block does
+// not follow the latest block or does not reproduce its own hashes.
+var ErrInvalidBlock = errors.New("invalid block")
+
+// ProduceBlock applies a batch of transfers, membership changes, deposits and
+// payouts on top of the latest block and stores the result as the next block, in a
+// single transaction. Transfers that are no longer valid (used nonce, missing
+// sender, insufficient funds) are left out of the block and returned in
+// rejected, keyed by tx id, and so are membership changes that no longer
+// apply, keyed by computer_id, deposits already credited, keyed by outpoint,
+// and payouts that pay or spend something twice, keyed by txid; any other error aborts the whole block. It is used when the node
+// produces blocks on its own, without consensus.
+func (s *sqlStore) ProduceBlock(producer string, timestamp int64, transfers []Transfer, changes MembershipChanges, peg PegChanges) (block Block, rejected map[string]error, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Block{}, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	// Rollback if something goes wrong
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	block, rejected, err = s.buildBlock(tx, producer, timestamp, transfers, changes, peg)
+	if err != nil {
+		return Block{}, nil, err
+	}
+	if err = s.insertBlock(tx, block); err != nil {
+		return Block{}, nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Block{}, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return block, rejected, nil
+}
+
+// BuildBlock works out the next block like ProduceBlock but stores nothing.
+// It is used to make a block proposal.
+func (s *sqlStore) BuildBlock(producer string, timestamp int64, transfers []Transfer, changes MembershipChanges, peg PegChanges) (Block, map[string]error, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Block{}, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	return s.buildBlock(tx, producer, timestamp, transfers, changes, peg)
+}
+
+// VerifyBlock checks that a block follows the latest block and that applying
+// its transfers reproduces its tx root, state root and hash. It stores nothing.
+func (s *sqlStore) VerifyBlock(block Block) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	return s.replayBlock(tx, block)
+}
+
+// CommitBlock verifies a block like VerifyBlock and stores it, with its
+// certificate, as the next block in a single transaction.
+func (s *sqlStore) CommitBlock(block Block) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	// Rollback if something goes wrong
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = s.replayBlock(tx, block); err != nil {
+		return err
+	}
+	if err = s.insertBlock(tx, block); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// latestHeader reads the height, hash and timestamp of the latest block
+// inside an open transaction. Before the first block it returns height 0 and
+// the zero hash.
+func (s *sqlStore) latestHeader(tx *sql.Tx) (height int64, hash string, timestamp int64, err error) {
+	err = tx.QueryRow("SELECT height, hash, created_at FROM blocks ORDER BY height DESC LIMIT 1"+s.dialect.forUpdate).
+		Scan(&height, &hash, &timestamp)
+	if err == sql.ErrNoRows {
+		return 0, ZeroHash, 0, nil
+	}
+	if err != nil {
+		return 0, "", 0, fmt.Errorf("failed to read latest block: %w", err)
+	}
+	return height, hash, timestamp, nil
+}
+
+// buildBlock applies transfers, membership changes, deposits and payouts on
+// top of the latest block inside an open transaction and seals the resulting
+// block, leaving out rejected ones. Rejected changes are keyed by computer_id,
+// rejected deposits by outpoint and rejected payouts by txid.
+func (s *sqlStore) buildBlock(tx *sql.Tx, producer string, timestamp int64, transfers []Transfer, changes MembershipChanges, peg PegChanges) (Block, map[string]error, error) {
+	// Build on the latest block, or start the chain
+	height, prevHash, prevTimestamp, err := s.latestHeader(tx)
+	if err != nil {
+		return Block{}, nil, err
+	}
+	if timestamp < prevTimestamp {
+		timestamp = prevTimestamp
+	}
+	block := Block{Height: height + 1, PrevHash: prevHash, Timestamp: timestamp, Producer: producer, Transfers: []Transfer{}}
+
+	// Apply each transfer under a savepoint so a rejected one can be undone
+	// without losing the rest of the block
+	rejected := make(map[string]error)
+	for _, transfer := range transfers {
+		if transfer.Amount <= 0 {
+			rejected[transfer.TxID] = fmt.Errorf("%w: %d", ErrInvalidAmount, transfer.Amount)
+			continue
+		}
+		transfer.BlockHeight = block.Height
+		transfer.Timestamp = block.Timestamp
+
+		if _, err = tx.Exec("SAVEPOINT block_transfer"); err != nil {
+			return Block{}, nil, fmt.Errorf("failed to create savepoint: %w", err)
+		}
+		logged, applyErr := s.applyTransfer(tx, transfer)
+		switch {
+		case applyErr == nil:
+			block.Transfers = append(block.Transfers, logged)
+			_, err = tx.Exec("RELEASE SAVEPOINT block_transfer")
+		case errors.Is(applyErr, ErrNonceUsed), errors.Is(applyErr, ErrNotFound), errors.Is(applyErr, ErrInsufficientFunds):
+			rejected[transfer.TxID] = applyErr
+			_, err = tx.Exec("ROLLBACK TO SAVEPOINT block_transfer")
+		default:
+			return Block{}, nil, applyErr
+		}
+		if err != nil {
+			return Block{}, nil, fmt.Errorf("failed to close savepoint: %w", err)
+		}
+	}
+
+	// Apply the membership changes that still apply, keeping their order
+	applied, err := s.applyMembership(tx, block.Height, changes, rejected)
+	if err != nil {
+		return Block{}, nil, err
+	}
+	block.Admissions, block.Evictions, block.Excluded = applied.Admissions, applied.Evictions, applied.Excluded
+
+	// Credit the deposits not credited yet
+	block.Deposits, err = s.applyDeposits(tx, block.Height, block.Timestamp, peg.Deposits, rejected)
+	if err != nil {
+		return Block{}, nil, err
+	}
+
+	// Record the payouts that pay and spend nothing twice
+	block.Payouts, err = s.applyPayouts(tx, block.Height, peg.Payouts, rejected)
+	if err != nil {
+		return Block{}, nil, err
+	}
+
+	// Seal the block over the resulting balances
+	balances, err := s.balances(tx)
+	if err != nil {
+		return Block{}, nil, err
+	}
+	block.TxRoot = TxRoot(block.Transfers)
+	block.StateRoot = StateRoot(balances)
+	block.Hash = BlockHash(block)
+	return block, rejected, nil
+}
+
+// replayBlock applies every transfer of a block received from another node
+// inside an open transaction and checks the block against the result. Unlike
+// buildBlock, any rejected transfer makes the whole block invalid.
+func (s *sqlStore) replayBlock(tx *sql.Tx, block Block) error {
+	height, prevHash, prevTimestamp, err := s.latestHeader(tx)
+	if err != nil {
+		return err
+	}
+	if block.Height != height+1 {
+		return fmt.Errorf("%w: height %d, expected %d", ErrInvalidBlock, block.Height, height+1)
+	}
+	if block.PrevHash != prevHash {
+		return fmt.Errorf("%w: previous hash %s, expected %s", ErrInvalidBlock, block.PrevHash, prevHash)
+	}
+	if block.Timestamp < prevTimestamp {
+		return fmt.Errorf("%w: timestamp %d is before the previous block", ErrInvalidBlock, block.Timestamp)
+	}
+
+	for _, transfer := range block.Transfers {
+		if transfer.TxID != TransferID(transfer.From, transfer.To, transfer.Amount, transfer.Nonce) {
+			return fmt.Errorf("%w: transfer %s does not match its id", ErrInvalidBlock, transfer.TxID)
+		}
+		if transfer.Amount <= 0 {
+			return fmt.Errorf("%w: transfer %s: %w", ErrInvalidBlock, transfer.TxID, ErrInvalidAmount)
+		}
+		transfer.BlockHeight = block.Height
+		transfer.Timestamp = block.Timestamp
+		if _, err := s.applyTransfer(tx, transfer); err != nil {
+			if errors.Is(err, ErrNonceUsed) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrInsufficientFunds) {
+				return fmt.Errorf("%w: transfer %s: %w", ErrInvalidBlock, transfer.TxID, err)
+			}
+			return err
+		}
+	}
+	changes := MembershipChanges{Admissions: block.Admissions, Evictions: block.Evictions, Excluded: block.Excluded}
+	if _, err := s.applyMembership(tx, block.Height, changes, nil); err != nil {
+		return err
+	}
+	if _, err := s.applyDeposits(tx, block.Height, block.Timestamp, block.Deposits, nil); err != nil {
+		return err
+	}
+	if _, err := s.applyPayouts(tx, block.Height, block.Payouts, nil); err != nil {
+		return err
+	}
+
+	balances, err := s.balances(tx)
+	if err != nil {
+		return err
+	}
+	if root := TxRoot(block.Transfers); block.TxRoot != root {
+		return fmt.Errorf("%w: tx root %s, expected %s", ErrInvalidBlock, block.TxRoot, root)
+	}
+	if root := StateRoot(balances); block.StateRoot != root {
+		return fmt.Errorf("%w: state root %s, expected %s", ErrInvalidBlock, block.StateRoot, root)
+	}
+	if hash := BlockHash(block); block.Hash != hash {
+		return fmt.Errorf("%w: hash %s, expected %s", ErrInvalidBlock, block.Hash, hash)
+	}
+	return nil
+}
+
+// insertBlock stores a sealed block inside an open transaction.
+func (s *sqlStore) insertBlock(tx *sql.Tx, block Block) error {
+	var certificate interface{}
+	if len(block.Certificate) > 0 {
+		certificate = string(block.Certificate)
+	}
+	admissions, err := optionalJSON(block.Admissions, len(block.Admissions))
+	if err != nil {
+		return fmt.Errorf("failed to encode admissions of block %d: %w", block.Height, err)
+	}
+	evictions, err := optionalJSON(block.Evictions, len(block.Evictions))
+	if err != nil {
+		return fmt.Errorf("failed to encode evictions of block %d: %w", block.Height, err)
+	}
+	excluded, err := optionalJSON(block.Excluded, len(block.Excluded))
+	if err != nil {
+		return fmt.Errorf("failed to encode exclusions of block %d: %w", block.Height, err)
+	}
+	deposits, err := optionalJSON(block.Deposits, len(block.Deposits))
+	if err != nil {
+		return fmt.Errorf("failed to encode deposits of block %d: %w", block.Height, err)
+	}
+	payouts, err := optionalJSON(block.Payouts, len(block.Payouts))
+	if err != nil {
+		return fmt.Errorf("failed to encode payouts of block %d: %w", block.Height, err)
+	}
+	_, err = tx.Exec(`INSERT INTO blocks (height, hash, prev_hash, created_at, tx_root, state_root, producer, tx_count, certificate, admissions, evictions, excluded, deposits, payouts)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		block.Height, block.Hash, block.PrevHash, block.Timestamp, block.TxRoot, block.StateRoot, block.Producer, len(block.Transfers), certificate, admissions, evictions, excluded, deposits, payouts)
+	if err != nil {
+		return fmt.Errorf("failed to insert block %d: %w", block.Height, err)
+	}
+	return nil
+}
+
+// optionalJSON encodes a list of n items for a nullable column, as NULL when
+// it is empty.
+func optionalJSON(list interface{}, n int) (interface{}, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	payload, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+	return string(payload), nil
+}
+
+// balances reads every wallet balance inside an open transaction.
+func (s *sqlStore) balances(tx *sql.Tx) (map[string]int64, error) {
+	rows, err := tx.Query("SELECT wallet, COALESCE(balance, 0) FROM wallet_balances")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query wallet balances: %w", err)
+	}
+	defer rows.Close()
+
+	balances := make(map[string]int64)
+	for rows.Next() {
+		var wallet string
+		var balance int64
+		if err := rows.Scan(&wallet, &balance); err != nil {
+			return nil, fmt.Errorf("failed to scan wallet balance: %w", err)
+		}
+		balances[wallet] = balance
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through wallet balances: %w", err)
+	}
+	return balances, nil
+}
+
+// GetBlock returns the block at a height with its transfers, or ErrNotFound.
+func (s *sqlStore) GetBlock(height int64) (Block, error) {
+	var block Block
+	var certificate, admissions, evictions, excluded, deposits, payouts sql.NullString
+	err := s.db.QueryRow(`SELECT height, hash, prev_hash, created_at, tx_root, state_root, producer, certificate, admissions, evictions, excluded, deposits, payouts
+		FROM blocks
+		WHERE height = ?`, height).
+		Scan(&block.Height, &block.Hash, &block.PrevHash, &block.Timestamp, &block.TxRoot, &block.StateRoot, &block.Producer, &certificate, &admissions, &evictions, &excluded, &deposits, &payouts)
+	if err == sql.ErrNoRows {
+		return Block{}, ErrNotFound
+	}
+	if err != nil {
+		return Block{}, fmt.Errorf("failed to query block %d: %w", height, err)
+	}
+	if certificate.Valid && certificate.String != "" {
+		block.Certificate = json.RawMessage(certificate.String)
+	}
+	for _, column := range []struct {
+		name  string
+		value sql.NullString
+		into  interface{}
+	}{
+		{"admissions", admissions, &block.Admissions},
+		{"evictions", evictions, &block.Evictions},
+		{"exclusions", excluded, &block.Excluded},
+		{"deposits", deposits, &block.Deposits},
+		{"payouts", payouts, &block.Payouts},
+	} {
+		if column.value.Valid && column.value.String != "" {
+			if err := json.Unmarshal([]byte(column.value.String), column.into); err != nil {
+				return Block{}, fmt.Errorf("failed to decode %s of block %d: %w", column.name, height, err)
+			}
+		}
+	}
+
+	// The log entries that credit deposits have no sender and are not
+	// transfers of the block
+	rows, err := s.db.Query(`SELECT seq, tx_id, from_wallet, to_wallet, amount, nonce, signature, created_at, block_height
+		FROM transactions
+		WHERE block_height = ? AND from_wallet <> ''
+		ORDER BY seq`, height)
+	if err != nil {
+		return Block{}, fmt.Errorf("failed to query transactions of block %d: %w", height, err)
+	}
+	defer rows.Close()
+	block.Transfers, err = scanTransfers(rows)
+	if err != nil {
+		return Block{}, err
+	}
+	if block.Transfers == nil {
+		block.Transfers = []Transfer{}
+	}
+	return block, nil
+}
+
+// LatestBlock returns the highest block, or ErrNotFound if none was produced yet.
+func (s *sqlStore) LatestBlock() (Block, error) {
+	var height sql.NullInt64
+	if err := s.db.QueryRow("SELECT MAX(height) FROM blocks").Scan(&height); err != nil {
+		return Block{}, fmt.Errorf("failed to query latest block: %w", err)
+	}
+	if !height.Valid {
+		return Block{}, ErrNotFound
+	}
+	return s.GetBlock(height.Int64)
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// CustodyKey is a completed handoff of the peg key to the custodians of an
+// epoch. PublicKeys holds the group key with the verifying share of every
+// custodian, and Certificate the confirmations of the custodians that
+// finished the transcript with hash Transcript.
+type CustodyKey struct {
+	Epoch       int64           `json:"epoch"`
+	GroupKey    string          `json:"group_key"` // x-only, hex
+	PublicKeys  json.RawMessage `json:"public_keys"`
+	Transcript  string          `json:"transcript"`
+	Certificate json.RawMessage `json:"certificate"`
+	CreatedAt   int64           `json:"created_at"`
+}
+
+// CustodyShare is this node's secret share of the key of an epoch.
+type CustodyShare struct {
+	Epoch     int64
+	SignerID  int
+	KeyShare  json.RawMessage
+	CreatedAt int64
+}
+
+// CompleteHandoff stores a completed handoff together with this node's share
+// of it, if it holds one, and deletes its shares of earlier epochs, in a
+// single transaction. It returns false and changes nothing if a handoff to
+// that epoch is already stored.
+func (s *sqlStore) CompleteHandoff(key CustodyKey, share *CustodyShare) (saved bool, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	result, err := tx.Exec(s.dialect.insertIgnore+` INTO custody_keys (epoch, group_key, public_keys, transcript, certificate, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		key.Epoch, key.GroupKey, string(key.PublicKeys), key.Transcript, string(key.Certificate), key.CreatedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert custody key of epoch %d: %w", key.Epoch, err)
+	}
+	added, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to insert custody key of epoch %d: %w", key.Epoch, err)
+	}
+	if added == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	if share != nil {
+		if _, err = tx.Exec("DELETE FROM custody_shares WHERE epoch = ?", share.Epoch); err != nil {
+			return false, fmt.Errorf("failed to replace custody share: %w", err)
+		}
+		_, err = tx.Exec("INSERT INTO custody_shares (epoch, signer_id, key_share, created_at) VALUES (?, ?, ?, ?)",
+			share.Epoch, share.SignerID, string(share.KeyShare), share.CreatedAt)
+		if err != nil {
+			return false, fmt.Errorf("failed to insert custody share: %w", err)
+		}
+	}
+
+	// Shares of earlier keys must not outlive the handoff
+	if _, err = tx.Exec("DELETE FROM custody_shares WHERE epoch < ?", key.Epoch); err != nil {
+		return false, fmt.Errorf("failed to delete old custody shares: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return true, nil
+}
+
+// LatestCustodyKey returns the latest completed handoff, or ErrNotFound.
+func (s *sqlStore) LatestCustodyKey() (CustodyKey, error) {
+	return s.custodyKey("SELECT epoch, group_key, public_keys, transcript, certificate, created_at FROM custody_keys ORDER BY epoch DESC LIMIT 1")
+}
+
+// GetCustodyKey returns the handoff to an epoch, or ErrNotFound.
+func (s *sqlStore) GetCustodyKey(epoch int64) (CustodyKey, error) {
+	return s.custodyKey("SELECT epoch, group_key, public_keys, transcript, certificate, created_at FROM custody_keys WHERE epoch = ?", epoch)
+}
+
+func (s *sqlStore) custodyKey(query string, args ...interface{}) (CustodyKey, error) {
+	var key CustodyKey
+	var publicKeys, certificate string
+	err := s.db.QueryRow(query, args...).Scan(&key.Epoch, &key.GroupKey, &publicKeys, &key.Transcript, &certificate, &key.CreatedAt)
+	if err == sql.ErrNoRows {
+		return CustodyKey{}, ErrNotFound
+	}
+	if err != nil {
+		return CustodyKey{}, fmt.Errorf("failed to query custody key: %w", err)
+	}
+	key.PublicKeys = json.RawMessage(publicKeys)
+	key.Certificate = json.RawMessage(certificate)
+	return key, nil
+}
+
+// GetCustodyShare returns this node's share of the key of an epoch, or
+// ErrNotFound.
+func (s *sqlStore) GetCustodyShare(epoch int64) (CustodyShare, error) {
+	var share CustodyShare
+	var keyShare string
+	err := s.db.QueryRow("SELECT epoch, signer_id, key_share, created_at FROM custody_shares WHERE epoch = ?", epoch).
+		Scan(&share.Epoch, &share.SignerID, &keyShare, &share.CreatedAt)
+	if err == sql.ErrNoRows {
+		return CustodyShare{}, ErrNotFound
+	}
+	if err != nil {
+		return CustodyShare{}, fmt.Errorf("failed to query custody share: %w", err)
+	}
+	share.KeyShare = json.RawMessage(keyShare)
+	return share, nil
+}
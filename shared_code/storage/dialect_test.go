@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDialect is a database the dialect suite runs against.
+type testDialect struct {
+	name   string
+	driver string
+	fresh  func(t *testing.T) string // returns the DSN of an empty database
+}
+
+// testDialects returns SQLite and, when TEST_MYSQL_DSN names a scratch MySQL
+// database, MySQL. Every table of that database is dropped before each test.
+func testDialects() []testDialect {
+	dialects := []testDialect{{
+		name:   "sqlite",
+		driver: "sqlite3",
+		fresh: func(t *testing.T) string {
+			return filepath.Join(t.TempDir(), "node.db")
+		},
+	}}
+	if dsn := os.Getenv("TEST_MYSQL_DSN"); dsn != "" {
+		dialects = append(dialects, testDialect{
+			name:   "mysql",
+			driver: "mysql",
+			fresh: func(t *testing.T) string {
+				resetMySQL(t, dsn)
+				return dsn
+			},
+		})
+	}
+	return dialects
+}
+
+// resetMySQL drops every table of the MySQL database named by dsn.
+func resetMySQL(t *testing.T, dsn string) {
+	t.Helper()
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// FOREIGN_KEY_CHECKS is per connection
+	db.SetMaxOpenConns(1)
+
+	rows, err := db.Query("SHOW TABLES")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("SET FOREIGN_KEY_CHECKS = 0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if _, err := db.Exec("DROP TABLE `" + table + "`"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// forEachDialect runs test once per dialect on an empty database, which open
+// opens. It may be opened more than once.
+func forEachDialect(t *testing.T, test func(t *testing.T, open func() (Store, error))) {
+	for _, d := range testDialects() {
+		t.Run(d.name, func(t *testing.T) {
+			dsn := d.fresh(t)
+			test(t, func() (Store, error) { return Open(d.driver, dsn) })
+		})
+	}
+}
+
+func mustOpen(t *testing.T, open func() (Store, error)) Store {
+	t.Helper()
+	store, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestMigrationsMatchAcrossDialects(t *testing.T) {
+	mysqlMigrations, err := loadMigrations("mysql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqliteMigrations, err := loadMigrations("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mysqlMigrations) != len(sqliteMigrations) {
+		t.Fatalf("%d MySQL migrations, %d SQLite ones", len(mysqlMigrations), len(sqliteMigrations))
+	}
+	for i := range mysqlMigrations {
+		if mysqlMigrations[i].name != sqliteMigrations[i].name {
+			t.Errorf("migration %d is %s for MySQL and %s for SQLite", i+1, mysqlMigrations[i].name, sqliteMigrations[i].name)
+		}
+	}
+}
+
+func TestDialectMigrations(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, open func() (Store, error)) {
+		store := mustOpen(t, open)
+		migrations, err := loadMigrations(store.(*sqlStore).dialect.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		latest := migrations[len(migrations)-1].version
+		if version, err := store.SchemaVersion(); err != nil || version != latest {
+			t.Fatalf("schema version %d, %v; expected %d", version, err, latest)
+		}
+
+		// Opening again applies nothing
+		if version, err := mustOpen(t, open).SchemaVersion(); err != nil || version != latest {
+			t.Fatalf("schema version after reopening %d, %v; expected %d", version, err, latest)
+		}
+		var applied int
+		if err := store.(*sqlStore).db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+			t.Fatal(err)
+		}
+		if applied != len(migrations) {
+			t.Errorf("%d migrations recorded, expected %d", applied, len(migrations))
+		}
+
+		// A database migrated by a newer node is left alone
+		if _, err := store.(*sqlStore).db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+			latest+1, "future", time.Now().Unix()); err != nil {
+			t.Fatal(err)
+		}
+		if newer, err := open(); !errors.Is(err, ErrSchemaTooNew) {
+			if err == nil {
+				newer.Close()
+			}
+			t.Errorf("opening a newer schema: got %v, expected ErrSchemaTooNew", err)
+		}
+	})
+}
+
+// The statements built with insertIgnore skip rows that already exist on
+// both dialects.
+func TestDialectInsertIgnore(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, open func() (Store, error)) {
+		store := mustOpen(t, open)
+		genesis := Genesis{Wallets: []GenesisWallet{{Wallet: "alice", Balance: 10}, {Wallet: "bob"}}}
+		if applied, err := store.ApplyGenesis(genesis); err != nil || !applied {
+			t.Fatalf("genesis: %v, %v", applied, err)
+		}
+		if applied, err := store.ApplyGenesis(genesis); err != nil || applied {
+			t.Fatalf("second genesis: %v, %v", applied, err)
+		}
+		if created, err := store.CreateWallet("carol"); err != nil || !created {
+			t.Fatalf("new wallet: %v, %v", created, err)
+		}
+		if created, err := store.CreateWallet("carol"); err != nil || created {
+			t.Fatalf("existing wallet: %v, %v", created, err)
+		}
+
+		// The recipient is created once, and a nonce is consumed once
+		if _, err := store.ApplyTransfer(Transfer{From: "alice", To: "dave", Amount: 3, Nonce: "n1"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.ApplyTransfer(Transfer{From: "alice", To: "dave", Amount: 2, Nonce: "n2"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.ApplyTransfer(Transfer{From: "alice", To: "bob", Amount: 1, Nonce: "n1"}); !errors.Is(err, ErrNonceUsed) {
+			t.Fatalf("reused nonce: got %v, expected ErrNonceUsed", err)
+		}
+		for wallet, want := range map[string]int64{"alice": 5, "bob": 0, "dave": 5} {
+			if got, err := store.GetBalance(wallet); err != nil || got != want {
+				t.Errorf("wallet %s has %d, %v; expected %d", wallet, got, err, want)
+			}
+		}
+
+		registration := Registration{IPAddress: "10.0.0.1:80", PublicKey: "key", RegisteredBy: "node", Nonce: "nonce", Signature: "signature"}
+		if err := store.AddAllToBuffer([]Registration{registration, registration}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AddAllToBuffer([]Registration{registration}); err != nil {
+			t.Fatal(err)
+		}
+		if buffered, err := store.ListBuffer(); err != nil || len(buffered) != 1 {
+			t.Errorf("buffer holds %d registrations, %v; expected 1", len(buffered), err)
+		}
+	})
+}
+
+// The rows read with forUpdate stay locked until the transaction ends, so
+// concurrent writers on both dialects neither overspend nor deadlock.
+func TestDialectRowLocks(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, open func() (Store, error)) {
+		store := mustOpen(t, open)
+		genesis := Genesis{Wallets: []GenesisWallet{{Wallet: "alice", Balance: 20}, {Wallet: "bob", Balance: 20}}}
+		if _, err := store.ApplyGenesis(genesis); err != nil {
+			t.Fatal(err)
+		}
+
+		// alice and bob pay each other and both pay the same new wallets
+		var wg sync.WaitGroup
+		errs := make(chan error, 200)
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				from, to := "alice", "bob"
+				if i%2 == 1 {
+					from, to = to, from
+				}
+				if i%4 >= 2 {
+					to = fmt.Sprintf("new-%d", i%5)
+				}
+				_, err := store.ApplyTransfer(Transfer{From: from, To: to, Amount: 1, Nonce: fmt.Sprintf("lock-%d", i)})
+				if err != nil && !errors.Is(err, ErrInsufficientFunds) {
+					errs <- err
+				}
+			}(i)
+		}
+
+		// Blocks built at the same time each extend the one before
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, _, err := store.ProduceBlock("producer", 1, nil, MembershipChanges{}, PegChanges{}); err != nil {
+					errs <- err
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+
+		if supply, err := store.TotalSupply(); err != nil || supply != 40 {
+			t.Errorf("total supply is %d, %v; expected 40", supply, err)
+		}
+		balances, err := store.ListBalances()
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed, err := ReplayLedger(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for wallet, balance := range balances {
+			if balance < 0 || replayed[wallet] != balance {
+				t.Errorf("wallet %s has %d, the log gives %d", wallet, balance, replayed[wallet])
+			}
+		}
+
+		prevHash := ZeroHash
+		for height := int64(1); height <= 5; height++ {
+			block, err := store.GetBlock(height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.PrevHash != prevHash {
+				t.Errorf("block %d builds on %s, expected %s", height, block.PrevHash, prevHash)
+			}
+			prevHash = block.Hash
+		}
+		if latest, err := store.LatestBlock(); err != nil || latest.Height != 5 {
+			t.Errorf("latest block is %d, %v; expected 5", latest.Height, err)
+		}
+	})
+}
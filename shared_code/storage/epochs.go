@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Epoch is one leader rotation period: the shuffle seed, the group each node
+// was assigned to, the group that is currently leading and the failovers
+// that moved the lead to a standby group.
+type Epoch struct {
+	Number      int64         `json:"epoch"`
+	StartHeight int64         `json:"start_height"`
+	Seed        string        `json:"seed"`
+	GroupSize   int           `json:"group_size"`
+	ActiveGroup int           `json:"active_group"`
+	CreatedAt   int64         `json:"created_at"`
+	Members     []EpochMember `json:"members"`
+	Failovers   []Failover    `json:"failovers"`
+}
+
+// Failover records a standby group taking the lead from a stalled group.
+// ToGroup decides every height from Height on, for the rest of the epoch or
+// until the next failover. Certificate holds the signed timeout votes that
+// justify it.
+type Failover struct {
+	Epoch       int64           `json:"epoch"`
+	Seq         int             `json:"seq"`
+	Height      int64           `json:"height"`
+	FromGroup   int             `json:"from_group"`
+	ToGroup     int             `json:"to_group"`
+	Certificate json.RawMessage `json:"certificate"`
+	CreatedAt   int64           `json:"created_at"`
+}
+
+// EpochMember is the place of one node in an epoch.
+type EpochMember struct {
+	ComputerID string `json:"computer_id"`
+	IPAddress  string `json:"ip_address"`
+	SortOrder  int    `json:"sort_order"`
+	NodeGroup  int    `json:"node_group"`
+	PublicKey  string `json:"public_key"`
+}
+
+// Group returns the members of a group in sort order.
+func (e Epoch) Group(group int) []EpochMember {
+	var members []EpochMember
+	for _, member := range e.Members {
+		if member.NodeGroup == group {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// Leaders returns the members of the active group.
+func (e Epoch) Leaders() []EpochMember {
+	return e.Group(e.ActiveGroup)
+}
+
+// Groups returns the number of groups in the epoch.
+func (e Epoch) Groups() int {
+	groups := 0
+	for _, member := range e.Members {
+		if member.NodeGroup > groups {
+			groups = member.NodeGroup
+		}
+	}
+	return groups
+}
+
+// GroupAt returns the group that decides a height: group 1, or the group the
+// latest failover at or below that height handed the lead to.
+func (e Epoch) GroupAt(height int64) int {
+	group := 1
+	for _, failover := range e.Failovers {
+		if failover.Height <= height {
+			group = failover.ToGroup
+		}
+	}
+	return group
+}
+
+// SaveEpoch stores an epoch with its members and writes the same order and
+// groups to the nodes table, in a single transaction. The members are taken
+// from nodes; any other row of the nodes table, such as a node admitted after
+// the epoch started, is left without a group.
+func (s *sqlStore) SaveEpoch(epoch Epoch, nodes []Node) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if epoch.CreatedAt == 0 {
+		epoch.CreatedAt = time.Now().Unix()
+	}
+	_, err = tx.Exec(`INSERT INTO epochs (epoch, start_height, seed, group_size, active_group, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		epoch.Number, epoch.StartHeight, epoch.Seed, epoch.GroupSize, epoch.ActiveGroup, epoch.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert epoch %d: %w", epoch.Number, err)
+	}
+
+	for _, node := range nodes {
+		_, err = tx.Exec(`INSERT INTO epoch_groups (epoch, computer_id, ip_address, sort_order, node_group, public_key)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			epoch.Number, node.ComputerID, node.IPAddress, node.SortOrder, node.NodeGroup, node.PublicKey)
+		if err != nil {
+			return fmt.Errorf("failed to insert member %s of epoch %d: %w", node.ComputerID, epoch.Number, err)
+		}
+	}
+
+	if _, err = tx.Exec("UPDATE nodes SET sort_order = NULL, node_group = NULL"); err != nil {
+		return fmt.Errorf("failed to clear node groups: %w", err)
+	}
+	for _, node := range nodes {
+		_, err = tx.Exec("UPDATE nodes SET sort_order = ?, node_group = ? WHERE computer_id = ?",
+			node.SortOrder, node.NodeGroup, node.ComputerID)
+		if err != nil {
+			return fmt.Errorf("failed to assign node %s: %w", node.ComputerID, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetEpoch returns an epoch with its members, or ErrNotFound.
+func (s *sqlStore) GetEpoch(number int64) (Epoch, error) {
+	var epoch Epoch
+	err := s.db.QueryRow(`SELECT epoch, start_height, seed, group_size, active_group, created_at
+		FROM epochs
+		WHERE epoch = ?`, number).
+		Scan(&epoch.Number, &epoch.StartHeight, &epoch.Seed, &epoch.GroupSize, &epoch.ActiveGroup, &epoch.CreatedAt)
+	if err == sql.ErrNoRows {
+		return Epoch{}, ErrNotFound
+	}
+	if err != nil {
+		return Epoch{}, fmt.Errorf("failed to query epoch %d: %w", number, err)
+	}
+
+	rows, err := s.db.Query(`SELECT computer_id, ip_address, sort_order, node_group, public_key
+		FROM epoch_groups
+		WHERE epoch = ?
+		ORDER BY sort_order`, number)
+	if err != nil {
+		return Epoch{}, fmt.Errorf("failed to query members of epoch %d: %w", number, err)
+	}
+	defer rows.Close()
+
+	epoch.Members = []EpochMember{}
+	for rows.Next() {
+		var member EpochMember
+		if err := rows.Scan(&member.ComputerID, &member.IPAddress, &member.SortOrder, &member.NodeGroup, &member.PublicKey); err != nil {
+			return Epoch{}, fmt.Errorf("failed to scan epoch member: %w", err)
+		}
+		epoch.Members = append(epoch.Members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return Epoch{}, fmt.Errorf("encountered error while iterating through epoch members: %w", err)
+	}
+
+	if epoch.Failovers, err = s.failovers(number); err != nil {
+		return Epoch{}, err
+	}
+	return epoch, nil
+}
+
+// failovers returns the failovers of an epoch in the order they happened.
+func (s *sqlStore) failovers(number int64) ([]Failover, error) {
+	rows, err := s.db.Query(`SELECT epoch, seq, height, from_group, to_group, certificate, created_at
+		FROM epoch_failovers
+		WHERE epoch = ?
+		ORDER BY seq`, number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query failovers of epoch %d: %w", number, err)
+	}
+	defer rows.Close()
+
+	failovers := []Failover{}
+	for rows.Next() {
+		var failover Failover
+		var certificate string
+		if err := rows.Scan(&failover.Epoch, &failover.Seq, &failover.Height, &failover.FromGroup, &failover.ToGroup, &certificate, &failover.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan failover: %w", err)
+		}
+		failover.Certificate = json.RawMessage(certificate)
+		failovers = append(failovers, failover)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through failovers: %w", err)
+	}
+	return failovers, nil
+}
+
+// SaveFailover stores a failover and makes its group the active group of the
+// epoch. Failovers are numbered from 0 within an epoch; storing a number
+// twice fails, so two nodes racing to store the same failover cannot both win.
+func (s *sqlStore) SaveFailover(failover Failover) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if failover.CreatedAt == 0 {
+		failover.CreatedAt = time.Now().Unix()
+	}
+	_, err = tx.Exec(`INSERT INTO epoch_failovers (epoch, seq, height, from_group, to_group, certificate, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		failover.Epoch, failover.Seq, failover.Height, failover.FromGroup, failover.ToGroup, string(failover.Certificate), failover.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert failover %d of epoch %d: %w", failover.Seq, failover.Epoch, err)
+	}
+
+	result, err := tx.Exec("UPDATE epochs SET active_group = ? WHERE epoch = ?", failover.ToGroup, failover.Epoch)
+	if err != nil {
+		return fmt.Errorf("failed to update active group of epoch %d: %w", failover.Epoch, err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		err = ErrNotFound
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// LatestEpoch returns the highest stored epoch, or ErrNotFound if none was
+// stored yet.
+func (s *sqlStore) LatestEpoch() (Epoch, error) {
+	var number sql.NullInt64
+	if err := s.db.QueryRow("SELECT MAX(epoch) FROM epochs").Scan(&number); err != nil {
+		return Epoch{}, fmt.Errorf("failed to query latest epoch: %w", err)
+	}
+	if !number.Valid {
+		return Epoch{}, ErrNotFound
+	}
+	return s.GetEpoch(number.Int64)
+}
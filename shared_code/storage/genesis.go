@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Genesis is the optional seed data for a new chain: starting wallet
+// balances and the first entries of the node list.
+type Genesis struct {
+	Wallets []GenesisWallet `json:"wallets"`
+	Nodes   []GenesisNode   `json:"nodes"`
+}
+
+// GenesisWallet is a wallet and its starting balance.
+type GenesisWallet struct {
+	Wallet  string `json:"wallet"`
+	Balance int64  `json:"balance"`
+}
+
+// GenesisNode is a node that is part of the network from the start.
+type GenesisNode struct {
+	ComputerID string `json:"computer_id"`
+	IPAddress  string `json:"ip_address"`
+	PublicKey  string `json:"public_key"`
+}
+
+// LoadGenesis reads a genesis file.
+func LoadGenesis(filename string) (Genesis, error) {
+	var genesis Genesis
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return genesis, fmt.Errorf("failed to read genesis file: %w", err)
+	}
+	if err := json.Unmarshal(data, &genesis); err != nil {
+		return genesis, fmt.Errorf("failed to parse genesis file: %w", err)
+	}
+	return genesis, nil
+}
+
+// ApplyGenesis seeds an empty database. It does nothing and returns false if
+// the database already holds wallets or nodes.
+func (s *sqlStore) ApplyGenesis(genesis Genesis) (applied bool, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var count int
+	err = tx.QueryRow("SELECT (SELECT COUNT(*) FROM wallet_balances) + (SELECT COUNT(*) FROM nodes)").Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for existing data: %w", err)
+	}
+	if count > 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	for _, wallet := range genesis.Wallets {
+		if _, err = tx.Exec("INSERT INTO wallet_balances (wallet, balance) VALUES (?, ?)", wallet.Wallet, wallet.Balance); err != nil {
+			return false, fmt.Errorf("failed to seed wallet %s: %w", wallet.Wallet, err)
+		}
+		// Log the starting balance so replaying the log reproduces it
+		if wallet.Balance > 0 {
+			if _, err = s.appendTransfer(tx, Transfer{To: wallet.Wallet, Amount: wallet.Balance, Nonce: "genesis"}); err != nil {
+				return false, err
+			}
+		}
+	}
+	for i, node := range genesis.Nodes {
+		if _, err = tx.Exec("INSERT INTO nodes (sort_order, computer_id, ip_address, node_group, reachable, public_key) VALUES (?, ?, ?, 1, 1, ?)",
+			i+1, node.ComputerID, node.IPAddress, node.PublicKey); err != nil {
+			return false, fmt.Errorf("failed to seed node %s: %w", node.ComputerID, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return true, nil
+}
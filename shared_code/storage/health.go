@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// HealthWindow is the number of latest probes a node's success rate is
+// computed over.
+const HealthWindow = 64
+
+// NodeHealth is the liveness of a node as seen by this node. A node that was
+// never probed has Since 0.
+type NodeHealth struct {
+	ComputerID string `json:"computer_id"`
+	IPAddress  string `json:"ip_address"`
+	Reachable  bool   `json:"reachable"`
+	Since      int64  `json:"since"`      // first probe
+	LastCheck  int64  `json:"last_check"` // latest probe
+	LastSeen   int64  `json:"last_seen"`  // latest probe that passed
+	Failures   int    `json:"consecutive_failures"`
+	Checks     int    `json:"checks"`
+	History    string `json:"history"` // latest probes, oldest first: '1' passed, '0' failed
+}
+
+// SuccessRate returns the share of the probes in History that passed, or 1
+// for a node that was never probed.
+func (h NodeHealth) SuccessRate() float64 {
+	if h.History == "" {
+		return 1
+	}
+	return float64(strings.Count(h.History, "1")) / float64(len(h.History))
+}
+
+// NodeProbe is the result of probing a node at a unix time.
+type NodeProbe struct {
+	ComputerID string
+	OK         bool
+	At         int64
+}
+
+// RecordNodeProbes records the results of a sweep of probes and sets the
+// reachable flag of each node to match, in a single transaction.
+func (s *sqlStore) RecordNodeProbes(probes []NodeProbe) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, probe := range probes {
+		if err = s.recordNodeProbe(tx, probe); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// recordNodeProbe records the result of one probe inside an open
+// transaction.
+func (s *sqlStore) recordNodeProbe(tx *sql.Tx, probe NodeProbe) error {
+	if _, err := tx.Exec(s.dialect.insertIgnore+" INTO node_health (computer_id, since) VALUES (?, ?)", probe.ComputerID, probe.At); err != nil {
+		return fmt.Errorf("failed to create health of node %s: %w", probe.ComputerID, err)
+	}
+	var history string
+	err := tx.QueryRow("SELECT history FROM node_health WHERE computer_id = ?"+s.dialect.forUpdate, probe.ComputerID).Scan(&history)
+	if err != nil {
+		return fmt.Errorf("failed to read health of node %s: %w", probe.ComputerID, err)
+	}
+
+	// Keep the latest HealthWindow results
+	if probe.OK {
+		history += "1"
+	} else {
+		history += "0"
+	}
+	if len(history) > HealthWindow {
+		history = history[len(history)-HealthWindow:]
+	}
+
+	if probe.OK {
+		_, err = tx.Exec("UPDATE node_health SET last_check = ?, last_seen = ?, failures = 0, checks = checks + 1, history = ? WHERE computer_id = ?",
+			probe.At, probe.At, history, probe.ComputerID)
+	} else {
+		_, err = tx.Exec("UPDATE node_health SET last_check = ?, failures = failures + 1, checks = checks + 1, history = ? WHERE computer_id = ?",
+			probe.At, history, probe.ComputerID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update health of node %s: %w", probe.ComputerID, err)
+	}
+	if _, err := tx.Exec("UPDATE nodes SET reachable = ? WHERE computer_id = ?", probe.OK, probe.ComputerID); err != nil {
+		return fmt.Errorf("failed to update reachable status of node %s: %w", probe.ComputerID, err)
+	}
+	return nil
+}
+
+// ListNodeHealth returns the health of every node in the nodes table ordered
+// by computer_id, with zero values for nodes that were never probed.
+func (s *sqlStore) ListNodeHealth() ([]NodeHealth, error) {
+	rows, err := s.db.Query(`
+		SELECT n.computer_id, COALESCE(n.ip_address, ''), n.reachable,
+			COALESCE(h.since, 0), COALESCE(h.last_check, 0), COALESCE(h.last_seen, 0),
+			COALESCE(h.failures, 0), COALESCE(h.checks, 0), COALESCE(h.history, '')
+		FROM nodes n
+		LEFT JOIN node_health h ON h.computer_id = n.computer_id
+		ORDER BY n.computer_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query node health: %w", err)
+	}
+	defer rows.Close()
+
+	var list []NodeHealth
+	for rows.Next() {
+		var h NodeHealth
+		if err := rows.Scan(&h.ComputerID, &h.IPAddress, &h.Reachable, &h.Since, &h.LastCheck, &h.LastSeen, &h.Failures, &h.Checks, &h.History); err != nil {
+			return nil, fmt.Errorf("failed to scan node health: %w", err)
+		}
+		list = append(list, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through node health: %w", err)
+	}
+	return list, nil
+}
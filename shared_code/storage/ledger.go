@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transfer is one entry of the append-only transactions log. Seq is assigned
+// by the store when the entry is appended, and so is Timestamp unless the
+// transfer belongs to a block. An empty From means the sats were created
+// (genesis or an opening balance). BlockHeight is 0 for transfers applied
+// outside a block.
+type Transfer struct {
+	Seq         int64  `json:"seq"`
+	TxID        string `json:"tx_id"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Amount      int64  `json:"amount"`
+	Nonce       string `json:"nonce"`
+	Signature   string `json:"signature"`
+	Timestamp   int64  `json:"timestamp"`
+	BlockHeight int64  `json:"block_height"`
+}
+
+// TransferID returns the id of a transfer: the hex SHA-256 of its canonical
+// payload, a JSON object with sorted keys and the amount as a string, which is
+// the same form the wallet page signs.
+func TransferID(from string, to string, amount int64, nonce string) string {
+	payload, _ := json.Marshal(map[string]string{
+		"amount": strconv.FormatInt(amount, 10),
+		"from":   from,
+		"nonce":  nonce,
+		"to":     to,
+	})
+	hash := sha256.Sum256(payload)
+	return hex.EncodeToString(hash[:])
+}
+
+// appendTransfer writes a transfer to the transactions log inside an open
+// transaction and returns it with its sequence number and timestamp.
+func (s *sqlStore) appendTransfer(tx *sql.Tx, transfer Transfer) (Transfer, error) {
+	if transfer.TxID == "" {
+		transfer.TxID = TransferID(transfer.From, transfer.To, transfer.Amount, transfer.Nonce)
+	}
+	if transfer.BlockHeight == 0 {
+		transfer.Timestamp = time.Now().Unix()
+	}
+
+	result, err := tx.Exec(`INSERT INTO transactions (tx_id, from_wallet, to_wallet, amount, nonce, signature, created_at, block_height)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		transfer.TxID, transfer.From, transfer.To, transfer.Amount, transfer.Nonce, transfer.Signature, transfer.Timestamp, transfer.BlockHeight)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to append transfer %s to the log: %w", transfer.TxID, err)
+	}
+	transfer.Seq, err = result.LastInsertId()
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to read sequence number of transfer %s: %w", transfer.TxID, err)
+	}
+	return transfer, nil
+}
+
+// internalNonce makes a nonce for transfers that are not signed by a wallet,
+// such as MoveSats.
+func internalNonce() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return "internal-" + hex.EncodeToString(random), nil
+}
+
+// ListTransfers returns up to limit log entries with a sequence number greater
+// than afterSeq, oldest first.
+func (s *sqlStore) ListTransfers(afterSeq int64, limit int) ([]Transfer, error) {
+	rows, err := s.db.Query(`SELECT seq, tx_id, from_wallet, to_wallet, amount, nonce, signature, created_at, block_height
+		FROM transactions
+		WHERE seq > ?
+		ORDER BY seq
+		LIMIT ?`, afterSeq, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query transactions: %w", err)
+	}
+	defer rows.Close()
+	return scanTransfers(rows)
+}
+
+// HistoryQuery selects the log entries of one wallet for ListWalletTransfers.
+type HistoryQuery struct {
+	Wallet    string
+	Direction string // "in", "out" or "" for both
+	Since     int64  // unix seconds, inclusive; 0 for no lower bound
+	Until     int64  // unix seconds, inclusive; 0 for no upper bound
+	BeforeSeq int64  // cursor: only entries older than this seq; 0 to start at the newest
+	Limit     int
+}
+
+// ListWalletTransfers returns the incoming and outgoing log entries of a
+// wallet, newest first.
+func (s *sqlStore) ListWalletTransfers(query HistoryQuery) ([]Transfer, error) {
+	conditions := []string{}
+	args := []interface{}{}
+
+	switch query.Direction {
+	case "in":
+		conditions = append(conditions, "to_wallet = ?")
+		args = append(args, query.Wallet)
+	case "out":
+		conditions = append(conditions, "from_wallet = ?")
+		args = append(args, query.Wallet)
+	case "":
+		conditions = append(conditions, "(from_wallet = ? OR to_wallet = ?)")
+		args = append(args, query.Wallet, query.Wallet)
+	default:
+		return nil, fmt.Errorf("invalid direction: %s", query.Direction)
+	}
+	if query.Since > 0 {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, query.Since)
+	}
+	if query.Until > 0 {
+		conditions = append(conditions, "created_at <= ?")
+		args = append(args, query.Until)
+	}
+	if query.BeforeSeq > 0 {
+		conditions = append(conditions, "seq < ?")
+		args = append(args, query.BeforeSeq)
+	}
+	args = append(args, query.Limit)
+
+	rows, err := s.db.Query(`SELECT seq, tx_id, from_wallet, to_wallet, amount, nonce, signature, created_at, block_height
+		FROM transactions
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY seq DESC
+		LIMIT ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query wallet transactions: %w", err)
+	}
+	defer rows.Close()
+	return scanTransfers(rows)
+}
+
+// scanTransfers reads rows selected in the column order used by ListTransfers.
+func scanTransfers(rows *sql.Rows) ([]Transfer, error) {
+	var transfers []Transfer
+	for rows.Next() {
+		var t Transfer
+		if err := rows.Scan(&t.Seq, &t.TxID, &t.From, &t.To, &t.Amount, &t.Nonce, &t.Signature, &t.Timestamp, &t.BlockHeight); err != nil {
+			return nil, fmt.Errorf("failed to scan transaction: %w", err)
+		}
+		transfers = append(transfers, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through transactions: %w", err)
+	}
+	return transfers, nil
+}
+
+// ListBalances returns every row of wallet_balances.
+func (s *sqlStore) ListBalances() (map[string]int64, error) {
+	rows, err := s.db.Query("SELECT wallet, COALESCE(balance, 0) FROM wallet_balances")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query wallet balances: %w", err)
+	}
+	defer rows.Close()
+
+	balances := make(map[string]int64)
+	for rows.Next() {
+		var wallet string
+		var balance int64
+		if err := rows.Scan(&wallet, &balance); err != nil {
+			return nil, fmt.Errorf("failed to scan wallet balance: %w", err)
+		}
+		balances[wallet] = balance
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through wallet balances: %w", err)
+	}
+	return balances, nil
+}
+
+// ReplaceBalances overwrites wallet_balances with the given balances in one
+// transaction. It is used to rebuild the table from the transactions log.
+// Wallets that are not in balances keep their row with a zero balance, so a
+// wallet created without any transfer can still be credited afterwards.
+func (s *sqlStore) ReplaceBalances(balances map[string]int64) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec("UPDATE wallet_balances SET balance = 0"); err != nil {
+		return fmt.Errorf("failed to clear wallet_balances: %w", err)
+	}
+	for wallet, balance := range balances {
+		if _, err = tx.Exec(s.dialect.insertIgnore+" INTO wallet_balances (wallet, balance) VALUES (?, 0)", wallet); err != nil {
+			return fmt.Errorf("failed to create wallet %s: %w", wallet, err)
+		}
+		if _, err = tx.Exec("UPDATE wallet_balances SET balance = ? WHERE wallet = ?", balance, wallet); err != nil {
+			return fmt.Errorf("failed to write balance of %s: %w", wallet, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ReplayLedger rebuilds every wallet balance by replaying the transactions log
+// in sequence order. Withdrawals to Bitcoin credit no wallet. It fails if the
+// log ever spends more than a wallet holds.
+func ReplayLedger(store Store) (map[string]int64, error) {
+	const pageSize = 1000
+
+	balances := make(map[string]int64)
+	var afterSeq int64
+	for {
+		transfers, err := store.ListTransfers(afterSeq, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range transfers {
+			if t.From != "" {
+				if balances[t.From] < t.Amount {
+					return nil, fmt.Errorf("transaction %d (%s) overspends wallet %s", t.Seq, t.TxID, t.From)
+				}
+				balances[t.From] -= t.Amount
+			}
+			if _, ok := WithdrawalAddress(t.To); !ok {
+				balances[t.To] += t.Amount
+			}
+			afterSeq = t.Seq
+		}
+		if len(transfers) < pageSize {
+			return balances, nil
+		}
+	}
+}
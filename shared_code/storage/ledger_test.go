@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestStore(t *testing.T) Store {
+	t.Helper()
+	store, err := Open("sqlite3", filepath.Join(t.TempDir(), "node.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestReplaceBalancesKeepsWalletsWithoutTransfers(t *testing.T) {
+	store := openTestStore(t)
+	genesis := Genesis{Wallets: []GenesisWallet{{Wallet: "alice", Balance: 10}, {Wallet: "bob"}}}
+	if _, err := store.ApplyGenesis(genesis); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateWallet("carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	// bob ends up with nothing and no transfer ever touched carol
+	if err := store.MoveSats("alice", "bob", 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MoveSats("bob", "alice", 4); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := ReplayLedger(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ReplaceBalances(replayed); err != nil {
+		t.Fatal(err)
+	}
+
+	balances, err := store.ListBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"alice": 10, "bob": 0, "carol": 0}
+	for wallet, balance := range want {
+		got, ok := balances[wallet]
+		if !ok {
+			t.Fatalf("wallet %s was dropped from wallet_balances", wallet)
+		}
+		if got != balance {
+			t.Errorf("wallet %s has %d, expected %d", wallet, got, balance)
+		}
+	}
+
+	// A wallet that kept its row can be credited
+	if err := store.MoveSats("alice", "carol", 3); err != nil {
+		t.Fatalf("credit to a wallet without transfers: %v", err)
+	}
+	if balance, _ := store.GetBalance("carol"); balance != 3 {
+		t.Errorf("carol has %d, expected 3", balance)
+	}
+}
+
+// The history of a wallet pages newest first by seq, so entries of the same
+// block, which share a timestamp, are neither repeated nor skipped.
+func TestListWalletTransfers(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, open func() (Store, error)) {
+		store := mustOpen(t, open)
+		genesis := Genesis{Wallets: []GenesisWallet{{Wallet: "alice", Balance: 100}, {Wallet: "bob", Balance: 100}}}
+		if _, err := store.ApplyGenesis(genesis); err != nil {
+			t.Fatal(err)
+		}
+		blocks := map[int64][]Transfer{
+			1000: {{From: "alice", To: "bob", Amount: 1, Nonce: "h1"}, {From: "bob", To: "alice", Amount: 2, Nonce: "h2"}, {From: "alice", To: "carol", Amount: 3, Nonce: "h3"}},
+			2000: {{From: "bob", To: "carol", Amount: 4, Nonce: "h4"}, {From: "alice", To: "bob", Amount: 5, Nonce: "h5"}},
+			3000: {{From: "carol", To: "alice", Amount: 6, Nonce: "h6"}, {From: "alice", To: "bob", Amount: 7, Nonce: "h7"}},
+		}
+		for _, timestamp := range []int64{1000, 2000, 3000} {
+			var transfers []Transfer
+			for _, transfer := range blocks[timestamp] {
+				transfer.TxID = TransferID(transfer.From, transfer.To, transfer.Amount, transfer.Nonce)
+				transfers = append(transfers, transfer)
+			}
+			if _, rejected, err := store.ProduceBlock("historytest", timestamp, transfers, MembershipChanges{}, PegChanges{}); err != nil || len(rejected) != 0 {
+				t.Fatalf("block at %d: %v, %v", timestamp, rejected, err)
+			}
+		}
+		nonces := func(transfers []Transfer) string {
+			var list []string
+			for _, transfer := range transfers {
+				list = append(list, transfer.Nonce)
+			}
+			return strings.Join(list, " ")
+		}
+
+		// Pages of 2 from the newest entry of alice, her genesis credit last: it
+		// comes first in the log but is stamped when the genesis was applied
+		all, err := store.ListWalletTransfers(HistoryQuery{Wallet: "alice", Limit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 7 || nonces(all[:6]) != "h7 h6 h5 h3 h2 h1" || all[6].From != "" {
+			t.Fatalf("history of alice is %v", all)
+		}
+		var paged []Transfer
+		query := HistoryQuery{Wallet: "alice", Limit: 2}
+		for page := 0; ; page++ {
+			if page > len(all) {
+				t.Fatal("paging does not end")
+			}
+			transfers, err := store.ListWalletTransfers(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(transfers) == 0 {
+				break
+			}
+			paged = append(paged, transfers...)
+			query.BeforeSeq = transfers[len(transfers)-1].Seq
+		}
+		if nonces(paged) != nonces(all) {
+			t.Errorf("pages give %q, expected %q", nonces(paged), nonces(all))
+		}
+		for i := 1; i < len(paged); i++ {
+			if paged[i].Seq >= paged[i-1].Seq || paged[i].BlockHeight > 0 && paged[i].Timestamp > paged[i-1].Timestamp {
+				t.Errorf("entry %d (seq %d at %d) is not older than the one before (seq %d at %d)", i, paged[i].Seq, paged[i].Timestamp, paged[i-1].Seq, paged[i-1].Timestamp)
+			}
+		}
+
+		// Direction and time range
+		tests := []struct {
+			query HistoryQuery
+			want  string
+		}{
+			{HistoryQuery{Wallet: "alice", Direction: "out", Limit: 100}, "h7 h5 h3 h1"},
+			{HistoryQuery{Wallet: "alice", Direction: "in", Until: 3000, Limit: 100}, "h6 h2"},
+			{HistoryQuery{Wallet: "alice", Since: 2000, Until: 2000, Limit: 100}, "h5"},
+			{HistoryQuery{Wallet: "bob", Since: 1000, Until: 2000, Limit: 100}, "h5 h4 h2 h1"},
+			{HistoryQuery{Wallet: "bob", Direction: "in", Since: 2000, Until: 3000, Limit: 1}, "h7"},
+			{HistoryQuery{Wallet: "carol", Direction: "out", Until: 2999, Limit: 100}, ""},
+		}
+		for _, test := range tests {
+			transfers, err := store.ListWalletTransfers(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := nonces(transfers); got != test.want {
+				t.Errorf("%+v: got %q, expected %q", test.query, got, test.want)
+			}
+		}
+		if _, err := store.ListWalletTransfers(HistoryQuery{Wallet: "alice", Direction: "sideways", Limit: 10}); err == nil {
+			t.Error("invalid direction accepted")
+		}
+	})
+}
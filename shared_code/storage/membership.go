@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Admission is a node admitted into the nodes table by a block. Only the
+// block that starts an epoch carries admissions.
+type Admission struct {
+	ComputerID string `json:"computer_id"`
+	IPAddress  string `json:"ip_address"`
+	PublicKey  string `json:"public_key"`
+}
+
+// AdmissionRoot returns the hex SHA-256 of the JSON array of admissions, in
+// block order.
+func AdmissionRoot(admissions []Admission) string {
+	payload, _ := json.Marshal(admissions)
+	hash := sha256.Sum256(payload)
+	return hex.EncodeToString(hash[:])
+}
+
+// Registration is the proof an address gave when it asked to join: its
+// signed answer to the challenge of the node it registered with (see
+// networkUtils.VerifyRegistration). It stays with the address in the buffer
+// and the queue, so other nodes can check it before taking the address.
+type Registration struct {
+	IPAddress    string `json:"ip_address"`
+	PublicKey    string `json:"public_key"`
+	RegisteredBy string `json:"registered_by"` // computer_id of the node that challenged it
+	Nonce        string `json:"nonce"`
+	Signature    string `json:"signature"`
+}
+
+// QueueEntry is one row of nodes_que: an address on probation and the
+// results of probing it.
+type QueueEntry struct {
+	Registration
+	QueuedEpoch int64 `json:"queued_epoch"` // epoch the probation started with
+	Checks      int   `json:"checks"`
+	Passes      int   `json:"passes"`
+	Failures    int   `json:"failures"` // failed probes since the last one that passed
+	LastCheck   int64 `json:"last_check"`
+}
+
+// ListQueue returns every entry of nodes_que ordered by address.
+func (s *sqlStore) ListQueue() ([]QueueEntry, error) {
+	rows, err := s.db.Query(`SELECT ip_address, public_key, registered_by, registration_nonce, registration_signature,
+			queued_epoch, checks, passes, failures, last_check
+		FROM nodes_que
+		ORDER BY ip_address`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query nodes_que: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []QueueEntry
+	for rows.Next() {
+		var entry QueueEntry
+		if err := rows.Scan(&entry.IPAddress, &entry.PublicKey, &entry.RegisteredBy, &entry.Nonce, &entry.Signature, &entry.QueuedEpoch, &entry.Checks, &entry.Passes, &entry.Failures, &entry.LastCheck); err != nil {
+			return nil, fmt.Errorf("failed to scan queue entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through nodes_que: %w", err)
+	}
+	return entries, nil
+}
+
+// AddAllToQueue inserts queue entries from a peer into nodes_que with their
+// registrations in a single transaction, with their probation starting at
+// their QueuedEpoch and ignoring addresses already queued. Probe results are
+// not copied.
+func (s *sqlStore) AddAllToQueue(entries []QueueEntry) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, entry := range entries {
+		_, err = tx.Exec(s.dialect.insertIgnore+` INTO nodes_que
+				(ip_address, public_key, registered_by, registration_nonce, registration_signature, queued_epoch)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			entry.IPAddress, entry.PublicKey, entry.RegisteredBy, entry.Nonce, entry.Signature, entry.QueuedEpoch)
+		if err != nil {
+			return fmt.Errorf("failed to add %s to nodes_que: %w", entry.IPAddress, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// QueueProbe is the result of probing a queued address at a unix time.
+// Drop removes the address from the queue instead of recording the result.
+type QueueProbe struct {
+	IPAddress string
+	OK        bool
+	At        int64
+	Drop      bool
+}
+
+// RecordProbes records the results of a sweep of probes of the queue in a
+// single transaction. A probe that passes clears the failures counted since
+// the last one.
+func (s *sqlStore) RecordProbes(probes []QueueProbe) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, probe := range probes {
+		var query string
+		switch {
+		case probe.Drop:
+			_, err = tx.Exec("DELETE FROM nodes_que WHERE ip_address = ?", probe.IPAddress)
+		case probe.OK:
+			query = "UPDATE nodes_que SET checks = checks + 1, passes = passes + 1, failures = 0, last_check = ? WHERE ip_address = ?"
+		default:
+			query = "UPDATE nodes_que SET checks = checks + 1, failures = failures + 1, last_check = ? WHERE ip_address = ?"
+		}
+		if query != "" {
+			_, err = tx.Exec(query, probe.At, probe.IPAddress)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to record probe of %s: %w", probe.IPAddress, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RemoveFromQueue deletes an address from nodes_que.
+func (s *sqlStore) RemoveFromQueue(ipAddress string) error {
+	if _, err := s.db.Exec("DELETE FROM nodes_que WHERE ip_address = ?", ipAddress); err != nil {
+		return fmt.Errorf("failed to remove %s from nodes_que: %w", ipAddress, err)
+	}
+	return nil
+}
+
+// MembershipChanges are the changes to the nodes table that the block
+// starting an epoch carries: the nodes it admits, the nodes it evicts and the
+// nodes it leaves out of the leader groups of the epoch. Evictions and
+// exclusions are computer_ids in ascending order.
+type MembershipChanges struct {
+	Admissions []Admission
+	Evictions  []string
+	Excluded   []string
+}
+
+// admissionConflict returns an error if an admission names a computer_id or
+// address that is already in the nodes table.
+func (s *sqlStore) admissionConflict(tx *sql.Tx, admission Admission) error {
+	if admission.ComputerID == "" || admission.IPAddress == "" || admission.PublicKey == "" {
+		return fmt.Errorf("%w: admission of %q is incomplete", ErrInvalidBlock, admission.IPAddress)
+	}
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM nodes WHERE computer_id = ? OR ip_address = ?",
+		admission.ComputerID, admission.IPAddress).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to query nodes: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: node %s at %s is already admitted", ErrInvalidBlock, admission.ComputerID, admission.IPAddress)
+	}
+	return nil
+}
+
+// missingNode returns an error if a computer_id is not in the nodes table.
+func (s *sqlStore) missingNode(tx *sql.Tx, computerID string) error {
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM nodes WHERE computer_id = ?", computerID).Scan(&count); err != nil {
+		return fmt.Errorf("failed to query nodes: %w", err)
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: node %s is not in the nodes table", ErrInvalidBlock, computerID)
+	}
+	return nil
+}
+
+// applyMembership applies the membership changes of the block at height
+// inside an open transaction and returns the changes that were applied.
+// Admitted nodes are added to the nodes table and taken off the queue and
+// the buffer, and evicted nodes are deleted with their health records. They
+// join or leave the leader groups with the next epoch that is shuffled.
+//
+// With rejected set, a change that no longer applies (a node already
+// admitted, or no longer in the nodes table) is left out and recorded in
+// rejected, keyed by computer_id. Without it, such a change makes the whole
+// block invalid.
+func (s *sqlStore) applyMembership(tx *sql.Tx, height int64, changes MembershipChanges, rejected map[string]error) (MembershipChanges, error) {
+	var applied MembershipChanges
+
+	// skip decides what to do with a change that does not apply
+	skip := func(id string, conflict error) error {
+		if rejected == nil || !errors.Is(conflict, ErrInvalidBlock) {
+			return conflict
+		}
+		rejected[id] = conflict
+		return nil
+	}
+
+	for _, admission := range changes.Admissions {
+		if conflict := s.admissionConflict(tx, admission); conflict != nil {
+			if err := skip(admission.ComputerID, conflict); err != nil {
+				return MembershipChanges{}, err
+			}
+			continue
+		}
+		_, err := tx.Exec("INSERT INTO nodes (computer_id, ip_address, reachable, public_key, admitted_height) VALUES (?, ?, ?, ?, ?)",
+			admission.ComputerID, admission.IPAddress, true, admission.PublicKey, height)
+		if err != nil {
+			return MembershipChanges{}, fmt.Errorf("failed to admit node %s: %w", admission.ComputerID, err)
+		}
+		if _, err := tx.Exec("DELETE FROM nodes_que WHERE ip_address = ?", admission.IPAddress); err != nil {
+			return MembershipChanges{}, fmt.Errorf("failed to remove %s from nodes_que: %w", admission.IPAddress, err)
+		}
+		if _, err := tx.Exec("DELETE FROM nodes_buffer WHERE ip_address = ?", admission.IPAddress); err != nil {
+			return MembershipChanges{}, fmt.Errorf("failed to remove %s from nodes_buffer: %w", admission.IPAddress, err)
+		}
+		applied.Admissions = append(applied.Admissions, admission)
+	}
+
+	for _, computerID := range changes.Evictions {
+		if conflict := s.missingNode(tx, computerID); conflict != nil {
+			if err := skip(computerID, conflict); err != nil {
+				return MembershipChanges{}, err
+			}
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM nodes WHERE computer_id = ?", computerID); err != nil {
+			return MembershipChanges{}, fmt.Errorf("failed to evict node %s: %w", computerID, err)
+		}
+		if _, err := tx.Exec("DELETE FROM node_health WHERE computer_id = ?", computerID); err != nil {
+			return MembershipChanges{}, fmt.Errorf("failed to delete health of node %s: %w", computerID, err)
+		}
+		applied.Evictions = append(applied.Evictions, computerID)
+	}
+
+	for _, computerID := range changes.Excluded {
+		if conflict := s.missingNode(tx, computerID); conflict != nil {
+			if err := skip(computerID, conflict); err != nil {
+				return MembershipChanges{}, err
+			}
+			continue
+		}
+		applied.Excluded = append(applied.Excluded, computerID)
+	}
+	return applied, nil
+}
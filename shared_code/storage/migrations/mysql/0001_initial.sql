@@ -0,0 +1,31 @@
+-- Node list, admission buffer and queue, used nonces and wallet balances.
+
+CREATE TABLE IF NOT EXISTS `nodes` (
+  `sort_order` int DEFAULT NULL,
+  `computer_id` varchar(255) NOT NULL,
+  `ip_address` varchar(255) DEFAULT NULL,
+  `node_group` int DEFAULT NULL,
+  `reachable` tinyint NOT NULL DEFAULT '1',
+  PRIMARY KEY (`computer_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `nodes_buffer` (
+  `ip_address` varchar(45) NOT NULL,
+  PRIMARY KEY (`ip_address`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `nodes_que` (
+  `ip_address` varchar(45) NOT NULL,
+  PRIMARY KEY (`ip_address`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `nonce` (
+  `nonce` varchar(255) NOT NULL,
+  PRIMARY KEY (`nonce`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `wallet_balances` (
+  `wallet` varchar(255) NOT NULL,
+  `balance` int DEFAULT NULL,
+  PRIMARY KEY (`wallet`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,7 @@
+-- A wallet balance can never go below zero, whatever the application does.
+
+UPDATE `wallet_balances` SET `balance` = 0 WHERE `balance` IS NULL;
+
+ALTER TABLE `wallet_balances`
+  MODIFY `balance` bigint NOT NULL DEFAULT '0',
+  ADD CONSTRAINT `wallet_balance_non_negative` CHECK (`balance` >= 0);
@@ -0,0 +1,27 @@
+-- Append-only log of every accepted transfer. wallet_balances is derived
+-- from it and can be rebuilt by replaying the log in seq order.
+-- Entries with an empty from_wallet create sats (genesis and opening balances).
+
+CREATE TABLE IF NOT EXISTS `transactions` (
+  `seq` bigint NOT NULL AUTO_INCREMENT,
+  `tx_id` varchar(255) NOT NULL,
+  `from_wallet` varchar(255) NOT NULL DEFAULT '',
+  `to_wallet` varchar(255) NOT NULL,
+  `amount` bigint NOT NULL,
+  `nonce` varchar(255) NOT NULL,
+  `signature` text NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`seq`),
+  UNIQUE KEY `tx_id_UNIQUE` (`tx_id`),
+  KEY `from_wallet_seq` (`from_wallet`, `seq`),
+  KEY `to_wallet_seq` (`to_wallet`, `seq`),
+  CONSTRAINT `transaction_amount_positive` CHECK (`amount` > 0)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Balances that existed before the log get an opening entry so a replay
+-- reproduces them.
+INSERT INTO `transactions` (`tx_id`, `from_wallet`, `to_wallet`, `amount`, `nonce`, `signature`, `created_at`)
+  SELECT CONCAT('opening-', `wallet`), '', `wallet`, `balance`, 'opening', '', UNIX_TIMESTAMP()
+  FROM `wallet_balances`
+  WHERE `balance` > 0
+  ORDER BY `wallet`;
@@ -0,0 +1,19 @@
+-- Hash-chained blocks. Each block applies a batch of transfers from the log;
+-- transfers logged before the first block (or outside one) have block_height 0.
+
+CREATE TABLE IF NOT EXISTS `blocks` (
+  `height` bigint NOT NULL,
+  `hash` char(64) NOT NULL,
+  `prev_hash` char(64) NOT NULL,
+  `created_at` bigint NOT NULL,
+  `tx_root` char(64) NOT NULL,
+  `state_root` char(64) NOT NULL,
+  `producer` varchar(255) NOT NULL,
+  `tx_count` int NOT NULL DEFAULT '0',
+  PRIMARY KEY (`height`),
+  UNIQUE KEY `hash_UNIQUE` (`hash`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE `transactions` ADD COLUMN `block_height` bigint NOT NULL DEFAULT '0';
+
+ALTER TABLE `transactions` ADD KEY `block_height_seq` (`block_height`, `seq`);
@@ -0,0 +1,22 @@
+-- Leader rotation. Each epoch records the seed of its shuffle and the group
+-- every node was assigned to; active_group is the group currently leading.
+
+CREATE TABLE IF NOT EXISTS `epochs` (
+  `epoch` bigint NOT NULL,
+  `start_height` bigint NOT NULL,
+  `seed` char(64) NOT NULL,
+  `group_size` int NOT NULL,
+  `active_group` int NOT NULL DEFAULT '1',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`epoch`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `epoch_groups` (
+  `epoch` bigint NOT NULL,
+  `computer_id` varchar(255) NOT NULL,
+  `ip_address` varchar(255) NOT NULL DEFAULT '',
+  `sort_order` int NOT NULL,
+  `node_group` int NOT NULL,
+  PRIMARY KEY (`epoch`, `computer_id`),
+  KEY `epoch_node_group` (`epoch`, `node_group`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,8 @@
+-- Keys used to check the signatures of nodes, and the commit certificate
+-- (the precommit votes of the leader group) of every block.
+
+ALTER TABLE `nodes` ADD COLUMN `public_key` varchar(255) NOT NULL DEFAULT '';
+
+ALTER TABLE `epoch_groups` ADD COLUMN `public_key` varchar(255) NOT NULL DEFAULT '';
+
+ALTER TABLE `blocks` ADD COLUMN `certificate` mediumtext NULL;
@@ -0,0 +1,14 @@
+-- Standby groups taking over a stalled epoch. Each row holds the certificate
+-- of signed timeout votes that moved the lead from one group to the next,
+-- starting at the height the previous group failed to commit.
+
+CREATE TABLE IF NOT EXISTS `epoch_failovers` (
+  `epoch` bigint NOT NULL,
+  `seq` int NOT NULL,
+  `height` bigint NOT NULL,
+  `from_group` int NOT NULL,
+  `to_group` int NOT NULL,
+  `certificate` mediumtext NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`epoch`, `seq`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
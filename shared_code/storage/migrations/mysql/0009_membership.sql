@@ -0,0 +1,18 @@
+-- Staged admission of new nodes. Applicants wait in nodes_buffer until the
+-- next epoch, then serve a probation in nodes_que while they are probed, and
+-- are admitted into nodes by the block that starts a later epoch. The block
+-- records who it admitted, and each node the height it was admitted at.
+
+ALTER TABLE `nodes` ADD COLUMN `admitted_height` bigint NOT NULL DEFAULT '0';
+
+ALTER TABLE `nodes_que` ADD COLUMN `queued_epoch` bigint NOT NULL DEFAULT '0';
+
+ALTER TABLE `nodes_que` ADD COLUMN `checks` int NOT NULL DEFAULT '0';
+
+ALTER TABLE `nodes_que` ADD COLUMN `passes` int NOT NULL DEFAULT '0';
+
+ALTER TABLE `nodes_que` ADD COLUMN `failures` int NOT NULL DEFAULT '0';
+
+ALTER TABLE `nodes_que` ADD COLUMN `last_check` bigint NOT NULL DEFAULT '0';
+
+ALTER TABLE `blocks` ADD COLUMN `admissions` mediumtext NULL;
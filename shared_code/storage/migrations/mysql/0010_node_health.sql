@@ -0,0 +1,20 @@
+-- Liveness of every node as seen by this node: when it was first and last
+-- probed, when it last answered, the failed probes since then and the result
+-- of the latest probes, oldest first, as a string of '1' and '0'. The block
+-- that starts an epoch records the nodes it leaves out of the leader groups
+-- and the nodes it evicts.
+
+CREATE TABLE IF NOT EXISTS `node_health` (
+  `computer_id` varchar(255) NOT NULL,
+  `since` bigint NOT NULL,
+  `last_check` bigint NOT NULL DEFAULT '0',
+  `last_seen` bigint NOT NULL DEFAULT '0',
+  `failures` int NOT NULL DEFAULT '0',
+  `checks` int NOT NULL DEFAULT '0',
+  `history` varchar(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (`computer_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE `blocks` ADD COLUMN `excluded` mediumtext NULL;
+
+ALTER TABLE `blocks` ADD COLUMN `evictions` mediumtext NULL;
@@ -0,0 +1,15 @@
+-- Signed registration each address in the buffer and the queue gave when it
+-- joined: the node that challenged it, the nonce and the signature of its
+-- answer. Peers check it before they take the address from another node.
+
+ALTER TABLE `nodes_buffer` ADD COLUMN `registered_by` varchar(64) NOT NULL DEFAULT '';
+
+ALTER TABLE `nodes_buffer` ADD COLUMN `registration_nonce` varchar(64) NOT NULL DEFAULT '';
+
+ALTER TABLE `nodes_buffer` ADD COLUMN `registration_signature` varchar(255) NOT NULL DEFAULT '';
+
+ALTER TABLE `nodes_que` ADD COLUMN `registered_by` varchar(64) NOT NULL DEFAULT '';
+
+ALTER TABLE `nodes_que` ADD COLUMN `registration_nonce` varchar(64) NOT NULL DEFAULT '';
+
+ALTER TABLE `nodes_que` ADD COLUMN `registration_signature` varchar(255) NOT NULL DEFAULT '';
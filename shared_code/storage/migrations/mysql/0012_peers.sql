@@ -0,0 +1,13 @@
+-- Address book of peers learned from seeds and gossip: the key each address
+-- was announced with, who told us about it, when it was first and last heard
+-- of and when this node last tried to register it.
+
+CREATE TABLE IF NOT EXISTS `peers` (
+  `ip_address` varchar(45) NOT NULL,
+  `public_key` varchar(255) NOT NULL DEFAULT '',
+  `source` varchar(45) NOT NULL DEFAULT '',
+  `first_seen` bigint NOT NULL DEFAULT '0',
+  `last_seen` bigint NOT NULL DEFAULT '0',
+  `last_attempt` bigint NOT NULL DEFAULT '0',
+  PRIMARY KEY (`ip_address`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,23 @@
+-- Custody of the peg key. custody_keys holds every completed handoff: the
+-- group key and verifying shares of the custodians of an epoch, the hash of
+-- the transcript they finished and the confirmations of a quorum of them.
+-- custody_shares holds this node's own secret share of a key, and only until
+-- a later handoff completes.
+
+CREATE TABLE IF NOT EXISTS `custody_keys` (
+  `epoch` bigint NOT NULL,
+  `group_key` varchar(64) NOT NULL,
+  `public_keys` mediumtext NOT NULL,
+  `transcript` varchar(64) NOT NULL,
+  `certificate` mediumtext NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`epoch`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `custody_shares` (
+  `epoch` bigint NOT NULL,
+  `signer_id` int NOT NULL,
+  `key_share` text NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`epoch`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,45 @@
+-- Peg-ins. deposit_addresses maps each wallet to its Bitcoin deposit address.
+-- bitcoin_blocks and pegin_pending are this node's view of the Bitcoin chain:
+-- the blocks it scanned and the deposits it found in them. pegins holds the
+-- deposits credited by blocks, one row per outpoint, and the block records
+-- the deposits it credits.
+
+CREATE TABLE IF NOT EXISTS `deposit_addresses` (
+  `wallet` varchar(255) NOT NULL,
+  `address` varchar(100) NOT NULL,
+  `script` varchar(100) NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`wallet`),
+  UNIQUE KEY `address_UNIQUE` (`address`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `bitcoin_blocks` (
+  `height` bigint NOT NULL,
+  `hash` varchar(64) NOT NULL,
+  PRIMARY KEY (`height`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `pegin_pending` (
+  `outpoint` varchar(80) NOT NULL,
+  `wallet` varchar(255) NOT NULL,
+  `address` varchar(100) NOT NULL,
+  `amount` bigint NOT NULL,
+  `bitcoin_block` varchar(64) NOT NULL,
+  `bitcoin_height` bigint NOT NULL,
+  PRIMARY KEY (`outpoint`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `pegins` (
+  `outpoint` varchar(80) NOT NULL,
+  `wallet` varchar(255) NOT NULL,
+  `address` varchar(100) NOT NULL,
+  `amount` bigint NOT NULL,
+  `bitcoin_block` varchar(64) NOT NULL,
+  `bitcoin_height` bigint NOT NULL,
+  `block_height` bigint NOT NULL,
+  PRIMARY KEY (`outpoint`),
+  KEY `wallet_block_height` (`wallet`, `block_height`),
+  CONSTRAINT `pegin_amount_positive` CHECK (`amount` > 0)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE `blocks` ADD COLUMN `deposits` mediumtext NULL;
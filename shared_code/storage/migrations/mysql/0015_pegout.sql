@@ -0,0 +1,45 @@
+-- Peg-outs. peg_utxos are the Bitcoin outputs the peg holds: the credited
+-- deposits, with the wallet whose address they paid, and the change of
+-- payouts, with an empty wallet. spent_by is the payout spending one, empty
+-- while it is unspent. withdrawals holds the signed transfers to a Bitcoin
+-- address, queued until a payout pays them. payouts holds the signed Bitcoin
+-- transactions recorded by blocks; bitcoin_height is where this node saw one
+-- confirm, 0 until then. The block records the payouts it carries.
+
+CREATE TABLE IF NOT EXISTS `peg_utxos` (
+  `outpoint` varchar(80) NOT NULL,
+  `wallet` varchar(255) NOT NULL,
+  `amount` bigint NOT NULL,
+  `block_height` bigint NOT NULL,
+  `spent_by` varchar(64) NOT NULL DEFAULT '',
+  PRIMARY KEY (`outpoint`),
+  KEY `spent_by_block_height` (`spent_by`, `block_height`),
+  CONSTRAINT `peg_utxo_amount_positive` CHECK (`amount` > 0)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT IGNORE INTO `peg_utxos` (`outpoint`, `wallet`, `amount`, `block_height`, `spent_by`)
+  SELECT `outpoint`, `wallet`, `amount`, `block_height`, '' FROM `pegins`;
+
+CREATE TABLE IF NOT EXISTS `withdrawals` (
+  `tx_id` varchar(64) NOT NULL,
+  `wallet` varchar(255) NOT NULL,
+  `address` varchar(100) NOT NULL,
+  `amount` bigint NOT NULL,
+  `block_height` bigint NOT NULL,
+  `payout` varchar(64) NOT NULL DEFAULT '',
+  PRIMARY KEY (`tx_id`),
+  KEY `payout_block_height` (`payout`, `block_height`),
+  CONSTRAINT `withdrawal_amount_positive` CHECK (`amount` > 0)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `payouts` (
+  `txid` varchar(64) NOT NULL,
+  `tx` mediumtext NOT NULL,
+  `fee` bigint NOT NULL,
+  `change_amount` bigint NOT NULL,
+  `block_height` bigint NOT NULL,
+  `bitcoin_height` bigint NOT NULL DEFAULT 0,
+  PRIMARY KEY (`txid`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE `blocks` ADD COLUMN `payouts` mediumtext NULL;
@@ -0,0 +1,26 @@
+-- Node list, admission buffer and queue, used nonces and wallet balances.
+
+CREATE TABLE IF NOT EXISTS nodes (
+  sort_order INTEGER DEFAULT NULL,
+  computer_id TEXT NOT NULL PRIMARY KEY,
+  ip_address TEXT DEFAULT NULL,
+  node_group INTEGER DEFAULT NULL,
+  reachable INTEGER NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS nodes_buffer (
+  ip_address TEXT NOT NULL PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS nodes_que (
+  ip_address TEXT NOT NULL PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS nonce (
+  nonce TEXT NOT NULL PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS wallet_balances (
+  wallet TEXT NOT NULL PRIMARY KEY,
+  balance INTEGER DEFAULT NULL
+);
@@ -0,0 +1,14 @@
+-- A wallet balance can never go below zero, whatever the application does.
+-- SQLite cannot add a constraint to an existing table, so rebuild it.
+
+CREATE TABLE wallet_balances_new (
+  wallet TEXT NOT NULL PRIMARY KEY,
+  balance INTEGER NOT NULL DEFAULT 0 CHECK (balance >= 0)
+);
+
+INSERT INTO wallet_balances_new (wallet, balance)
+  SELECT wallet, COALESCE(balance, 0) FROM wallet_balances;
+
+DROP TABLE wallet_balances;
+
+ALTER TABLE wallet_balances_new RENAME TO wallet_balances;
@@ -0,0 +1,26 @@
+-- Append-only log of every accepted transfer. wallet_balances is derived
+-- from it and can be rebuilt by replaying the log in seq order.
+-- Entries with an empty from_wallet create sats (genesis and opening balances).
+
+CREATE TABLE IF NOT EXISTS transactions (
+  seq INTEGER PRIMARY KEY AUTOINCREMENT,
+  tx_id TEXT NOT NULL UNIQUE,
+  from_wallet TEXT NOT NULL DEFAULT '',
+  to_wallet TEXT NOT NULL,
+  amount INTEGER NOT NULL CHECK (amount > 0),
+  nonce TEXT NOT NULL,
+  signature TEXT NOT NULL,
+  created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS transactions_from_wallet_seq ON transactions (from_wallet, seq);
+
+CREATE INDEX IF NOT EXISTS transactions_to_wallet_seq ON transactions (to_wallet, seq);
+
+-- Balances that existed before the log get an opening entry so a replay
+-- reproduces them.
+INSERT INTO transactions (tx_id, from_wallet, to_wallet, amount, nonce, signature, created_at)
+  SELECT 'opening-' || wallet, '', wallet, balance, 'opening', '', CAST(strftime('%s', 'now') AS INTEGER)
+  FROM wallet_balances
+  WHERE balance > 0
+  ORDER BY wallet;
@@ -0,0 +1,17 @@
+-- Hash-chained blocks. Each block applies a batch of transfers from the log;
+-- transfers logged before the first block (or outside one) have block_height 0.
+
+CREATE TABLE IF NOT EXISTS blocks (
+  height INTEGER NOT NULL PRIMARY KEY,
+  hash TEXT NOT NULL UNIQUE,
+  prev_hash TEXT NOT NULL,
+  created_at INTEGER NOT NULL,
+  tx_root TEXT NOT NULL,
+  state_root TEXT NOT NULL,
+  producer TEXT NOT NULL,
+  tx_count INTEGER NOT NULL DEFAULT 0
+);
+
+ALTER TABLE transactions ADD COLUMN block_height INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS transactions_block_height_seq ON transactions (block_height, seq);
@@ -0,0 +1,22 @@
+-- Leader rotation. Each epoch records the seed of its shuffle and the group
+-- every node was assigned to; active_group is the group currently leading.
+
+CREATE TABLE IF NOT EXISTS epochs (
+  epoch INTEGER NOT NULL PRIMARY KEY,
+  start_height INTEGER NOT NULL,
+  seed TEXT NOT NULL,
+  group_size INTEGER NOT NULL,
+  active_group INTEGER NOT NULL DEFAULT 1,
+  created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS epoch_groups (
+  epoch INTEGER NOT NULL,
+  computer_id TEXT NOT NULL,
+  ip_address TEXT NOT NULL DEFAULT '',
+  sort_order INTEGER NOT NULL,
+  node_group INTEGER NOT NULL,
+  PRIMARY KEY (epoch, computer_id)
+);
+
+CREATE INDEX IF NOT EXISTS epoch_groups_epoch_node_group ON epoch_groups (epoch, node_group);
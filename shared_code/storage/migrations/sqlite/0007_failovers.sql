@@ -0,0 +1,14 @@
+-- Standby groups taking over a stalled epoch. Each row holds the certificate
+-- of signed timeout votes that moved the lead from one group to the next,
+-- starting at the height the previous group failed to commit.
+
+CREATE TABLE IF NOT EXISTS epoch_failovers (
+  epoch INTEGER NOT NULL,
+  seq INTEGER NOT NULL,
+  height INTEGER NOT NULL,
+  from_group INTEGER NOT NULL,
+  to_group INTEGER NOT NULL,
+  certificate TEXT NOT NULL,
+  created_at INTEGER NOT NULL,
+  PRIMARY KEY (epoch, seq)
+);
@@ -0,0 +1,6 @@
+-- Public key each registered address proved to hold, carried from the buffer
+-- to the queue.
+
+ALTER TABLE nodes_buffer ADD COLUMN public_key TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE nodes_que ADD COLUMN public_key TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,19 @@
+-- Liveness of every node as seen by this node: when it was first and last
+-- probed, when it last answered, the failed probes since then and the result
+-- of the latest probes, oldest first, as a string of '1' and '0'. The block
+-- that starts an epoch records the nodes it leaves out of the leader groups
+-- and the nodes it evicts.
+
+CREATE TABLE IF NOT EXISTS node_health (
+  computer_id TEXT NOT NULL PRIMARY KEY,
+  since INTEGER NOT NULL,
+  last_check INTEGER NOT NULL DEFAULT 0,
+  last_seen INTEGER NOT NULL DEFAULT 0,
+  failures INTEGER NOT NULL DEFAULT 0,
+  checks INTEGER NOT NULL DEFAULT 0,
+  history TEXT NOT NULL DEFAULT ''
+);
+
+ALTER TABLE blocks ADD COLUMN excluded TEXT;
+
+ALTER TABLE blocks ADD COLUMN evictions TEXT;
@@ -0,0 +1,12 @@
+-- Address book of peers learned from seeds and gossip: the key each address
+-- was announced with, who told us about it, when it was first and last heard
+-- of and when this node last tried to register it.
+
+CREATE TABLE IF NOT EXISTS peers (
+  ip_address TEXT NOT NULL PRIMARY KEY,
+  public_key TEXT NOT NULL DEFAULT '',
+  source TEXT NOT NULL DEFAULT '',
+  first_seen INTEGER NOT NULL DEFAULT 0,
+  last_seen INTEGER NOT NULL DEFAULT 0,
+  last_attempt INTEGER NOT NULL DEFAULT 0
+);
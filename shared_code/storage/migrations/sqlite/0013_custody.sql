@@ -0,0 +1,21 @@
+-- Custody of the peg key. custody_keys holds every completed handoff: the
+-- group key and verifying shares of the custodians of an epoch, the hash of
+-- the transcript they finished and the confirmations of a quorum of them.
+-- custody_shares holds this node's own secret share of a key, and only until
+-- a later handoff completes.
+
+CREATE TABLE IF NOT EXISTS custody_keys (
+  epoch INTEGER NOT NULL PRIMARY KEY,
+  group_key TEXT NOT NULL,
+  public_keys TEXT NOT NULL,
+  transcript TEXT NOT NULL,
+  certificate TEXT NOT NULL,
+  created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS custody_shares (
+  epoch INTEGER NOT NULL PRIMARY KEY,
+  signer_id INTEGER NOT NULL,
+  key_share TEXT NOT NULL,
+  created_at INTEGER NOT NULL
+);
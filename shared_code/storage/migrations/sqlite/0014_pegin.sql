@@ -0,0 +1,40 @@
+-- Peg-ins. deposit_addresses maps each wallet to its Bitcoin deposit address.
+-- bitcoin_blocks and pegin_pending are this node's view of the Bitcoin chain:
+-- the blocks it scanned and the deposits it found in them. pegins holds the
+-- deposits credited by blocks, one row per outpoint, and the block records
+-- the deposits it credits.
+
+CREATE TABLE IF NOT EXISTS deposit_addresses (
+  wallet TEXT NOT NULL PRIMARY KEY,
+  address TEXT NOT NULL UNIQUE,
+  script TEXT NOT NULL,
+  created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS bitcoin_blocks (
+  height INTEGER NOT NULL PRIMARY KEY,
+  hash TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS pegin_pending (
+  outpoint TEXT NOT NULL PRIMARY KEY,
+  wallet TEXT NOT NULL,
+  address TEXT NOT NULL,
+  amount INTEGER NOT NULL,
+  bitcoin_block TEXT NOT NULL,
+  bitcoin_height INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS pegins (
+  outpoint TEXT NOT NULL PRIMARY KEY,
+  wallet TEXT NOT NULL,
+  address TEXT NOT NULL,
+  amount INTEGER NOT NULL CHECK (amount > 0),
+  bitcoin_block TEXT NOT NULL,
+  bitcoin_height INTEGER NOT NULL,
+  block_height INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS pegins_wallet ON pegins (wallet, block_height);
+
+ALTER TABLE blocks ADD COLUMN deposits TEXT;
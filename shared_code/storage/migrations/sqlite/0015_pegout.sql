@@ -0,0 +1,42 @@
+-- Peg-outs. peg_utxos are the Bitcoin outputs the peg holds: the credited
+-- deposits, with the wallet whose address they paid, and the change of
+-- payouts, with an empty wallet. spent_by is the payout spending one, empty
+-- while it is unspent. withdrawals holds the signed transfers to a Bitcoin
+-- address, queued until a payout pays them. payouts holds the signed Bitcoin
+-- transactions recorded by blocks; bitcoin_height is where this node saw one
+-- confirm, 0 until then. The block records the payouts it carries.
+
+CREATE TABLE IF NOT EXISTS peg_utxos (
+  outpoint TEXT NOT NULL PRIMARY KEY,
+  wallet TEXT NOT NULL,
+  amount INTEGER NOT NULL CHECK (amount > 0),
+  block_height INTEGER NOT NULL,
+  spent_by TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS peg_utxos_spent_by ON peg_utxos (spent_by, block_height);
+
+INSERT OR IGNORE INTO peg_utxos (outpoint, wallet, amount, block_height, spent_by)
+  SELECT outpoint, wallet, amount, block_height, '' FROM pegins;
+
+CREATE TABLE IF NOT EXISTS withdrawals (
+  tx_id TEXT NOT NULL PRIMARY KEY,
+  wallet TEXT NOT NULL,
+  address TEXT NOT NULL,
+  amount INTEGER NOT NULL CHECK (amount > 0),
+  block_height INTEGER NOT NULL,
+  payout TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS withdrawals_payout ON withdrawals (payout, block_height);
+
+CREATE TABLE IF NOT EXISTS payouts (
+  txid TEXT NOT NULL PRIMARY KEY,
+  tx TEXT NOT NULL,
+  fee INTEGER NOT NULL,
+  change_amount INTEGER NOT NULL,
+  block_height INTEGER NOT NULL,
+  bitcoin_height INTEGER NOT NULL DEFAULT 0
+);
+
+ALTER TABLE blocks ADD COLUMN payouts TEXT;
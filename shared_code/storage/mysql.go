@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// errDeadlock is the MySQL error number of a transaction rolled back to
+// break a deadlock.
+const errDeadlock = 1213
+
+// isDeadlock reports whether err rolled back a transaction to break a deadlock.
+func isDeadlock(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == errDeadlock
+}
+
+// NewMySQLStore connects to MySQL using a DSN such as
+// "node:test@tcp(node-1-database:3306)/node" and brings its schema up to date.
+func NewMySQLStore(dsn string) (Store, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open MySQL database: %w", err)
+	}
+
+	// Check if the connection is actually alive
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping the MySQL database: %w", err)
+	}
+
+	store := &sqlStore{
+		db: db,
+		dialect: dialect{
+			name:         "mysql",
+			insertIgnore: "INSERT IGNORE",
+			forUpdate:    " FOR UPDATE",
+			deadlock:     isDeadlock,
+		},
+	}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestIsDeadlock(t *testing.T) {
+	deadlock := fmt.Errorf("failed to lock wallets: %w", &mysql.MySQLError{Number: errDeadlock, Message: "Deadlock found when trying to get lock"})
+	if !isDeadlock(deadlock) {
+		t.Error("error 1213 is not taken for a deadlock")
+	}
+	for _, err := range []error{
+		fmt.Errorf("failed to lock wallets: %w", &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}),
+		errors.New("deadlock"),
+		ErrInsufficientFunds,
+	} {
+		if isDeadlock(err) {
+			t.Errorf("%v is taken for a deadlock", err)
+		}
+	}
+}
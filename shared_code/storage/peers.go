@@ -0,0 +1,126 @@
+package storage
+
+import "fmt"
+
+// Peer is an entry of the address book.
+type Peer struct {
+	IPAddress   string `json:"ip_address"`
+	PublicKey   string `json:"public_key"` // as announced, not yet proven
+	Source      string `json:"source"`     // address that told us, or "seed" or "nodes"
+	FirstSeen   int64  `json:"first_seen"`
+	LastSeen    int64  `json:"last_seen"`
+	LastAttempt int64  `json:"last_attempt"` // latest registration attempt
+}
+
+// ListPeers returns the address book, most recently seen first.
+func (s *sqlStore) ListPeers() ([]Peer, error) {
+	rows, err := s.db.Query(`SELECT ip_address, public_key, source, first_seen, last_seen, last_attempt
+		FROM peers
+		ORDER BY last_seen DESC, ip_address`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query peers: %w", err)
+	}
+	defer rows.Close()
+
+	var peers []Peer
+	for rows.Next() {
+		var p Peer
+		if err := rows.Scan(&p.IPAddress, &p.PublicKey, &p.Source, &p.FirstSeen, &p.LastSeen, &p.LastAttempt); err != nil {
+			return nil, fmt.Errorf("failed to scan peer: %w", err)
+		}
+		peers = append(peers, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through peers: %w", err)
+	}
+	return peers, nil
+}
+
+// SavePeers adds peers to the address book, or marks known ones as seen at
+// their LastSeen, in a single transaction. A known address keeps its public
+// key unless it had none. The book is then trimmed to limit entries by
+// dropping the ones seen longest ago.
+func (s *sqlStore) SavePeers(peers []Peer, limit int) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, p := range peers {
+		_, err = tx.Exec(s.dialect.insertIgnore+" INTO peers (ip_address, public_key, source, first_seen, last_seen) VALUES (?, ?, ?, ?, ?)",
+			p.IPAddress, p.PublicKey, p.Source, p.LastSeen, p.LastSeen)
+		if err != nil {
+			return fmt.Errorf("failed to add peer %s: %w", p.IPAddress, err)
+		}
+		_, err = tx.Exec(`UPDATE peers SET last_seen = ?, public_key = CASE WHEN public_key = '' THEN ? ELSE public_key END
+			WHERE ip_address = ? AND last_seen <= ?`,
+			p.LastSeen, p.PublicKey, p.IPAddress, p.LastSeen)
+		if err != nil {
+			return fmt.Errorf("failed to update peer %s: %w", p.IPAddress, err)
+		}
+	}
+
+	// Keep the limit most recently seen peers
+	var stale []string
+	rows, err := tx.Query("SELECT ip_address FROM peers ORDER BY last_seen DESC, ip_address")
+	if err != nil {
+		return fmt.Errorf("failed to query peers: %w", err)
+	}
+	for i := 0; rows.Next(); i++ {
+		var ipAddress string
+		if err = rows.Scan(&ipAddress); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan peer: %w", err)
+		}
+		if i >= limit {
+			stale = append(stale, ipAddress)
+		}
+	}
+	rows.Close()
+	for _, ipAddress := range stale {
+		if _, err = tx.Exec("DELETE FROM peers WHERE ip_address = ?", ipAddress); err != nil {
+			return fmt.Errorf("failed to drop peer %s: %w", ipAddress, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RecordPeerAttempts marks the peers at the given addresses as tried at a
+// unix time, and drops those in forget from the address book, in a single
+// transaction.
+func (s *sqlStore) RecordPeerAttempts(attempted []string, forget []string, at int64) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, ipAddress := range attempted {
+		if _, err = tx.Exec("UPDATE peers SET last_attempt = ? WHERE ip_address = ?", at, ipAddress); err != nil {
+			return fmt.Errorf("failed to update peer %s: %w", ipAddress, err)
+		}
+	}
+	for _, ipAddress := range forget {
+		if _, err = tx.Exec("DELETE FROM peers WHERE ip_address = ?", ipAddress); err != nil {
+			return fmt.Errorf("failed to drop peer %s: %w", ipAddress, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
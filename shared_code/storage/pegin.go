@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// DepositAddress is the Bitcoin address a wallet pegs in to, with its output
+// script in hex.
+type DepositAddress struct {
+	Wallet    string `json:"wallet"`
+	Address   string `json:"address"`
+	Script    string `json:"script"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Deposit is a Bitcoin output paid to the deposit address of a wallet. A
+// block credits it to the wallet once it is deep enough.
+type Deposit struct {
+	Outpoint      string `json:"outpoint"` // txid:vout
+	Wallet        string `json:"wallet"`
+	Address       string `json:"address"`
+	Amount        int64  `json:"amount"` // sats
+	BitcoinBlock  string `json:"bitcoin_block"`
+	BitcoinHeight int64  `json:"bitcoin_height"`
+}
+
+// PegIn is a deposit credited by the block at BlockHeight.
+type PegIn struct {
+	Deposit
+	BlockHeight int64 `json:"block_height"`
+}
+
+// DepositRoot returns the hex SHA-256 of the JSON array of deposits, in block
+// order.
+func DepositRoot(deposits []Deposit) string {
+	payload, _ := json.Marshal(deposits)
+	hash := sha256.Sum256(payload)
+	return hex.EncodeToString(hash[:])
+}
+
+// pegInNonce is the nonce of the log entry that credits a deposit.
+func pegInNonce(outpoint string) string {
+	return "pegin:" + outpoint
+}
+
+// applyDeposits credits the deposits of the block at height inside an open
+// transaction and returns those that were applied. Each credit is logged as
+// an entry without a sender, like genesis, so a replay of the log
+// reproduces it, and the output becomes a peg UTXO.
+//
+// With rejected set, a deposit that was already credited is left out and
+// recorded in rejected, keyed by outpoint. Without it, such a deposit makes
+// the whole block invalid.
+func (s *sqlStore) applyDeposits(tx *sql.Tx, height, timestamp int64, deposits []Deposit, rejected map[string]error) ([]Deposit, error) {
+	var applied []Deposit
+	for _, deposit := range deposits {
+		if deposit.Amount <= 0 || deposit.Outpoint == "" || deposit.Wallet == "" {
+			return nil, fmt.Errorf("%w: deposit %s is incomplete", ErrInvalidBlock, deposit.Outpoint)
+		}
+		result, err := tx.Exec(s.dialect.insertIgnore+` INTO pegins (outpoint, wallet, address, amount, bitcoin_block, bitcoin_height, block_height)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			deposit.Outpoint, deposit.Wallet, deposit.Address, deposit.Amount, deposit.BitcoinBlock, deposit.BitcoinHeight, height)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert peg-in %s: %w", deposit.Outpoint, err)
+		}
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert peg-in %s: %w", deposit.Outpoint, err)
+		}
+		if inserted == 0 {
+			conflict := fmt.Errorf("%w: deposit %s is already credited", ErrInvalidBlock, deposit.Outpoint)
+			if rejected == nil {
+				return nil, conflict
+			}
+			rejected[deposit.Outpoint] = conflict
+			continue
+		}
+
+		if _, err := tx.Exec(s.dialect.insertIgnore+" INTO wallet_balances (wallet, balance) VALUES (?, 0)", deposit.Wallet); err != nil {
+			return nil, fmt.Errorf("failed to create wallet %s: %w", deposit.Wallet, err)
+		}
+		if err := s.credit(tx, deposit.Wallet, deposit.Amount); err != nil {
+			return nil, err
+		}
+		_, err = s.appendTransfer(tx, Transfer{
+			To:          deposit.Wallet,
+			Amount:      deposit.Amount,
+			Nonce:       pegInNonce(deposit.Outpoint),
+			Timestamp:   timestamp,
+			BlockHeight: height,
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec("INSERT INTO peg_utxos (outpoint, wallet, amount, block_height, spent_by) VALUES (?, ?, ?, ?, '')",
+			deposit.Outpoint, deposit.Wallet, deposit.Amount, height)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert peg output %s: %w", deposit.Outpoint, err)
+		}
+		applied = append(applied, deposit)
+	}
+	return applied, nil
+}
+
+// SaveDepositAddress stores the deposit address of a wallet. It returns false
+// if the wallet already has one.
+func (s *sqlStore) SaveDepositAddress(address DepositAddress) (bool, error) {
+	result, err := s.db.Exec(s.dialect.insertIgnore+" INTO deposit_addresses (wallet, address, script, created_at) VALUES (?, ?, ?, ?)",
+		address.Wallet, address.Address, address.Script, address.CreatedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert deposit address of %s: %w", address.Wallet, err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to insert deposit address of %s: %w", address.Wallet, err)
+	}
+	return inserted > 0, nil
+}
+
+// GetDepositAddress returns the deposit address of a wallet, or ErrNotFound.
+func (s *sqlStore) GetDepositAddress(wallet string) (DepositAddress, error) {
+	var address DepositAddress
+	err := s.db.QueryRow("SELECT wallet, address, script, created_at FROM deposit_addresses WHERE wallet = ?", wallet).
+		Scan(&address.Wallet, &address.Address, &address.Script, &address.CreatedAt)
+	if err == sql.ErrNoRows {
+		return DepositAddress{}, ErrNotFound
+	}
+	if err != nil {
+		return DepositAddress{}, fmt.Errorf("failed to query deposit address: %w", err)
+	}
+	return address, nil
+}
+
+// ListDepositAddresses returns every deposit address.
+func (s *sqlStore) ListDepositAddresses() ([]DepositAddress, error) {
+	rows, err := s.db.Query("SELECT wallet, address, script, created_at FROM deposit_addresses ORDER BY wallet")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deposit addresses: %w", err)
+	}
+	defer rows.Close()
+
+	var addresses []DepositAddress
+	for rows.Next() {
+		var address DepositAddress
+		if err := rows.Scan(&address.Wallet, &address.Address, &address.Script, &address.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan deposit address: %w", err)
+		}
+		addresses = append(addresses, address)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through deposit addresses: %w", err)
+	}
+	return addresses, nil
+}
+
+// LatestBitcoinBlock returns the height and hash of the last Bitcoin block
+// scanned, or ErrNotFound before the first.
+func (s *sqlStore) LatestBitcoinBlock() (int64, string, error) {
+	var height int64
+	var hash string
+	err := s.db.QueryRow("SELECT height, hash FROM bitcoin_blocks ORDER BY height DESC LIMIT 1").Scan(&height, &hash)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrNotFound
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to query latest bitcoin block: %w", err)
+	}
+	return height, hash, nil
+}
+
+// GetBitcoinBlock returns the hash of the scanned Bitcoin block at a height,
+// or ErrNotFound.
+func (s *sqlStore) GetBitcoinBlock(height int64) (string, error) {
+	var hash string
+	err := s.db.QueryRow("SELECT hash FROM bitcoin_blocks WHERE height = ?", height).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query bitcoin block %d: %w", height, err)
+	}
+	return hash, nil
+}
+
+// RecordBitcoinBlock stores a scanned Bitcoin block with the deposits found
+// in it and marks the recorded payouts it confirms, by txid, in a single
+// transaction.
+func (s *sqlStore) RecordBitcoinBlock(height int64, hash string, deposits []Deposit, payouts []string) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec("DELETE FROM bitcoin_blocks WHERE height = ?", height); err != nil {
+		return fmt.Errorf("failed to replace bitcoin block %d: %w", height, err)
+	}
+	if _, err = tx.Exec("INSERT INTO bitcoin_blocks (height, hash) VALUES (?, ?)", height, hash); err != nil {
+		return fmt.Errorf("failed to insert bitcoin block %d: %w", height, err)
+	}
+	for _, deposit := range deposits {
+		_, err = tx.Exec(s.dialect.insertIgnore+` INTO pegin_pending (outpoint, wallet, address, amount, bitcoin_block, bitcoin_height)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			deposit.Outpoint, deposit.Wallet, deposit.Address, deposit.Amount, deposit.BitcoinBlock, deposit.BitcoinHeight)
+		if err != nil {
+			return fmt.Errorf("failed to insert pending deposit %s: %w", deposit.Outpoint, err)
+		}
+	}
+	for _, txid := range payouts {
+		if _, err = tx.Exec("UPDATE payouts SET bitcoin_height = ? WHERE txid = ?", height, txid); err != nil {
+			return fmt.Errorf("failed to confirm payout %s: %w", txid, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RewindBitcoin forgets the scanned Bitcoin blocks above a height, the
+// deposits found in them and the confirmations of the payouts they held,
+// after a reorganization.
+func (s *sqlStore) RewindBitcoin(height int64) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec("DELETE FROM bitcoin_blocks WHERE height > ?", height); err != nil {
+		return fmt.Errorf("failed to delete bitcoin blocks above %d: %w", height, err)
+	}
+	if _, err = tx.Exec("DELETE FROM pegin_pending WHERE bitcoin_height > ?", height); err != nil {
+		return fmt.Errorf("failed to delete pending deposits above %d: %w", height, err)
+	}
+	if _, err = tx.Exec("UPDATE payouts SET bitcoin_height = 0 WHERE bitcoin_height > ?", height); err != nil {
+		return fmt.Errorf("failed to unconfirm payouts above %d: %w", height, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ListPendingDeposits returns the deposits found in scanned Bitcoin blocks
+// that no block credited yet, oldest first.
+func (s *sqlStore) ListPendingDeposits() ([]Deposit, error) {
+	rows, err := s.db.Query(`SELECT p.outpoint, p.wallet, p.address, p.amount, p.bitcoin_block, p.bitcoin_height
+		FROM pegin_pending p
+		LEFT JOIN pegins c ON c.outpoint = p.outpoint
+		WHERE c.outpoint IS NULL
+		ORDER BY p.bitcoin_height, p.outpoint`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending deposits: %w", err)
+	}
+	defer rows.Close()
+
+	var deposits []Deposit
+	for rows.Next() {
+		var d Deposit
+		if err := rows.Scan(&d.Outpoint, &d.Wallet, &d.Address, &d.Amount, &d.BitcoinBlock, &d.BitcoinHeight); err != nil {
+			return nil, fmt.Errorf("failed to scan pending deposit: %w", err)
+		}
+		deposits = append(deposits, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through pending deposits: %w", err)
+	}
+	return deposits, nil
+}
+
+// GetPegIn returns the credited deposit of an outpoint, or ErrNotFound.
+func (s *sqlStore) GetPegIn(outpoint string) (PegIn, error) {
+	pegins, err := s.pegIns("WHERE outpoint = ?", outpoint)
+	if err != nil {
+		return PegIn{}, err
+	}
+	if len(pegins) == 0 {
+		return PegIn{}, ErrNotFound
+	}
+	return pegins[0], nil
+}
+
+// ListWalletPegIns returns the deposits credited to a wallet, newest first.
+func (s *sqlStore) ListWalletPegIns(wallet string) ([]PegIn, error) {
+	return s.pegIns("WHERE wallet = ? ORDER BY block_height DESC, outpoint", wallet)
+}
+
+func (s *sqlStore) pegIns(where string, args ...interface{}) ([]PegIn, error) {
+	rows, err := s.db.Query(`SELECT outpoint, wallet, address, amount, bitcoin_block, bitcoin_height, block_height
+		FROM pegins `+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query peg-ins: %w", err)
+	}
+	defer rows.Close()
+
+	var pegins []PegIn
+	for rows.Next() {
+		var p PegIn
+		if err := rows.Scan(&p.Outpoint, &p.Wallet, &p.Address, &p.Amount, &p.BitcoinBlock, &p.BitcoinHeight, &p.BlockHeight); err != nil {
+			return nil, fmt.Errorf("failed to scan peg-in: %w", err)
+		}
+		pegins = append(pegins, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through peg-ins: %w", err)
+	}
+	return pegins, nil
+}
@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// WithdrawalPrefix starts the recipient of a transfer that withdraws to
+// Bitcoin: "bitcoin:" and the address. Such a transfer burns the amount and
+// queues a withdrawal instead of crediting a wallet.
+const WithdrawalPrefix = "bitcoin:"
+
+// WithdrawalAddress returns the Bitcoin address a transfer recipient
+// withdraws to, and false if the recipient is a wallet.
+func WithdrawalAddress(to string) (string, bool) {
+	if !strings.HasPrefix(to, WithdrawalPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(to, WithdrawalPrefix), true
+}
+
+// Withdrawal is a transfer to a Bitcoin address applied by the block at
+// BlockHeight. It is queued until the payout with the Bitcoin transaction id
+// Payout pays it.
+type Withdrawal struct {
+	TxID        string `json:"tx_id"`
+	Wallet      string `json:"wallet"`
+	Address     string `json:"address"`
+	Amount      int64  `json:"amount"` // sats burned; the payout pays it less its fee
+	BlockHeight int64  `json:"block_height"`
+	Payout      string `json:"payout,omitempty"`
+}
+
+// PegUTXO is a Bitcoin output held by the peg: a credited deposit, paid to
+// the deposit address of Wallet, or the change of a payout, with no wallet.
+type PegUTXO struct {
+	Outpoint    string `json:"outpoint"`
+	Wallet      string `json:"wallet,omitempty"`
+	Amount      int64  `json:"amount"`
+	BlockHeight int64  `json:"block_height"`
+	SpentBy     string `json:"spent_by,omitempty"`
+}
+
+// Payout is a signed Bitcoin transaction that spends peg UTXOs to pay queued
+// withdrawals. Output i pays withdrawal i its amount less Fee, and the last
+// output, if Change is not 0, returns the change to the peg.
+type Payout struct {
+	TxID        string   `json:"txid"`
+	Tx          string   `json:"tx"`          // hex
+	Withdrawals []string `json:"withdrawals"` // tx ids, in output order
+	Inputs      []string `json:"inputs"`      // outpoints, in input order
+	Fee         int64    `json:"fee"`         // sats taken from each withdrawal
+	Change      int64    `json:"change"`
+}
+
+// ChangeOutpoint returns the outpoint of the payout's change.
+func (p Payout) ChangeOutpoint() string {
+	return fmt.Sprintf("%s:%d", p.TxID, len(p.Withdrawals))
+}
+
+// PegOut is a payout recorded by the block at BlockHeight. BitcoinHeight is
+// where this node saw it confirm, 0 until then. Its withdrawals and inputs
+// are listed sorted.
+type PegOut struct {
+	Payout
+	BlockHeight   int64 `json:"block_height"`
+	BitcoinHeight int64 `json:"bitcoin_height"`
+}
+
+// PegChanges are the Bitcoin deposits a block credits and the payouts it
+// records.
+type PegChanges struct {
+	Deposits []Deposit
+	Payouts  []Payout
+}
+
+// PayoutRoot returns the hex SHA-256 of the JSON array of payouts, in block
+// order.
+func PayoutRoot(payouts []Payout) string {
+	payload, _ := json.Marshal(payouts)
+	hash := sha256.Sum256(payload)
+	return hex.EncodeToString(hash[:])
+}
+
+// applyWithdrawal burns the amount of a transfer to a Bitcoin address inside
+// an open transaction and queues the withdrawal. The nonce is already
+// consumed.
+func (s *sqlStore) applyWithdrawal(tx *sql.Tx, transfer Transfer, address string) (Transfer, error) {
+	var balance int64
+	err := tx.QueryRow("SELECT COALESCE(balance, 0) FROM wallet_balances WHERE wallet = ?"+s.dialect.forUpdate, transfer.From).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return Transfer{}, fmt.Errorf("wallet %s: %w", transfer.From, ErrNotFound)
+	}
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to lock wallet: %w", err)
+	}
+	if balance < transfer.Amount {
+		return Transfer{}, fmt.Errorf("wallet %s: %w", transfer.From, ErrInsufficientFunds)
+	}
+	if err := s.debit(tx, transfer.From, transfer.Amount); err != nil {
+		return Transfer{}, err
+	}
+
+	logged, err := s.appendTransfer(tx, transfer)
+	if err != nil {
+		return Transfer{}, err
+	}
+	_, err = tx.Exec("INSERT INTO withdrawals (tx_id, wallet, address, amount, block_height, payout) VALUES (?, ?, ?, ?, ?, '')",
+		logged.TxID, logged.From, address, logged.Amount, logged.BlockHeight)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to queue withdrawal %s: %w", logged.TxID, err)
+	}
+	return logged, nil
+}
+
+// applyPayouts records the payouts of the block at height inside an open
+// transaction and returns those that were applied: their withdrawals are
+// paid, their inputs spent and their change becomes a peg UTXO.
+//
+// With rejected set, a payout that pays a withdrawal already paid or spends
+// an output already spent is left out and recorded in rejected, keyed by
+// txid. Without it, such a payout makes the whole block invalid.
+func (s *sqlStore) applyPayouts(tx *sql.Tx, height int64, payouts []Payout, rejected map[string]error) ([]Payout, error) {
+	var applied []Payout
+	for _, payout := range payouts {
+		if rejected == nil {
+			if err := s.applyPayout(tx, height, payout); err != nil {
+				return nil, err
+			}
+			applied = append(applied, payout)
+			continue
+		}
+
+		if _, err := tx.Exec("SAVEPOINT block_payout"); err != nil {
+			return nil, fmt.Errorf("failed to create savepoint: %w", err)
+		}
+		applyErr := s.applyPayout(tx, height, payout)
+		var err error
+		switch {
+		case applyErr == nil:
+			applied = append(applied, payout)
+			_, err = tx.Exec("RELEASE SAVEPOINT block_payout")
+		case errors.Is(applyErr, ErrInvalidBlock):
+			rejected[payout.TxID] = applyErr
+			_, err = tx.Exec("ROLLBACK TO SAVEPOINT block_payout")
+		default:
+			return nil, applyErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to close savepoint: %w", err)
+		}
+	}
+	return applied, nil
+}
+
+// applyPayout records one payout. The amounts must add up: the inputs hold
+// exactly the withdrawn amounts and the change.
+func (s *sqlStore) applyPayout(tx *sql.Tx, height int64, payout Payout) error {
+	if payout.TxID == "" || payout.Tx == "" || len(payout.Withdrawals) == 0 || len(payout.Inputs) == 0 || payout.Fee <= 0 || payout.Change < 0 {
+		return fmt.Errorf("%w: payout %s is incomplete", ErrInvalidBlock, payout.TxID)
+	}
+
+	// Pay the withdrawals, each once
+	var withdrawn int64
+	for _, id := range payout.Withdrawals {
+		var amount int64
+		err := tx.QueryRow("SELECT amount FROM withdrawals WHERE tx_id = ? AND payout = ''", id).Scan(&amount)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: payout %s pays withdrawal %s, which is not queued", ErrInvalidBlock, payout.TxID, id)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query withdrawal %s: %w", id, err)
+		}
+		if _, err := tx.Exec("UPDATE withdrawals SET payout = ? WHERE tx_id = ?", payout.TxID, id); err != nil {
+			return fmt.Errorf("failed to mark withdrawal %s paid: %w", id, err)
+		}
+		withdrawn += amount
+	}
+
+	// Spend the inputs, each once
+	var spent int64
+	for _, outpoint := range payout.Inputs {
+		var amount int64
+		err := tx.QueryRow("SELECT amount FROM peg_utxos WHERE outpoint = ? AND spent_by = ''", outpoint).Scan(&amount)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: payout %s spends %s, which is not an unspent peg output", ErrInvalidBlock, payout.TxID, outpoint)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query peg output %s: %w", outpoint, err)
+		}
+		if _, err := tx.Exec("UPDATE peg_utxos SET spent_by = ? WHERE outpoint = ?", payout.TxID, outpoint); err != nil {
+			return fmt.Errorf("failed to mark peg output %s spent: %w", outpoint, err)
+		}
+		spent += amount
+	}
+	if spent != withdrawn+payout.Change {
+		return fmt.Errorf("%w: payout %s spends %d sats for %d withdrawn and %d change", ErrInvalidBlock, payout.TxID, spent, withdrawn, payout.Change)
+	}
+
+	if payout.Change > 0 {
+		_, err := tx.Exec("INSERT INTO peg_utxos (outpoint, wallet, amount, block_height, spent_by) VALUES (?, '', ?, ?, '')",
+			payout.ChangeOutpoint(), payout.Change, height)
+		if err != nil {
+			return fmt.Errorf("failed to insert change of payout %s: %w", payout.TxID, err)
+		}
+	}
+	result, err := tx.Exec(s.dialect.insertIgnore+" INTO payouts (txid, tx, fee, change_amount, block_height, bitcoin_height) VALUES (?, ?, ?, ?, ?, 0)",
+		payout.TxID, payout.Tx, payout.Fee, payout.Change, height)
+	if err != nil {
+		return fmt.Errorf("failed to insert payout %s: %w", payout.TxID, err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to insert payout %s: %w", payout.TxID, err)
+	}
+	if inserted == 0 {
+		return fmt.Errorf("%w: payout %s is already recorded", ErrInvalidBlock, payout.TxID)
+	}
+	return nil
+}
+
+// GetWithdrawal returns a withdrawal by tx id, or ErrNotFound.
+func (s *sqlStore) GetWithdrawal(txID string) (Withdrawal, error) {
+	withdrawals, err := s.withdrawals("WHERE tx_id = ?", txID)
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	if len(withdrawals) == 0 {
+		return Withdrawal{}, ErrNotFound
+	}
+	return withdrawals[0], nil
+}
+
+// ListQueuedWithdrawals returns up to limit withdrawals no payout pays yet,
+// oldest first.
+func (s *sqlStore) ListQueuedWithdrawals(limit int) ([]Withdrawal, error) {
+	return s.withdrawals("WHERE payout = '' ORDER BY block_height, tx_id LIMIT ?", limit)
+}
+
+func (s *sqlStore) withdrawals(where string, args ...interface{}) ([]Withdrawal, error) {
+	return queryWithdrawals(s.db, where, args...)
+}
+
+func queryWithdrawals(db querier, where string, args ...interface{}) ([]Withdrawal, error) {
+	rows, err := db.Query("SELECT tx_id, wallet, address, amount, block_height, payout FROM withdrawals "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query withdrawals: %w", err)
+	}
+	defer rows.Close()
+
+	var withdrawals []Withdrawal
+	for rows.Next() {
+		var w Withdrawal
+		if err := rows.Scan(&w.TxID, &w.Wallet, &w.Address, &w.Amount, &w.BlockHeight, &w.Payout); err != nil {
+			return nil, fmt.Errorf("failed to scan withdrawal: %w", err)
+		}
+		withdrawals = append(withdrawals, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through withdrawals: %w", err)
+	}
+	return withdrawals, nil
+}
+
+// GetPegUTXO returns a peg output, spent or not, or ErrNotFound.
+func (s *sqlStore) GetPegUTXO(outpoint string) (PegUTXO, error) {
+	utxos, err := s.pegUTXOs("WHERE outpoint = ?", outpoint)
+	if err != nil {
+		return PegUTXO{}, err
+	}
+	if len(utxos) == 0 {
+		return PegUTXO{}, ErrNotFound
+	}
+	return utxos[0], nil
+}
+
+// ListUnspentPegUTXOs returns the outputs the peg holds, oldest first.
+func (s *sqlStore) ListUnspentPegUTXOs() ([]PegUTXO, error) {
+	return s.pegUTXOs("WHERE spent_by = '' ORDER BY block_height, outpoint")
+}
+
+func (s *sqlStore) pegUTXOs(where string, args ...interface{}) ([]PegUTXO, error) {
+	return queryPegUTXOs(s.db, where, args...)
+}
+
+func queryPegUTXOs(db querier, where string, args ...interface{}) ([]PegUTXO, error) {
+	rows, err := db.Query("SELECT outpoint, wallet, amount, block_height, spent_by FROM peg_utxos "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query peg outputs: %w", err)
+	}
+	defer rows.Close()
+
+	var utxos []PegUTXO
+	for rows.Next() {
+		var u PegUTXO
+		if err := rows.Scan(&u.Outpoint, &u.Wallet, &u.Amount, &u.BlockHeight, &u.SpentBy); err != nil {
+			return nil, fmt.Errorf("failed to scan peg output: %w", err)
+		}
+		utxos = append(utxos, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through peg outputs: %w", err)
+	}
+	return utxos, nil
+}
+
+// GetPayout returns a recorded payout, or ErrNotFound.
+func (s *sqlStore) GetPayout(txid string) (PegOut, error) {
+	payouts, err := s.payouts("WHERE txid = ?", txid)
+	if err != nil {
+		return PegOut{}, err
+	}
+	if len(payouts) == 0 {
+		return PegOut{}, ErrNotFound
+	}
+	return payouts[0], nil
+}
+
+// ListUnconfirmedPayouts returns the recorded payouts this node has not seen
+// confirm, oldest first.
+func (s *sqlStore) ListUnconfirmedPayouts() ([]PegOut, error) {
+	return s.payouts("WHERE bitcoin_height = 0 ORDER BY block_height, txid")
+}
+
+func (s *sqlStore) payouts(where string, args ...interface{}) ([]PegOut, error) {
+	rows, err := s.db.Query("SELECT txid, tx, fee, change_amount, block_height, bitcoin_height FROM payouts "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query payouts: %w", err)
+	}
+	var payouts []PegOut
+	for rows.Next() {
+		var p PegOut
+		if err := rows.Scan(&p.TxID, &p.Tx, &p.Fee, &p.Change, &p.BlockHeight, &p.BitcoinHeight); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan payout: %w", err)
+		}
+		payouts = append(payouts, p)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through payouts: %w", err)
+	}
+
+	// Fill in what each pays and spends
+	for i := range payouts {
+		paid, err := s.withdrawals("WHERE payout = ? ORDER BY tx_id", payouts[i].TxID)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range paid {
+			payouts[i].Withdrawals = append(payouts[i].Withdrawals, w.TxID)
+		}
+		spent, err := s.pegUTXOs("WHERE spent_by = ? ORDER BY outpoint", payouts[i].TxID)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range spent {
+			payouts[i].Inputs = append(payouts[i].Inputs, u.Outpoint)
+		}
+	}
+	return payouts, nil
+}
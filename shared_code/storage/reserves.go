@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// querier runs a query on the database or inside a transaction.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Reserves is what backs the supply after the block at Height: the peg UTXOs
+// not spent by a recorded payout and the withdrawals burnt but not paid yet.
+// Every credit comes with a peg UTXO and every burn queues a withdrawal, so
+// the UTXOs add up to Supply plus the queued withdrawals.
+type Reserves struct {
+	Height      int64
+	BlockHash   string
+	Supply      int64
+	UTXOs       []PegUTXO    // by outpoint
+	Withdrawals []Withdrawal // oldest first
+}
+
+// GetReserves reads the supply, the unspent peg UTXOs and the queued
+// withdrawals in one transaction, so they all belong to the same block.
+func (s *sqlStore) GetReserves() (reserves Reserves, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Reserves{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT height, hash FROM blocks ORDER BY height DESC LIMIT 1").Scan(&reserves.Height, &reserves.BlockHash)
+	if err == sql.ErrNoRows {
+		reserves.BlockHash, err = ZeroHash, nil
+	}
+	if err != nil {
+		return Reserves{}, fmt.Errorf("failed to read latest block: %w", err)
+	}
+	if err := tx.QueryRow("SELECT COALESCE(SUM(balance), 0) FROM wallet_balances").Scan(&reserves.Supply); err != nil {
+		return Reserves{}, fmt.Errorf("failed to sum wallet balances: %w", err)
+	}
+	if reserves.UTXOs, err = queryPegUTXOs(tx, "WHERE spent_by = '' ORDER BY outpoint"); err != nil {
+		return Reserves{}, err
+	}
+	if reserves.Withdrawals, err = queryWithdrawals(tx, "WHERE payout = '' ORDER BY block_height, tx_id"); err != nil {
+		return Reserves{}, err
+	}
+	return reserves, nil
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// NewSQLiteStore opens (or creates) an SQLite database file and brings its
+// schema up to date.
+func NewSQLiteStore(path string) (Store, error) {
+	// Take the write lock when a transaction begins and wait for other
+	// writers instead of failing with "database is locked".
+	dsn := path
+	if strings.Contains(dsn, "?") {
+		dsn += "&"
+	} else {
+		dsn += "?"
+	}
+	dsn += "_txlock=immediate&_busy_timeout=5000"
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+	// SQLite allows a single writer, so share one connection.
+	db.SetMaxOpenConns(1)
+
+	store := &sqlStore{
+		db: db,
+		dialect: dialect{
+			name:         "sqlite",
+			insertIgnore: "INSERT OR IGNORE",
+		},
+	}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
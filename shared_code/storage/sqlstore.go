@@ -0,0 +1,566 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// dialect holds the few statements that differ between MySQL and SQLite.
+type dialect struct {
+	name         string           // migrations directory: "mysql" or "sqlite"
+	insertIgnore string           // "INSERT IGNORE" or "INSERT OR IGNORE"
+	forUpdate    string           // row lock suffix for SELECT; empty where the whole database is locked
+	deadlock     func(error) bool // reports a transaction rolled back as a deadlock victim; nil if none can be
+}
+
+// maxTransferAttempts bounds how often a transfer that lost a deadlock is
+// tried again.
+const maxTransferAttempts = 5
+
+// sqlStore implements Store on top of database/sql. The MySQL and SQLite
+// backends share it and only differ in their dialect.
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// GetBalance returns the balance of a wallet, or ErrNotFound.
+func (s *sqlStore) GetBalance(wallet string) (int64, error) {
+	var balance int64
+	err := s.db.QueryRow("SELECT COALESCE(balance, 0) FROM wallet_balances WHERE wallet = ?", wallet).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to query wallet balance: %w", err)
+	}
+	return balance, nil
+}
+
+// CreateWallet creates a wallet with a balance of 0. It returns false if the
+// wallet already exists.
+func (s *sqlStore) CreateWallet(wallet string) (bool, error) {
+	var exists int
+	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM wallet_balances WHERE wallet = ?)", wallet).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check wallet existence: %w", err)
+	}
+	if exists == 1 {
+		return false, nil
+	}
+
+	_, err = s.db.Exec("INSERT INTO wallet_balances (wallet, balance) VALUES (?, 0)", wallet)
+	if err != nil {
+		return false, fmt.Errorf("failed to create new wallet: %w", err)
+	}
+	return true, nil
+}
+
+// MoveSats moves an amount from one wallet to another, checking for sufficient balance.
+func (s *sqlStore) MoveSats(from string, to string, amount int64) (err error) {
+	if amount <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidAmount, amount)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	// Rollback if something goes wrong
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Check balance of the sender, locking the row so concurrent transfers
+	// from the same wallet wait for this one to finish
+	var fromBalance int64
+	err = tx.QueryRow("SELECT COALESCE(balance, 0) FROM wallet_balances WHERE wallet = ?"+s.dialect.forUpdate, from).Scan(&fromBalance)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("wallet %s: %w", from, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to retrieve balance for fromAddress: %w", err)
+	}
+
+	// Ensure the sender has sufficient funds
+	if fromBalance < amount {
+		return fmt.Errorf("wallet %s: %w", from, ErrInsufficientFunds)
+	}
+
+	if err = s.debit(tx, from, amount); err != nil {
+		return err
+	}
+	if err = s.credit(tx, to, amount); err != nil {
+		return err
+	}
+
+	// Record the move in the transactions log under an internal nonce
+	nonce, err := internalNonce()
+	if err != nil {
+		return err
+	}
+	if _, err = s.appendTransfer(tx, Transfer{From: from, To: to, Amount: amount, Nonce: nonce}); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ApplyTransfer consumes the nonce, creates the recipient if needed, moves
+// the amount and appends the transfer to the transactions log in a single
+// transaction. The sender and recipient rows are locked for the duration, so
+// either every step happens or none does. It returns the logged entry.
+func (s *sqlStore) ApplyTransfer(transfer Transfer) (Transfer, error) {
+	if transfer.Amount <= 0 {
+		return Transfer{}, fmt.Errorf("%w: %d", ErrInvalidAmount, transfer.Amount)
+	}
+
+	// MySQL can still pick the transaction as a deadlock victim, when two
+	// transfers lock the gap where the same new recipient goes. Nothing of it
+	// was kept, so it is tried again
+	for attempt := 1; ; attempt++ {
+		logged, err := s.tryTransfer(transfer)
+		if err == nil || s.dialect.deadlock == nil || !s.dialect.deadlock(err) || attempt == maxTransferAttempts {
+			return logged, err
+		}
+	}
+}
+
+// tryTransfer runs applyTransfer in a transaction of its own.
+func (s *sqlStore) tryTransfer(transfer Transfer) (logged Transfer, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	// Rollback if something goes wrong
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	logged, err = s.applyTransfer(tx, transfer)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Transfer{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return logged, nil
+}
+
+// applyTransfer runs the steps of ApplyTransfer inside an open transaction.
+func (s *sqlStore) applyTransfer(tx *sql.Tx, transfer Transfer) (Transfer, error) {
+	from, to, amount := transfer.From, transfer.To, transfer.Amount
+
+	// Consume the nonce; an ignored insert means it was already used
+	result, err := tx.Exec(s.dialect.insertIgnore+" INTO nonce (nonce) VALUES (?)", transfer.Nonce)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to insert nonce: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to insert nonce: %w", err)
+	}
+	if inserted == 0 {
+		return Transfer{}, fmt.Errorf("nonce %s: %w", transfer.Nonce, ErrNonceUsed)
+	}
+
+	// A transfer to a Bitcoin address burns the amount instead
+	if address, ok := WithdrawalAddress(to); ok {
+		return s.applyWithdrawal(tx, transfer, address)
+	}
+
+	// Lock both rows, always in the same order, before anything is written,
+	// so two transfers never hold rows the other one waits for
+	rows, err := tx.Query("SELECT wallet, COALESCE(balance, 0) FROM wallet_balances WHERE wallet IN (?, ?) ORDER BY wallet"+s.dialect.forUpdate, from, to)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to lock wallets: %w", err)
+	}
+	var fromBalance int64
+	var fromFound, toFound bool
+	for rows.Next() {
+		var wallet string
+		var balance int64
+		if err = rows.Scan(&wallet, &balance); err != nil {
+			rows.Close()
+			return Transfer{}, fmt.Errorf("failed to scan wallet: %w", err)
+		}
+		if wallet == from {
+			fromBalance, fromFound = balance, true
+		}
+		if wallet == to {
+			toFound = true
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return Transfer{}, fmt.Errorf("failed to lock wallets: %w", err)
+	}
+	if !fromFound {
+		return Transfer{}, fmt.Errorf("wallet %s: %w", from, ErrNotFound)
+	}
+
+	// Ensure the sender has sufficient funds
+	if fromBalance < amount {
+		return Transfer{}, fmt.Errorf("wallet %s: %w", from, ErrInsufficientFunds)
+	}
+
+	// Create the recipient with a balance of 0 if it does not exist yet
+	if !toFound {
+		if _, err = tx.Exec(s.dialect.insertIgnore+" INTO wallet_balances (wallet, balance) VALUES (?, 0)", to); err != nil {
+			return Transfer{}, fmt.Errorf("failed to create recipient wallet: %w", err)
+		}
+	}
+
+	if err = s.debit(tx, from, amount); err != nil {
+		return Transfer{}, err
+	}
+	if err = s.credit(tx, to, amount); err != nil {
+		return Transfer{}, err
+	}
+
+	return s.appendTransfer(tx, transfer)
+}
+
+// debit subtracts an amount from a wallet. The balance condition is checked
+// again in the UPDATE itself, so a balance can never go below zero even if a
+// caller skipped the locked read.
+func (s *sqlStore) debit(tx *sql.Tx, wallet string, amount int64) error {
+	result, err := tx.Exec("UPDATE wallet_balances SET balance = balance - ? WHERE wallet = ? AND balance >= ?", amount, wallet, amount)
+	if err != nil {
+		return fmt.Errorf("failed to deduct amount from %s: %w", wallet, err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to deduct amount from %s: %w", wallet, err)
+	}
+	if updated != 1 {
+		return fmt.Errorf("wallet %s: %w", wallet, ErrInsufficientFunds)
+	}
+	return nil
+}
+
+// credit adds an amount to an existing wallet.
+func (s *sqlStore) credit(tx *sql.Tx, wallet string, amount int64) error {
+	result, err := tx.Exec("UPDATE wallet_balances SET balance = COALESCE(balance, 0) + ? WHERE wallet = ?", amount, wallet)
+	if err != nil {
+		return fmt.Errorf("failed to add amount to %s: %w", wallet, err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to add amount to %s: %w", wallet, err)
+	}
+	if updated != 1 {
+		return fmt.Errorf("wallet %s: %w", wallet, ErrNotFound)
+	}
+	return nil
+}
+
+// TotalSupply returns the sum of every wallet balance.
+func (s *sqlStore) TotalSupply() (int64, error) {
+	var total int64
+	if err := s.db.QueryRow("SELECT COALESCE(SUM(balance), 0) FROM wallet_balances").Scan(&total); err != nil {
+		return 0, fmt.Errorf("failed to sum wallet balances: %w", err)
+	}
+	return total, nil
+}
+
+// CheckNonce checks if a nonce exists in the nonce table and adds it if it
+// does not. It returns true if the nonce was already used.
+func (s *sqlStore) CheckNonce(nonce string) (bool, error) {
+	var exists int
+	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM nonce WHERE nonce = ?)", nonce).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("query execution failed: %w", err)
+	}
+	if exists == 1 {
+		return true, nil
+	}
+
+	if _, err := s.db.Exec("INSERT INTO nonce (nonce) VALUES (?)", nonce); err != nil {
+		return false, fmt.Errorf("failed to insert nonce: %w", err)
+	}
+	return false, nil
+}
+
+// NonceUsed reports whether a nonce was already consumed, without consuming it.
+func (s *sqlStore) NonceUsed(nonce string) (bool, error) {
+	var exists int
+	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM nonce WHERE nonce = ?)", nonce).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("query execution failed: %w", err)
+	}
+	return exists == 1, nil
+}
+
+// ListNodes returns every row of the nodes table ordered by computer_id.
+func (s *sqlStore) ListNodes() ([]Node, error) {
+	rows, err := s.db.Query(`
+		SELECT COALESCE(sort_order, 0), computer_id, COALESCE(ip_address, ''), COALESCE(node_group, 0), reachable, public_key, admitted_height
+		FROM nodes
+		ORDER BY computer_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query nodes: %w", err)
+	}
+	defer rows.Close()
+
+	var nodes []Node
+	for rows.Next() {
+		var node Node
+		if err := rows.Scan(&node.SortOrder, &node.ComputerID, &node.IPAddress, &node.NodeGroup, &node.Reachable, &node.PublicKey, &node.AdmittedHeight); err != nil {
+			return nil, fmt.Errorf("failed to scan node: %w", err)
+		}
+		nodes = append(nodes, node)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through nodes: %w", err)
+	}
+	return nodes, nil
+}
+
+// GetNode returns the node with a computer_id, or ErrNotFound.
+func (s *sqlStore) GetNode(computerID string) (Node, error) {
+	return s.getNode("computer_id = ?", computerID)
+}
+
+// GetNodeAt returns the node listed at an ip_address, the first in sort
+// order if several are, or ErrNotFound.
+func (s *sqlStore) GetNodeAt(ipAddress string) (Node, error) {
+	return s.getNode("ip_address = ? ORDER BY sort_order, computer_id LIMIT 1", ipAddress)
+}
+
+// getNode returns the first node matching a condition on the nodes table.
+func (s *sqlStore) getNode(condition string, value string) (Node, error) {
+	var node Node
+	err := s.db.QueryRow(`
+		SELECT COALESCE(sort_order, 0), computer_id, COALESCE(ip_address, ''), COALESCE(node_group, 0), reachable, public_key, admitted_height
+		FROM nodes
+		WHERE `+condition, value).
+		Scan(&node.SortOrder, &node.ComputerID, &node.IPAddress, &node.NodeGroup, &node.Reachable, &node.PublicKey, &node.AdmittedHeight)
+	if err == sql.ErrNoRows {
+		return Node{}, ErrNotFound
+	}
+	if err != nil {
+		return Node{}, fmt.Errorf("failed to query node %s: %w", value, err)
+	}
+	return node, nil
+}
+
+// ReplaceNodes clears the nodes table and inserts the given rows in one transaction.
+func (s *sqlStore) ReplaceNodes(nodes []Node) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = s.replaceNodes(tx, nodes); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// replaceNodes runs the steps of ReplaceNodes inside an open transaction.
+func (s *sqlStore) replaceNodes(tx *sql.Tx, nodes []Node) error {
+	if _, err := tx.Exec("DELETE FROM nodes"); err != nil {
+		return fmt.Errorf("failed to delete data from 'nodes' table: %w", err)
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO nodes (sort_order, computer_id, ip_address, node_group, reachable, public_key, admitted_height) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, node := range nodes {
+		if _, err = stmt.Exec(node.SortOrder, node.ComputerID, node.IPAddress, node.NodeGroup, node.Reachable, node.PublicKey, node.AdmittedHeight); err != nil {
+			return fmt.Errorf("failed to insert node %s: %w", node.ComputerID, err)
+		}
+	}
+	return nil
+}
+
+// InsertNode adds a single row to the nodes table.
+func (s *sqlStore) InsertNode(node Node) error {
+	_, err := s.db.Exec("INSERT INTO nodes (sort_order, computer_id, ip_address, node_group, reachable, public_key, admitted_height) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		node.SortOrder, node.ComputerID, node.IPAddress, node.NodeGroup, node.Reachable, node.PublicKey, node.AdmittedHeight)
+	if err != nil {
+		return fmt.Errorf("failed to insert node %s: %w", node.ComputerID, err)
+	}
+	return nil
+}
+
+// NodeExists reports whether an address is in the nodes table.
+func (s *sqlStore) NodeExists(ipAddress string) (bool, error) {
+	return s.contains("nodes", ipAddress)
+}
+
+// SetNodeReachable updates the reachable flag of a node.
+func (s *sqlStore) SetNodeReachable(ipAddress string, reachable bool) error {
+	_, err := s.db.Exec("UPDATE nodes SET reachable = ? WHERE ip_address = ?", reachable, ipAddress)
+	if err != nil {
+		return fmt.Errorf("failed to update reachable status for %s: %w", ipAddress, err)
+	}
+	return nil
+}
+
+// ListReachableNodes returns the addresses of every node marked reachable.
+func (s *sqlStore) ListReachableNodes() ([]string, error) {
+	return s.listAddresses("SELECT ip_address FROM nodes WHERE reachable = 1 AND ip_address IS NOT NULL")
+}
+
+// QueueContains reports whether an address is in nodes_que.
+func (s *sqlStore) QueueContains(ipAddress string) (bool, error) {
+	return s.contains("nodes_que", ipAddress)
+}
+
+// AddToBuffer inserts an address, the public key it proved to hold and the
+// registration that proved it into nodes_buffer.
+func (s *sqlStore) AddToBuffer(registration Registration) error {
+	_, err := s.db.Exec(`INSERT INTO nodes_buffer (ip_address, public_key, registered_by, registration_nonce, registration_signature)
+		VALUES (?, ?, ?, ?, ?)`,
+		registration.IPAddress, registration.PublicKey, registration.RegisteredBy, registration.Nonce, registration.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to add %s to nodes_buffer: %w", registration.IPAddress, err)
+	}
+	return nil
+}
+
+// AddAllToBuffer inserts registrations from a peer into nodes_buffer in a
+// single transaction, ignoring addresses already buffered.
+func (s *sqlStore) AddAllToBuffer(registrations []Registration) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, registration := range registrations {
+		_, err = tx.Exec(s.dialect.insertIgnore+` INTO nodes_buffer
+				(ip_address, public_key, registered_by, registration_nonce, registration_signature)
+			VALUES (?, ?, ?, ?, ?)`,
+			registration.IPAddress, registration.PublicKey, registration.RegisteredBy, registration.Nonce, registration.Signature)
+		if err != nil {
+			return fmt.Errorf("failed to add %s to nodes_buffer: %w", registration.IPAddress, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ListBuffer returns every registration in nodes_buffer ordered by address.
+func (s *sqlStore) ListBuffer() ([]Registration, error) {
+	rows, err := s.db.Query(`SELECT ip_address, public_key, registered_by, registration_nonce, registration_signature
+		FROM nodes_buffer
+		ORDER BY ip_address`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query nodes_buffer: %w", err)
+	}
+	defer rows.Close()
+
+	var registrations []Registration
+	for rows.Next() {
+		var r Registration
+		if err := rows.Scan(&r.IPAddress, &r.PublicKey, &r.RegisteredBy, &r.Nonce, &r.Signature); err != nil {
+			return nil, fmt.Errorf("failed to scan buffer entry: %w", err)
+		}
+		registrations = append(registrations, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through nodes_buffer: %w", err)
+	}
+	return registrations, nil
+}
+
+// BufferContains reports whether an address is in nodes_buffer.
+func (s *sqlStore) BufferContains(ipAddress string) (bool, error) {
+	return s.contains("nodes_buffer", ipAddress)
+}
+
+// MoveBufferToQueue moves every address from nodes_buffer to nodes_que, where
+// its probation starts with epoch.
+func (s *sqlStore) MoveBufferToQueue(epoch int64) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec(s.dialect.insertIgnore+` INTO nodes_que
+			(ip_address, public_key, registered_by, registration_nonce, registration_signature, queued_epoch)
+		SELECT ip_address, public_key, registered_by, registration_nonce, registration_signature, ? FROM nodes_buffer`, epoch)
+	if err != nil {
+		return fmt.Errorf("error moving data from nodes_buffer to nodes_que: %w", err)
+	}
+	if _, err = tx.Exec("DELETE FROM nodes_buffer"); err != nil {
+		return fmt.Errorf("error clearing nodes_buffer: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// contains reports whether an address is present in one of the node tables.
+func (s *sqlStore) contains(table string, ipAddress string) (bool, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE ip_address = ?", ipAddress).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error querying %s: %w", table, err)
+	}
+	return count > 0, nil
+}
+
+// listAddresses runs a query returning a single ip_address column.
+func (s *sqlStore) listAddresses(query string) ([]string, error) {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query addresses: %w", err)
+	}
+	defer rows.Close()
+
+	var addresses []string
+	for rows.Next() {
+		var ipAddress string
+		if err := rows.Scan(&ipAddress); err != nil {
+			return nil, fmt.Errorf("failed to scan address: %w", err)
+		}
+		addresses = append(addresses, ipAddress)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("encountered error while iterating through addresses: %w", err)
+	}
+	return addresses, nil
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned when a requested wallet, node, block or epoch does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrInsufficientFunds is returned by MoveSats when the sender cannot cover the amount.
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// ErrInvalidAmount is returned when a transfer amount is not a positive number of sats.
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// ErrNonceUsed is returned by ApplyTransfer when the nonce was already consumed.
+var ErrNonceUsed = errors.New("nonce already used")
+
+// Node is one row of the nodes table.
+type Node struct {
+	SortOrder  int
+	ComputerID string
+	IPAddress  string
+	NodeGroup  int
+	Reachable  bool
+	PublicKey  string // base64 secp256k1 key used to check the node's signatures
+
+	// AdmittedHeight is the block that admitted the node, 0 for genesis nodes
+	AdmittedHeight int64
+}
+
+// Store is the storage layer shared by every part of the node. All access to
+// wallet_balances, nonce, nodes, nodes_que and nodes_buffer goes through it so
+// the same code runs against MySQL or SQLite.
+type Store interface {
+	// Wallets
+	GetBalance(wallet string) (int64, error)
+	CreateWallet(wallet string) (bool, error)
+	MoveSats(from string, to string, amount int64) error
+	ApplyTransfer(transfer Transfer) (Transfer, error)
+	TotalSupply() (int64, error)
+
+	// Transactions log
+	ListTransfers(afterSeq int64, limit int) ([]Transfer, error)
+	ListWalletTransfers(query HistoryQuery) ([]Transfer, error)
+	ListBalances() (map[string]int64, error)
+	ReplaceBalances(balances map[string]int64) error
+
+	// Blocks
+	ProduceBlock(producer string, timestamp int64, transfers []Transfer, changes MembershipChanges, peg PegChanges) (Block, map[string]error, error)
+	BuildBlock(producer string, timestamp int64, transfers []Transfer, changes MembershipChanges, peg PegChanges) (Block, map[string]error, error)
+	VerifyBlock(block Block) error
+	CommitBlock(block Block) error
+	GetBlock(height int64) (Block, error)
+	LatestBlock() (Block, error)
+
+	// Epochs
+	SaveEpoch(epoch Epoch, nodes []Node) error
+	GetEpoch(number int64) (Epoch, error)
+	LatestEpoch() (Epoch, error)
+	SaveFailover(failover Failover) error
+
+	// Nonces
+	CheckNonce(nonce string) (bool, error)
+	NonceUsed(nonce string) (bool, error)
+
+	// Nodes
+	ListNodes() ([]Node, error)
+	GetNode(computerID string) (Node, error)
+	GetNodeAt(ipAddress string) (Node, error)
+	ReplaceNodes(nodes []Node) error
+	InsertNode(node Node) error
+	NodeExists(ipAddress string) (bool, error)
+	SetNodeReachable(ipAddress string, reachable bool) error
+	ListReachableNodes() ([]string, error)
+	RecordNodeProbes(probes []NodeProbe) error
+	ListNodeHealth() ([]NodeHealth, error)
+
+	// Queue and buffer
+	ListQueue() ([]QueueEntry, error)
+	QueueContains(ipAddress string) (bool, error)
+	AddAllToQueue(entries []QueueEntry) error
+	RecordProbes(probes []QueueProbe) error
+	RemoveFromQueue(ipAddress string) error
+	AddToBuffer(registration Registration) error
+	AddAllToBuffer(registrations []Registration) error
+	ListBuffer() ([]Registration, error)
+	BufferContains(ipAddress string) (bool, error)
+	MoveBufferToQueue(epoch int64) error
+
+	// Address book
+	ListPeers() ([]Peer, error)
+	SavePeers(peers []Peer, limit int) error
+	RecordPeerAttempts(attempted []string, forget []string, at int64) error
+
+	// Peg key custody
+	CompleteHandoff(key CustodyKey, share *CustodyShare) (bool, error)
+	LatestCustodyKey() (CustodyKey, error)
+	GetCustodyKey(epoch int64) (CustodyKey, error)
+	GetCustodyShare(epoch int64) (CustodyShare, error)
+
+	// Peg-ins
+	SaveDepositAddress(address DepositAddress) (bool, error)
+	GetDepositAddress(wallet string) (DepositAddress, error)
+	ListDepositAddresses() ([]DepositAddress, error)
+	LatestBitcoinBlock() (int64, string, error)
+	GetBitcoinBlock(height int64) (string, error)
+	RecordBitcoinBlock(height int64, hash string, deposits []Deposit, payouts []string) error
+	RewindBitcoin(height int64) error
+	ListPendingDeposits() ([]Deposit, error)
+	GetPegIn(outpoint string) (PegIn, error)
+	ListWalletPegIns(wallet string) ([]PegIn, error)
+
+	// Peg-outs
+	GetWithdrawal(txID string) (Withdrawal, error)
+	ListQueuedWithdrawals(limit int) ([]Withdrawal, error)
+	GetPegUTXO(outpoint string) (PegUTXO, error)
+	ListUnspentPegUTXOs() ([]PegUTXO, error)
+	GetPayout(txid string) (PegOut, error)
+	ListUnconfirmedPayouts() ([]PegOut, error)
+	GetReserves() (Reserves, error)
+
+	// Schema and seed data
+	SchemaVersion() (int, error)
+	ApplyGenesis(genesis Genesis) (bool, error)
+
+	Close() error
+}
+
+// Open returns the Store for the given driver name. Supported drivers are
+// "mysql" and "sqlite3".
+func Open(driver string, dsn string) (Store, error) {
+	switch driver {
+	case "mysql":
+		return NewMySQLStore(dsn)
+	case "sqlite3", "sqlite":
+		return NewSQLiteStore(dsn)
+	default:
+		return nil, fmt.Errorf("unknown database driver: %s", driver)
+	}
+}
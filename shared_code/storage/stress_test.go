@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestParallelTransfers fires thousands of parallel transfers from a single
+// wallet and checks that its balance never goes negative and that the total
+// supply stays the same, on SQLite and, with TEST_MYSQL_DSN, on MySQL.
+func TestParallelTransfers(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, open func() (Store, error)) {
+		const transfers, balance, amount = 5000, 1000, 1
+		store := mustOpen(t, open)
+
+		// Fund the sender and a few existing recipients through genesis
+		sender := "stress-sender"
+		genesis := Genesis{Wallets: []GenesisWallet{{Wallet: sender, Balance: balance}}}
+		for i := 0; i < 10; i++ {
+			genesis.Wallets = append(genesis.Wallets, GenesisWallet{Wallet: fmt.Sprintf("stress-recipient-%d", i)})
+		}
+		applied, err := store.ApplyGenesis(genesis)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !applied {
+			t.Fatal("database is not empty")
+		}
+		supply, err := store.TotalSupply()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Watch the sender balance and the total supply while transfers run
+		var violations atomic.Int64
+		done := make(chan struct{})
+		var watcher sync.WaitGroup
+		watcher.Add(1)
+		go func() {
+			defer watcher.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if current, err := store.GetBalance(sender); err == nil && current < 0 {
+					t.Errorf("balance went negative: %d", current)
+					violations.Add(1)
+				}
+				if total, err := store.TotalSupply(); err == nil && total != supply {
+					t.Errorf("total supply changed: %d != %d", total, supply)
+					violations.Add(1)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+
+		// Half of the transfers use MoveSats to existing wallets, the other half
+		// go through ApplyTransfer to new wallets, several at once to each, so
+		// concurrent transfers create the same recipient
+		var succeeded atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < transfers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var err error
+				if i%2 == 0 {
+					err = store.MoveSats(sender, fmt.Sprintf("stress-recipient-%d", i%10), amount)
+				} else {
+					_, err = store.ApplyTransfer(Transfer{
+						From:   sender,
+						To:     fmt.Sprintf("stress-new-%d", i%50),
+						Amount: amount,
+						Nonce:  fmt.Sprintf("stress-nonce-%d", i),
+					})
+				}
+				switch {
+				case err == nil:
+					succeeded.Add(1)
+				case !errors.Is(err, ErrInsufficientFunds):
+					t.Errorf("transfer %d failed: %v", i, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(done)
+		watcher.Wait()
+		if violations.Load() > 0 {
+			t.Fatalf("%d violations observed", violations.Load())
+		}
+
+		final, err := store.GetBalance(sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total, err := store.TotalSupply()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if succeeded.Load() != balance/amount {
+			t.Errorf("expected %d transfers to succeed, got %d", balance/amount, succeeded.Load())
+		}
+		if final != balance-succeeded.Load()*amount || final < 0 {
+			t.Errorf("sender balance is %d, expected %d", final, balance-succeeded.Load()*amount)
+		}
+		if total != supply {
+			t.Errorf("total supply changed from %d to %d", supply, total)
+		}
+		replayed, err := ReplayLedger(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replayed[sender] != final {
+			t.Errorf("replaying the log gives sender balance %d, wallet_balances has %d", replayed[sender], final)
+		}
+	})
+}